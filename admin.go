@@ -0,0 +1,543 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Admin is the maintenance interface of a database, implemented by
+// *Driver, so operators can script what would otherwise need a shell on
+// the host. AdminHandler serves it over HTTP.
+type Admin interface {
+	Compact(collection string) error
+	Backup(remote RemoteStore) (*BackupManifest, error)
+	Snapshot(dir string) error
+	RebuildIndexes() ([]string, error)
+	Verify() ([]CorruptRecord, error)
+	Repair(collection string, opts RepairOptions) (*RepairReport, error)
+	CollectionMeta(collection string) (CollectionMeta, bool)
+	SetCollectionMeta(collection string, meta CollectionMeta) error
+	SetAlertLimits(limits AlertLimits) error
+	GC() (*GCReport, error)
+	Archive(collection string, dryRun bool) (*ArchiveReport, error)
+	ArchiveReports() []ArchiveReport
+	ClusterStatus() (*ClusterStatus, error)
+	Join(id, addr string) error
+	Leave(id string) error
+}
+
+var _ Admin = (*Driver)(nil)
+
+// AlertLimits are the thresholds of AlertOptions that can be changed while
+// the database is open.
+type AlertLimits struct {
+	MaxRecords    int   `json:"maxRecords"`
+	MaxBytes      int64 `json:"maxBytes"`
+	MaxRecordSize int64 `json:"maxRecordSize"`
+}
+
+// Backup uploads every record and a manifest of them to remote. Writes are
+// held back meanwhile, so the backup is a consistent point in time.
+func (d *Driver) Backup(remote RemoteStore) (*BackupManifest, error) {
+	resume := d.Pause()
+	defer resume()
+
+	manifest, err := d.uploadAll(remote)
+	if err != nil {
+		return nil, err
+	}
+	if d.changes != nil {
+		manifest.Seq = d.changes.lastSeq()
+	}
+	if err := writeManifest(remote, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Snapshot copies the collections to dir, which must not exist yet, while
+// writes are held back. The copy can be opened with New like any database
+// directory. The files of the built-in engines are copied as they are; the
+// records of a database kept in a Store, sharded or not, are copied one by
+// one into a database of the file engine.
+func (d *Driver) Snapshot(dir string) error {
+	if _, err := d.fs.Stat(dir); err == nil {
+		return fmt.Errorf("could not snapshot to %s: %w", dir, os.ErrExist)
+	}
+
+	resume := d.Pause()
+	defer resume()
+
+	collections, err := d.Collections()
+	if err != nil {
+		return err
+	}
+	for _, collection := range collections {
+		src, dst := filepath.Join(d.dir, collection), filepath.Join(dir, collection)
+		switch d.store.(type) {
+		case *fileStorage, *logStorage:
+			err = d.layout.copyCollection(d.fs, src, dst)
+		default:
+			err = d.snapshotStored(collection, dir)
+		}
+		if err != nil {
+			return fmt.Errorf("could not snapshot collection %s: %v", collection, err)
+		}
+	}
+	if err := d.fs.MkdirAll(dir, d.layout.dirMode()); err != nil {
+		return fmt.Errorf("could not create snapshot directory: %v", err)
+	}
+	// The copy is laid out like the database, so it must say how.
+	err = d.layout.copyFile(d.fs, filepath.Join(d.dir, layoutFile), filepath.Join(dir, layoutFile))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not snapshot layout: %v", err)
+	}
+
+	d.log.Info("Snapshotted %d collections to %s", len(collections), dir)
+	return nil
+}
+
+// snapshotStored copies the records of a collection kept in a Store, and
+// its configuration, to the file engine database in dir.
+func (d *Driver) snapshotStored(collection, dir string) error {
+	copied := &fileStorage{dir: dir, checksums: d.opts.Checksums, layout: d.layout, fs: d.fs}
+	keys, err := d.store.keys(collection)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, key := range keys {
+		data, err := d.store.get(collection, key)
+		if err != nil {
+			return fmt.Errorf("could not read record %s: %v", key, err)
+		}
+		if err := copied.put(collection, key, data); err != nil {
+			return err
+		}
+	}
+
+	meta := filepath.Join(d.dir, collection, metaFile)
+	if _, err := d.fs.Stat(meta); os.IsNotExist(err) {
+		return nil
+	}
+	// A collection without records has no directory in the copy yet.
+	if err := d.fs.MkdirAll(filepath.Join(dir, collection), d.layout.dirMode()); err != nil {
+		return err
+	}
+	return d.layout.copyFile(d.fs, meta, filepath.Join(dir, collection, metaFile))
+}
+
+// copyCollection copies the files of a collection, and of its fan-out
+// directories, leaving out leftovers of interrupted compactions.
+func (l layout) copyCollection(fsys FS, src, dst string) error {
+	entries, err := fsys.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	if err := fsys.MkdirAll(dst, l.dirMode()); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		srcPath, dstPath := filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())
+		switch {
+		case entry.IsDir() && isFanOutDir(entry.Name()):
+			err = l.copyCollection(fsys, srcPath, dstPath)
+		case entry.IsDir() || strings.HasSuffix(entry.Name(), compactSuffix):
+			continue
+		default:
+			err = l.copyFile(fsys, srcPath, dstPath)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l layout) copyFile(fsys FS, src, dst string) error {
+	in, err := fsys.OpenFile(src, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := fsys.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, l.fileMode())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// RebuildIndexes rebuilds the storage engine's in-memory indexes from disk
+// and returns the collections it rebuilt. Engines without indexes have
+// nothing to rebuild.
+func (d *Driver) RebuildIndexes() ([]string, error) {
+	r, ok := d.store.(reindexer)
+	if !ok {
+		return nil, nil
+	}
+
+	resume := d.Pause()
+	defer resume()
+
+	rebuilt, err := r.reindex()
+	if err != nil {
+		return nil, fmt.Errorf("could not rebuild indexes: %v", err)
+	}
+	d.log.Info("Rebuilt indexes of %d collections", len(rebuilt))
+	return rebuilt, nil
+}
+
+// SetAlertLimits changes the collection alert thresholds and checks every
+// collection against them. Alerts must have been enabled with
+// Options.Alerts.
+func (d *Driver) SetAlertLimits(limits AlertLimits) error {
+	a := d.alerts
+	if a == nil {
+		return errors.New("collection alerts are not enabled")
+	}
+
+	a.mutex.Lock()
+	a.opts.MaxRecords = limits.MaxRecords
+	a.opts.MaxBytes = limits.MaxBytes
+	a.opts.MaxRecordSize = limits.MaxRecordSize
+	// Alerts on disabled thresholds are dropped rather than cleared.
+	for _, active := range a.active {
+		if limits.MaxRecords <= 0 {
+			delete(active, AlertRecords)
+		}
+		if limits.MaxBytes <= 0 {
+			delete(active, AlertBytes)
+		}
+		if limits.MaxRecordSize <= 0 {
+			delete(active, AlertRecordSize)
+		}
+	}
+	a.mutex.Unlock()
+
+	collections, err := d.Collections()
+	if err != nil {
+		return err
+	}
+	for _, collection := range collections {
+		d.checkAlerts(a, collection)
+	}
+	d.log.Info("Changed collection alert limits")
+	return nil
+}
+
+// AdminOptions configures the HTTP admin API returned by AdminHandler.
+type AdminOptions struct {
+	// Remote is where POST /admin/backup uploads to. Backups are disabled
+	// if nil.
+	Remote RemoteStore
+	// SnapshotDir is where POST /admin/snapshot creates timestamped
+	// snapshots. Snapshots are disabled if empty.
+	SnapshotDir string
+	// Policy restricts the admin API to admins and enables the principal
+	// routes. Everything is allowed if nil.
+	Policy *Policy
+}
+
+// AdminHandler serves the Admin interface over HTTP. It should only be
+// reachable by operators:
+//
+//	POST /admin/compact/{collection}       compact a collection
+//	POST /admin/backup                     back up to the remote store
+//	POST /admin/snapshot                   snapshot under SnapshotDir
+//	POST /admin/reindex                    rebuild in-memory indexes
+//	POST /admin/verify                     list corrupt records
+//	POST /admin/repair/{collection}        repair a collection; ?action=delete
+//	                                       or report instead of quarantining
+//	GET  /admin/collections/{collection}   read a collection's configuration
+//	PUT  /admin/collections/{collection}   change a collection's configuration
+//	PUT  /admin/alerts                     change the alert limits
+//	POST /admin/gc                         remove empty collections and
+//	                                       stale files
+//	POST /admin/archive/{collection}       apply a collection's archival
+//	                                       policy; ?dryRun=true only reports
+//	GET  /admin/archive                    the last background archival
+//	                                       sweep of each collection
+//	GET  /admin/cluster                    the cluster as this node sees it
+//	PUT  /admin/cluster/servers/{id}       join a node, {"address": "..."},
+//	                                       on the leader
+//	DELETE /admin/cluster/servers/{id}     remove a node, on the leader
+//
+// With a Policy, only admins may use it, and principals are managed with:
+//
+//	GET    /admin/principals               list principals and their access
+//	PUT    /admin/principals/{name}        grant a principal access
+//	POST   /admin/principals/{name}/token  issue a new token, returned once
+//	DELETE /admin/principals/{name}        revoke a principal
+//
+// Errors are returned as {"error": "..."}.
+func (d *Driver) AdminHandler(opts AdminOptions) http.Handler {
+	a := &adminServer{admin: d, opts: opts}
+
+	p := opts.Policy
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /admin/compact/{collection}", p.guardAdmin(a.compact))
+	mux.HandleFunc("POST /admin/backup", p.guardAdmin(a.backup))
+	mux.HandleFunc("POST /admin/snapshot", p.guardAdmin(a.snapshot))
+	mux.HandleFunc("POST /admin/reindex", p.guardAdmin(a.reindex))
+	mux.HandleFunc("POST /admin/verify", p.guardAdmin(a.verify))
+	mux.HandleFunc("POST /admin/repair/{collection}", p.guardAdmin(a.repair))
+	mux.HandleFunc("GET /admin/collections/{collection}", p.guardAdmin(a.readMeta))
+	mux.HandleFunc("PUT /admin/collections/{collection}", p.guardAdmin(a.writeMeta))
+	mux.HandleFunc("PUT /admin/alerts", p.guardAdmin(a.setAlertLimits))
+	mux.HandleFunc("POST /admin/gc", p.guardAdmin(a.gc))
+	mux.HandleFunc("POST /admin/archive/{collection}", p.guardAdmin(a.archive))
+	mux.HandleFunc("GET /admin/archive", p.guardAdmin(a.archiveReports))
+	mux.HandleFunc("GET /admin/cluster", p.guardAdmin(a.clusterStatus))
+	mux.HandleFunc("PUT /admin/cluster/servers/{id}", p.guardAdmin(a.join))
+	mux.HandleFunc("DELETE /admin/cluster/servers/{id}", p.guardAdmin(a.leave))
+	if p != nil {
+		mux.HandleFunc("GET /admin/principals", p.guardAdmin(a.listPrincipals))
+		mux.HandleFunc("PUT /admin/principals/{name}", p.guardAdmin(a.grant))
+		mux.HandleFunc("POST /admin/principals/{name}/token", p.guardAdmin(a.issueToken))
+		mux.HandleFunc("DELETE /admin/principals/{name}", p.guardAdmin(a.revoke))
+	}
+	return mux
+}
+
+type adminServer struct {
+	admin Admin
+	opts  AdminOptions
+}
+
+func (a *adminServer) compact(w http.ResponseWriter, r *http.Request) {
+	if err := a.admin.Compact(r.PathValue("collection")); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminServer) gc(w http.ResponseWriter, r *http.Request) {
+	report, err := a.admin.GC()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (a *adminServer) archive(w http.ResponseWriter, r *http.Request) {
+	var dryRun bool
+	if s := r.URL.Query().Get("dryRun"); s != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(s); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "dryRun must be true or false"})
+			return
+		}
+	}
+
+	report, err := a.admin.Archive(r.PathValue("collection"), dryRun)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (a *adminServer) archiveReports(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.admin.ArchiveReports())
+}
+
+func (a *adminServer) clusterStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := a.admin.ClusterStatus()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (a *adminServer) join(w http.ResponseWriter, r *http.Request) {
+	var server ClusterServer
+	if err := json.NewDecoder(r.Body).Decode(&server); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body: " + err.Error()})
+		return
+	}
+	if server.Address == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "address is required"})
+		return
+	}
+
+	if err := a.admin.Join(r.PathValue("id"), server.Address); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminServer) leave(w http.ResponseWriter, r *http.Request) {
+	if err := a.admin.Leave(r.PathValue("id")); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminServer) backup(w http.ResponseWriter, r *http.Request) {
+	if a.opts.Remote == nil {
+		writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "no remote store configured"})
+		return
+	}
+
+	manifest, err := a.admin.Backup(a.opts.Remote)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"seq": manifest.Seq, "records": len(manifest.Records)})
+}
+
+func (a *adminServer) snapshot(w http.ResponseWriter, r *http.Request) {
+	if a.opts.SnapshotDir == "" {
+		writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "no snapshot directory configured"})
+		return
+	}
+
+	dir := filepath.Join(a.opts.SnapshotDir, time.Now().UTC().Format("20060102T150405.000Z"))
+	if err := a.admin.Snapshot(dir); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"dir": dir})
+}
+
+func (a *adminServer) reindex(w http.ResponseWriter, r *http.Request) {
+	rebuilt, err := a.admin.RebuildIndexes()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if rebuilt == nil {
+		rebuilt = []string{}
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"collections": rebuilt})
+}
+
+func (a *adminServer) verify(w http.ResponseWriter, r *http.Request) {
+	corrupt, err := a.admin.Verify()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	records := []map[string]string{}
+	for _, c := range corrupt {
+		records = append(records, map[string]string{"collection": c.Collection, "key": c.Key, "error": c.Err.Error()})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"corrupt": records})
+}
+
+func (a *adminServer) repair(w http.ResponseWriter, r *http.Request) {
+	opts := RepairOptions{Action: RepairQuarantine}
+	switch r.URL.Query().Get("action") {
+	case "", "quarantine":
+	case "delete":
+		opts.Action = RepairDelete
+	case "report":
+		opts.Action = RepairReportOnly
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "action must be quarantine, delete or report"})
+		return
+	}
+
+	report, err := a.admin.Repair(r.PathValue("collection"), opts)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"report": report.String()})
+}
+
+func (a *adminServer) readMeta(w http.ResponseWriter, r *http.Request) {
+	meta, ok := a.admin.CollectionMeta(r.PathValue("collection"))
+	if !ok {
+		writeError(w, os.ErrNotExist)
+		return
+	}
+	writeJSON(w, http.StatusOK, meta)
+}
+
+func (a *adminServer) writeMeta(w http.ResponseWriter, r *http.Request) {
+	var meta CollectionMeta
+	if err := json.NewDecoder(r.Body).Decode(&meta); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body: " + err.Error()})
+		return
+	}
+
+	if err := a.admin.SetCollectionMeta(r.PathValue("collection"), meta); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, meta)
+}
+
+func (a *adminServer) setAlertLimits(w http.ResponseWriter, r *http.Request) {
+	var limits AlertLimits
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body: " + err.Error()})
+		return
+	}
+
+	if err := a.admin.SetAlertLimits(limits); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, limits)
+}
+
+func (a *adminServer) listPrincipals(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.opts.Policy.Principals())
+}
+
+func (a *adminServer) grant(w http.ResponseWriter, r *http.Request) {
+	var principal Principal
+	if err := json.NewDecoder(r.Body).Decode(&principal); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body: " + err.Error()})
+		return
+	}
+
+	if err := a.opts.Policy.Grant(r.PathValue("name"), principal); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, a.opts.Policy.Principals()[r.PathValue("name")])
+}
+
+func (a *adminServer) issueToken(w http.ResponseWriter, r *http.Request) {
+	token, err := a.opts.Policy.IssueToken(r.PathValue("name"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"name": r.PathValue("name"), "token": token})
+}
+
+func (a *adminServer) revoke(w http.ResponseWriter, r *http.Request) {
+	if err := a.opts.Policy.Revoke(r.PathValue("name")); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	tests := []struct {
+		name string
+		opts func(t *testing.T) *Options
+	}{
+		{"files", func(t *testing.T) *Options { return &Options{} }},
+		{"log", func(t *testing.T) *Options { return &Options{Engine: EngineLog} }},
+		{"shards", func(t *testing.T) *Options { return &Options{Shards: []string{t.TempDir(), t.TempDir()}} }},
+		{"memory store", func(t *testing.T) *Options { return &Options{Store: NewMemoryStore()} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _ := openTestDB(t, tt.opts(t))
+			const n = 10
+			for i := 0; i < n; i++ {
+				if err := d.Write("users", fmt.Sprint("user", i), User{Name: fmt.Sprint(i)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := d.SetCollectionMeta("posts", CollectionMeta{Indexes: []string{"Name"}}); err != nil {
+				t.Fatal(err)
+			}
+
+			dir := filepath.Join(t.TempDir(), "snapshot")
+			if err := d.Snapshot(dir); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.Snapshot(dir); err == nil {
+				t.Error("snapshot over an existing directory succeeded")
+			}
+
+			opts := tt.opts(t)
+			if opts.Store != nil || opts.Shards != nil {
+				// Snapshots of Stores are file engine databases.
+				opts = &Options{}
+			}
+			opts.Slog = openTestLogger()
+			copied, err := New(dir, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer copied.Close()
+			users, err := copied.ReadAll("users")
+			if err != nil || len(users) != n {
+				t.Errorf("snapshot holds %d users, %v; want %d", len(users), err, n)
+			}
+			if meta, ok := copied.CollectionMeta("posts"); !ok || len(meta.Indexes) != 1 {
+				t.Errorf("snapshot configuration of posts = %+v, %v", meta, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AlertOptions sets per-collection thresholds. A collection crossing one
+// raises an alert, logged at Warn and passed to Notify; falling back under
+// it clears the alert. Zero disables a threshold.
+type AlertOptions struct {
+	MaxRecords    int
+	MaxBytes      int64
+	MaxRecordSize int64
+	// Interval is how often collections changed since the last check are
+	// measured. Defaults to one minute. Oversized records are caught as
+	// they are written.
+	Interval time.Duration
+	// Notify, if set, is called with every alert raised or cleared.
+	Notify func(Alert)
+}
+
+// AlertKind names the threshold an alert is about.
+type AlertKind string
+
+const (
+	AlertRecords    AlertKind = "records"
+	AlertBytes      AlertKind = "bytes"
+	AlertRecordSize AlertKind = "record_size"
+)
+
+// Alert reports a collection crossing a threshold, or falling back under it
+// when Cleared is set.
+type Alert struct {
+	Collection string
+	Kind       AlertKind
+	Value      int64
+	Limit      int64
+	// Key is the offending record of an AlertRecordSize alert raised on write.
+	Key     string
+	Cleared bool
+	Time    time.Time
+}
+
+func (a Alert) String() string {
+	if a.Cleared {
+		return fmt.Sprintf("collection %s back under its %s limit: %d <= %d", a.Collection, a.Kind, a.Value, a.Limit)
+	}
+	return fmt.Sprintf("collection %s over its %s limit: %d > %d", a.Collection, a.Kind, a.Value, a.Limit)
+}
+
+// collectionUsage measures the records of a collection.
+type collectionUsage struct {
+	Records    int
+	Bytes      int64
+	Largest    int64
+	LargestKey string
+	// Modified is when a record was last written, as far as the storage
+	// engine can tell.
+	Modified time.Time
+}
+
+// usager is implemented by storage engines that can measure a collection
+// without reading every record.
+type usager interface {
+	usage(collection string) (collectionUsage, error)
+}
+
+// alerter tracks which thresholds each collection is over.
+type alerter struct {
+	mutex  sync.Mutex
+	opts   AlertOptions
+	dirty  map[string]bool
+	active map[string]map[AlertKind]bool
+}
+
+// startAlerts checks every collection against the thresholds, then keeps
+// checking changed ones until the Driver is closed.
+func (d *Driver) startAlerts(opts *AlertOptions) {
+	if opts == nil {
+		return
+	}
+	if _, ok := d.store.(usager); !ok {
+		d.log.Info("Collection alerts are not supported by this storage engine, ignoring")
+		return
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = time.Minute
+	}
+
+	a := &alerter{opts: *opts, dirty: make(map[string]bool), active: make(map[string]map[AlertKind]bool)}
+	d.alerts = a
+	d.subscribe(func(c Change) {
+		a.mutex.Lock()
+		a.dirty[c.Collection] = true
+		limit := a.opts.MaxRecordSize
+		a.mutex.Unlock()
+
+		if size := int64(len(c.Data)); c.Op == OpWrite && limit > 0 && size > limit {
+			d.raise(a, Alert{Collection: c.Collection, Kind: AlertRecordSize, Value: size, Limit: limit, Key: c.Key})
+		}
+	})
+
+	if collections, err := d.Collections(); err == nil {
+		for _, collection := range collections {
+			d.checkAlerts(a, collection)
+		}
+	}
+
+	ran := d.background.track("alerts", opts.Interval)
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-d.stop:
+				return
+			case <-ticker.C:
+			}
+
+			a.mutex.Lock()
+			var dirty []string
+			for collection := range a.dirty {
+				dirty = append(dirty, collection)
+			}
+			a.dirty = make(map[string]bool)
+			a.mutex.Unlock()
+
+			sort.Strings(dirty)
+			for _, collection := range dirty {
+				d.checkAlerts(a, collection)
+			}
+			ran()
+		}
+	}()
+}
+
+// checkAlerts measures a collection and raises or clears its alerts.
+func (d *Driver) checkAlerts(a *alerter, collection string) {
+	usage, err := d.store.(usager).usage(collection)
+	if err != nil && !os.IsNotExist(err) {
+		d.log.Error("Could not measure collection %s: %v", collection, err)
+		return
+	}
+
+	a.mutex.Lock()
+	limits := a.opts
+	a.mutex.Unlock()
+
+	check := func(kind AlertKind, value, limit int64, key string) {
+		if limit <= 0 {
+			return
+		}
+		alert := Alert{Collection: collection, Kind: kind, Value: value, Limit: limit, Key: key}
+		if value > limit {
+			d.raise(a, alert)
+		} else {
+			d.clear(a, alert)
+		}
+	}
+	check(AlertRecords, int64(usage.Records), int64(limits.MaxRecords), "")
+	check(AlertBytes, usage.Bytes, limits.MaxBytes, "")
+	check(AlertRecordSize, usage.Largest, limits.MaxRecordSize, usage.LargestKey)
+}
+
+// raise reports an alert unless it is already active.
+func (d *Driver) raise(a *alerter, alert Alert) {
+	a.mutex.Lock()
+	if a.active[alert.Collection] == nil {
+		a.active[alert.Collection] = make(map[AlertKind]bool)
+	}
+	if a.active[alert.Collection][alert.Kind] {
+		a.mutex.Unlock()
+		return
+	}
+	a.active[alert.Collection][alert.Kind] = true
+	a.mutex.Unlock()
+
+	args := []any{"collection", alert.Collection, "threshold", string(alert.Kind), "value", alert.Value, "limit", alert.Limit}
+	if alert.Key != "" {
+		args = append(args, "key", alert.Key)
+	}
+	d.slog.Warn("collection threshold crossed", args...)
+	d.notifyAlert(a, alert)
+}
+
+// clear reports that an active alert no longer applies.
+func (d *Driver) clear(a *alerter, alert Alert) {
+	a.mutex.Lock()
+	if !a.active[alert.Collection][alert.Kind] {
+		a.mutex.Unlock()
+		return
+	}
+	delete(a.active[alert.Collection], alert.Kind)
+	a.mutex.Unlock()
+
+	alert.Cleared = true
+	d.slog.Info("collection threshold cleared", "collection", alert.Collection, "threshold", string(alert.Kind),
+		"value", alert.Value, "limit", alert.Limit)
+	d.notifyAlert(a, alert)
+}
+
+func (d *Driver) notifyAlert(a *alerter, alert Alert) {
+	if a.opts.Notify == nil {
+		return
+	}
+	alert.Time = time.Now()
+	a.opts.Notify(alert)
+}
+
+func (s *fileStorage) usage(collection string) (collectionUsage, error) {
+	var usage collectionUsage
+	dirs, err := s.layout.recordDirs(s.fs, s.dir, collection)
+	if err != nil {
+		return usage, err
+	}
+
+	ext := s.layout.extension()
+	for _, dir := range dirs {
+		entries, err := s.fs.ReadDir(dir)
+		if err != nil {
+			return usage, err
+		}
+		for _, entry := range entries {
+			if !strings.HasSuffix(entry.Name(), ext) || entry.Name() == metaFile || entry.IsDir() {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			usage.Records++
+			usage.Bytes += info.Size()
+			if info.ModTime().After(usage.Modified) {
+				usage.Modified = info.ModTime()
+			}
+			if info.Size() > usage.Largest {
+				usage.Largest, usage.LargestKey = info.Size(), strings.TrimSuffix(entry.Name(), ext)
+			}
+		}
+	}
+	return usage, nil
+}
+
+func (s *logStorage) usage(collection string) (collectionUsage, error) {
+	var usage collectionUsage
+	c, err := s.collection(collection, false)
+	if err != nil {
+		return usage, err
+	}
+
+	if info, err := os.Stat(c.path); err == nil {
+		usage.Modified = info.ModTime()
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+
+	for key, entry := range c.index {
+		size := entry.size - logHeaderSize - int64(len(key))
+		usage.Records++
+		usage.Bytes += size
+		if size > usage.Largest {
+			usage.Largest, usage.LargestKey = size, key
+		}
+	}
+	return usage, nil
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// modifiedField holds the time a record of a collection with an archival
+// policy was last written.
+const modifiedField = "_modified"
+
+const (
+	defaultArchiveInterval  = time.Hour
+	defaultArchiveBatchSize = 100
+)
+
+// ArchiveOptions configures where the records of collections with an
+// ArchiveAfter policy go, and how often collections with an archival policy
+// are swept.
+type ArchiveOptions struct {
+	// Store receives archived records, as collection/key.json, exactly as
+	// they were stored: NewDirStore for a cold directory, NewS3Store for
+	// object storage. ArchiveAfter policies fail without one.
+	Store RemoteStore
+	// Interval is how often collections are swept. Defaults to an hour.
+	Interval time.Duration
+	// BatchSize is how many records a sweep archives or drops before it
+	// pauses for BatchPause. Defaults to 100.
+	BatchSize  int
+	BatchPause time.Duration
+}
+
+// ArchiveReport describes what an archival sweep of a collection did, or on
+// a dry run would do.
+type ArchiveReport struct {
+	Collection string    `json:"collection"`
+	DryRun     bool      `json:"dryRun"`
+	Started    time.Time `json:"started"`
+	// Archived lists the keys moved to the archive store.
+	Archived []string `json:"archived"`
+	// Dropped lists the keys deleted from the collection, and
+	// DroppedArchived those deleted from the archive store.
+	Dropped         []string `json:"dropped"`
+	DroppedArchived []string `json:"droppedArchived"`
+}
+
+// errRewritten is the condition of an archival delete failing because the
+// record was written since it was found old enough.
+var errRewritten = errors.New("record was written meanwhile")
+
+// stampModified sets when a record about to be written was written, if its
+// collection has an archival policy. Records written before the collection
+// had one are not stamped and are kept until they are written again.
+func (d *Driver) stampModified(collection string, data []byte) ([]byte, error) {
+	meta, _ := d.collectionMeta(collection)
+	if meta.ArchiveAfter <= 0 && meta.DropAfter <= 0 {
+		return data, nil
+	}
+	modified, err := json.Marshal(time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	return setRecordField(data, modifiedField, modified)
+}
+
+// modifiedAt returns when a record was last written, if it was stamped.
+func modifiedAt(data []byte) (time.Time, bool) {
+	var stamp struct {
+		Modified *time.Time `json:"_modified"`
+	}
+	if err := json.Unmarshal(data, &stamp); err != nil || stamp.Modified == nil {
+		return time.Time{}, false
+	}
+	return *stamp.Modified, true
+}
+
+// Archive applies the archival policy of a collection right away, rather
+// than waiting for the background sweep: records not written for
+// ArchiveAfter are moved to the archive store and records not written for
+// DropAfter are deleted, from the archive store too. With dryRun nothing is
+// changed and the report tells what would be.
+func (d *Driver) Archive(collection string, dryRun bool) (*ArchiveReport, error) {
+	if err := d.checkNames(&collection); err != nil {
+		return nil, err
+	}
+
+	var o ArchiveOptions
+	if d.opts.Archive != nil {
+		o = *d.opts.Archive
+	}
+	return d.archive(collection, dryRun, o)
+}
+
+// archive is Archive pacing its changes as o says.
+func (d *Driver) archive(collection string, dryRun bool, o ArchiveOptions) (*ArchiveReport, error) {
+	meta, _ := d.collectionMeta(collection)
+	if meta.ArchiveAfter <= 0 && meta.DropAfter <= 0 {
+		return nil, fmt.Errorf("collection %s has no archival policy", collection)
+	}
+	if meta.ArchiveAfter > 0 && o.Store == nil {
+		return nil, fmt.Errorf("could not archive collection %s: no archive store configured in Options.Archive", collection)
+	}
+	if !dryRun {
+		if err := d.writable(); err != nil {
+			return nil, err
+		}
+	}
+
+	report := &ArchiveReport{
+		Collection:      collection,
+		DryRun:          dryRun,
+		Started:         time.Now().UTC(),
+		Archived:        []string{},
+		Dropped:         []string{},
+		DroppedArchived: []string{},
+	}
+	now := time.Now()
+	old := func(modified time.Time, after time.Duration) bool {
+		return after > 0 && !modified.Add(after).After(now)
+	}
+
+	stamps := make(map[string]time.Time)
+	err := d.scanStored(collection, func(key string, data []byte) error {
+		modified, ok := modifiedAt(data)
+		switch {
+		case !ok:
+		case old(modified, meta.DropAfter):
+			report.Dropped = append(report.Dropped, key)
+		case old(modified, meta.ArchiveAfter):
+			report.Archived = append(report.Archived, key)
+		default:
+			return nil
+		}
+		stamps[key] = modified
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not sweep collection %s: %v", collection, err)
+	}
+	if meta.DropAfter > 0 && o.Store != nil {
+		keys, err := d.archivedOlderThan(o.Store, collection, now.Add(-meta.DropAfter))
+		if err != nil {
+			return nil, err
+		}
+		report.DroppedArchived = append(report.DroppedArchived, keys...)
+	}
+	if dryRun {
+		return report, nil
+	}
+
+	pace := pacer(d.stop, o.BatchSize, o.BatchPause)
+	unchanged := func(key string) func(current []byte) error {
+		return func(current []byte) error {
+			if modified, ok := modifiedAt(current); !ok || !modified.Equal(stamps[key]) {
+				return errRewritten
+			}
+			return nil
+		}
+	}
+
+	archived := report.Archived[:0]
+	for _, key := range report.Archived {
+		if !pace() {
+			break
+		}
+		// The record is copied before it is deleted, so a crash between
+		// the two leaves it in both places until the next sweep.
+		data, err := d.store.get(collection, key)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return report, fmt.Errorf("could not archive %s in collection %s: %v", key, collection, err)
+		}
+		name := objectName(collection, key)
+		if err := o.Store.Put(name, data); err != nil {
+			return report, fmt.Errorf("could not archive %s in collection %s: %v", key, collection, err)
+		}
+		err = d.delete(context.Background(), collection, key, unchanged(key))
+		if errors.Is(err, errRewritten) {
+			o.Store.Delete(name)
+			continue
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return report, fmt.Errorf("could not archive %s in collection %s: %v", key, collection, err)
+		}
+		archived = append(archived, key)
+	}
+	report.Archived = archived
+
+	dropped := report.Dropped[:0]
+	for _, key := range report.Dropped {
+		if !pace() {
+			break
+		}
+		err := d.delete(context.Background(), collection, key, unchanged(key))
+		switch {
+		case err == nil:
+			dropped = append(dropped, key)
+		case errors.Is(err, errRewritten), errors.Is(err, os.ErrNotExist):
+		default:
+			return report, fmt.Errorf("could not drop %s in collection %s: %v", key, collection, err)
+		}
+	}
+	report.Dropped = dropped
+
+	droppedArchived := report.DroppedArchived[:0]
+	for _, key := range report.DroppedArchived {
+		if !pace() {
+			break
+		}
+		err := o.Store.Delete(objectName(collection, key))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return report, fmt.Errorf("could not drop archived %s of collection %s: %v", key, collection, err)
+		}
+		droppedArchived = append(droppedArchived, key)
+	}
+	report.DroppedArchived = droppedArchived
+
+	if len(report.Archived) > 0 || len(report.Dropped) > 0 || len(report.DroppedArchived) > 0 {
+		d.log.Info("Archived %d, dropped %d and dropped %d archived records of collection %s",
+			len(report.Archived), len(report.Dropped), len(report.DroppedArchived), collection)
+	}
+	return report, nil
+}
+
+// archivedOlderThan lists the keys of the records of a collection in the
+// archive store last written before cutoff.
+func (d *Driver) archivedOlderThan(store RemoteStore, collection string, cutoff time.Time) ([]string, error) {
+	names, err := store.List(collection + "/")
+	if err != nil {
+		return nil, fmt.Errorf("could not list archive of collection %s: %v", collection, err)
+	}
+
+	var keys []string
+	for _, name := range names {
+		c, key, ok := parseObjectName(name)
+		if !ok || c != collection || checkRecordPath(c, key) != nil {
+			continue
+		}
+		data, err := store.Get(name)
+		if err != nil {
+			return nil, fmt.Errorf("could not read archived %s of collection %s: %v", key, collection, err)
+		}
+		if modified, ok := modifiedAt(data); ok && modified.Before(cutoff) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// pacer returns a function to call before each change of a sweep, which
+// pauses for pause after every batch changes and returns false once stop
+// is closed.
+func pacer(stop <-chan struct{}, batch int, pause time.Duration) func() bool {
+	n := 0
+	return func() bool {
+		if batch > 0 && n > 0 && n%batch == 0 && pause > 0 {
+			select {
+			case <-stop:
+				return false
+			case <-time.After(pause):
+			}
+		}
+		n++
+		return true
+	}
+}
+
+// ReadArchived retrieves a record of a collection from the archive store.
+func (d *Driver) ReadArchived(collection, key string) (_ User, err error) {
+	if err := d.checkNames(&collection, &key); err != nil {
+		return User{}, err
+	}
+
+	op := d.begin(opRead, collection, key)
+	defer op.end(&err)
+
+	if d.opts.Archive == nil || d.opts.Archive.Store == nil {
+		return User{}, errors.New("no archive store configured in Options.Archive")
+	}
+	data, err := d.opts.Archive.Store.Get(objectName(collection, key))
+	if err != nil {
+		return User{}, fmt.Errorf("could not read archived %s of collection %s: %w", key, collection, err)
+	}
+	user, size, err := d.readUser(collection, key, func() ([]byte, error) {
+		if data, _, err = d.upgrade(collection, key, data); err != nil {
+			return nil, err
+		}
+		return d.openFields(collection, key, data)
+	})
+	op.bytes = size
+	return user, err
+}
+
+// ArchiveReports returns the report of the last background sweep of every
+// collection with an archival policy, in collection order.
+func (d *Driver) ArchiveReports() []ArchiveReport {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	reports := make([]ArchiveReport, 0, len(d.archiveReports))
+	for _, report := range d.archiveReports {
+		reports = append(reports, *report)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Collection < reports[j].Collection })
+	return reports
+}
+
+// startArchiver applies the archival policies of collections periodically,
+// until the Driver is closed.
+func (d *Driver) startArchiver(opts *ArchiveOptions) {
+	if d.opts.ReadOnly {
+		return
+	}
+	var o ArchiveOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.Interval <= 0 {
+		o.Interval = defaultArchiveInterval
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = defaultArchiveBatchSize
+	}
+
+	sweep := func() {
+		d.mutex.Lock()
+		var collections []string
+		for collection, meta := range d.meta {
+			if meta.ArchiveAfter > 0 || meta.DropAfter > 0 {
+				collections = append(collections, collection)
+			}
+		}
+		d.mutex.Unlock()
+
+		sort.Strings(collections)
+		for _, collection := range collections {
+			report, err := d.archive(collection, false, o)
+			if err != nil && !errors.Is(err, ErrFollower) && !errors.Is(err, ErrNotReplicated) {
+				d.log.Error("Archival failed: %v", err)
+			}
+			if report != nil {
+				d.mutex.Lock()
+				if d.archiveReports == nil {
+					d.archiveReports = make(map[string]*ArchiveReport)
+				}
+				d.archiveReports[collection] = report
+				d.mutex.Unlock()
+			}
+		}
+	}
+
+	ran := d.background.track("archive", o.Interval)
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+
+		ticker := time.NewTicker(o.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-d.stop:
+				return
+			case <-ticker.C:
+				sweep()
+				ran()
+			}
+		}
+	}()
+}
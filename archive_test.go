@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func openArchiveDB(t *testing.T, meta CollectionMeta) *Driver {
+	t.Helper()
+	d, _ := openTestDB(t, &Options{Archive: &ArchiveOptions{Store: NewDirStore(t.TempDir())}})
+	if err := d.Write("users", "unstamped", User{Name: "unstamped"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetCollectionMeta("users", meta); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestArchive(t *testing.T) {
+	d := openArchiveDB(t, CollectionMeta{ArchiveAfter: 200 * time.Millisecond})
+	writeUsers(t, d, "a", "b")
+	time.Sleep(250 * time.Millisecond)
+	writeUsers(t, d, "c")
+
+	report, err := d.Archive("users", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.DryRun || !slices.Equal(report.Archived, []string{"a", "b"}) {
+		t.Errorf("dry run report = %+v, want a and b archived", report)
+	}
+	if _, err := d.Read("users", "a"); err != nil {
+		t.Errorf("dry run changed the collection: %v", err)
+	}
+
+	if report, err = d.Archive("users", false); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(report.Archived, []string{"a", "b"}) || len(report.Dropped) != 0 {
+		t.Errorf("report = %+v, want a and b archived", report)
+	}
+	for _, key := range []string{"a", "b"} {
+		if _, err := d.Read("users", key); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("archived %s still read from the collection: %v", key, err)
+		}
+		if user, err := d.ReadArchived("users", key); err != nil || user.Name != key {
+			t.Errorf("ReadArchived(%s) = %+v, %v", key, user, err)
+		}
+	}
+	// Records written recently, or before the policy, stay.
+	for _, key := range []string{"c", "unstamped"} {
+		if _, err := d.Read("users", key); err != nil {
+			t.Errorf("read %s: %v", key, err)
+		}
+	}
+}
+
+func TestArchiveDrops(t *testing.T) {
+	d := openArchiveDB(t, CollectionMeta{ArchiveAfter: 100 * time.Millisecond, DropAfter: 300 * time.Millisecond})
+	writeUsers(t, d, "archived")
+	time.Sleep(150 * time.Millisecond)
+	if _, err := d.Archive("users", false); err != nil {
+		t.Fatal(err)
+	}
+	writeUsers(t, d, "dropped")
+	time.Sleep(350 * time.Millisecond)
+
+	report, err := d.Archive("users", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(report.Dropped, []string{"dropped"}) || !slices.Equal(report.DroppedArchived, []string{"archived"}) ||
+		len(report.Archived) != 0 {
+		t.Errorf("report = %+v, want dropped deleted and archived deleted from the archive", report)
+	}
+	if _, err := d.Read("users", "dropped"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("dropped record read: %v", err)
+	}
+	if _, err := d.ReadArchived("users", "archived"); err == nil {
+		t.Error("record dropped from the archive store still read")
+	}
+}
+
+func TestArchiveNeedsPolicyAndStore(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+	writeUsers(t, d, "a")
+	if _, err := d.Archive("users", false); err == nil {
+		t.Error("archiving a collection without a policy succeeded")
+	}
+	if err := d.SetCollectionMeta("users", CollectionMeta{ArchiveAfter: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Archive("users", false); err == nil {
+		t.Error("archiving without an archive store succeeded")
+	}
+}
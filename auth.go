@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrUnauthenticated is returned for requests without valid credentials.
+	ErrUnauthenticated = errors.New("authentication required")
+	// ErrForbidden is returned for requests the caller is not granted.
+	ErrForbidden = errors.New("permission denied")
+)
+
+// Access is a permission on a collection. Write access includes read
+// access.
+type Access string
+
+const (
+	AccessRead  Access = "read"
+	AccessWrite Access = "write"
+)
+
+// Principal is a client of the HTTP API and what it may do. Collections
+// maps collection names, or "*" for every collection, to the access
+// granted. Admins may do anything, including using the admin API.
+type Principal struct {
+	Admin       bool              `json:"admin,omitempty"`
+	Collections map[string]Access `json:"collections,omitempty"`
+	// TokenHash is the SHA-256 of the principal's API token. Tokens are
+	// only shown when issued.
+	TokenHash string `json:"tokenHash,omitempty"`
+}
+
+func (p *Principal) allows(collection string, access Access) bool {
+	if p.Admin {
+		return true
+	}
+	granted, ok := p.Collections[collection]
+	if !ok {
+		granted = p.Collections["*"]
+	}
+	return granted == AccessWrite || (granted == AccessRead && access == AccessRead)
+}
+
+// Policy authenticates HTTP API clients by API token and authorizes them
+// per collection. It is kept in a JSON policy file, which the admin API
+// updates as principals are granted access and issued tokens.
+//
+// Clients send their token as "Authorization: Bearer <token>", or with
+// basic auth as the password of their principal's name.
+type Policy struct {
+	mutex      sync.Mutex
+	path       string
+	principals map[string]*Principal
+}
+
+type policyFile struct {
+	Principals map[string]*Principal `json:"principals"`
+}
+
+// LoadPolicy reads the policy file at path. A missing file is an empty
+// policy, which grants nothing; it is created when first changed.
+func LoadPolicy(path string) (*Policy, error) {
+	p := &Policy{path: path, principals: make(map[string]*Principal)}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read policy: %v", err)
+	}
+
+	var file policyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("could not parse policy %s: %v", path, err)
+	}
+	for name, principal := range file.Principals {
+		if err := principal.validate(); err != nil {
+			return nil, fmt.Errorf("invalid principal %s in policy %s: %v", name, path, err)
+		}
+		p.principals[name] = principal
+	}
+	return p, nil
+}
+
+func (p *Principal) validate() error {
+	for collection, access := range p.Collections {
+		if access != AccessRead && access != AccessWrite {
+			return fmt.Errorf("unknown access %q to collection %s", access, collection)
+		}
+	}
+	return nil
+}
+
+// Principals returns the principals of the policy, without token hashes.
+func (p *Policy) Principals() map[string]Principal {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	principals := make(map[string]Principal, len(p.principals))
+	for name, principal := range p.principals {
+		c := *principal
+		c.TokenHash = ""
+		principals[name] = c
+	}
+	return principals
+}
+
+// Grant creates a principal or replaces its permissions, keeping its token.
+func (p *Policy) Grant(name string, principal Principal) error {
+	if name == "" || strings.Contains(name, ":") {
+		return fmt.Errorf("invalid principal name %q", name)
+	}
+	if err := principal.validate(); err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if current, ok := p.principals[name]; ok {
+		principal.TokenHash = current.TokenHash
+	} else {
+		principal.TokenHash = ""
+	}
+	p.principals[name] = &principal
+	return p.save()
+}
+
+// IssueToken gives a principal a new API token, revoking its previous one.
+func (p *Policy) IssueToken(name string) (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("could not generate token: %v", err)
+	}
+	token := hex.EncodeToString(secret)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	principal, ok := p.principals[name]
+	if !ok {
+		return "", fmt.Errorf("principal %s: %w", name, os.ErrNotExist)
+	}
+	principal.TokenHash = hashToken(token)
+	if err := p.save(); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Revoke removes a principal.
+func (p *Policy) Revoke(name string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if _, ok := p.principals[name]; !ok {
+		return fmt.Errorf("principal %s: %w", name, os.ErrNotExist)
+	}
+	delete(p.principals, name)
+	return p.save()
+}
+
+// save writes the policy file. The mutex must be held.
+func (p *Policy) save() error {
+	data, err := json.MarshalIndent(policyFile{Principals: p.principals}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not marshal policy: %v", err)
+	}
+
+	// The file holds token hashes, so it is only readable by its owner.
+	if err := os.WriteFile(p.path+".tmp", data, 0600); err != nil {
+		return fmt.Errorf("could not write policy: %v", err)
+	}
+	if err := os.Rename(p.path+".tmp", p.path); err != nil {
+		return fmt.Errorf("could not write policy: %v", err)
+	}
+	return nil
+}
+
+// authenticate returns the principal a request's credentials belong to.
+func (p *Policy) authenticate(r *http.Request) (string, *Principal, error) {
+	var name, token string
+	if user, password, ok := r.BasicAuth(); ok {
+		name, token = user, password
+	} else if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		token = strings.TrimSpace(bearer)
+	}
+	if token == "" {
+		return "", nil, ErrUnauthenticated
+	}
+	hash := []byte(hashToken(token))
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	names := make([]string, 0, len(p.principals))
+	for n := range p.principals {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		principal := p.principals[n]
+		if principal.TokenHash == "" || (name != "" && n != name) {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(principal.TokenHash), hash) == 1 {
+			c := *principal
+			return n, &c, nil
+		}
+	}
+	return "", nil, ErrUnauthenticated
+}
+
+// authorize checks that a request may access a collection, or the admin
+// API when collection is empty.
+func (p *Policy) authorize(r *http.Request, collection string, access Access) error {
+	name, principal, err := p.authenticate(r)
+	if err != nil {
+		return err
+	}
+	if collection == "" && !principal.Admin {
+		return fmt.Errorf("%w: %s is not an admin", ErrForbidden, name)
+	}
+	if collection != "" && !principal.allows(collection, access) {
+		return fmt.Errorf("%w: %s has no %s access to collection %s", ErrForbidden, name, access, collection)
+	}
+	return nil
+}
+
+// guard wraps a handler so it only runs for requests the policy allows. A
+// nil policy allows everything. The collection is checked under the name d
+// normalizes it to, so a name differing only by, say, case reaches the
+// collection it is granted for rather than the wildcard.
+func (p *Policy) guard(d *Driver, access Access, h http.HandlerFunc) http.HandlerFunc {
+	if p == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		collection := r.PathValue("collection")
+		if err := d.checkNames(&collection); err != nil {
+			// Only authenticated clients learn that a name is invalid.
+			if _, _, authErr := p.authenticate(r); authErr != nil {
+				err = authErr
+			}
+			writeError(w, err)
+			return
+		}
+		if err := p.authorize(r, collection, access); err != nil {
+			writeError(w, err)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// guardAdmin wraps a handler so it only runs for admins.
+func (p *Policy) guardAdmin(h http.HandlerFunc) http.HandlerFunc {
+	if p == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := p.authorize(r, "", ""); err != nil {
+			writeError(w, err)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	d, dir := openTestDB(t, nil)
+	if err := d.Write("users", "alice", User{Name: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "policy.json")
+	policy, err := LoadPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens := make(map[string]string)
+	for name, principal := range map[string]Principal{
+		"reader":  {Collections: map[string]Access{"users": AccessRead}},
+		"writer":  {Collections: map[string]Access{"*": AccessWrite, "audit": AccessRead}},
+		"admin":   {Admin: true},
+		"revoked": {Admin: true},
+	} {
+		if err := policy.Grant(name, principal); err != nil {
+			t.Fatal(err)
+		}
+		if tokens[name], err = policy.IssueToken(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := policy.Revoke("revoked"); err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.Grant("bad", Principal{Collections: map[string]Access{"users": "delete"}}); err == nil {
+		t.Error("granting an unknown access succeeded")
+	}
+
+	// The policy is reloaded from its file, as a restarted server would.
+	if policy, err = LoadPolicy(path); err != nil {
+		t.Fatal(err)
+	}
+	h := d.Handler(HandlerOptions{Policy: policy})
+
+	tests := []struct {
+		name      string
+		principal string // "" sends no credentials
+		basic     bool
+		method    string
+		path      string
+		want      int
+	}{
+		{"anonymous", "", false, "GET", "/collections/users/alice", http.StatusUnauthorized},
+		{"revoked", "revoked", false, "GET", "/collections/users/alice", http.StatusUnauthorized},
+		{"read granted", "reader", false, "GET", "/collections/users/alice", http.StatusOK},
+		{"basic auth", "reader", true, "GET", "/collections/users/alice", http.StatusOK},
+		{"write not granted", "reader", false, "PUT", "/collections/users/bob", http.StatusForbidden},
+		{"other collection", "reader", false, "GET", "/collections/posts", http.StatusForbidden},
+		{"wildcard", "writer", false, "PUT", "/collections/posts/p1", http.StatusOK},
+		{"named over wildcard", "writer", false, "PUT", "/collections/audit/a1", http.StatusForbidden},
+		{"admin", "admin", false, "DELETE", "/collections/users/alice", http.StatusNoContent},
+		{"health is open", "", false, "GET", "/healthz", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(`{"Name": "x"}`))
+			switch {
+			case tt.principal != "" && tt.basic:
+				req.SetBasicAuth(tt.principal, tokens[tt.principal])
+			case tt.principal != "":
+				req.Header.Set("Authorization", "Bearer "+tokens[tt.principal])
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("%s %s as %q: status %d, want %d: %s", tt.method, tt.path, tt.principal, rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+
+	for name, principal := range policy.Principals() {
+		if principal.TokenHash != "" {
+			t.Errorf("Principals shows the token hash of %s", name)
+		}
+	}
+}
+
+func TestPolicyFoldedCollection(t *testing.T) {
+	d, dir := openTestDB(t, &Options{Naming: &NamingPolicy{FoldCase: true}})
+	policy, err := LoadPolicy(filepath.Join(dir, "policy.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.Grant("writer", Principal{Collections: map[string]Access{"*": AccessWrite, "secrets": AccessRead}}); err != nil {
+		t.Fatal(err)
+	}
+	token, err := policy.IssueToken("writer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := d.Handler(HandlerOptions{Policy: policy})
+
+	for _, path := range []string{"/collections/secrets/x", "/collections/SECRETS/x", "/collections/Secrets/x"} {
+		req := httptest.NewRequest("PUT", path, strings.NewReader(`{"Name": "x"}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("PUT %s: status %d, want %d", path, rec.Code, http.StatusForbidden)
+		}
+	}
+	if _, err := d.Read("secrets", "x"); err == nil {
+		t.Error("a mixed-case write reached the read-only collection")
+	}
+
+	req := httptest.NewRequest("PUT", "/collections/.hidden/x", strings.NewReader(`{"Name": "x"}`))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("invalid collection without credentials: status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
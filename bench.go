@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// benchQuery is the filter the query benchmark runs; it matches about half
+// of the synthetic users.
+const benchQuery = "Age >= 50"
+
+// BenchOptions configures Bench.
+type BenchOptions struct {
+	// Records is how many synthetic users are written. Defaults to 1000.
+	Records int
+	// Reads is how many random reads are timed. Defaults to Records, at
+	// most 100000.
+	Reads int
+	// Scans is how many times ReadAll and Query are timed. Defaults to 5.
+	Scans int
+}
+
+// BenchResult is the outcome of benchmarking one operation.
+type BenchResult struct {
+	Op      string `json:"op"`
+	Records int    `json:"records"`
+	Ops     int    `json:"ops"`
+	// Elapsed is the time the operations took together.
+	Elapsed   time.Duration `json:"elapsed"`
+	OpsPerSec float64       `json:"opsPerSec"`
+	P50       time.Duration `json:"p50"`
+	P99       time.Duration `json:"p99"`
+}
+
+// Bench measures Write, Read, ReadAll and Query on a collection it fills
+// with synthetic users, so performance changes can be compared between
+// builds, engines and options. The collection must be empty; it is left
+// filled, so run Bench against a scratch database.
+func (d *Driver) Bench(collection string, opts BenchOptions) ([]BenchResult, error) {
+	if err := d.checkNames(&collection); err != nil {
+		return nil, err
+	}
+
+	if opts.Records <= 0 {
+		opts.Records = 1000
+	}
+	if opts.Reads <= 0 {
+		opts.Reads = min(opts.Records, 100000)
+	}
+	if opts.Scans <= 0 {
+		opts.Scans = 5
+	}
+
+	collections, err := d.Collections()
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(collections, collection) {
+		return nil, fmt.Errorf("could not benchmark collection %s: it already exists", collection)
+	}
+
+	random := rand.New(rand.NewPCG(1, uint64(opts.Records)))
+	key := func(i int) string { return fmt.Sprintf("user-%09d", i) }
+	var results []BenchResult
+
+	result, err := benchmark("write", opts.Records, opts.Records, func(i int) error {
+		return d.Write(collection, key(i), User{
+			Name:    "User " + strconv.Itoa(i),
+			Age:     json.Number(strconv.Itoa(random.IntN(100))),
+			Company: "Company " + strconv.Itoa(random.IntN(1000)),
+			Address: Address{Street: strconv.Itoa(i) + " Main Street", City: "Pune", State: "MH", Country: "India"},
+		})
+	})
+	if err != nil {
+		return results, err
+	}
+	results = append(results, result)
+
+	result, err = benchmark("read", opts.Records, opts.Reads, func(int) error {
+		_, err := d.Read(collection, key(random.IntN(opts.Records)))
+		return err
+	})
+	if err != nil {
+		return results, err
+	}
+	results = append(results, result)
+
+	result, err = benchmark("readall", opts.Records, opts.Scans, func(int) error {
+		users, err := d.ReadAll(collection)
+		if err == nil && len(users) != opts.Records {
+			err = fmt.Errorf("ReadAll returned %d of %d users", len(users), opts.Records)
+		}
+		return err
+	})
+	if err != nil {
+		return results, err
+	}
+	results = append(results, result)
+
+	result, err = benchmark("query", opts.Records, opts.Scans, func(int) error {
+		_, err := d.Query(collection, benchQuery)
+		return err
+	})
+	if err != nil {
+		return results, err
+	}
+	return append(results, result), nil
+}
+
+// benchmark times n calls of fn.
+func benchmark(op string, records, n int, fn func(i int) error) (BenchResult, error) {
+	latencies := make([]time.Duration, n)
+	start := time.Now()
+	for i := range latencies {
+		t := time.Now()
+		if err := fn(i); err != nil {
+			return BenchResult{}, fmt.Errorf("%s benchmark failed: %v", op, err)
+		}
+		latencies[i] = time.Since(t)
+	}
+	elapsed := time.Since(start)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return BenchResult{
+		Op:        op,
+		Records:   records,
+		Ops:       n,
+		Elapsed:   elapsed,
+		OpsPerSec: float64(n) / elapsed.Seconds(),
+		P50:       latencies[n/2],
+		P99:       latencies[n*99/100],
+	}, nil
+}
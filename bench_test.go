@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// benchSizes are the collection sizes the benchmarks run against. Select
+// one with e.g. go test -bench 'Read/files/records=100000'.
+var benchSizes = []int{1000, 100000, 1000000}
+
+var benchEngines = []struct {
+	name   string
+	engine Engine
+}{
+	{"files", EngineFiles},
+	{"log", EngineLog},
+}
+
+// benchFixture is a database holding a collection of synthetic users,
+// filled once and shared by the benchmarks using it.
+type benchFixture struct {
+	d   *Driver
+	dir string
+}
+
+var benchFixtures struct {
+	sync.Mutex
+	open map[string]*benchFixture
+}
+
+// openBenchFixture returns the database holding records users with engine,
+// filling it on first use.
+func openBenchFixture(b *testing.B, engine Engine, records int) *Driver {
+	b.Helper()
+	benchFixtures.Lock()
+	defer benchFixtures.Unlock()
+
+	id := fmt.Sprint(engine, "/", records)
+	if f, ok := benchFixtures.open[id]; ok {
+		return f.d
+	}
+
+	b.StopTimer()
+	defer b.StartTimer()
+	dir, err := os.MkdirTemp("", "bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	d, err := New(dir, &Options{Engine: engine, Slog: openTestLogger()})
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := d.BeginBulkLoad("users"); err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < records; i++ {
+		if err := d.Write("users", benchKey(i), benchUser(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := d.EndBulkLoad("users"); err != nil {
+		b.Fatal(err)
+	}
+
+	if benchFixtures.open == nil {
+		benchFixtures.open = make(map[string]*benchFixture)
+	}
+	benchFixtures.open[id] = &benchFixture{d: d, dir: dir}
+	return d
+}
+
+// closeBenchFixtures closes and removes the fixtures the benchmarks filled.
+func closeBenchFixtures() {
+	benchFixtures.Lock()
+	defer benchFixtures.Unlock()
+
+	for _, f := range benchFixtures.open {
+		f.d.Close()
+		os.RemoveAll(f.dir)
+	}
+	benchFixtures.open = nil
+}
+
+func benchKey(i int) string {
+	return fmt.Sprintf("user-%09d", i)
+}
+
+func benchUser(i int) User {
+	random := rand.New(rand.NewPCG(uint64(i), 1))
+	return User{
+		Name:    "User " + strconv.Itoa(i),
+		Age:     json.Number(strconv.Itoa(random.IntN(100))),
+		Company: "Company " + strconv.Itoa(random.IntN(1000)),
+		Address: Address{Street: strconv.Itoa(i) + " Main Street", City: "Pune", State: "MH", Country: "India"},
+	}
+}
+
+// runBenchmarks runs fn as a benchmark against every engine and size.
+func runBenchmarks(b *testing.B, fn func(b *testing.B, d *Driver, records int)) {
+	for _, e := range benchEngines {
+		for _, records := range benchSizes {
+			b.Run(fmt.Sprintf("%s/records=%d", e.name, records), func(b *testing.B) {
+				fn(b, openBenchFixture(b, e.engine, records), records)
+			})
+		}
+	}
+}
+
+func BenchmarkWrite(b *testing.B) {
+	runBenchmarks(b, func(b *testing.B, d *Driver, records int) {
+		random := rand.New(rand.NewPCG(2, uint64(records)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			key := random.IntN(records)
+			if err := d.Write("users", benchKey(key), benchUser(key)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkRead(b *testing.B) {
+	runBenchmarks(b, func(b *testing.B, d *Driver, records int) {
+		random := rand.New(rand.NewPCG(3, uint64(records)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := d.Read("users", benchKey(random.IntN(records))); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkReadAll(b *testing.B) {
+	runBenchmarks(b, func(b *testing.B, d *Driver, records int) {
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			users, err := d.ReadAll("users")
+			if err != nil {
+				b.Fatal(err)
+			}
+			if len(users) != records {
+				b.Fatalf("read %d records, want %d", len(users), records)
+			}
+		}
+	})
+}
+
+func BenchmarkQuery(b *testing.B) {
+	runBenchmarks(b, func(b *testing.B, d *Driver, records int) {
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := d.Query("users", benchQuery); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// bulkBufferSize is how much a log collection buffers during a bulk load.
+const bulkBufferSize = 1 << 20
+
+// bulkLoader is implemented by storage engines that can batch the writes
+// of a bulk load.
+type bulkLoader interface {
+	beginBulk(collection string) error
+	endBulk(collection string) error
+	// flushBulk writes out what every bulk load has buffered.
+	flushBulk() error
+}
+
+// bulkLoad tracks a bulk load in progress.
+type bulkLoad struct {
+	records int
+	start   time.Time
+}
+
+// BeginBulkLoad puts a collection in bulk load mode for fast initial
+// ingestion, until EndBulkLoad. Writes are not logged one by one, and the
+// log engine buffers appends and defers remapping its memory mapping
+// instead of writing every record through on its own. Records written
+// meanwhile can be read as usual, but are only on disk once the buffer
+// fills or the load ends, so a crash loses the unflushed part of the load.
+// The file engine writes every record as usual, but under DurabilityAlways
+// syncs them all once the load ends, and leaves the key manifest of the
+// collection to be rebuilt afterwards rather than updating it per record.
+func (d *Driver) BeginBulkLoad(collection string) error {
+	if err := d.checkNames(&collection); err != nil {
+		return err
+	}
+
+	if err := d.writable(); err != nil {
+		return err
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	d.mutex.Lock()
+	if d.bulk == nil {
+		d.bulk = make(map[string]*bulkLoad)
+	}
+	if _, ok := d.bulk[collection]; ok {
+		d.mutex.Unlock()
+		return fmt.Errorf("collection %s is already being bulk loaded", collection)
+	}
+	d.bulk[collection] = &bulkLoad{start: time.Now()}
+	d.mutex.Unlock()
+
+	if b, ok := d.store.(bulkLoader); ok {
+		if err := b.beginBulk(collection); err != nil {
+			d.mutex.Lock()
+			delete(d.bulk, collection)
+			d.mutex.Unlock()
+			return fmt.Errorf("could not begin bulk load of collection %s: %v", collection, err)
+		}
+	}
+	return nil
+}
+
+// EndBulkLoad flushes a bulk load to disk and returns the collection to
+// normal operation.
+func (d *Driver) EndBulkLoad(collection string) error {
+	if err := d.checkNames(&collection); err != nil {
+		return err
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	d.mutex.Lock()
+	load, ok := d.bulk[collection]
+	delete(d.bulk, collection)
+	d.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("collection %s is not being bulk loaded", collection)
+	}
+
+	if b, ok := d.store.(bulkLoader); ok {
+		if err := b.endBulk(collection); err != nil {
+			return fmt.Errorf("could not end bulk load of collection %s: %v", collection, err)
+		}
+	}
+	d.log.Info("Bulk loaded %d records into collection %s in %s", load.records, collection, time.Since(load.start))
+	return nil
+}
+
+// flushBulkLoads writes out what bulk loads have buffered, so the files
+// on disk are complete.
+func (d *Driver) flushBulkLoads() {
+	if b, ok := d.store.(bulkLoader); ok {
+		if err := b.flushBulk(); err != nil {
+			d.log.Error("Could not flush bulk loads: %v", err)
+		}
+	}
+}
+
+// countBulk counts a write to a collection being bulk loaded, reporting
+// whether it is.
+func (d *Driver) countBulk(collection string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	load, ok := d.bulk[collection]
+	if ok {
+		load.records++
+	}
+	return ok
+}
+
+func (s *fileStorage) beginBulk(collection string) error {
+	if err := s.forgetManifest(collection); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.bulk == nil {
+		s.bulk = make(map[string]bool)
+	}
+	s.bulk[collection] = true
+	return nil
+}
+
+func (s *fileStorage) endBulk(collection string) error {
+	s.mutex.Lock()
+	delete(s.bulk, collection)
+	s.mutex.Unlock()
+
+	// Reads during the load may have loaded the manifest, which the writes
+	// after them did not update.
+	if err := s.forgetManifest(collection); err != nil {
+		return err
+	}
+	return s.flushBulk()
+}
+
+func (s *fileStorage) flushBulk() error {
+	if s.durability != DurabilityAlways {
+		return nil
+	}
+	return s.syncDirty()
+}
+
+// bulkLoading reports whether dir holds records of a collection being bulk
+// loaded.
+func (s *fileStorage) bulkLoading(dir string) bool {
+	rel, err := filepath.Rel(s.dir, dir)
+	if err != nil {
+		return false
+	}
+	collection, _, _ := strings.Cut(filepath.ToSlash(rel), "/")
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.bulk[collection]
+}
+
+func (s *logStorage) beginBulk(collection string) error {
+	c, err := s.collection(collection, true)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	s.bulk[collection] = true
+	s.mutex.Unlock()
+
+	c.Lock()
+	defer c.Unlock()
+	c.startBulk()
+	return nil
+}
+
+func (s *logStorage) endBulk(collection string) error {
+	s.mutex.Lock()
+	delete(s.bulk, collection)
+	c, ok := s.collections[collection]
+	s.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	err := c.flushBulk()
+	c.bulk = nil
+	c.remap()
+	return err
+}
+
+func (s *logStorage) flushBulk() error {
+	s.mutex.Lock()
+	var loading []*logCollection
+	for name := range s.bulk {
+		if c, ok := s.collections[name]; ok {
+			loading = append(loading, c)
+		}
+	}
+	s.mutex.Unlock()
+
+	var errs []error
+	for _, c := range loading {
+		c.Lock()
+		errs = append(errs, c.flushBulk())
+		c.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// startBulk buffers appends from the end of the log. The lock must be
+// held.
+func (c *logCollection) startBulk() {
+	c.bulk = bufio.NewWriterSize(io.NewOffsetWriter(c.file, c.size), bulkBufferSize)
+}
+
+// flushBulk writes buffered appends out. The lock must be held.
+func (c *logCollection) flushBulk() error {
+	if c.bulk == nil || c.bulk.Buffered() == 0 {
+		return nil
+	}
+	if err := c.bulk.Flush(); err != nil {
+		return fmt.Errorf("could not flush bulk load of %s: %v", c.path, err)
+	}
+	c.buffered.Store(false)
+	return c.written()
+}
+
+// flushForRead makes buffered appends readable from the file.
+func (c *logCollection) flushForRead() error {
+	if !c.buffered.Load() {
+		return nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return errLogClosed
+	}
+	return c.flushBulk()
+}
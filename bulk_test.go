@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBulkLoadDefersSyncs(t *testing.T) {
+	var syncs atomic.Int32
+	fsys := &FaultFS{FS: OSFS{}, Fault: func(op, path string) error {
+		if op == "sync" {
+			syncs.Add(1)
+		}
+		return nil
+	}}
+	d, _ := openTestDB(t, &Options{FS: fsys, Durability: DurabilityAlways, KeyManifest: true})
+
+	if err := d.BeginBulkLoad("users"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := d.Write("users", fmt.Sprint("user", i), User{Name: fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := syncs.Load(); n != 0 {
+		t.Errorf("bulk load synced %d times before it ended", n)
+	}
+	if err := d.EndBulkLoad("users"); err != nil {
+		t.Fatal(err)
+	}
+	if syncs.Load() == 0 {
+		t.Error("ending the bulk load synced nothing")
+	}
+
+	keys, err := d.store.keys("users")
+	if err != nil || len(keys) != 100 {
+		t.Errorf("listed %d keys after the bulk load, want 100: %v", len(keys), err)
+	}
+
+	syncs.Store(0)
+	if err := d.Write("users", "alice", User{Name: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if syncs.Load() == 0 {
+		t.Error("write after the bulk load was not synced")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+// APIVersion is bumped whenever the Driver API changes in a way clients may
+// need to detect. It is reported by Capabilities alongside the release
+// version.
+const APIVersion = 1
+
+// Optional subsystems a Driver may report through Capabilities.
+const (
+	FeatureCompaction   = "compaction"
+	FeatureMmapReads    = "mmap-reads"
+	FeatureExternalLock = "external-lock"
+	FeatureDevNotify    = "dev-notify"
+	FeatureMetrics      = "metrics"
+	FeatureTracing      = "tracing"
+	FeatureChecksums    = "checksums"
+	FeatureReadOnly     = "read-only"
+	FeatureTransactions = "transactions"
+	FeatureChangeLog    = "change-log"
+	FeatureAlerts       = "alerts"
+	FeatureRemoteSync   = "remote-sync"
+	FeatureCRDT         = "crdt"
+	FeatureQuotas       = "quotas"
+	FeatureTimeSeries   = "time-series"
+	FeatureTTL          = "ttl"
+	FeatureEncryption   = "encryption"
+	FeatureDedup        = "dedup"
+	FeatureKeyManifest  = "key-manifest"
+	// FeatureSearch is reported when a collection indexes locations for
+	// Near and WithinBox.
+	FeatureSearch = "search"
+)
+
+// Capabilities describes what a Driver supports with its current directory
+// and configuration, so generic tools and clients can adapt at runtime.
+type Capabilities struct {
+	Version    string   `json:"version"`
+	APIVersion int      `json:"apiVersion"`
+	Engine     string   `json:"engine"`
+	Features   []string `json:"features"`
+}
+
+// Has reports whether feature is enabled.
+func (c Capabilities) Has(feature string) bool {
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the name of the engine.
+func (e Engine) String() string {
+	switch e {
+	case EngineLog:
+		return "log"
+	default:
+		return "files"
+	}
+}
+
+// engineName names the storage engine or backend in use.
+func (d *Driver) engineName() string {
+	switch s := d.store.(type) {
+	case *logStorage:
+		return EngineLog.String()
+	case *fileStorage:
+		return EngineFiles.String()
+	case externalStore:
+		if _, ok := s.Store.(*ShardedStore); ok {
+			return "sharded"
+		}
+	}
+	if d.opts.Backend != "" {
+		return d.opts.Backend
+	}
+	return "custom"
+}
+
+// Capabilities reports the optional subsystems enabled on this Driver.
+func (d *Driver) Capabilities() Capabilities {
+	caps := Capabilities{
+		Version:    version,
+		APIVersion: APIVersion,
+		Engine:     d.engineName(),
+		Features:   []string{FeatureMetrics},
+	}
+
+	// Transactions are refused by read-only Drivers, followers and cluster
+	// nodes, which only replicate plain writes and deletes.
+	if d.writable() == nil {
+		caps.Features = append(caps.Features, FeatureTransactions)
+	}
+
+	if _, ok := d.store.(compacter); ok {
+		caps.Features = append(caps.Features, FeatureCompaction)
+	}
+	switch s := d.store.(type) {
+	case *logStorage:
+		caps.Features = append(caps.Features, FeatureChecksums)
+		if d.opts.MmapReads {
+			caps.Features = append(caps.Features, FeatureMmapReads)
+		}
+	case *fileStorage:
+		if s.checksums {
+			caps.Features = append(caps.Features, FeatureChecksums)
+		}
+		if s.dedup {
+			caps.Features = append(caps.Features, FeatureDedup)
+		}
+		if s.manifest {
+			caps.Features = append(caps.Features, FeatureKeyManifest)
+		}
+	}
+	if d.opts.ExternalLock.PollInterval > 0 {
+		caps.Features = append(caps.Features, FeatureExternalLock)
+	}
+	if d.opts.DevNotify != nil {
+		caps.Features = append(caps.Features, FeatureDevNotify)
+	}
+	if d.opts.ReadOnly {
+		caps.Features = append(caps.Features, FeatureReadOnly)
+	}
+	if d.changes != nil {
+		caps.Features = append(caps.Features, FeatureChangeLog)
+	}
+	if _, ok := d.store.(usager); ok && d.opts.Alerts != nil {
+		caps.Features = append(caps.Features, FeatureAlerts)
+	}
+	if d.opts.Sync != nil && d.changes != nil {
+		caps.Features = append(caps.Features, FeatureRemoteSync)
+	}
+	if d.usage.enforcing() {
+		caps.Features = append(caps.Features, FeatureQuotas)
+	}
+	if d.hasTimeSeries() {
+		caps.Features = append(caps.Features, FeatureTimeSeries)
+	}
+	if d.hasTTL() {
+		caps.Features = append(caps.Features, FeatureTTL)
+	}
+	if d.hasCRDTs() {
+		caps.Features = append(caps.Features, FeatureCRDT)
+	}
+	if d.opts.Tracer != nil {
+		caps.Features = append(caps.Features, FeatureTracing)
+	}
+	if d.fields != nil {
+		caps.Features = append(caps.Features, FeatureEncryption)
+	}
+	if d.hasGeo() {
+		caps.Features = append(caps.Features, FeatureSearch)
+	}
+	return caps
+}
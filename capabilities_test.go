@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCapabilities(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     *Options
+		meta     map[string]CollectionMeta
+		engine   string
+		has, not []string
+	}{
+		{
+			name:   "files",
+			engine: "files",
+			has:    []string{FeatureMetrics, FeatureTransactions},
+			not:    []string{FeatureCompaction, FeatureChecksums, FeatureSearch, FeatureTTL, FeatureChangeLog},
+		},
+		{
+			name:   "log",
+			opts:   &Options{Engine: EngineLog, MmapReads: true, ChangeLog: true},
+			engine: "log",
+			has:    []string{FeatureCompaction, FeatureChecksums, FeatureMmapReads, FeatureChangeLog},
+		},
+		{
+			name:   "configured collections",
+			opts:   &Options{Checksums: true, EncryptionKey: []byte("secret")},
+			meta:   map[string]CollectionMeta{"places": {Geo: []string{"Location"}}, "sessions": {TTL: time.Hour}},
+			engine: "files",
+			has:    []string{FeatureChecksums, FeatureEncryption, FeatureSearch, FeatureTTL},
+		},
+		{
+			name:   "memory store",
+			opts:   &Options{Store: NewMemoryStore()},
+			engine: "custom",
+			not:    []string{FeatureCompaction, FeatureChecksums},
+		},
+		{
+			name:   "cluster node",
+			opts:   &Options{Cluster: &ClusterOptions{NodeID: "a", Bind: "127.0.0.1:0", Bootstrap: true}},
+			engine: "files",
+			not:    []string{FeatureTransactions},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _ := openTestDB(t, tt.opts)
+			for collection, meta := range tt.meta {
+				if err := d.SetCollectionMeta(collection, meta); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			caps := d.Capabilities()
+			if caps.Version != version || caps.APIVersion != APIVersion || caps.Engine != tt.engine {
+				t.Errorf("capabilities = %+v, want version %s, API version %d and engine %s", caps, version, APIVersion, tt.engine)
+			}
+			for _, feature := range tt.has {
+				if !caps.Has(feature) {
+					t.Errorf("features %q lack %s", caps.Features, feature)
+				}
+			}
+			for _, feature := range tt.not {
+				if caps.Has(feature) {
+					t.Errorf("features %q include %s", caps.Features, feature)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// The change log records every change with its data and a sequence number,
+// one JSON object per line, so changes can be replayed elsewhere in order.
+const (
+	changeLogDir  = ".changelog"
+	changeLogFile = "changes.log"
+)
+
+// errStopped is returned by a changeReader whose stop channel closed.
+var errStopped = errors.New("stopped")
+
+// ErrChangesTrimmed is returned when following the change log from a
+// change it no longer holds.
+var ErrChangesTrimmed = errors.New("change log no longer holds the changes asked for")
+
+// changeLog is the append-only change log of a database.
+type changeLog struct {
+	mutex   sync.Mutex
+	path    string
+	file    *os.File
+	seq     uint64
+	changed chan struct{}
+
+	mode       os.FileMode
+	durability Durability
+	dirty      bool  // appended to since last synced
+	failed     error // of the last append, until one succeeds
+
+	// retain is how many changes trimming keeps, or zero to keep all.
+	// keep, if set, returns the last change a reader has yet to get past,
+	// which is kept however old. first and entries describe the changes
+	// held, and generation counts the trims, so readers reopen the log.
+	retain     int
+	keep       func() uint64
+	first      uint64
+	entries    int
+	generation int
+}
+
+// openChangeLog opens the change log under dir, dropping a torn last line
+// left by a crash.
+func openChangeLog(dir string, mode layout, durability Durability, retain int) (*changeLog, error) {
+	logDir := filepath.Join(dir, changeLogDir)
+	if err := os.MkdirAll(logDir, mode.dirMode()); err != nil {
+		return nil, fmt.Errorf("could not create change log directory: %v", err)
+	}
+
+	path := filepath.Join(logDir, changeLogFile)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, mode.fileMode())
+	if err != nil {
+		return nil, fmt.Errorf("could not open change log: %v", err)
+	}
+
+	l := &changeLog{path: path, file: file, changed: make(chan struct{}),
+		mode: mode.fileMode(), durability: durability, retain: retain}
+
+	var offset int64
+	r := bufio.NewReader(file)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("could not read change log: %v", err)
+		}
+
+		var c Change
+		if err := json.Unmarshal(line, &c); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("corrupt change log %s at offset %d: %v", path, offset, err)
+		}
+		if l.entries == 0 {
+			l.first = c.Seq
+		}
+		l.seq = c.Seq
+		l.entries++
+		offset += int64(len(line))
+	}
+
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("could not truncate torn change log entry: %v", err)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// append records a change and returns it with its sequence number. A change
+// that already carries one (replicated from elsewhere) keeps it, and is
+// skipped if it is not newer than the last recorded change.
+func (l *changeLog) append(c Change) (Change, bool, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if c.Seq == 0 {
+		c.Seq = l.seq + 1
+	} else if c.Seq <= l.seq {
+		return c, false, nil
+	}
+
+	line, err := json.Marshal(c)
+	if err == nil {
+		_, err = l.file.Write(append(line, '\n'))
+	}
+	if err == nil && l.durability == DurabilityAlways {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		l.failed = fmt.Errorf("could not append change %d to change log: %v", c.Seq, err)
+		return c, false, l.failed
+	}
+
+	if l.entries == 0 {
+		l.first = c.Seq
+	}
+	l.seq = c.Seq
+	l.entries++
+	l.dirty = l.durability == DurabilityInterval
+	l.failed = nil
+	close(l.changed)
+	l.changed = make(chan struct{})
+
+	// Trimming waits for twice as many changes as are retained, so it
+	// rewrites the log only every so often.
+	if l.retain > 0 && l.entries >= 2*l.retain {
+		if err := l.trim(); err != nil {
+			l.failed = err
+			return c, true, err
+		}
+	}
+	return c, true, nil
+}
+
+// trim rewrites the log keeping the last retain changes, and any a reader
+// has yet to get past.
+func (l *changeLog) trim() error {
+	floor := l.seq - uint64(min(l.retain, l.entries))
+	if l.keep != nil {
+		floor = min(floor, l.keep())
+	}
+	if floor < l.first {
+		return nil
+	}
+
+	if _, err := l.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("could not trim change log: %v", err)
+	}
+	tmp := l.path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, l.mode)
+	if err != nil {
+		return fmt.Errorf("could not trim change log: %v", err)
+	}
+	w := bufio.NewWriter(out)
+	first, entries := uint64(0), 0
+	r := bufio.NewReader(l.file)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			out.Close()
+			os.Remove(tmp)
+			return fmt.Errorf("could not trim change log: %v", err)
+		}
+		var c Change
+		if json.Unmarshal(line, &c) != nil || c.Seq <= floor {
+			continue
+		}
+		if entries == 0 {
+			first = c.Seq
+		}
+		entries++
+		w.Write(line)
+	}
+
+	err = w.Flush()
+	if err == nil {
+		err = out.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, l.path)
+	}
+	if err != nil {
+		out.Close()
+		os.Remove(tmp)
+		l.file.Seek(0, io.SeekEnd)
+		return fmt.Errorf("could not trim change log: %v", err)
+	}
+	syncDir(OSFS{}, filepath.Dir(l.path))
+
+	l.file.Close()
+	l.file = out
+	l.first, l.entries = first, entries
+	l.generation++
+	return nil
+}
+
+// sync syncs the changes appended since it was last called.
+func (l *changeLog) sync() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !l.dirty {
+		return nil
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("could not sync change log: %v", err)
+	}
+	l.dirty = false
+	return nil
+}
+
+// err returns why the last change could not be recorded, if it could not.
+func (l *changeLog) err() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.failed
+}
+
+// lastSeq is the sequence number of the last recorded change.
+func (l *changeLog) lastSeq() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.seq
+}
+
+// wait returns a channel closed by the next append.
+func (l *changeLog) wait() <-chan struct{} {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.changed
+}
+
+func (l *changeLog) close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var err error
+	if l.dirty {
+		err = l.file.Sync()
+	}
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// changeReader follows the change log from a sequence number on, waiting
+// for new changes once it has caught up.
+type changeReader struct {
+	log        *changeLog
+	file       *os.File
+	r          *bufio.Reader
+	partial    []byte
+	since      uint64
+	generation int
+}
+
+// reader returns a changeReader yielding the changes after since, failing
+// with ErrChangesTrimmed if some of them were trimmed.
+func (l *changeLog) reader(since uint64) (*changeReader, error) {
+	r := &changeReader{log: l, since: since}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open opens the change log as it is now.
+func (r *changeReader) open() error {
+	l := r.log
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.entries > 0 && r.since+1 < l.first {
+		return fmt.Errorf("%w: change %d is gone, the log starts at %d", ErrChangesTrimmed, r.since+1, l.first)
+	}
+	file, err := os.Open(l.path)
+	if err != nil {
+		return fmt.Errorf("could not open change log: %v", err)
+	}
+	if r.file != nil {
+		r.file.Close()
+	}
+	r.file, r.r, r.partial, r.generation = file, bufio.NewReader(file), nil, l.generation
+	return nil
+}
+
+// trimmed reports whether the log was rewritten since the reader opened it.
+func (r *changeReader) trimmed() bool {
+	r.log.mutex.Lock()
+	defer r.log.mutex.Unlock()
+
+	return r.log.generation != r.generation
+}
+
+// next returns the next change, blocking until one is appended or stop
+// closes.
+func (r *changeReader) next(stop <-chan struct{}) (Change, error) {
+	for {
+		changed := r.log.wait()
+
+		line, err := r.r.ReadBytes('\n')
+		r.partial = append(r.partial, line...)
+		if err == io.EOF && r.trimmed() {
+			// The rest is in the rewritten log, after what was read.
+			if err := r.open(); err != nil {
+				return Change{}, err
+			}
+			continue
+		}
+		if err == io.EOF {
+			select {
+			case <-changed:
+				continue
+			case <-stop:
+				return Change{}, errStopped
+			}
+		}
+		if err != nil {
+			return Change{}, err
+		}
+
+		var c Change
+		err = json.Unmarshal(bytes.TrimSpace(r.partial), &c)
+		r.partial = r.partial[:0]
+		if err != nil {
+			return Change{}, fmt.Errorf("corrupt change log entry: %v", err)
+		}
+		if c.Seq <= r.since {
+			continue
+		}
+		r.since = c.Seq
+		return c, nil
+	}
+}
+
+func (r *changeReader) close() error {
+	return r.file.Close()
+}
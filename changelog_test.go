@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestChangeLogTrims(t *testing.T) {
+	d, _ := openTestDB(t, &Options{ChangeLog: true, ChangeLogRetention: 5})
+	write := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if err := d.Write("users", fmt.Sprint("user", i), User{Name: fmt.Sprint(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	write(3)
+	// A reader following the log keeps up across trims.
+	follower, err := d.changes.reader(d.changes.lastSeq())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.close()
+	for i := 0; i < 30; i++ {
+		write(1)
+		change, err := follower.next(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if change.Seq != d.changes.lastSeq() {
+			t.Fatalf("follower got change %d, want %d", change.Seq, d.changes.lastSeq())
+		}
+	}
+
+	if d.changes.entries >= 10 {
+		t.Errorf("change log holds %d changes, want fewer than 10", d.changes.entries)
+	}
+	if _, err := d.changes.reader(0); !errors.Is(err, ErrChangesTrimmed) {
+		t.Errorf("reading trimmed changes = %v, want ErrChangesTrimmed", err)
+	}
+	r, err := d.changes.reader(d.changes.lastSeq() - 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.close()
+	if change, err := r.next(nil); err != nil || change.Seq != d.changes.lastSeq()-2 {
+		t.Errorf("next retained change = %d, %v", change.Seq, err)
+	}
+}
+
+func TestChangeLogFailureStillNotifies(t *testing.T) {
+	d, _ := openTestDB(t, &Options{ChangeLog: true})
+
+	var got []Change
+	d.subscribe(func(c Change) { got = append(got, c) })
+
+	// Closing the log under the Driver fails every append.
+	d.changes.file.Close()
+	if err := d.Write("users", "alice", User{Name: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 1 || got[0].Key != "alice" {
+		t.Errorf("subscribers got %+v, want the write to alice", got)
+	}
+	if report := d.Health(); report.Status == HealthOK {
+		t.Errorf("health is ok after the change log failed: %+v", report)
+	}
+}
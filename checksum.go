@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrCorruptRecord is returned (wrapped) when a record fails checksum
+// verification.
+var ErrCorruptRecord = errors.New("corrupt record")
+
+// checksumExt is the extension of the sidecar file holding a record's
+// checksum in the file engine.
+const checksumExt = ".sum"
+
+// CorruptRecord identifies a record that failed verification.
+type CorruptRecord struct {
+	Collection string
+	Key        string
+	Err        error
+}
+
+// Verify reads every record of every collection and reports the ones that
+// fail their checksum or do not hold valid JSON.
+func (d *Driver) Verify() ([]CorruptRecord, error) {
+	collections, err := d.Collections()
+	if err != nil {
+		return nil, err
+	}
+
+	var corrupt []CorruptRecord
+	for _, collection := range collections {
+		keys, err := d.store.keys(collection)
+		if err != nil {
+			continue
+		}
+
+		for _, key := range keys {
+			data, err := d.store.get(collection, key)
+			if err == nil && !json.Valid(data) {
+				err = fmt.Errorf("%w: invalid JSON", ErrCorruptRecord)
+			}
+			if err != nil {
+				corrupt = append(corrupt, CorruptRecord{Collection: collection, Key: key, Err: err})
+			}
+		}
+	}
+
+	if len(corrupt) > 0 {
+		d.log.Error("Verify found %d corrupt records", len(corrupt))
+	}
+	d.opMetrics.mutex.Lock()
+	d.opMetrics.corrupt = len(corrupt)
+	d.opMetrics.mutex.Unlock()
+	return corrupt, nil
+}
+
+// checksum renders the checksum stored in a record's sidecar.
+func checksum(data []byte) []byte {
+	return formatChecksum(crc32.ChecksumIEEE(data))
+}
+
+func formatChecksum(sum uint32) []byte {
+	return []byte(fmt.Sprintf("crc32:%08x\n", sum))
+}
+
+// moveRecord calls move to put a new record in place at path, keeping its
+// sidecar in step with sum, the checksum of the new record, or nil when
+// checksums are disabled. Whichever record a crash leaves behind passes
+// verification: while the record is replaced, the sidecar lists the
+// checksums of both the old and the new one.
+func (s *fileStorage) moveRecord(path string, sum []byte, move func() error) error {
+	old, err := s.fs.ReadFile(path + checksumExt)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not read checksum: %v", err)
+	}
+
+	// A record without a sidecar always passes, so with no old sidecar the
+	// new one can wait until the record is in place.
+	if len(old) > 0 && !bytes.Equal(old, sum) {
+		if sum == nil {
+			err = s.fs.Remove(path + checksumExt)
+		} else {
+			if old[len(old)-1] != '\n' {
+				old = append(old, '\n')
+			}
+			err = s.writeSidecar(path, append(old, sum...))
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not update checksum: %v", err)
+		}
+		if err := s.persist(filepath.Dir(path), path+checksumExt); err != nil {
+			return err
+		}
+	}
+
+	if err := move(); err != nil {
+		return err
+	}
+	if sum != nil && !bytes.Equal(old, sum) {
+		if err := s.writeSidecar(path, sum); err != nil {
+			return fmt.Errorf("could not write checksum: %v", err)
+		}
+	}
+	return nil
+}
+
+// writeSidecar replaces the sidecar of the record at path, writing it aside
+// first so it is never torn.
+func (s *fileStorage) writeSidecar(path string, sums []byte) error {
+	tmp := path + checksumExt + ".tmp"
+	if err := writeFileSync(s.fs, tmp, sums, s.layout.fileMode(), s.syncsAside(filepath.Dir(path))); err != nil {
+		return err
+	}
+	return s.fs.Rename(tmp, path+checksumExt)
+}
+
+// verifyChecksum compares data against the sidecar of the record at path,
+// which passes if it matches any checksum listed there. Records written
+// without checksums have no sidecar and always pass.
+func (s *fileStorage) verifyChecksum(path string, data []byte) error {
+	want, err := s.fs.ReadFile(path + checksumExt)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read checksum: %v", err)
+	}
+
+	got := checksum(data)
+	for _, line := range bytes.SplitAfter(want, []byte("\n")) {
+		if bytes.Equal(got, line) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s: checksum %s does not match stored %s",
+		ErrCorruptRecord, path, strings.TrimSpace(string(got)), strings.TrimSpace(string(want)))
+}
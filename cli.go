@@ -0,0 +1,1169 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+
+	"github.com/jcelliott/lumber"
+)
+
+// Exit codes shared by dbcli commands. fsck has its own, following fsck(8).
+const (
+	exitOK       = 0
+	exitFailure  = 1
+	exitUsage    = 2
+	exitConflict = 3
+	exitNotFound = 4
+)
+
+const usage = `usage: dbcli <command> [flags] [arguments]
+
+Records:
+  put collection key [--file record.json]   write a record (from stdin without --file or --set)
+      [--set Address.City=Pune ...]         set fields by dot path
+  get collection key [--field Address.City] print a record or one of its fields
+  ls collection                             list the keys of a collection
+  rm collection key                         delete a record
+  query collection expression               print the records matching a filter, e.g. 'Age > 30'
+  shell                                     start an interactive shell
+
+Maintenance:
+  fsck [collection...]                      check and repair collections
+  gc                                        remove empty collections and stale files
+  archive [--dry-run] [collection...]       archive and drop old records as the archival policies
+      [--archive-dir dir]                   of collections say
+  bench [--records 1000,100000] [--json]    time writes, reads, ReadAll and queries on synthetic
+                                            data, in a scratch database unless --db is given
+  export [--redact] collection              write a collection with revisions as JSON
+  import collection file.json               load records written by export
+  dump [--redact] [collection...]           write collections to stdout in the portable dump format
+  load [file.ndjson]                        load a dump (from stdin without a file)
+  restore                                   restore an empty database from a remote store and verify it
+  verify                                    check a database against the manifest of a remote store
+  token name [--admin] [--grant users=read] grant an HTTP API principal access and issue its token
+      [--policy policy.json]
+  serve [--addr :8080] [--policy file]      serve the HTTP API and the web UI at /ui/; the admin
+                                            API needs --policy
+      [--tls-cert file --tls-key file]      serve HTTPS
+      [--tls-client-ca file]                require client certificates signed by these CAs
+      [--cluster-node id --cluster-bind     join a Raft cluster as node id, listening for the
+       host:port [--cluster-bootstrap]]     other nodes on host:port; the first node bootstraps
+                                            it and the admin API joins the others
+
+Every command accepts --db (default ./db) and --engine (files or log).
+get, ls and query print with --format (or -o) text, table, json, jsonl, yaml
+or go-template='{{.Name}} {{.Age}}'.
+restore and verify take the remote store as --from dir or --s3-endpoint,
+--s3-bucket, --s3-region and --s3-prefix with credentials from
+AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+Exit codes: 0 success, 1 failure, 2 usage error, 3 import conflicts, 4 not found.
+`
+
+// runCommand runs a dbcli subcommand and returns the process exit code.
+func runCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return exitUsage
+	}
+
+	switch args[0] {
+	case "put":
+		return runPut(args[1:])
+	case "get":
+		return runGet(args[1:])
+	case "ls":
+		return runList(args[1:])
+	case "rm":
+		return runRemove(args[1:])
+	case "query":
+		return runQuery(args[1:])
+	case "shell":
+		return runShell(args[1:])
+	case "fsck":
+		return runFsck(args[1:])
+	case "gc":
+		return runGC(args[1:])
+	case "archive":
+		return runArchive(args[1:])
+	case "bench":
+		return runBench(args[1:])
+	case "export":
+		return runExport(args[1:])
+	case "import":
+		return runImport(args[1:])
+	case "dump":
+		return runDump(args[1:])
+	case "load":
+		return runLoad(args[1:])
+	case "restore":
+		return runRestore(args[1:])
+	case "verify":
+		return runVerify(args[1:])
+	case "token":
+		return runToken(args[1:])
+	case "serve":
+		return runServe(args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+		return exitOK
+	}
+
+	fmt.Fprintf(os.Stderr, "dbcli: unknown command %q\n\n%s", args[0], usage)
+	return exitUsage
+}
+
+// parseArgs parses flags wherever they appear among args, so both
+// "dbcli get --db x users alice" and "dbcli get users alice --db x" work,
+// and returns the positional arguments.
+func parseArgs(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// dbFlags are the flags every command uses to locate a database.
+type dbFlags struct {
+	dir    *string
+	engine *string
+	// archive is the archive directory, for commands that take one.
+	archive *string
+	// cluster makes the database a cluster node, for serve.
+	cluster *ClusterOptions
+}
+
+func addDBFlags(flags *flag.FlagSet) *dbFlags {
+	return &dbFlags{
+		dir:    flags.String("db", "./db", "database directory"),
+		engine: flags.String("engine", "files", "storage engine: files, log, or a registered backend such as memory"),
+	}
+}
+
+// open opens the database, logging only warnings and errors so command
+// output stays clean. Failed operations are reported by the commands
+// themselves, so the structured operation log is dropped.
+func (f *dbFlags) open() (*Driver, error) {
+	opts := &Options{
+		Logger: lumber.NewConsoleLogger(lumber.WARN),
+		Slog:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	engine, err := parseEngine(*f.engine)
+	switch {
+	case err == nil:
+		opts.Engine = engine
+	case registeredStore(*f.engine):
+		opts.Backend = *f.engine
+	default:
+		return nil, err
+	}
+	if f.archive != nil && *f.archive != "" {
+		opts.Archive = &ArchiveOptions{Store: NewDirStore(*f.archive)}
+	}
+	if f.cluster != nil && f.cluster.NodeID != "" {
+		opts.Cluster = f.cluster
+		opts.Durability = DurabilityAlways
+	}
+	return New(*f.dir, opts)
+}
+
+// parseEngine maps an engine name as printed by Engine.String back to it.
+func parseEngine(name string) (Engine, error) {
+	switch name {
+	case "files":
+		return EngineFiles, nil
+	case "log":
+		return EngineLog, nil
+	}
+	return 0, fmt.Errorf("unknown storage engine %q", name)
+}
+
+// Exit codes of dbcli fsck, following fsck(8).
+const (
+	fsckClean       = 0
+	fsckCorrected   = 1
+	fsckUncorrected = 4
+	fsckFailed      = 8
+)
+
+// runFsck checks and repairs collections: dbcli fsck [flags] [collection...]
+func runFsck(args []string) int {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	db := addDBFlags(flags)
+	remove := flags.Bool("delete", false, "delete damaged records instead of quarantining them")
+	dryRun := flags.Bool("n", false, "report damaged records without changing anything")
+	collections, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+
+	opts := RepairOptions{Action: RepairQuarantine}
+	switch {
+	case *dryRun:
+		opts.Action = RepairReportOnly
+	case *remove:
+		opts.Action = RepairDelete
+	}
+
+	driver, err := db.open()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dbcli:", err)
+		return fsckFailed
+	}
+	defer driver.Close()
+
+	if len(collections) == 0 {
+		if collections, err = driver.Collections(); err != nil {
+			fmt.Fprintln(os.Stderr, "dbcli:", err)
+			return fsckFailed
+		}
+	}
+
+	code := fsckClean
+	for _, collection := range collections {
+		report, err := driver.Repair(collection, opts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "dbcli:", err)
+			return fsckFailed
+		}
+
+		fmt.Println(report)
+		if !report.Clean() {
+			if opts.Action == RepairReportOnly {
+				code = fsckUncorrected
+			} else if code == fsckClean {
+				code = fsckCorrected
+			}
+		}
+	}
+	return code
+}
+
+// runGC removes empty collections and stale files: dbcli gc [flags]
+func runGC(args []string) int {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	db := addDBFlags(flags)
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(positional) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: dbcli gc [flags]")
+		return exitUsage
+	}
+
+	driver, err := db.open()
+	if err != nil {
+		return fail(err)
+	}
+	defer driver.Close()
+
+	report, err := driver.GC()
+	if err != nil {
+		return fail(err)
+	}
+	for _, collection := range report.Collections {
+		fmt.Printf("removed collection %s\n", collection)
+	}
+	for _, file := range report.Files {
+		fmt.Printf("removed %s\n", file)
+	}
+	fmt.Println(report)
+	return exitOK
+}
+
+// runArchive applies the archival policies of collections, of all that
+// have one when none are given: dbcli archive [flags] [collection...]
+func runArchive(args []string) int {
+	flags := flag.NewFlagSet("archive", flag.ContinueOnError)
+	db := addDBFlags(flags)
+	db.archive = flags.String("archive-dir", "", "directory records are archived to")
+	dryRun := flags.Bool("dry-run", false, "only report what would be archived and dropped")
+	collections, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+
+	driver, err := db.open()
+	if err != nil {
+		return fail(err)
+	}
+	defer driver.Close()
+
+	if len(collections) == 0 {
+		all, err := driver.Collections()
+		if err != nil {
+			return fail(err)
+		}
+		for _, collection := range all {
+			if meta, _ := driver.CollectionMeta(collection); meta.ArchiveAfter > 0 || meta.DropAfter > 0 {
+				collections = append(collections, collection)
+			}
+		}
+	}
+
+	archive, drop, dropArchived := "archived", "dropped", "dropped archived"
+	if *dryRun {
+		archive, drop, dropArchived = "would archive", "would drop", "would drop archived"
+	}
+	for _, collection := range collections {
+		report, err := driver.Archive(collection, *dryRun)
+		if err != nil {
+			return fail(err)
+		}
+		for _, key := range report.Archived {
+			fmt.Printf("%s %s/%s\n", archive, collection, key)
+		}
+		for _, key := range report.Dropped {
+			fmt.Printf("%s %s/%s\n", drop, collection, key)
+		}
+		for _, key := range report.DroppedArchived {
+			fmt.Printf("%s %s/%s\n", dropArchived, collection, key)
+		}
+	}
+	return exitOK
+}
+
+// runBench benchmarks the database on synthetic collections of the given
+// sizes: dbcli bench [flags]
+func runBench(args []string) int {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	db := addDBFlags(flags)
+	sizes := flags.String("records", "1000", "comma-separated collection sizes, e.g. 1000,100000,1000000")
+	reads := flags.Int("reads", 0, "random reads to time per size (default the size, at most 100000)")
+	scans := flags.Int("scans", 5, "ReadAll and queries to time per size")
+	asJSON := flags.Bool("json", false, "print the results as JSON")
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(positional) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: dbcli bench [flags]")
+		return exitUsage
+	}
+	var records []int
+	for _, size := range strings.Split(*sizes, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(size))
+		if err != nil || n <= 0 {
+			fmt.Fprintf(os.Stderr, "dbcli: invalid collection size %q\n", size)
+			return exitUsage
+		}
+		records = append(records, n)
+	}
+
+	scratch := true
+	flags.Visit(func(f *flag.Flag) { scratch = scratch && f.Name != "db" })
+	if scratch {
+		dir, err := os.MkdirTemp("", "dbcli-bench-")
+		if err != nil {
+			return fail(err)
+		}
+		defer os.RemoveAll(dir)
+		*db.dir = dir
+	}
+
+	driver, err := db.open()
+	if err != nil {
+		return fail(err)
+	}
+	defer driver.Close()
+
+	var results []BenchResult
+	for _, n := range records {
+		collection := fmt.Sprintf("bench-%d", n)
+		result, err := driver.Bench(collection, BenchOptions{Records: n, Reads: *reads, Scans: *scans})
+		results = append(results, result...)
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(results); err != nil {
+			return fail(err)
+		}
+		return exitOK
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RECORDS\tOP\tOPS\tOPS/S\tP50\tP99")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%.0f\t%s\t%s\n", r.Records, r.Op, r.Ops, r.OpsPerSec, r.P50, r.P99)
+	}
+	if err := tw.Flush(); err != nil {
+		return fail(err)
+	}
+	return exitOK
+}
+
+// runExport writes a collection as a JSON array of records with their
+// revisions: dbcli export [flags] collection
+func runExport(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	db := addDBFlags(flags)
+	redact := flags.Bool("redact", false, "mask the fields the collection redacts")
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(positional) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: dbcli export [flags] collection")
+		return exitUsage
+	}
+
+	driver, err := db.open()
+	if err != nil {
+		return fail(err)
+	}
+	defer driver.Close()
+
+	export := driver.Export
+	if *redact {
+		export = driver.ExportRedacted
+	}
+	records, err := export(positional[0])
+	if err != nil {
+		return fail(err)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(records); err != nil {
+		return fail(err)
+	}
+	return exitOK
+}
+
+// runImport loads records written by export into a collection:
+// dbcli import [flags] collection file.json
+//
+// With -report nothing is written; the records that would be created,
+// overwritten or are in conflict are listed instead. The exit code is
+// exitConflict when conflicts were found (and, without -force, skipped).
+func runImport(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	db := addDBFlags(flags)
+	report := flags.Bool("report", false, "list what the import would change without writing")
+	force := flags.Bool("force", false, "overwrite records changed since they were exported")
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(positional) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: dbcli import [flags] collection file.json")
+		return exitUsage
+	}
+
+	data, err := os.ReadFile(positional[1])
+	if err != nil {
+		return fail(err)
+	}
+	var records []Record
+	if err := json.Unmarshal(data, &records); err != nil {
+		return fail(fmt.Errorf("could not parse %s: %v", positional[1], err))
+	}
+
+	driver, err := db.open()
+	if err != nil {
+		return fail(err)
+	}
+	defer driver.Close()
+
+	opts := ImportOptions{Force: *force}
+	if *report {
+		opts.Mode = ImportModeReport
+	}
+
+	result, err := driver.Import(positional[0], records, opts)
+	if err != nil {
+		return fail(err)
+	}
+
+	fmt.Println(result)
+	if len(result.Conflicts) > 0 {
+		return exitConflict
+	}
+	return exitOK
+}
+
+// runDump writes collections in the dump format, newline-delimited JSON
+// described in dump.go: dbcli dump [flags] [collection...] > out.ndjson
+func runDump(args []string) int {
+	flags := flag.NewFlagSet("dump", flag.ContinueOnError)
+	db := addDBFlags(flags)
+	redact := flags.Bool("redact", false, "mask the fields each collection redacts")
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+
+	driver, err := db.open()
+	if err != nil {
+		return fail(err)
+	}
+	defer driver.Close()
+
+	dump := driver.Dump
+	if *redact {
+		dump = driver.DumpRedacted
+	}
+	if _, err := dump(os.Stdout, positional...); err != nil {
+		return fail(err)
+	}
+	return exitOK
+}
+
+// runLoad loads a dump written by dump: dbcli load [flags] [file.ndjson]
+// reads stdin without a file.
+func runLoad(args []string) int {
+	flags := flag.NewFlagSet("load", flag.ContinueOnError)
+	db := addDBFlags(flags)
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(positional) > 1 {
+		fmt.Fprintln(os.Stderr, "usage: dbcli load [flags] [file.ndjson]")
+		return exitUsage
+	}
+
+	in := io.Reader(os.Stdin)
+	if len(positional) == 1 {
+		file, err := os.Open(positional[0])
+		if err != nil {
+			return fail(err)
+		}
+		defer file.Close()
+		in = file
+	}
+
+	driver, err := db.open()
+	if err != nil {
+		return fail(err)
+	}
+	defer driver.Close()
+
+	records, err := driver.Load(in)
+	if err != nil {
+		return fail(err)
+	}
+	fmt.Printf("loaded %d records\n", records)
+	return exitOK
+}
+
+// fail reports err and returns the matching exit code.
+func fail(err error) int {
+	fmt.Fprintln(os.Stderr, "dbcli:", err)
+	if errors.Is(err, os.ErrNotExist) {
+		return exitNotFound
+	}
+	return exitFailure
+}
+
+// Output formats of the record commands. A format may also be
+// go-template=TEMPLATE, a text/template executed once per record (or key)
+// and followed by a newline, e.g. go-template='{{.Name}} {{.Age}}'.
+const (
+	formatText  = "text"
+	formatTable = "table"
+	formatJSON  = "json"
+	formatJSONL = "jsonl"
+	formatYAML  = "yaml"
+
+	formatTemplate = "go-template="
+)
+
+// addOutputFlag adds -o and its long form --format.
+func addOutputFlag(flags *flag.FlagSet) *string {
+	format := flags.String("o", formatText, "output format: text, table, json, jsonl, yaml or go-template=TEMPLATE")
+	flags.StringVar(format, "format", formatText, "same as -o")
+	return format
+}
+
+func checkFormat(format string) error {
+	switch format {
+	case formatText, formatTable, formatJSON, formatJSONL, formatYAML:
+		return nil
+	}
+	if strings.HasPrefix(format, formatTemplate) {
+		_, err := outputTemplate(format)
+		return err
+	}
+	return fmt.Errorf("unknown output format %q", format)
+}
+
+// outputTemplate parses the template of a go-template format. Besides the
+// builtins it offers json, which renders its argument as JSON.
+func outputTemplate(format string) (*template.Template, error) {
+	text := strings.TrimPrefix(format, formatTemplate)
+	tmpl, err := template.New("output").Option("missingkey=error").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			data, err := json.Marshal(v)
+			return string(data), err
+		},
+	}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid output template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// printTemplate executes the template of a go-template format once for
+// each item.
+func printTemplate[T any](w io.Writer, format string, items []T) error {
+	tmpl, err := outputTemplate(format)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if err := tmpl.Execute(w, item); err != nil {
+			return fmt.Errorf("could not execute output template: %v", err)
+		}
+		if _, err := fmt.Fprintln(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printUsers writes users in the given format: a table as text or table,
+// an array (or a single object when one is set) as json or yaml, one object
+// per line as jsonl.
+func printUsers(w io.Writer, format string, users []User, one bool) error {
+	if strings.HasPrefix(format, formatTemplate) {
+		return printTemplate(w, format, users)
+	}
+	if users == nil {
+		users = []User{}
+	}
+	switch format {
+	case formatYAML:
+		if one {
+			return writeYAML(w, users[0])
+		}
+		return writeYAML(w, users)
+	case formatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if one {
+			return encoder.Encode(users[0])
+		}
+		return encoder.Encode(users)
+	case formatJSONL:
+		encoder := json.NewEncoder(w)
+		for _, user := range users {
+			if err := encoder.Encode(user); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tAGE\tCOMPANY\tADDRESS")
+	for _, user := range users {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", user.Name, user.Age, user.Company, user.Address)
+	}
+	return tw.Flush()
+}
+
+// printValue writes a single field value: strings bare as text, anything
+// else as JSON unless yaml or a template is asked for.
+func printValue(w io.Writer, format string, value interface{}) error {
+	if strings.HasPrefix(format, formatTemplate) {
+		return printTemplate(w, format, []interface{}{value})
+	}
+	if s, ok := value.(string); ok && (format == formatText || format == formatTable) {
+		_, err := fmt.Fprintln(w, s)
+		return err
+	}
+	if format == formatYAML {
+		return writeYAML(w, value)
+	}
+
+	encoder := json.NewEncoder(w)
+	if format == formatJSON {
+		encoder.SetIndent("", "  ")
+	}
+	return encoder.Encode(value)
+}
+
+// runPut writes a record: dbcli put [flags] collection key
+//
+// The record is read as JSON from --file, or from stdin when it is absent
+// or "-". Fields can be set with --set path=value, e.g.
+// --set Address.City=Pune; without --file they apply to the stored record
+// (or a new one) instead of reading stdin.
+func runPut(args []string) int {
+	flags := flag.NewFlagSet("put", flag.ContinueOnError)
+	db := addDBFlags(flags)
+	file := flags.String("file", "", "JSON file holding the record, - for stdin")
+	var sets [][2]string
+	flags.Func("set", "set the field at a dot path, as path=value (repeatable)", func(s string) error {
+		path, value, ok := strings.Cut(s, "=")
+		if !ok {
+			return fmt.Errorf("expected path=value, got %q", s)
+		}
+		sets = append(sets, [2]string{path, value})
+		return nil
+	})
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(positional) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: dbcli put [flags] collection key")
+		return exitUsage
+	}
+	collection, key := positional[0], positional[1]
+
+	driver, err := db.open()
+	if err != nil {
+		return fail(err)
+	}
+	defer driver.Close()
+
+	var data []byte
+	switch {
+	case *file == "-" || (*file == "" && len(sets) == 0):
+		data, err = io.ReadAll(os.Stdin)
+	case *file != "":
+		data, err = os.ReadFile(*file)
+	default:
+		if data, err = driver.readRaw(collection, key); errors.Is(err, os.ErrNotExist) {
+			data, err = []byte("{}"), nil
+		}
+	}
+	if err != nil {
+		return fail(fmt.Errorf("could not read record: %v", err))
+	}
+
+	user, err := updateUser(data, sets)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dbcli: invalid record:", err)
+		return exitUsage
+	}
+
+	if err := driver.Write(collection, key, user); err != nil {
+		return fail(err)
+	}
+	return exitOK
+}
+
+// runGet prints a record, or with --field one field of it:
+// dbcli get [flags] collection key
+func runGet(args []string) int {
+	flags := flag.NewFlagSet("get", flag.ContinueOnError)
+	db := addDBFlags(flags)
+	format := addOutputFlag(flags)
+	field := flags.String("field", "", "print only the field at this dot path, e.g. Address.City")
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(positional) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: dbcli get [flags] collection key")
+		return exitUsage
+	}
+	if err := checkFormat(*format); err != nil {
+		fmt.Fprintln(os.Stderr, "dbcli:", err)
+		return exitUsage
+	}
+
+	driver, err := db.open()
+	if err != nil {
+		return fail(err)
+	}
+	defer driver.Close()
+
+	if *field != "" {
+		value, err := driver.ReadField(positional[0], positional[1], *field)
+		if errors.Is(err, ErrNoField) {
+			fmt.Fprintln(os.Stderr, "dbcli:", err)
+			return exitNotFound
+		}
+		if err != nil {
+			return fail(err)
+		}
+		if err := printValue(os.Stdout, *format, value); err != nil {
+			return fail(err)
+		}
+		return exitOK
+	}
+
+	user, err := driver.Read(positional[0], positional[1])
+	if err != nil {
+		return fail(err)
+	}
+	if err := printUsers(os.Stdout, *format, []User{user}, true); err != nil {
+		return fail(err)
+	}
+	return exitOK
+}
+
+// runList prints the keys of a collection: dbcli ls [flags] collection
+func runList(args []string) int {
+	flags := flag.NewFlagSet("ls", flag.ContinueOnError)
+	db := addDBFlags(flags)
+	format := addOutputFlag(flags)
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(positional) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: dbcli ls [flags] collection")
+		return exitUsage
+	}
+	if err := checkFormat(*format); err != nil {
+		fmt.Fprintln(os.Stderr, "dbcli:", err)
+		return exitUsage
+	}
+
+	driver, err := db.open()
+	if err != nil {
+		return fail(err)
+	}
+	defer driver.Close()
+
+	keys, err := driver.Keys(positional[0])
+	if err != nil {
+		return fail(err)
+	}
+
+	switch {
+	case strings.HasPrefix(*format, formatTemplate):
+		err = printTemplate(os.Stdout, *format, keys)
+	case *format == formatYAML:
+		if keys == nil {
+			keys = []string{}
+		}
+		err = writeYAML(os.Stdout, keys)
+	case *format == formatJSON:
+		if keys == nil {
+			keys = []string{}
+		}
+		err = json.NewEncoder(os.Stdout).Encode(keys)
+	case *format == formatJSONL:
+		encoder := json.NewEncoder(os.Stdout)
+		for _, key := range keys {
+			if err = encoder.Encode(key); err != nil {
+				break
+			}
+		}
+	default:
+		for _, key := range keys {
+			fmt.Println(key)
+		}
+	}
+	if err != nil {
+		return fail(err)
+	}
+	return exitOK
+}
+
+// runRemove deletes a record: dbcli rm [flags] collection key
+func runRemove(args []string) int {
+	flags := flag.NewFlagSet("rm", flag.ContinueOnError)
+	db := addDBFlags(flags)
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(positional) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: dbcli rm [flags] collection key")
+		return exitUsage
+	}
+
+	driver, err := db.open()
+	if err != nil {
+		return fail(err)
+	}
+	defer driver.Close()
+
+	if err := driver.Delete(positional[0], positional[1]); err != nil {
+		return fail(err)
+	}
+	return exitOK
+}
+
+// runQuery prints the records matching a filter:
+// dbcli query [flags] collection expression
+func runQuery(args []string) int {
+	flags := flag.NewFlagSet("query", flag.ContinueOnError)
+	db := addDBFlags(flags)
+	format := addOutputFlag(flags)
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(positional) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: dbcli query [flags] collection expression")
+		return exitUsage
+	}
+	if err := checkFormat(*format); err != nil {
+		fmt.Fprintln(os.Stderr, "dbcli:", err)
+		return exitUsage
+	}
+
+	driver, err := db.open()
+	if err != nil {
+		return fail(err)
+	}
+	defer driver.Close()
+
+	users, err := driver.Query(positional[0], positional[1])
+	var queryErr *QueryError
+	if errors.As(err, &queryErr) {
+		fmt.Fprintf(os.Stderr, "dbcli: %v\n%s\n", queryErr, queryErr.Pointer())
+		return exitUsage
+	}
+	if err != nil {
+		return fail(err)
+	}
+	if err := printUsers(os.Stdout, *format, users, false); err != nil {
+		return fail(err)
+	}
+	return exitOK
+}
+
+// remoteFlags are the flags locating a remote store.
+type remoteFlags struct {
+	dir, endpoint, bucket, region, prefix *string
+}
+
+func addRemoteFlags(flags *flag.FlagSet) *remoteFlags {
+	return &remoteFlags{
+		dir:      flags.String("from", "", "directory holding the remote store"),
+		endpoint: flags.String("s3-endpoint", "", "S3 endpoint URL"),
+		bucket:   flags.String("s3-bucket", "", "S3 bucket"),
+		region:   flags.String("s3-region", "", "S3 region"),
+		prefix:   flags.String("s3-prefix", "", "prefix of the objects in the bucket"),
+	}
+}
+
+func (f *remoteFlags) open() (RemoteStore, error) {
+	switch {
+	case *f.dir != "":
+		return NewDirStore(*f.dir), nil
+	case *f.bucket != "":
+		return NewS3Store(S3Options{
+			Endpoint:        *f.endpoint,
+			Region:          *f.region,
+			Bucket:          *f.bucket,
+			Prefix:          *f.prefix,
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		})
+	}
+	return nil, errors.New("no remote store given; use --from or --s3-bucket")
+}
+
+// runRestore restores an empty database from a remote store, verifying it
+// against the backup manifest: dbcli restore [flags]
+func runRestore(args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	db := addDBFlags(flags)
+	from := addRemoteFlags(flags)
+	if positional, err := parseArgs(flags, args); err != nil || len(positional) != 0 {
+		return exitUsage
+	}
+
+	remote, err := from.open()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dbcli:", err)
+		return exitUsage
+	}
+	engine, err := parseEngine(*db.engine)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dbcli:", err)
+		return exitUsage
+	}
+
+	driver, err := RestoreFromRemote(remote, *db.dir, &Options{
+		Logger: lumber.NewConsoleLogger(lumber.INFO),
+		Slog:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Engine: engine,
+	})
+	if err != nil {
+		return fail(err)
+	}
+	driver.Close()
+	return exitOK
+}
+
+// runVerify compares a database with the manifest of a remote store:
+// dbcli verify [flags]
+func runVerify(args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	db := addDBFlags(flags)
+	from := addRemoteFlags(flags)
+	if positional, err := parseArgs(flags, args); err != nil || len(positional) != 0 {
+		return exitUsage
+	}
+
+	remote, err := from.open()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dbcli:", err)
+		return exitUsage
+	}
+	manifest, err := ReadManifest(remote)
+	if err != nil {
+		return fail(err)
+	}
+
+	driver, err := db.open()
+	if err != nil {
+		return fail(err)
+	}
+	defer driver.Close()
+
+	verification, err := driver.VerifyManifest(manifest)
+	if err != nil {
+		return fail(err)
+	}
+	fmt.Println(verification)
+	if !verification.Clean() {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// runToken grants a principal of an HTTP API policy access and prints a new
+// token for it: dbcli token [flags] name
+func runToken(args []string) int {
+	flags := flag.NewFlagSet("token", flag.ContinueOnError)
+	path := flags.String("policy", "policy.json", "policy file")
+	admin := flags.Bool("admin", false, "grant access to everything, including the admin API")
+	principal := Principal{Collections: make(map[string]Access)}
+	flags.Func("grant", "grant access to a collection, as collection=read or collection=write (repeatable)", func(s string) error {
+		collection, access, ok := strings.Cut(s, "=")
+		if !ok {
+			return fmt.Errorf("expected collection=access, got %q", s)
+		}
+		principal.Collections[collection] = Access(access)
+		return nil
+	})
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(positional) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: dbcli token [flags] name")
+		return exitUsage
+	}
+	principal.Admin = *admin
+
+	policy, err := LoadPolicy(*path)
+	if err != nil {
+		return fail(err)
+	}
+	if err := policy.Grant(positional[0], principal); err != nil {
+		return fail(err)
+	}
+	token, err := policy.IssueToken(positional[0])
+	if err != nil {
+		return fail(err)
+	}
+	fmt.Println(token)
+	return exitOK
+}
+
+// runServe serves the HTTP API until interrupted: dbcli serve [flags]
+//
+// Records are served under /collections/, metrics at /metrics and the web
+// UI at /ui/. The admin API is only served under /admin/ with a policy,
+// which then also guards the rest.
+func runServe(args []string) int {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	db := addDBFlags(flags)
+	addr := flags.String("addr", ":8080", "address to listen on")
+	policyPath := flags.String("policy", "", "access policy file, see dbcli token")
+	snapshots := flags.String("snapshot-dir", "", "directory for snapshots taken through the admin API")
+	db.archive = flags.String("archive-dir", "", "directory collections with an archival policy archive records to")
+	var t TLSOptions
+	flags.StringVar(&t.CertFile, "tls-cert", "", "PEM certificate to serve HTTPS with")
+	flags.StringVar(&t.KeyFile, "tls-key", "", "PEM key of the certificate")
+	flags.StringVar(&t.ClientCAFile, "tls-client-ca", "", "PEM CAs client certificates must be signed by")
+	db.cluster = &ClusterOptions{}
+	flags.StringVar(&db.cluster.NodeID, "cluster-node", "", "ID of this node in a Raft cluster; clustering is off without it")
+	flags.StringVar(&db.cluster.Bind, "cluster-bind", "", "address to listen on for the other cluster nodes")
+	flags.StringVar(&db.cluster.Advertise, "cluster-advertise", "", "address the other cluster nodes reach this one at, if not --cluster-bind")
+	flags.BoolVar(&db.cluster.Bootstrap, "cluster-bootstrap", false, "start a new cluster made of this node")
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(positional) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: dbcli serve [flags]")
+		return exitUsage
+	}
+
+	server := &http.Server{Addr: *addr}
+	if t.CertFile != "" || t.KeyFile != "" || t.ClientCAFile != "" {
+		if server.TLSConfig, err = t.ServerConfig(); err != nil {
+			return fail(err)
+		}
+	}
+
+	var policy *Policy
+	if *policyPath != "" {
+		if policy, err = LoadPolicy(*policyPath); err != nil {
+			return fail(err)
+		}
+	}
+
+	driver, err := db.open()
+	if err != nil {
+		return fail(err)
+	}
+	defer driver.Close()
+
+	mux := http.NewServeMux()
+	api := driver.Handler(HandlerOptions{Policy: policy})
+	mux.Handle("/collections/", api)
+	mux.Handle("/healthz", api)
+	mux.Handle("/metrics", policy.guardAdmin(driver.MetricsHandler().ServeHTTP))
+	mux.Handle("/ui/", driver.UIHandler(UIOptions{Policy: policy}))
+	if policy != nil {
+		mux.Handle("/admin/", driver.AdminHandler(AdminOptions{Policy: policy, SnapshotDir: *snapshots}))
+	}
+	server.Handler = mux
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	go func() {
+		<-stop
+		server.Close()
+	}()
+
+	fmt.Fprintf(os.Stderr, "Serving %s on %s\n", *db.dir, *addr)
+	if server.TLSConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fail(err)
+	}
+	return exitOK
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPrintUsers(t *testing.T) {
+	users := []User{
+		{Name: "Ann", Age: "30", Company: "Acme", Address: Address{City: "Pune"}},
+		{Name: "Bob", Age: "41"},
+	}
+	tests := []struct {
+		name   string
+		format string
+		users  []User
+		one    bool
+		want   string
+	}{
+		{"text", formatText, users, false,
+			"NAME  AGE  COMPANY  ADDRESS\nAnn   30   Acme     Pune\nBob   41            \n"},
+		{"table", formatTable, users[:1], false,
+			"NAME  AGE  COMPANY  ADDRESS\nAnn   30   Acme     Pune\n"},
+		{"json", formatJSON, users[1:], false,
+			"[\n  {\n    \"Name\": \"Bob\",\n    \"Age\": 41,\n    \"Company\": \"\",\n    \"Address\": {\n" +
+				"      \"Street\": \"\",\n      \"City\": \"\",\n      \"State\": \"\",\n      \"Country\": \"\"\n    }\n  }\n]\n"},
+		{"json without users", formatJSON, nil, false, "[]\n"},
+		{"json of one", formatJSON, users[1:], true,
+			"{\n  \"Name\": \"Bob\",\n  \"Age\": 41,\n  \"Company\": \"\",\n  \"Address\": {\n" +
+				"    \"Street\": \"\",\n    \"City\": \"\",\n    \"State\": \"\",\n    \"Country\": \"\"\n  }\n}\n"},
+		{"jsonl", formatJSONL, users, false,
+			`{"Name":"Ann","Age":30,"Company":"Acme","Address":{"Street":"","City":"Pune","State":"","Country":""}}` + "\n" +
+				`{"Name":"Bob","Age":41,"Company":"","Address":{"Street":"","City":"","State":"","Country":""}}` + "\n"},
+		{"yaml", formatYAML, users[1:], false,
+			"- Name: Bob\n  Age: 41\n  Company: \"\"\n  Address:\n    Street: \"\"\n    City: \"\"\n    State: \"\"\n    Country: \"\"\n"},
+		{"yaml of one", formatYAML, users[:1], true,
+			"Name: Ann\nAge: 30\nCompany: Acme\nAddress:\n  Street: \"\"\n  City: Pune\n  State: \"\"\n  Country: \"\"\n"},
+		{"yaml without users", formatYAML, nil, false, "[]\n"},
+		{"template", formatTemplate + "{{.Name}} {{json .Age}}", users, false, "Ann 30\nBob 41\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+			if err := printUsers(&b, tt.format, tt.users, tt.one); err != nil {
+				t.Fatal(err)
+			}
+			if b.String() != tt.want {
+				t.Errorf("printUsers = %q, want %q", b.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestPrintValue(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		value  interface{}
+		want   string
+	}{
+		{"text string", formatText, "Pune", "Pune\n"},
+		{"table string", formatTable, "Pune", "Pune\n"},
+		{"text object", formatText, map[string]string{"City": "Pune"}, "{\"City\":\"Pune\"}\n"},
+		{"json string", formatJSON, "Pune", "\"Pune\"\n"},
+		{"json object", formatJSON, map[string]string{"City": "Pune"}, "{\n  \"City\": \"Pune\"\n}\n"},
+		{"jsonl object", formatJSONL, map[string]string{"City": "Pune"}, "{\"City\":\"Pune\"}\n"},
+		{"yaml string", formatYAML, "Pune", "Pune\n"},
+		{"yaml quoted string", formatYAML, ".inf", "\".inf\"\n"},
+		{"yaml object", formatYAML, map[string]string{"City": "Pune"}, "City: Pune\n"},
+		{"template", formatTemplate + "<{{.}}>", "Pune", "<Pune>\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+			if err := printValue(&b, tt.format, tt.value); err != nil {
+				t.Fatal(err)
+			}
+			if b.String() != tt.want {
+				t.Errorf("printValue = %q, want %q", b.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckFormat(t *testing.T) {
+	for _, format := range []string{formatText, formatTable, formatJSON, formatJSONL, formatYAML, formatTemplate + "{{.Name}}"} {
+		if err := checkFormat(format); err != nil {
+			t.Errorf("checkFormat(%q) = %v", format, err)
+		}
+	}
+	for _, format := range []string{"xml", formatTemplate + "{{.Name"} {
+		if err := checkFormat(format); err == nil {
+			t.Errorf("checkFormat(%q) succeeded", format)
+		}
+	}
+}
+
+// runCLI runs dbcli with args, feeding it stdin, and returns what it wrote
+// to stdout and stderr with its exit code.
+func runCLI(t *testing.T, stdin string, args ...string) (stdout, stderr string, code int) {
+	t.Helper()
+	dir := t.TempDir()
+	files := make([]*os.File, 3)
+	for i, name := range []string{"stdin", "stdout", "stderr"} {
+		file, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		files[i] = file
+	}
+	if _, err := io.WriteString(files[0], stdin); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := files[0].Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	os.Stdin, os.Stdout, os.Stderr = files[0], files[1], files[2]
+	code = runCommand(args)
+	os.Stdin, os.Stdout, os.Stderr = saved[0], saved[1], saved[2]
+
+	out, err := os.ReadFile(files[1].Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	errOut, err := os.ReadFile(files[2].Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out), string(errOut), code
+}
+
+// cliStep is one dbcli invocation and what it should print and return.
+type cliStep struct {
+	stdin string
+	args  []string
+	code  int
+	// stdout is the exact output, unless empty; stderr is a substring of
+	// the error output.
+	stdout, stderr string
+}
+
+func runCLISteps(t *testing.T, steps []cliStep) {
+	t.Helper()
+	for _, step := range steps {
+		stdout, stderr, code := runCLI(t, step.stdin, step.args...)
+		name := strings.Join(step.args, " ")
+		if code != step.code {
+			t.Errorf("dbcli %s exited %d, want %d; stderr: %s", name, code, step.code, stderr)
+		}
+		if step.stdout != "" && stdout != step.stdout {
+			t.Errorf("dbcli %s printed %q, want %q", name, stdout, step.stdout)
+		}
+		if !strings.Contains(stderr, step.stderr) {
+			t.Errorf("dbcli %s reported %q, want %q in it", name, stderr, step.stderr)
+		}
+	}
+}
+
+func TestCLIRecords(t *testing.T) {
+	db := "--db=" + t.TempDir()
+	runCLISteps(t, []cliStep{
+		{stdin: `{"Name": "Ann", "Age": 30, "Address": {"City": "Pune"}}`, args: []string{"put", db, "users", "ann"}},
+		{args: []string{"put", "users", "bob", db, "--set", "Name=Bob", "--set", "Age=41"}},
+		{args: []string{"put", db, "--set", "Address.City=Delhi", "users", "bob"}},
+		{args: []string{"get", db, "users", "ann", "--field", "Address.City"}, stdout: "Pune\n"},
+		{args: []string{"get", db, "users", "bob", "--field", "Address.City", "-o", "json"}, stdout: "\"Delhi\"\n"},
+		{args: []string{"get", db, "users", "bob", "-o", "go-template={{.Name}} {{.Age}}"}, stdout: "Bob 41\n"},
+		{args: []string{"ls", db, "users"}, stdout: "ann\nbob\n"},
+		{args: []string{"ls", db, "users", "--format", "json"}, stdout: "[\"ann\",\"bob\"]\n"},
+		{args: []string{"query", db, "users", "Age > 35", "-o", "jsonl"},
+			stdout: `{"Name":"Bob","Age":41,"Company":"","Address":{"Street":"","City":"Delhi","State":"","Country":""}}` + "\n"},
+		{args: []string{"rm", db, "users", "ann"}},
+		{args: []string{"get", db, "users", "ann"}, code: exitNotFound, stderr: "dbcli:"},
+		{args: []string{"get", db, "users", "bob", "--field", "Phone"}, code: exitNotFound},
+		{args: []string{"rm", db, "users", "ann"}, code: exitNotFound},
+		{stdin: "{", args: []string{"put", db, "users", "cat"}, code: exitUsage, stderr: "invalid record"},
+		{args: []string{"query", db, "users", "Age >"}, code: exitUsage},
+		{args: []string{"get", db, "users"}, code: exitUsage, stderr: "usage: dbcli get"},
+		{args: []string{"ls", db, "users", "-o", "xml"}, code: exitUsage, stderr: "unknown output format"},
+		{args: []string{"get", db, "--bogus", "users", "bob"}, code: exitUsage},
+		{args: []string{"frobnicate"}, code: exitUsage, stderr: `unknown command "frobnicate"`},
+		{args: nil, code: exitUsage, stderr: "usage: dbcli"},
+		{args: []string{"help"}},
+	})
+}
+
+func TestCLIMaintenance(t *testing.T) {
+	dir := t.TempDir()
+	db := "--db=" + filepath.Join(dir, "db")
+	runCLISteps(t, []cliStep{
+		{args: []string{"put", db, "users", "ann", "--set", "Name=Ann"}},
+		{args: []string{"put", db, "users", "bob", "--set", "Name=Bob"}},
+		{args: []string{"fsck", db}, code: fsckClean, stdout: "users: scanned 2 records, 0 corrupt\n"},
+		{args: []string{"gc", db}},
+	})
+
+	// A damaged record is only reported with -n, and quarantined without.
+	if err := os.WriteFile(filepath.Join(dir, "db", "users", "bob.json"), []byte(`{"Name": "B`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	runCLISteps(t, []cliStep{
+		{args: []string{"fsck", db, "-n"}, code: fsckUncorrected},
+		{args: []string{"fsck", db, "users"}, code: fsckCorrected},
+		{args: []string{"fsck", db, "users"}, code: fsckClean},
+		{args: []string{"ls", db, "users"}, stdout: "ann\n"},
+	})
+
+	// A dump loads into another database.
+	dump, _, code := runCLI(t, "", "dump", db)
+	if code != exitOK || !strings.Contains(dump, "ann") {
+		t.Fatalf("dump = %q, exit %d", dump, code)
+	}
+	copyDB := "--db=" + filepath.Join(dir, "copy")
+	runCLISteps(t, []cliStep{
+		{stdin: dump, args: []string{"load", copyDB}, stdout: "loaded 1 records\n"},
+		{args: []string{"get", copyDB, "users", "ann", "--field", "Name"}, stdout: "Ann\n"},
+		{args: []string{"load", copyDB, filepath.Join(dir, "missing.ndjson")}, code: exitNotFound},
+	})
+
+	// An export imported after the record changed is in conflict.
+	export, _, code := runCLI(t, "", "export", db, "users")
+	if code != exitOK {
+		t.Fatalf("export exited %d", code)
+	}
+	file := filepath.Join(dir, "users.json")
+	if err := os.WriteFile(file, []byte(strings.Replace(export, `"Ann"`, `"Ann imported"`, 1)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	runCLISteps(t, []cliStep{
+		{args: []string{"put", db, "users", "ann", "--set", "Name=Ann edited"}},
+		{args: []string{"import", db, "users", file, "--report"}, code: exitConflict},
+		{args: []string{"get", db, "users", "ann", "--field", "Name"}, stdout: "Ann edited\n"},
+		{args: []string{"import", db, "users", file, "--force"}, code: exitConflict},
+		{args: []string{"get", db, "users", "ann", "--field", "Name"}, stdout: "Ann imported\n"},
+		{args: []string{"import", db, "users"}, code: exitUsage},
+	})
+}
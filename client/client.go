@@ -0,0 +1,377 @@
+// Package client talks to a database served over HTTP by Driver.Handler. The
+// Driver lives in package main and cannot be imported, so this is how other
+// programs use the database. Its Client mirrors the Driver API, with the same
+// method names and errors:
+//
+//	db, err := client.New("http://host:8080", nil)
+//	...
+//	err = db.Write("users", "ada", client.User{Name: "Ada"})
+//	user, err := db.Read("users", "ada")
+//
+// Errors match the Driver's: reading a missing record fails with an error
+// wrapping os.ErrNotExist, and the other failures wrap the sentinels below.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Errors returned for the failures the server reports, matching the
+// Driver's errors of the same name.
+var (
+	ErrConditionFailed = errors.New("condition failed")
+	ErrQuotaExceeded   = errors.New("quota exceeded")
+	ErrConflict        = errors.New("conflicting reference")
+	ErrUnauthenticated = errors.New("unauthenticated")
+	ErrForbidden       = errors.New("forbidden")
+	ErrBehind          = errors.New("database has not caught up with the session")
+	ErrBadRequest      = errors.New("bad request")
+)
+
+// sessionHeader carries read-your-writes session tokens.
+const sessionHeader = "X-Session-Token"
+
+// User is a record, as the Driver's User.
+type User struct {
+	Name     string
+	Age      json.Number
+	Company  string
+	Address  Address
+	Computed map[string]interface{} `json:",omitempty"`
+}
+
+// Address is the address of a User.
+type Address struct {
+	Street  string
+	City    string
+	State   string
+	Country string
+	Pincode json.Number `json:",omitempty"`
+}
+
+// Change is a change to a record, as received by Watch.
+type Change struct {
+	Seq        uint64
+	Op         string
+	Collection string
+	Key        string
+	Time       time.Time
+	Data       []byte
+}
+
+// Options configures a Client.
+type Options struct {
+	// HTTPClient sends the requests. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	// Token authenticates the client to a server with a Policy.
+	Token string
+}
+
+// Client is a database served over HTTP. It is safe for concurrent use.
+//
+// A Client reads its own writes: it sends the session token of its last
+// write with every read, so a read served by a replication follower or a
+// cluster node waits until it has caught up with it. The server issues
+// tokens only with a change log or a cluster.
+type Client struct {
+	base  *url.URL
+	http  *http.Client
+	token string
+
+	mutex   sync.Mutex
+	session string
+}
+
+// New returns a Client for the server at baseURL.
+func New(baseURL string, opts *Options) (*Client, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server URL: %v", err)
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("invalid server URL %q: scheme must be http or https", baseURL)
+	}
+
+	if opts == nil {
+		opts = &Options{}
+	}
+	c := &Client{base: base, http: opts.HTTPClient, token: opts.Token}
+	if c.http == nil {
+		c.http = http.DefaultClient
+	}
+	return c, nil
+}
+
+// record is a keyed record as exchanged with the server.
+type record struct {
+	Key   string `json:"key"`
+	Value User   `json:"value"`
+}
+
+// Write saves a record.
+func (c *Client) Write(collection, key string, value User) error {
+	return c.write(collection, key, value, nil)
+}
+
+// WriteIfAbsent saves a record only if the key is not taken yet, failing
+// with ErrConditionFailed otherwise.
+func (c *Client) WriteIfAbsent(collection, key string, value User) error {
+	return c.write(collection, key, value, http.Header{"If-None-Match": {"*"}})
+}
+
+func (c *Client) write(collection, key string, value User, header http.Header) error {
+	value.Computed = nil
+	body, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("could not marshal data: %v", err)
+	}
+	resp, err := c.do(http.MethodPut, c.path(collection, key), nil, header, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("could not write user %s: %w", key, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Read returns a record.
+func (c *Client) Read(collection, key string) (User, error) {
+	var r record
+	if err := c.get(c.path(collection, key), nil, &r); err != nil {
+		return User{}, fmt.Errorf("could not read user %s: %w", key, err)
+	}
+	return r.Value, nil
+}
+
+// ReadAll returns every record of a collection.
+func (c *Client) ReadAll(collection string) ([]User, error) {
+	return c.list(collection, nil)
+}
+
+// Query returns the records of a collection matching a filter expression,
+// in the syntax of the Driver's ParseQuery.
+func (c *Client) Query(collection, expr string) ([]User, error) {
+	return c.list(collection, url.Values{"q": {expr}})
+}
+
+func (c *Client) list(collection string, query url.Values) ([]User, error) {
+	var records []record
+	if err := c.get(c.path(collection), query, &records); err != nil {
+		return nil, fmt.Errorf("could not read collection %s: %w", collection, err)
+	}
+	users := make([]User, len(records))
+	for i, r := range records {
+		users[i] = r.Value
+	}
+	return users, nil
+}
+
+// Delete removes a record.
+func (c *Client) Delete(collection, key string) error {
+	resp, err := c.do(http.MethodDelete, c.path(collection, key), nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("could not delete user %s: %w", key, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Watch returns a channel receiving every change to a collection, and a
+// function to stop watching. The channel is closed by stop, and when the
+// connection ends, in which case the reader should read the collection
+// again and watch anew.
+func (c *Client) Watch(collection string) (changes <-chan Change, stop func(), err error) {
+	req, err := c.request(http.MethodGet, c.path(collection, "watch"), nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req = req.WithContext(ctx)
+
+	resp, err := c.send(req)
+	if err != nil {
+		cancel()
+		return nil, nil, fmt.Errorf("could not watch collection %s: %w", collection, err)
+	}
+
+	out := make(chan Change)
+	go func() {
+		defer close(out)
+		defer cancel()
+		defer resp.Body.Close()
+
+		readEvents(resp.Body, func(data []byte) bool {
+			var event struct {
+				Seq   uint64          `json:"seq"`
+				Op    string          `json:"op"`
+				Key   string          `json:"key"`
+				Time  time.Time       `json:"time"`
+				Value json.RawMessage `json:"value"`
+			}
+			if err := json.Unmarshal(data, &event); err != nil {
+				return false
+			}
+			change := Change{Seq: event.Seq, Op: event.Op, Collection: collection, Key: event.Key, Time: event.Time}
+			if len(event.Value) > 0 {
+				change.Data = event.Value
+			}
+			select {
+			case out <- change:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+	return out, cancel, nil
+}
+
+// readEvents hands the data of every server-sent event to fn until the
+// stream ends or fn returns false.
+func readEvents(r io.Reader, fn func(data []byte) bool) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<26)
+	var data []byte
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if data != nil && !fn(data) {
+				return
+			}
+			data = nil
+		case strings.HasPrefix(line, "data:"):
+			if data != nil {
+				data = append(data, '\n')
+			}
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")...)
+		}
+	}
+}
+
+// path returns the escaped path segments of a resource.
+func (c *Client) path(collection string, rest ...string) []string {
+	segments := []string{"collections", url.PathEscape(collection)}
+	for _, segment := range rest {
+		segments = append(segments, url.PathEscape(segment))
+	}
+	return segments
+}
+
+func (c *Client) get(path []string, query url.Values, v interface{}) error {
+	resp, err := c.do(http.MethodGet, path, query, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("could not decode response: %v", err)
+	}
+	return nil
+}
+
+func (c *Client) do(method string, path []string, query url.Values, header http.Header, body io.Reader) (*http.Response, error) {
+	req, err := c.request(method, path, query, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	return c.send(req)
+}
+
+func (c *Client) request(method string, path []string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := c.base.JoinPath(path...)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if method == http.MethodGet {
+		c.mutex.Lock()
+		if c.session != "" {
+			req.Header.Set(sessionHeader, c.session)
+		}
+		c.mutex.Unlock()
+	}
+	return req, nil
+}
+
+// send sends a request, remembering the session token a write returns and
+// turning error responses into errors.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if token := resp.Header.Get(sessionHeader); token != "" {
+		c.mutex.Lock()
+		c.session = token
+		c.mutex.Unlock()
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Error string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if body.Error == "" {
+		body.Error = resp.Status
+	}
+	return nil, statusError(resp.StatusCode, body.Error)
+}
+
+// statusError maps an error response to the error the Driver would have
+// returned.
+func statusError(status int, message string) error {
+	var sentinel error
+	switch status {
+	case http.StatusNotFound:
+		sentinel = os.ErrNotExist
+	case http.StatusBadRequest:
+		sentinel = ErrBadRequest
+	case http.StatusConflict:
+		sentinel = ErrConflict
+	case http.StatusPreconditionFailed:
+		sentinel = ErrConditionFailed
+	case http.StatusInsufficientStorage:
+		sentinel = ErrQuotaExceeded
+	case http.StatusUnauthorized:
+		sentinel = ErrUnauthenticated
+	case http.StatusForbidden:
+		sentinel = ErrForbidden
+	case http.StatusServiceUnavailable:
+		sentinel = ErrBehind
+	default:
+		return fmt.Errorf("server error: %s", message)
+	}
+	if sentinel == os.ErrNotExist || message == sentinel.Error() {
+		return sentinel
+	}
+	return fmt.Errorf("%w: %s", sentinel, message)
+}
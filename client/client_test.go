@@ -0,0 +1,183 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeServer serves one collection from memory the way Driver.Handler
+// does, issuing a session token with every write.
+type fakeServer struct {
+	mutex    sync.Mutex
+	records  map[string]User
+	writes   int
+	sessions []string // the session tokens reads were sent with
+}
+
+func (s *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "authentication required"})
+		return
+	}
+	key, keyed := strings.CutPrefix(r.URL.EscapedPath(), "/collections/users/")
+	key, _ = url.PathUnescape(key)
+
+	switch {
+	case r.Method == "GET" && !keyed:
+		s.sessions = append(s.sessions, r.Header.Get(sessionHeader))
+		records := []record{}
+		for key, user := range s.records {
+			records = append(records, record{Key: key, Value: user})
+		}
+		json.NewEncoder(w).Encode(records)
+	case r.Method == "GET":
+		s.sessions = append(s.sessions, r.Header.Get(sessionHeader))
+		user, ok := s.records[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "not found"})
+			return
+		}
+		json.NewEncoder(w).Encode(record{Key: key, Value: user})
+	case r.Method == "PUT":
+		if _, ok := s.records[key]; ok && r.Header.Get("If-None-Match") == "*" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			json.NewEncoder(w).Encode(map[string]string{"error": "condition failed"})
+			return
+		}
+		var user User
+		json.NewDecoder(r.Body).Decode(&user)
+		s.records[key] = user
+		s.writes++
+		w.Header().Set(sessionHeader, strconv.Itoa(s.writes))
+		json.NewEncoder(w).Encode(record{Key: key, Value: user})
+	case r.Method == "DELETE":
+		delete(s.records, key)
+		s.writes++
+		w.Header().Set(sessionHeader, strconv.Itoa(s.writes))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestClient(t *testing.T) {
+	fake := &fakeServer{records: make(map[string]User)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	c, err := New(srv.URL, &Options{Token: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys are escaped into a single path segment.
+	const key = "a b/c"
+	if err := c.Write("users", key, User{Name: "Ada"}); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := c.Read("users", key); err != nil || user.Name != "Ada" {
+		t.Errorf("Read = %+v, %v", user, err)
+	}
+	if err := c.WriteIfAbsent("users", key, User{Name: "Bob"}); !errors.Is(err, ErrConditionFailed) {
+		t.Errorf("WriteIfAbsent over a record = %v, want ErrConditionFailed", err)
+	}
+	if err := c.Write("users", "bob", User{Name: "Bob"}); err != nil {
+		t.Fatal(err)
+	}
+	users, err := c.ReadAll("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, user := range users {
+		names = append(names, user.Name)
+	}
+	slices.Sort(names)
+	if !slices.Equal(names, []string{"Ada", "Bob"}) {
+		t.Errorf("ReadAll = %v", names)
+	}
+	if err := c.Delete("users", key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Read("users", key); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Read of a deleted record = %v, want os.ErrNotExist", err)
+	}
+
+	// Reads carry the session token of the last write before them.
+	if want := []string{"1", "2", "3"}; !slices.Equal(fake.sessions, want) {
+		t.Errorf("reads sent session tokens %q, want %q", fake.sessions, want)
+	}
+
+	anonymous, err := New(srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := anonymous.Read("users", "bob"); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("Read without a token = %v, want ErrUnauthenticated", err)
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	tests := []struct {
+		status  int
+		message string
+		want    error
+		text    string
+	}{
+		{http.StatusNotFound, "no such record", os.ErrNotExist, os.ErrNotExist.Error()},
+		{http.StatusBadRequest, "invalid query", ErrBadRequest, "bad request: invalid query"},
+		{http.StatusConflict, "referenced", ErrConflict, "conflicting reference: referenced"},
+		{http.StatusPreconditionFailed, "condition failed", ErrConditionFailed, "condition failed"},
+		{http.StatusInsufficientStorage, "too big", ErrQuotaExceeded, "quota exceeded: too big"},
+		{http.StatusForbidden, "no write access", ErrForbidden, "forbidden: no write access"},
+		{http.StatusServiceUnavailable, "behind", ErrBehind, ErrBehind.Error() + ": behind"},
+		{http.StatusInternalServerError, "disk full", nil, "server error: disk full"},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			err := statusError(tt.status, tt.message)
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("error %v does not wrap %v", err, tt.want)
+			}
+			if err.Error() != tt.text {
+				t.Errorf("error %q, want %q", err, tt.text)
+			}
+		})
+	}
+}
+
+func TestReadEvents(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   []string
+	}{
+		{"events", "event: write\ndata: {\"a\":1}\n\nevent: delete\ndata: {\"b\":2}\n\n", []string{`{"a":1}`, `{"b":2}`}},
+		{"comments and ids", ": keep-alive\n\nid: 7\nevent: write\ndata: x\n\n", []string{"x"}},
+		{"multi-line data", "data: a\ndata: b\n\n", []string{"a\nb"}},
+		{"unterminated event", "data: a\n\ndata: b\n", []string{"a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			readEvents(strings.NewReader(tt.stream), func(data []byte) bool {
+				got = append(got, string(data))
+				return true
+			})
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("events %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+// A cluster replicates a database between nodes with Raft
+// (github.com/hashicorp/raft), and every node holds every record. Write,
+// Delete and SetCollectionMeta on the leader return once a majority of the
+// nodes has committed them, and every node applies them in the same order,
+// so an acknowledged write survives the loss of a minority of the nodes and
+// is seen by every later read on the node that acknowledged it. Each node
+// serves reads from its own copy, so followers, and a newly elected leader
+// until its first write, may lag behind.
+//
+// Writes on a follower fail with ErrNotLeader. Writes Raft does not carry,
+// such as transactions, conditional writes, Increment, streams, bulk loads
+// and writes to collections with references or event sourcing, fail with
+// ErrNotReplicated on every node.
+//
+// A cluster starts from one node opened with ClusterOptions.Bootstrap. The
+// other nodes are opened without it and joined on the leader with Join, or
+// PUT /admin/cluster/servers/{id} of the admin API. A node keeps its Raft
+// log and snapshots under .raft and rejoins when it is reopened. Options.
+// Durability must be DurabilityAlways for acknowledged writes to survive a
+// node crashing.
+
+// Errors returned by a clustered Driver.
+var (
+	// ErrNotLeader is returned by writes on a node that is not the leader.
+	// The error names the leader when one is known.
+	ErrNotLeader = errors.New("not the cluster leader")
+	// ErrNotReplicated is returned by writes the cluster does not replicate.
+	ErrNotReplicated = errors.New("write is not replicated by the cluster")
+	// ErrNotClustered is returned by cluster administration on a Driver
+	// opened without Options.Cluster.
+	ErrNotClustered = errors.New("database is not clustered")
+)
+
+const (
+	clusterDir         = ".raft"
+	clusterAppliedFile = "applied"
+	// clusterOpMeta is the operation of a replicated SetCollectionMeta.
+	clusterOpMeta = "meta"
+)
+
+// ClusterOptions makes the database a node of a Raft cluster.
+type ClusterOptions struct {
+	// NodeID names the node. It must be unique in the cluster and stay the
+	// same across restarts.
+	NodeID string
+	// Bind is the TCP address the node listens on for the other nodes, and
+	// Advertise the address they reach it at if different, e.g. when Bind
+	// is 0.0.0.0:7000. Raft traffic is neither encrypted nor
+	// authenticated, so only the other nodes should reach it.
+	Bind      string
+	Advertise string
+	// Bootstrap starts a new cluster made of this node alone. It is
+	// ignored once the node holds cluster state.
+	Bootstrap bool
+	// ElectionTimeout is how long followers go without hearing from the
+	// leader before electing another. It defaults to one second.
+	ElectionTimeout time.Duration
+	// ApplyTimeout bounds how long a write waits to be committed. It
+	// defaults to ten seconds.
+	ApplyTimeout time.Duration
+}
+
+// ClusterServer is a member of a cluster.
+type ClusterServer struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+	Voter   bool   `json:"voter"`
+	Leader  bool   `json:"leader"`
+}
+
+// ClusterStatus describes a cluster as a node sees it.
+type ClusterStatus struct {
+	NodeID string `json:"nodeId"`
+	// State is the Raft state of the node: Leader, Follower, Candidate or
+	// Shutdown.
+	State   string          `json:"state"`
+	Leader  string          `json:"leader,omitempty"`
+	Servers []ClusterServer `json:"servers"`
+	// Applied is the index of the last Raft log entry the node applied.
+	Applied uint64 `json:"applied"`
+}
+
+// cluster is the Raft node of a clustered Driver. It is the Raft FSM: every
+// committed entry is applied to the Driver's store.
+type cluster struct {
+	d         *Driver
+	id        string
+	raft      *raft.Raft
+	transport *raft.NetworkTransport
+	logs      *raftboltdb.BoltStore
+	timeout   time.Duration
+	dir       string
+	closeOnce sync.Once
+	closeErr  error
+
+	// applied is the index of the last entry applied. It is kept on disk,
+	// as the records are, so entries Raft replays on restart are skipped.
+	// changed is closed when it moves on.
+	mutex   sync.Mutex
+	applied uint64
+	changed chan struct{}
+}
+
+// startCluster joins the Driver to the cluster described by opts.
+func (d *Driver) startCluster(opts *ClusterOptions) error {
+	if opts == nil {
+		return nil
+	}
+	if opts.NodeID == "" || opts.Bind == "" {
+		return errors.New("could not start cluster: NodeID and Bind are required")
+	}
+	if d.opts.ReadOnly || d.memory != "" {
+		return errors.New("could not start cluster: a cluster node must be writable and on disk")
+	}
+
+	c := &cluster{d: d, id: opts.NodeID, timeout: opts.ApplyTimeout, dir: filepath.Join(d.dir, clusterDir)}
+	if c.timeout <= 0 {
+		c.timeout = 10 * time.Second
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return fmt.Errorf("could not create cluster directory: %v", err)
+	}
+	applied, err := c.readApplied()
+	if err != nil {
+		return err
+	}
+	c.applied = applied
+
+	out := raftLogWriter{log: d.log}
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(opts.NodeID)
+	config.Logger = hclog.New(&hclog.LoggerOptions{Name: "raft", Output: out, Level: hclog.Info})
+	if opts.ElectionTimeout > 0 {
+		config.HeartbeatTimeout = opts.ElectionTimeout
+		config.ElectionTimeout = opts.ElectionTimeout
+		config.LeaderLeaseTimeout = opts.ElectionTimeout / 2
+	}
+
+	var advertise net.Addr
+	if opts.Advertise != "" {
+		if advertise, err = net.ResolveTCPAddr("tcp", opts.Advertise); err != nil {
+			return fmt.Errorf("could not resolve cluster address %s: %v", opts.Advertise, err)
+		}
+	}
+	if c.transport, err = raft.NewTCPTransport(opts.Bind, advertise, 3, 10*time.Second, out); err != nil {
+		return fmt.Errorf("could not listen for cluster nodes: %v", err)
+	}
+	if c.logs, err = raftboltdb.NewBoltStore(filepath.Join(c.dir, "raft.db")); err != nil {
+		c.transport.Close()
+		return fmt.Errorf("could not open Raft log: %v", err)
+	}
+	snapshots, err := raft.NewFileSnapshotStore(c.dir, 2, out)
+	if err != nil {
+		c.close()
+		return fmt.Errorf("could not open Raft snapshots: %v", err)
+	}
+
+	// The records applied so far are on disk, so the latest snapshot only
+	// needs restoring if this node had not applied it yet.
+	list, err := snapshots.List()
+	if err != nil {
+		c.close()
+		return fmt.Errorf("could not list Raft snapshots: %v", err)
+	}
+	config.NoSnapshotRestoreOnStart = len(list) == 0 || list[0].Index <= applied
+
+	existing, err := raft.HasExistingState(c.logs, c.logs, snapshots)
+	if err != nil {
+		c.close()
+		return fmt.Errorf("could not read Raft state: %v", err)
+	}
+	if c.raft, err = raft.NewRaft(config, c, c.logs, c.logs, snapshots, c.transport); err != nil {
+		c.close()
+		return fmt.Errorf("could not start Raft: %v", err)
+	}
+	d.cluster = c
+
+	if opts.Bootstrap && !existing {
+		bootstrap := raft.Configuration{Servers: []raft.Server{{ID: config.LocalID, Address: c.transport.LocalAddr()}}}
+		if err := c.raft.BootstrapCluster(bootstrap).Error(); err != nil {
+			return fmt.Errorf("could not bootstrap cluster: %v", err)
+		}
+	}
+	d.log.Info("Cluster node %s listening on %s", opts.NodeID, c.transport.LocalAddr())
+	return nil
+}
+
+// close stops the Raft node. The Driver is still open, so an entry being
+// applied completes.
+func (c *cluster) close() error {
+	if c == nil {
+		return nil
+	}
+	c.closeOnce.Do(func() {
+		if c.raft != nil {
+			c.closeErr = c.raft.Shutdown().Error()
+		}
+		if c.transport != nil {
+			if err := c.transport.Close(); c.closeErr == nil {
+				c.closeErr = err
+			}
+		}
+		if c.logs != nil {
+			if err := c.logs.Close(); c.closeErr == nil {
+				c.closeErr = err
+			}
+		}
+	})
+	return c.closeErr
+}
+
+// writable fails writes on a node that is not the leader.
+func (c *cluster) writable() error {
+	if c == nil || c.raft.State() == raft.Leader {
+		return nil
+	}
+	return c.notLeader()
+}
+
+func (c *cluster) notLeader() error {
+	if addr, id := c.raft.LeaderWithID(); addr != "" {
+		return fmt.Errorf("%w; the leader is %s at %s", ErrNotLeader, id, addr)
+	}
+	return fmt.Errorf("%w; no leader is elected", ErrNotLeader)
+}
+
+// apply commits a change through Raft and returns once this node applied
+// it.
+func (c *cluster) apply(change Change) error {
+	cmd, err := json.Marshal(change)
+	if err != nil {
+		return fmt.Errorf("could not marshal change: %v", err)
+	}
+
+	future := c.raft.Apply(cmd, c.timeout)
+	if err := future.Error(); err != nil {
+		if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) {
+			return c.notLeader()
+		}
+		return fmt.Errorf("could not commit change: %v", err)
+	}
+	if err, ok := future.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+// Apply applies a committed entry to the store.
+func (c *cluster) Apply(l *raft.Log) interface{} {
+	if l.Type != raft.LogCommand || l.Index <= c.appliedIndex() {
+		return nil
+	}
+
+	var change Change
+	err := json.Unmarshal(l.Data, &change)
+	if err == nil {
+		err = c.d.applyClustered(change)
+	}
+	if err != nil {
+		c.d.log.Error("Could not apply cluster entry %d: %v", l.Index, err)
+	}
+	if saveErr := c.setApplied(l.Index); saveErr != nil {
+		c.d.log.Error("%v", saveErr)
+	}
+	return err
+}
+
+// applyClustered applies a change committed by the cluster.
+func (d *Driver) applyClustered(change Change) error {
+	if change.Op != clusterOpMeta {
+		return d.applyReplicated(change)
+	}
+
+	var meta CollectionMeta
+	if err := json.Unmarshal(change.Data, &meta); err != nil {
+		return fmt.Errorf("invalid configuration of collection %s: %v", change.Collection, err)
+	}
+	return d.setCollectionMeta(change.Collection, meta)
+}
+
+// clusterSnapshot holds the index of the last entry it includes on its
+// first line, then one change per line: a configuration change for every
+// configured collection and a write for every record. Only the keys are
+// captured when the snapshot is taken; Persist streams the records.
+type clusterSnapshot struct {
+	d           *Driver
+	applied     uint64
+	collections []snapshotCollection
+}
+
+// snapshotCollection is a collection as captured by a cluster snapshot.
+type snapshotCollection struct {
+	name string
+	// meta is the configuration change of a configured collection.
+	meta *Change
+	keys []string
+}
+
+// Snapshot captures the applied index, the configuration of collections and
+// their keys. Raft does not apply entries meanwhile, and other writes are
+// not allowed on a cluster node, so they match the applied index.
+func (c *cluster) Snapshot() (raft.FSMSnapshot, error) {
+	d := c.d
+	snapshot := &clusterSnapshot{d: d, applied: c.appliedIndex()}
+
+	collections, err := d.Collections()
+	if err != nil {
+		return nil, err
+	}
+	for _, collection := range collections {
+		captured := snapshotCollection{name: collection}
+		if meta, ok := d.CollectionMeta(collection); ok {
+			data, err := json.Marshal(meta)
+			if err != nil {
+				return nil, fmt.Errorf("could not marshal collection configuration: %v", err)
+			}
+			captured.meta = &Change{Op: clusterOpMeta, Collection: collection, Data: data}
+		}
+		if captured.keys, err = d.store.keys(collection); err != nil {
+			return nil, err
+		}
+		snapshot.collections = append(snapshot.collections, captured)
+	}
+	return snapshot, nil
+}
+
+// Persist writes the snapshot, reading each record as it goes. Raft applies
+// entries meanwhile, so a record may be newer than the snapshot's index, or
+// gone; entries only ever set or delete whole records, so replaying those
+// after the index on restore still ends in the same state.
+func (s *clusterSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := s.write(sink); err != nil {
+		sink.Cancel()
+		return fmt.Errorf("could not write cluster snapshot: %v", err)
+	}
+	return sink.Close()
+}
+
+func (s *clusterSnapshot) write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%d\n", s.applied)
+	enc := json.NewEncoder(bw)
+
+	for _, collection := range s.collections {
+		if collection.meta != nil {
+			if err := enc.Encode(collection.meta); err != nil {
+				return err
+			}
+		}
+		for _, key := range collection.keys {
+			data, err := s.d.readStored(collection.name, key)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("could not read record %s of collection %s: %v", key, collection.name, err)
+			}
+			if err := enc.Encode(Change{Op: OpWrite, Collection: collection.name, Key: key, Data: data}); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+func (s *clusterSnapshot) Release() {}
+
+// Restore replaces the records of the database with those of a snapshot,
+// deleting those it does not hold.
+func (c *cluster) Restore(snapshot io.ReadCloser) error {
+	defer snapshot.Close()
+	d := c.d
+
+	r := bufio.NewReader(snapshot)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("could not read cluster snapshot: %v", err)
+	}
+	applied, err := strconv.ParseUint(strings.TrimSpace(line), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid cluster snapshot: %v", err)
+	}
+
+	stale := make(map[recordID]bool)
+	collections, err := d.Collections()
+	if err != nil {
+		return err
+	}
+	for _, collection := range collections {
+		keys, err := d.store.keys(collection)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			stale[recordID{collection, key}] = true
+		}
+	}
+
+	records := 0
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) == 0 && err == io.EOF {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("could not read cluster snapshot: %v", err)
+		}
+
+		var change Change
+		if err := json.Unmarshal(line, &change); err != nil {
+			return fmt.Errorf("invalid cluster snapshot: %v", err)
+		}
+		change.Time = time.Now()
+		if err := d.applyClustered(change); err != nil {
+			return fmt.Errorf("could not restore cluster snapshot: %v", err)
+		}
+		if change.Op == OpWrite {
+			delete(stale, recordID{change.Collection, change.Key})
+			records++
+		}
+	}
+	for id := range stale {
+		if err := d.applyReplicated(Change{Op: OpDelete, Collection: id.collection, Key: id.key, Time: time.Now()}); err != nil {
+			return err
+		}
+	}
+
+	d.log.Info("Restored %d records from cluster snapshot at entry %d", records, applied)
+	return c.setApplied(applied)
+}
+
+func (c *cluster) appliedIndex() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.applied
+}
+
+// wait returns the applied index and a channel closed once it moves on.
+func (c *cluster) wait() (uint64, <-chan struct{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.changed == nil {
+		c.changed = make(chan struct{})
+	}
+	return c.applied, c.changed
+}
+
+func (c *cluster) readApplied() (uint64, error) {
+	data, err := os.ReadFile(filepath.Join(c.dir, clusterAppliedFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("could not read applied cluster index: %v", err)
+	}
+	applied, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		// Replaying entries is harmless, so a damaged index only costs time.
+		c.d.log.Error("Invalid applied cluster index, replaying the Raft log: %v", err)
+		return 0, nil
+	}
+	return applied, nil
+}
+
+// setApplied records that the entry at index was applied. It is written
+// after the records, so it never claims more than they hold.
+func (c *cluster) setApplied(index uint64) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	path := filepath.Join(c.dir, clusterAppliedFile)
+	if err := os.WriteFile(path+".tmp", []byte(strconv.FormatUint(index, 10)), 0644); err != nil {
+		return fmt.Errorf("could not record applied cluster index: %v", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("could not record applied cluster index: %v", err)
+	}
+	c.applied = index
+	if c.changed != nil {
+		close(c.changed)
+		c.changed = nil
+	}
+	return nil
+}
+
+// Join adds a node to the cluster as a voter. It must be called on the
+// leader; the node must already be running with the same NodeID and
+// listening on addr.
+func (d *Driver) Join(id, addr string) error {
+	if d.cluster == nil {
+		return ErrNotClustered
+	}
+	if id == "" || addr == "" {
+		return errors.New("could not join cluster: node ID and address are required")
+	}
+
+	future := d.cluster.raft.AddVoter(raft.ServerID(id), raft.ServerAddress(addr), 0, d.cluster.timeout)
+	if err := future.Error(); err != nil {
+		if errors.Is(err, raft.ErrNotLeader) {
+			return d.cluster.notLeader()
+		}
+		return fmt.Errorf("could not add node %s to cluster: %v", id, err)
+	}
+	d.log.Info("Node %s at %s joined the cluster", id, addr)
+	return nil
+}
+
+// Leave removes a node from the cluster. It must be called on the leader,
+// which can remove itself, handing leadership to another node.
+func (d *Driver) Leave(id string) error {
+	if d.cluster == nil {
+		return ErrNotClustered
+	}
+
+	future := d.cluster.raft.RemoveServer(raft.ServerID(id), 0, d.cluster.timeout)
+	if err := future.Error(); err != nil {
+		if errors.Is(err, raft.ErrNotLeader) {
+			return d.cluster.notLeader()
+		}
+		return fmt.Errorf("could not remove node %s from cluster: %v", id, err)
+	}
+	d.log.Info("Node %s left the cluster", id)
+	return nil
+}
+
+// ClusterStatus describes the cluster as this node sees it.
+func (d *Driver) ClusterStatus() (*ClusterStatus, error) {
+	c := d.cluster
+	if c == nil {
+		return nil, ErrNotClustered
+	}
+
+	future := c.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, fmt.Errorf("could not read cluster configuration: %v", err)
+	}
+	leader, leaderID := c.raft.LeaderWithID()
+	status := &ClusterStatus{
+		NodeID:  c.id,
+		State:   c.raft.State().String(),
+		Leader:  string(leaderID),
+		Servers: []ClusterServer{},
+		Applied: c.appliedIndex(),
+	}
+	for _, server := range future.Configuration().Servers {
+		status.Servers = append(status.Servers, ClusterServer{
+			ID:      string(server.ID),
+			Address: string(server.Address),
+			Voter:   server.Suffrage == raft.Voter,
+			Leader:  server.Address == leader,
+		})
+	}
+	return status, nil
+}
+
+// raftLogWriter hands the log lines of Raft to the Driver's Logger.
+type raftLogWriter struct {
+	log Logger
+}
+
+func (w raftLogWriter) Write(p []byte) (int, error) {
+	line := strings.TrimSpace(string(p))
+	if strings.Contains(line, "[ERROR]") || strings.Contains(line, "[WARN]") {
+		w.log.Error("%s", line)
+	} else {
+		w.log.Info("%s", line)
+	}
+	return len(p), nil
+}
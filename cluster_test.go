@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// freeAddr returns a local address nothing listens on, so a node can be
+// reopened on the address the cluster knows it by.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// openNode opens a cluster node on dir, listening on addr.
+func openNode(t *testing.T, id, addr, dir string, bootstrap bool) *Driver {
+	t.Helper()
+	d, err := New(dir, &Options{
+		Slog:       openTestLogger(),
+		Logger:     NewSlogLogger(openTestLogger()),
+		ChangeLog:  true,
+		Durability: DurabilityAlways,
+		Cluster: &ClusterOptions{
+			NodeID:          id,
+			Bind:            addr,
+			Bootstrap:       bootstrap,
+			ElectionTimeout: 200 * time.Millisecond,
+		},
+	})
+	if err != nil {
+		t.Fatalf("could not open node %s: %v", id, err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func isLeader(d *Driver) bool {
+	status, err := d.ClusterStatus()
+	return err == nil && status.State == "Leader"
+}
+
+type testNode struct {
+	id, addr, dir string
+	d             *Driver
+}
+
+// openCluster starts a cluster of n nodes and returns them, the leader
+// first.
+func openCluster(t *testing.T, n int) []*testNode {
+	t.Helper()
+	var nodes []*testNode
+	for i := 0; i < n; i++ {
+		node := &testNode{id: string(rune('a' + i)), addr: freeAddr(t), dir: t.TempDir()}
+		node.d = openNode(t, node.id, node.addr, node.dir, i == 0)
+		nodes = append(nodes, node)
+		if i == 0 {
+			waitFor(t, "a leader", func() bool { return isLeader(node.d) })
+			continue
+		}
+		if err := nodes[0].d.Join(node.id, node.addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return nodes
+}
+
+func TestClusterReplicates(t *testing.T) {
+	nodes := openCluster(t, 3)
+	leader := nodes[0].d
+
+	if err := leader.SetCollectionMeta("users", CollectionMeta{Indexes: []string{"Company"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.Write("users", "ada", User{Name: "Ada", Company: "Initech"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.Write("users", "bob", User{Name: "Bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.Delete("users", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	// A write is applied on the leader before it returns.
+	if user, err := leader.Read("users", "ada"); err != nil || user.Name != "Ada" {
+		t.Fatalf("read on leader = %+v, %v", user, err)
+	}
+
+	for _, node := range nodes[1:] {
+		follower := node.d
+		waitFor(t, "node "+node.id+" to apply the writes", func() bool {
+			_, err := follower.Read("users", "bob")
+			return errors.Is(err, os.ErrNotExist)
+		})
+		if user, err := follower.Read("users", "ada"); err != nil || user.Company != "Initech" {
+			t.Errorf("node %s read %+v, %v", node.id, user, err)
+		}
+		if meta, ok := follower.CollectionMeta("users"); !ok || len(meta.Indexes) != 1 {
+			t.Errorf("node %s has configuration %+v, %v", node.id, meta, ok)
+		}
+
+		if err := follower.Write("users", "eve", User{Name: "Eve"}); !errors.Is(err, ErrNotLeader) {
+			t.Errorf("write on node %s = %v, want ErrNotLeader", node.id, err)
+		} else if !strings.Contains(err.Error(), nodes[0].addr) {
+			t.Errorf("error %q does not name the leader", err)
+		}
+	}
+
+	if _, err := leader.Increment("users", "ada", "Age", 1); !errors.Is(err, ErrNotReplicated) {
+		t.Errorf("Increment on the leader = %v, want ErrNotReplicated", err)
+	}
+	if err := leader.Delete("users", "nobody"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("deleting a missing record = %v, want os.ErrNotExist", err)
+	}
+
+	status, err := leader.ClusterStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Servers) != 3 || status.Leader != "a" {
+		t.Errorf("cluster status = %+v", status)
+	}
+}
+
+func TestClusterFailover(t *testing.T) {
+	nodes := openCluster(t, 3)
+	if err := nodes[0].d.Write("users", "ada", User{Name: "Ada"}); err != nil {
+		t.Fatal(err)
+	}
+	nodes[0].d.Close()
+
+	var leader, other *Driver
+	waitFor(t, "a new leader", func() bool {
+		for i, node := range nodes[1:] {
+			if isLeader(node.d) {
+				leader, other = node.d, nodes[2-i].d
+				return true
+			}
+		}
+		return false
+	})
+
+	// An acknowledged write survives the loss of the leader. The new
+	// leader applies it by the time its own first write returns.
+	if err := leader.Write("users", "bob", User{Name: "Bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leader.Read("users", "ada"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the write to reach the remaining follower", func() bool {
+		_, err := other.Read("users", "bob")
+		return err == nil
+	})
+}
+
+func TestClusterNodeRejoins(t *testing.T) {
+	nodes := openCluster(t, 3)
+	leader, rejoining := nodes[0].d, nodes[1]
+	if err := leader.Write("users", "ada", User{Name: "Ada"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "node b to apply the write", func() bool {
+		_, err := rejoining.d.Read("users", "ada")
+		return err == nil
+	})
+	seq := rejoining.d.changes.lastSeq()
+	rejoining.d.Close()
+
+	if err := leader.Write("users", "bob", User{Name: "Bob"}); err != nil {
+		t.Fatal(err)
+	}
+	d := openNode(t, rejoining.id, rejoining.addr, rejoining.dir, false)
+	waitFor(t, "node b to catch up", func() bool {
+		_, err := d.Read("users", "bob")
+		return err == nil
+	})
+
+	// Entries applied before the restart are not applied again.
+	if got := d.changes.lastSeq(); got != seq+1 {
+		t.Errorf("change log of the rejoined node is at %d, want %d", got, seq+1)
+	}
+}
+
+func TestClusterSessionTokens(t *testing.T) {
+	nodes := openCluster(t, 2)
+	leader, follower := nodes[0].d, nodes[1].d
+	if err := leader.Write("users", "ada", User{Name: "Ada"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tokens are Raft log indexes, which the nodes share, not the
+	// sequence numbers of their own change logs.
+	token := leader.SessionToken()
+	status, err := leader.ClusterStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strconv.FormatUint(status.Applied, 10); token != want {
+		t.Errorf("session token = %q, want the applied index %s", token, want)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := follower.WaitSession(ctx, token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := follower.Read("users", "ada"); err != nil {
+		t.Errorf("read after waiting for the session: %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	ahead := strconv.FormatUint(status.Applied+100, 10)
+	if err := follower.WaitSession(ctx, ahead); !errors.Is(err, ErrBehind) {
+		t.Errorf("waiting for a later session = %v, want ErrBehind", err)
+	}
+}
+
+// bufferSink collects a snapshot persisted by the FSM.
+type bufferSink struct {
+	bytes.Buffer
+}
+
+func (s *bufferSink) ID() string    { return "test" }
+func (s *bufferSink) Cancel() error { return nil }
+func (s *bufferSink) Close() error  { return nil }
+
+func TestClusterSnapshotRestore(t *testing.T) {
+	source, _ := openTestDB(t, nil)
+	if err := source.Write("users", "ada", User{Name: "Ada"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.SetCollectionMeta("users", CollectionMeta{Indexes: []string{"Name"}}); err != nil {
+		t.Fatal(err)
+	}
+	fsm := &cluster{d: source, dir: t.TempDir(), applied: 7}
+	snapshot, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sink bufferSink
+	if err := snapshot.Persist(&sink); err != nil {
+		t.Fatal(err)
+	}
+
+	target, _ := openTestDB(t, nil)
+	if err := target.Write("users", "stale", User{Name: "Stale"}); err != nil {
+		t.Fatal(err)
+	}
+	restored := &cluster{d: target, dir: t.TempDir()}
+	if err := restored.Restore(&readCloser{&sink.Buffer}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := target.Read("users", "ada"); err != nil {
+		t.Errorf("restored record: %v", err)
+	}
+	if _, err := target.Read("users", "stale"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("record missing from the snapshot = %v, want os.ErrNotExist", err)
+	}
+	if _, ok := target.CollectionMeta("users"); !ok {
+		t.Error("configuration was not restored")
+	}
+	if applied, err := restored.readApplied(); err != nil || applied != 7 {
+		t.Errorf("applied index = %d, %v, want 7", applied, err)
+	}
+}
+
+// TestClusterSnapshotStreams checks that a snapshot captures only keys and
+// reads the records as it is persisted.
+func TestClusterSnapshotStreams(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+	writeUsers(t, d, "ada", "bob")
+	fsm := &cluster{d: d, dir: t.TempDir(), applied: 3}
+	snapshot, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Entries applied before the snapshot is persisted show in it, except
+	// for records created since, which their entries restore.
+	if err := d.Write("users", "ada", User{Name: "ada edited"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete("users", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	writeUsers(t, d, "cat")
+
+	var sink bufferSink
+	if err := snapshot.Persist(&sink); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(sink.String()), "\n")
+	if len(lines) != 2 || lines[0] != "3" {
+		t.Fatalf("snapshot = %q, want the index and ada", lines)
+	}
+	var change Change
+	if err := json.Unmarshal([]byte(lines[1]), &change); err != nil {
+		t.Fatal(err)
+	}
+	if change.Key != "ada" || !strings.Contains(string(change.Data), "ada edited") {
+		t.Errorf("snapshot holds %s = %s, want ada as edited", change.Key, change.Data)
+	}
+
+	failing := &failingSink{}
+	if err := snapshot.Persist(failing); err == nil || !failing.cancelled {
+		t.Errorf("Persist to a failing sink = %v, cancelled %v; want an error and the sink cancelled", err, failing.cancelled)
+	}
+}
+
+// failingSink is a snapshot sink whose writes fail.
+type failingSink struct {
+	bufferSink
+	cancelled bool
+}
+
+func (s *failingSink) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+func (s *failingSink) Cancel() error             { s.cancelled = true; return nil }
+
+type readCloser struct {
+	*bytes.Buffer
+}
+
+func (readCloser) Close() error { return nil }
+
+func TestClusterAdminAPI(t *testing.T) {
+	nodes := openCluster(t, 1)
+	joining := &testNode{id: "b", addr: freeAddr(t), dir: t.TempDir()}
+	joining.d = openNode(t, joining.id, joining.addr, joining.dir, false)
+	h := nodes[0].d.AdminHandler(AdminOptions{})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("PUT", "/admin/cluster/servers/b", strings.NewReader(`{"address": "`+joining.addr+`"}`)))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("join: status %d: %s", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/cluster", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"id":"b"`) {
+		t.Fatalf("status: %d: %s", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("DELETE", "/admin/cluster/servers/b", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("leave: status %d: %s", rec.Code, rec.Body)
+	}
+
+	plain, _ := openTestDB(t, nil)
+	rec = httptest.NewRecorder()
+	plain.AdminHandler(AdminOptions{}).ServeHTTP(rec, httptest.NewRequest("GET", "/admin/cluster", nil))
+	if rec.Code != http.StatusNotImplemented {
+		t.Errorf("status of an unclustered database: %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestClusterSkipsCompaction(t *testing.T) {
+	for _, cluster := range []bool{false, true} {
+		opts := &Options{Engine: EngineLog, Compaction: CompactionOptions{Interval: time.Hour}}
+		if cluster {
+			opts.Cluster = &ClusterOptions{NodeID: "a", Bind: "127.0.0.1:0", Bootstrap: true}
+		}
+		d, _ := openTestDB(t, opts)
+
+		compacting := false
+		for _, task := range d.Health().Tasks {
+			compacting = compacting || task.Name == "compaction"
+		}
+		if compacting == cluster {
+			t.Errorf("cluster node %v runs background compaction: %v", cluster, compacting)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const compactSuffix = ".compact"
+
+// CompactionOptions configures when the log engine rewrites a collection's
+// log to drop overwritten and deleted entries.
+type CompactionOptions struct {
+	// Interval is how often the background compactor runs. Zero disables
+	// background compaction; Compact can still be called manually. It does
+	// not run on cluster nodes, which do not replicate compaction.
+	Interval time.Duration
+	// DeadRatio is the share of dead bytes (0-1) a log must reach before the
+	// background compactor rewrites it. Zero compacts any log with dead bytes.
+	DeadRatio float64
+	// MinSize skips logs smaller than this many bytes in the background.
+	MinSize int64
+}
+
+// compacter is implemented by storage engines that can reclaim dead space.
+type compacter interface {
+	compact(collection string) (int64, error)
+	compactCandidates(opts CompactionOptions) []string
+}
+
+// Compact rewrites the log of a collection so it only holds live records.
+// It is only supported by EngineLog.
+func (d *Driver) Compact(collection string) (err error) {
+	if err := d.checkNames(&collection); err != nil {
+		return err
+	}
+
+	op := d.begin(opCompact, collection, "")
+	defer op.end(&err)
+
+	if err := d.writable(); err != nil {
+		return err
+	}
+
+	c, ok := d.store.(compacter)
+	if !ok {
+		return fmt.Errorf("compaction is not supported by this storage engine")
+	}
+
+	d.gate.RLock()
+	defer d.gate.RUnlock()
+
+	reclaimed, err := c.compact(collection)
+	if err != nil {
+		return fmt.Errorf("could not compact collection %s: %v", collection, err)
+	}
+
+	d.log.Info("Compacted collection %s, reclaimed %d bytes", collection, reclaimed)
+	return nil
+}
+
+// startCompactor runs background compaction until the Driver is closed.
+// Cluster nodes are told by their options, as the cluster starts later.
+func (d *Driver) startCompactor(opts CompactionOptions) {
+	c, ok := d.store.(compacter)
+	if !ok || opts.Interval <= 0 || d.opts.ReadOnly || d.opts.Cluster != nil {
+		return
+	}
+
+	ran := d.background.track("compaction", opts.Interval)
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-d.stop:
+				return
+			case <-ticker.C:
+				for _, collection := range c.compactCandidates(opts) {
+					if err := d.Compact(collection); err != nil {
+						d.log.Error("Background compaction failed: %v", err)
+					}
+				}
+				ran()
+			}
+		}
+	}()
+}
+
+func (s *logStorage) compact(collection string) (int64, error) {
+	var reclaimed int64
+	err := s.withCollection(collection, false, func(c *logCollection) error {
+		var err error
+		reclaimed, err = c.compact()
+		return err
+	})
+	return reclaimed, err
+}
+
+// compactCandidates lists the open logs whose dead space crosses the
+// configured thresholds.
+func (s *logStorage) compactCandidates(opts CompactionOptions) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var names []string
+	for name, c := range s.collections {
+		c.RLock()
+		size, dead := c.size, c.dead
+		c.RUnlock()
+
+		if dead == 0 || size < opts.MinSize {
+			continue
+		}
+		if float64(dead)/float64(size) >= opts.DeadRatio {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// compact copies the live entries into a fresh log and atomically swaps it
+// in place of the current one, returning the number of bytes reclaimed.
+func (c *logCollection) compact() (int64, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.closed {
+		return 0, errLogClosed
+	}
+	if c.dead == 0 {
+		return 0, nil
+	}
+	if err := c.flushBulk(); err != nil {
+		return 0, err
+	}
+
+	tmpPath := c.path + compactSuffix
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, c.mode)
+	if err != nil {
+		return 0, fmt.Errorf("could not create compaction file: %v", err)
+	}
+
+	index, size, err := c.copyLive(tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, c.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	// Until the rename is durable a crash could bring the old log back,
+	// losing the appends about to go to the new one. The new log is in
+	// place either way, so it is swapped in before the error is returned.
+	if err = syncDir(OSFS{}, filepath.Dir(c.path)); err != nil {
+		err = fmt.Errorf("could not sync collection directory: %v", err)
+	}
+
+	munmap(c.mapped)
+	c.mapped = nil
+	c.file.Close()
+	reclaimed := c.size - size
+	c.file, c.index, c.size, c.dead = tmp, index, size, 0
+	if c.bulk != nil {
+		c.startBulk()
+	}
+	c.remap()
+	return reclaimed, err
+}
+
+// copyLive writes the live entries to w in their original order and returns
+// the index describing their new positions.
+func (c *logCollection) copyLive(w *os.File) (map[string]logEntry, int64, error) {
+	keys := make([]string, 0, len(c.index))
+	for key := range c.index {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return c.index[keys[i]].offset < c.index[keys[j]].offset
+	})
+
+	bw := bufio.NewWriter(w)
+	index := make(map[string]logEntry, len(keys))
+	var offset int64
+	for _, key := range keys {
+		entry := c.index[key]
+		buf := make([]byte, entry.size)
+		if _, err := c.file.ReadAt(buf, entry.offset); err != nil {
+			return nil, 0, fmt.Errorf("could not read entry %s: %v", key, err)
+		}
+		if _, err := bw.Write(buf); err != nil {
+			return nil, 0, fmt.Errorf("could not write entry %s: %v", key, err)
+		}
+		index[key] = logEntry{offset: offset, size: entry.size}
+		offset += entry.size
+	}
+
+	if err := bw.Flush(); err != nil {
+		return nil, 0, err
+	}
+	return index, offset, nil
+}
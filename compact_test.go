@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeDeadEntries writes ten users to a log engine database, overwrites
+// each twice and deletes the first three, leaving the log mostly dead.
+func writeDeadEntries(t *testing.T, d *Driver) {
+	t.Helper()
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 10; i++ {
+			if err := d.Write("users", fmt.Sprint("user", i), User{Name: fmt.Sprint(i, "-", round)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if err := d.Delete("users", fmt.Sprint("user", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkCompacted checks that only the last writes of the users left by
+// writeDeadEntries are read.
+func checkCompacted(t *testing.T, d *Driver) {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		user, err := d.Read("users", fmt.Sprint("user", i))
+		switch {
+		case i < 3 && !errors.Is(err, os.ErrNotExist):
+			t.Errorf("deleted user%d read as %+v, %v", i, user, err)
+		case i >= 3 && (err != nil || user.Name != fmt.Sprint(i, "-2")):
+			t.Errorf("user%d = %+v, %v, want its last write", i, user, err)
+		}
+	}
+}
+
+func logSize(t *testing.T, dir string) int64 {
+	t.Helper()
+	info, err := os.Stat(filepath.Join(dir, "users", logFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestCompact(t *testing.T) {
+	d, dir := openTestDB(t, &Options{Engine: EngineLog})
+	writeDeadEntries(t, d)
+	before := logSize(t, dir)
+
+	if err := d.Compact("users"); err != nil {
+		t.Fatal(err)
+	}
+	after := logSize(t, dir)
+	if after >= before/2 {
+		t.Errorf("log is %d bytes after compaction, %d before", after, before)
+	}
+	checkCompacted(t, d)
+
+	if err := d.Compact("users"); err != nil || logSize(t, dir) != after {
+		t.Errorf("compacting a compacted log = %v, size %d, want %d", err, logSize(t, dir), after)
+	}
+
+	d.Close()
+	d, err := New(dir, &Options{Engine: EngineLog, Slog: openTestLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	checkCompacted(t, d)
+}
+
+func TestCompactInBackground(t *testing.T) {
+	d, dir := openTestDB(t, &Options{Engine: EngineLog, Compaction: CompactionOptions{
+		Interval:  10 * time.Millisecond,
+		DeadRatio: 0.5,
+	}})
+	writeDeadEntries(t, d)
+	before := logSize(t, dir)
+
+	waitFor(t, "background compaction", func() bool { return logSize(t, dir) < before })
+	checkCompacted(t, d)
+}
+
+func TestCompactUnsupported(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+	if err := d.Compact("users"); err == nil {
+		t.Error("compacting with the file engine succeeded")
+	}
+}
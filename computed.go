@@ -0,0 +1,50 @@
+package main
+
+import "fmt"
+
+// ComputeFunc derives the value of a computed field from a user. It may be
+// called for several users at once.
+type ComputeFunc func(user User) interface{}
+
+type computedField struct {
+	name    string
+	compute ComputeFunc
+}
+
+// RegisterComputed adds a computed field to the users of a collection.
+// Read, ReadAll, Query and the HTTP API fill it into User.Computed; it is
+// never stored.
+func (d *Driver) RegisterComputed(collection, field string, fn ComputeFunc) error {
+	if err := d.checkNames(&collection); err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.computed == nil {
+		d.computed = make(map[string][]computedField)
+	}
+	for _, f := range d.computed[collection] {
+		if f.name == field {
+			return fmt.Errorf("computed field %s of collection %s is already registered", field, collection)
+		}
+	}
+	d.computed[collection] = append(d.computed[collection], computedField{name: field, compute: fn})
+	return nil
+}
+
+// compute fills in the computed fields of a user read from a collection.
+func (d *Driver) compute(collection string, user *User) {
+	d.mutex.Lock()
+	fields := d.computed[collection]
+	d.mutex.Unlock()
+
+	if len(fields) == 0 {
+		return
+	}
+	user.Computed = make(map[string]interface{}, len(fields))
+	for _, f := range fields {
+		user.Computed[f.name] = f.compute(*user)
+	}
+}
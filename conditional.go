@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrConditionFailed is returned by conditional writes whose condition did
+// not hold; nothing was written.
+var ErrConditionFailed = errors.New("condition failed")
+
+// WriteIfAbsent writes a user only if no record is stored under key yet,
+// failing with ErrConditionFailed otherwise. The check and the write are
+// atomic, so of several concurrent callers exactly one succeeds, e.g. to
+// take a lock.
+func (d *Driver) WriteIfAbsent(collection, key string, value User) error {
+	if err := d.checkNames(&collection, &key); err != nil {
+		return err
+	}
+
+	return d.write(context.Background(), collection, key, value, func(_ []byte, exists bool) error {
+		if exists {
+			return fmt.Errorf("%w: %s already exists in collection %s", ErrConditionFailed, key, collection)
+		}
+		return nil
+	})
+}
+
+// CompareAndSwap replaces the user stored under key with value only if it
+// still equals expected, e.g. as returned by Read, failing with
+// ErrConditionFailed if it changed or is missing. The comparison and the
+// write are atomic, so read-modify-write cycles such as counters can retry
+// on failure instead of losing updates.
+func (d *Driver) CompareAndSwap(collection, key string, expected, value User) error {
+	if err := d.checkNames(&collection, &key); err != nil {
+		return err
+	}
+
+	want, err := canonicalUser(expected)
+	if err != nil {
+		return err
+	}
+
+	return d.write(context.Background(), collection, key, value, func(current []byte, exists bool) error {
+		if !exists {
+			return fmt.Errorf("%w: %s does not exist in collection %s", ErrConditionFailed, key, collection)
+		}
+		current, _, err := d.upgrade(collection, key, current)
+		if err != nil {
+			return err
+		}
+		if current, err = d.openFields(collection, key, current); err != nil {
+			return err
+		}
+		var user User
+		if err := json.Unmarshal(current, &user); err != nil {
+			return fmt.Errorf("could not unmarshal data: %v", err)
+		}
+		got, err := canonicalUser(user)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got, want) {
+			return fmt.Errorf("%w: %s in collection %s does not hold the expected value", ErrConditionFailed, key, collection)
+		}
+		return nil
+	})
+}
+
+// canonicalUser encodes a user for comparison, leaving out computed fields.
+func canonicalUser(user User) ([]byte, error) {
+	user.Computed = nil
+	data, err := json.Marshal(user)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal data: %v", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestWriteIfAbsent(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+	if err := d.WriteIfAbsent("users", "ann", User{Name: "Ann"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.WriteIfAbsent("users", "ann", User{Name: "Other"}); !errors.Is(err, ErrConditionFailed) {
+		t.Errorf("second WriteIfAbsent = %v, want ErrConditionFailed", err)
+	}
+	if user, err := d.Read("users", "ann"); err != nil || user.Name != "Ann" {
+		t.Errorf("read = %+v, %v, want the first write", user, err)
+	}
+
+	const callers = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- d.WriteIfAbsent("locks", "job", User{Name: strconv.Itoa(i)})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	won := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			won++
+		case !errors.Is(err, ErrConditionFailed):
+			t.Error(err)
+		}
+	}
+	if won != 1 {
+		t.Errorf("%d concurrent callers took the lock, want 1", won)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+	ann := User{Name: "Ann", Age: "30"}
+	if err := d.CompareAndSwap("users", "ann", User{}, ann); !errors.Is(err, ErrConditionFailed) {
+		t.Errorf("swap of a missing record = %v, want ErrConditionFailed", err)
+	}
+	if err := d.Write("users", "ann", ann); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CompareAndSwap("users", "ann", User{Name: "Ann", Age: "29"}, User{Name: "Ann", Age: "31"}); !errors.Is(err, ErrConditionFailed) {
+		t.Errorf("swap from a stale value = %v, want ErrConditionFailed", err)
+	}
+	current, err := d.Read("users", "ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CompareAndSwap("users", "ann", current, User{Name: "Ann", Age: "31"}); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := d.Read("users", "ann"); err != nil || user.Age != "31" {
+		t.Errorf("read = %+v, %v, want the swapped value", user, err)
+	}
+}
+
+// TestCompareAndSwapCounter checks that concurrent read-modify-write cycles
+// retrying on ErrConditionFailed lose no updates.
+func TestCompareAndSwapCounter(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+	if err := d.Write("counters", "hits", User{Age: "0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	const callers = 8
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				current, err := d.Read("counters", "hits")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				n, _ := current.Age.Int64()
+				next := User{Age: json.Number(strconv.FormatInt(n+1, 10))}
+				err = d.CompareAndSwap("counters", "hits", current, next)
+				if err == nil {
+					return
+				}
+				if !errors.Is(err, ErrConditionFailed) {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if user, err := d.Read("counters", "hits"); err != nil || user.Age != json.Number(strconv.Itoa(callers)) {
+		t.Errorf("counter = %+v, %v, want %d", user, err, callers)
+	}
+}
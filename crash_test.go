@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var (
+	crashRounds = flag.Int("crash.rounds", 10, "how many times TestCrash kills the writer per engine")
+	crashSeed   = flag.Uint64("crash.seed", 0, "seed of the random kills and writes of TestCrash (0 picks one)")
+)
+
+// crashWorkerEnv holds the configuration of a crash test worker. The test
+// binary re-executes itself with it set, and TestMain then runs the worker
+// instead of the tests.
+const crashWorkerEnv = "DB_CRASH_WORKER"
+
+// crashWorkerConfig is what a worker is told through crashWorkerEnv.
+type crashWorkerConfig struct {
+	Dir    string
+	Engine Engine
+	Keys   int
+	Seed   uint64
+	Start  uint64
+}
+
+// runCrashWorker opens the database described by crashWorkerEnv and writes
+// until it is killed, returning the exit code of the process.
+func runCrashWorker() int {
+	var config crashWorkerConfig
+	if err := json.Unmarshal([]byte(os.Getenv(crashWorkerEnv)), &config); err != nil {
+		fmt.Fprintf(os.Stderr, "crash worker: %v\n", err)
+		return 2
+	}
+
+	d, err := New(config.Dir, &Options{Engine: config.Engine, Slog: openTestLogger()})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "crash worker: %v\n", err)
+		return 1
+	}
+	defer d.Close()
+	if err := crashWorker(d, config.Keys, config.Seed, config.Start, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "crash worker: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// TestCrash runs a writer in a child process, kills it at a random moment,
+// reopens the database and checks what survived, round after round.
+func TestCrash(t *testing.T) {
+	if testing.Short() {
+		t.Skip("crash test kills child processes")
+	}
+	seed := *crashSeed
+	if seed == 0 {
+		seed = uint64(time.Now().UnixNano())
+	}
+	t.Logf("seed %d (rerun with -crash.seed)", seed)
+
+	for _, engine := range []struct {
+		name   string
+		engine Engine
+	}{{"files", EngineFiles}, {"log", EngineLog}} {
+		t.Run(engine.name, func(t *testing.T) {
+			testCrash(t, engine.engine, seed)
+		})
+	}
+}
+
+func testCrash(t *testing.T, engine Engine, seed uint64) {
+	const (
+		keys   = 50
+		maxRun = 200 * time.Millisecond
+	)
+	dir := t.TempDir()
+	random := rand.New(rand.NewPCG(seed, 0))
+	model := newCrashModel()
+
+	for round := 1; round <= *crashRounds; round++ {
+		config, err := json.Marshal(crashWorkerConfig{
+			Dir: dir, Engine: engine, Keys: keys, Seed: seed + uint64(round), Start: model.next,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		worker := exec.Command(os.Args[0])
+		worker.Env = append(os.Environ(), crashWorkerEnv+"="+string(config))
+		worker.Stderr = os.Stderr
+		out, err := worker.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := worker.Start(); err != nil {
+			t.Fatal(err)
+		}
+		killed := time.AfterFunc(time.Duration(random.Int64N(int64(maxRun))), func() { worker.Process.Kill() })
+		err = model.follow(out)
+		killed.Stop()
+		worker.Process.Kill()
+		worker.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := New(dir, &Options{Engine: engine, Slog: openTestLogger()})
+		if err != nil {
+			t.Fatalf("round %d: could not reopen the database: %v", round, err)
+		}
+		problems := model.check(d)
+		d.Close()
+		for _, problem := range problems {
+			t.Errorf("round %d: %s", round, problem)
+		}
+	}
+	if model.next == 0 {
+		t.Error("the worker never began an operation")
+	}
+}
+
+// crashCollection is the collection the crash test writes to.
+const crashCollection = "crashtest"
+
+// crashOp is an operation of the crash test worker. Every user it writes
+// holds the number of the operation as its Age and its key as its Name, so
+// what survives a crash can be traced back to the operation that wrote it.
+type crashOp struct {
+	n   uint64
+	del bool
+	key string
+}
+
+// crashState is what a key holds: nothing, or the user written by op n.
+type crashState struct {
+	present bool
+	n       uint64
+}
+
+// crashWorker writes and deletes random keys until it is killed, printing
+// "begin n write|delete key" before each operation and "ok n" once it
+// returned. Operations are numbered from start.
+func crashWorker(d *Driver, keys int, seed, start uint64, w io.Writer) error {
+	random := rand.New(rand.NewPCG(seed, start))
+	for n := start; ; n++ {
+		op := crashOp{n: n, del: random.IntN(5) == 0, key: fmt.Sprintf("key-%d", random.IntN(keys))}
+		kind := "write"
+		if op.del {
+			kind = "delete"
+		}
+		if _, err := fmt.Fprintf(w, "begin %d %s %s\n", op.n, kind, op.key); err != nil {
+			return err
+		}
+
+		var err error
+		if op.del {
+			err = d.Delete(crashCollection, op.key)
+			if errors.Is(err, os.ErrNotExist) {
+				err = nil
+			}
+		} else {
+			err = d.Write(crashCollection, op.key, User{Name: op.key, Age: json.Number(strconv.FormatUint(op.n, 10))})
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "ok %d\n", op.n); err != nil {
+			return err
+		}
+	}
+}
+
+// crashModel follows the operations a worker reported to tell what every
+// key may hold after it was killed.
+type crashModel struct {
+	state map[string]crashState
+	// pending is the operation begun but not acknowledged; it may or may
+	// not have taken effect.
+	pending *crashOp
+	next    uint64
+}
+
+func newCrashModel() *crashModel {
+	return &crashModel{state: make(map[string]crashState)}
+}
+
+// follow reads the output of a worker.
+func (m *crashModel) follow(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var op crashOp
+		var kind string
+		if _, err := fmt.Sscanf(scanner.Text(), "begin %d %s %s", &op.n, &kind, &op.key); err == nil {
+			op.del = kind == "delete"
+			m.pending = &op
+			m.next = op.n + 1
+			continue
+		}
+		var n uint64
+		if _, err := fmt.Sscanf(scanner.Text(), "ok %d", &n); err == nil && m.pending != nil && m.pending.n == n {
+			m.state[m.pending.key] = crashState{present: !m.pending.del, n: n}
+			m.pending = nil
+			continue
+		}
+		// A line cut short by the kill.
+	}
+	return scanner.Err()
+}
+
+// check compares the database with the model, returning the problems
+// found: acknowledged operations lost, records damaged or holding what no
+// operation wrote. The outcome of the pending operation is then adopted.
+func (m *crashModel) check(d *Driver) []string {
+	var problems []string
+	if corrupt, err := d.Verify(); err != nil {
+		problems = append(problems, fmt.Sprintf("verify failed: %v", err))
+	} else {
+		for _, record := range corrupt {
+			problems = append(problems, fmt.Sprintf("corrupt record %s: %v", record.Key, record.Err))
+		}
+	}
+
+	keys, err := d.Keys(crashCollection)
+	if err != nil && len(m.state) > 0 {
+		problems = append(problems, fmt.Sprintf("could not list keys: %v", err))
+	}
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		seen[key] = true
+		m.checkKey(d, key, true, &problems)
+	}
+	for key, state := range m.state {
+		if state.present && !seen[key] {
+			m.checkKey(d, key, false, &problems)
+		}
+	}
+	m.pending = nil
+	return problems
+}
+
+// checkKey checks what key holds against the model and records it.
+func (m *crashModel) checkKey(d *Driver, key string, present bool, problems *[]string) {
+	want, written := m.state[key]
+	var allowed []crashState
+	allowed = append(allowed, want)
+	if m.pending != nil && m.pending.key == key {
+		allowed = append(allowed, crashState{present: !m.pending.del, n: m.pending.n})
+	}
+
+	got := crashState{}
+	if present {
+		user, err := d.Read(crashCollection, key)
+		if err != nil {
+			*problems = append(*problems, fmt.Sprintf("%s is unreadable: %v", key, err))
+			m.state[key] = crashState{}
+			return
+		}
+		n, err := strconv.ParseUint(string(user.Age), 10, 64)
+		if err != nil || user.Name != key {
+			*problems = append(*problems, fmt.Sprintf("%s holds a damaged user: %+v", key, user))
+			m.state[key] = crashState{}
+			return
+		}
+		got = crashState{present: true, n: n}
+	}
+
+	for _, state := range allowed {
+		if state == got || (!state.present && !got.present) {
+			m.state[key] = got
+			return
+		}
+	}
+	switch {
+	case !written:
+		*problems = append(*problems, fmt.Sprintf("%s holds write %d but was never written", key, got.n))
+	case !got.present:
+		*problems = append(*problems, fmt.Sprintf("%s lost acknowledged write %d", key, want.n))
+	case !want.present:
+		*problems = append(*problems, fmt.Sprintf("%s holds write %d after its acknowledged delete", key, got.n))
+	default:
+		*problems = append(*problems, fmt.Sprintf("%s holds write %d instead of acknowledged write %d", key, got.n, want.n))
+	}
+	m.state[key] = got
+}
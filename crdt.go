@@ -0,0 +1,363 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// CRDTKind selects the conflict-free replicated data type the records of a
+// collection hold. Replicas of such a record can be edited independently,
+// e.g. by offline clients, and merged in any order with the same result.
+type CRDTKind string
+
+const (
+	// CRDTRegister holds a single JSON value; the most recent write wins.
+	CRDTRegister CRDTKind = "lww-register"
+	// CRDTSet holds a set of strings where an add concurrent with a remove
+	// wins (an observed-remove set).
+	CRDTSet CRDTKind = "or-set"
+	// CRDTCounter holds an integer that can be incremented and decremented
+	// concurrently.
+	CRDTCounter CRDTKind = "counter"
+)
+
+// ErrInvalidCRDT is returned when a CRDT state cannot be decoded.
+var ErrInvalidCRDT = errors.New("invalid CRDT state")
+
+// crdt is the merge interface shared by the CRDT types.
+type crdt interface {
+	mergeJSON(data []byte) error
+	resolve() interface{}
+}
+
+func newCRDT(kind CRDTKind) (crdt, error) {
+	switch kind {
+	case CRDTRegister:
+		return &LWWRegister{}, nil
+	case CRDTSet:
+		return &ORSet{}, nil
+	case CRDTCounter:
+		return &Counter{}, nil
+	}
+	return nil, fmt.Errorf("unknown CRDT kind %q", kind)
+}
+
+// LWWRegister is a last-writer-wins register. Ties between writes with the
+// same timestamp go to the greater node ID.
+type LWWRegister struct {
+	Value json.RawMessage `json:"value,omitempty"`
+	Time  int64           `json:"time"`
+	Node  string          `json:"node"`
+}
+
+// Set replaces the value as written by node at t.
+func (r *LWWRegister) Set(value json.RawMessage, node string, t time.Time) {
+	r.Merge(&LWWRegister{Value: value, Time: t.UnixNano(), Node: node})
+}
+
+// Merge keeps whichever of the two writes is later.
+func (r *LWWRegister) Merge(other *LWWRegister) {
+	if other.Time > r.Time || (other.Time == r.Time && other.Node > r.Node) {
+		*r = *other
+	}
+}
+
+func (r *LWWRegister) mergeJSON(data []byte) error {
+	var other LWWRegister
+	if err := json.Unmarshal(data, &other); err != nil {
+		return err
+	}
+	r.Merge(&other)
+	return nil
+}
+
+func (r *LWWRegister) resolve() interface{} {
+	return r.Value
+}
+
+// ORSet is an observed-remove set of strings. Every add is tagged uniquely
+// and a remove only removes the tags it has seen, so an add concurrent with
+// a remove survives the merge.
+type ORSet struct {
+	Adds    map[string][]string `json:"adds"`
+	Removed map[string]bool     `json:"removed"`
+}
+
+// Add adds element under a fresh tag.
+func (s *ORSet) Add(element string) {
+	tag := make([]byte, 8)
+	rand.Read(tag)
+	s.init()
+	s.Adds[element] = append(s.Adds[element], hex.EncodeToString(tag))
+}
+
+// Remove removes element as far as this replica has seen it added.
+func (s *ORSet) Remove(element string) {
+	s.init()
+	for _, tag := range s.Adds[element] {
+		s.Removed[tag] = true
+	}
+}
+
+// Contains reports whether element is in the set.
+func (s *ORSet) Contains(element string) bool {
+	for _, tag := range s.Adds[element] {
+		if !s.Removed[tag] {
+			return true
+		}
+	}
+	return false
+}
+
+// Elements lists the elements in the set, sorted.
+func (s *ORSet) Elements() []string {
+	elements := []string{}
+	for element := range s.Adds {
+		if s.Contains(element) {
+			elements = append(elements, element)
+		}
+	}
+	sort.Strings(elements)
+	return elements
+}
+
+// Merge takes the union of both sets' adds and removes.
+func (s *ORSet) Merge(other *ORSet) {
+	s.init()
+	for element, tags := range other.Adds {
+		seen := make(map[string]bool)
+		for _, tag := range s.Adds[element] {
+			seen[tag] = true
+		}
+		for _, tag := range tags {
+			if !seen[tag] {
+				s.Adds[element] = append(s.Adds[element], tag)
+			}
+		}
+		sort.Strings(s.Adds[element])
+	}
+	for tag := range other.Removed {
+		s.Removed[tag] = true
+	}
+}
+
+func (s *ORSet) init() {
+	if s.Adds == nil {
+		s.Adds = make(map[string][]string)
+	}
+	if s.Removed == nil {
+		s.Removed = make(map[string]bool)
+	}
+}
+
+func (s *ORSet) mergeJSON(data []byte) error {
+	var other ORSet
+	if err := json.Unmarshal(data, &other); err != nil {
+		return err
+	}
+	s.Merge(&other)
+	return nil
+}
+
+func (s *ORSet) resolve() interface{} {
+	return s.Elements()
+}
+
+// Counter is an increment/decrement counter: each node counts its own
+// increments and decrements, and merging keeps the highest count seen per
+// node.
+type Counter struct {
+	P map[string]int64 `json:"p"`
+	N map[string]int64 `json:"n"`
+}
+
+// Add adds delta, which may be negative, on behalf of node.
+func (c *Counter) Add(node string, delta int64) {
+	c.init()
+	if delta >= 0 {
+		c.P[node] += delta
+	} else {
+		c.N[node] -= delta
+	}
+}
+
+// Value is the current count.
+func (c *Counter) Value() int64 {
+	var value int64
+	for _, n := range c.P {
+		value += n
+	}
+	for _, n := range c.N {
+		value -= n
+	}
+	return value
+}
+
+// Merge keeps the highest count per node.
+func (c *Counter) Merge(other *Counter) {
+	c.init()
+	for node, n := range other.P {
+		if n > c.P[node] {
+			c.P[node] = n
+		}
+	}
+	for node, n := range other.N {
+		if n > c.N[node] {
+			c.N[node] = n
+		}
+	}
+}
+
+func (c *Counter) init() {
+	if c.P == nil {
+		c.P = make(map[string]int64)
+	}
+	if c.N == nil {
+		c.N = make(map[string]int64)
+	}
+}
+
+func (c *Counter) mergeJSON(data []byte) error {
+	var other Counter
+	if err := json.Unmarshal(data, &other); err != nil {
+		return err
+	}
+	c.Merge(&other)
+	return nil
+}
+
+func (c *Counter) resolve() interface{} {
+	return c.Value()
+}
+
+// crdtKind returns the CRDT kind of a collection, if it is configured as
+// one.
+func (d *Driver) crdtKind(collection string) (CRDTKind, bool) {
+	meta, _ := d.collectionMeta(collection)
+	return meta.CRDT, meta.CRDT != ""
+}
+
+// hasCRDTs reports whether any collection is configured as a CRDT one.
+func (d *Driver) hasCRDTs() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for _, meta := range d.meta {
+		if meta.CRDT != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// MergeCRDT merges a replica's state of the record under key into the
+// stored one and returns the merged state, which the replica should adopt.
+// The collection must be configured as a CRDT collection.
+func (d *Driver) MergeCRDT(collection, key string, state []byte) (merged []byte, err error) {
+	if err := d.checkNames(&collection, &key); err != nil {
+		return nil, err
+	}
+
+	op := d.begin(opWrite, collection, key)
+	defer op.end(&err)
+
+	if err := d.writable(); err != nil {
+		return nil, err
+	}
+	kind, ok := d.crdtKind(collection)
+	if !ok {
+		return nil, fmt.Errorf("collection %s is not a CRDT collection", collection)
+	}
+
+	hook := &HookOp{Op: OpWrite, Collection: collection, Key: key, Data: state}
+	defer func() { d.after(hook, err) }()
+	if err := d.before(hook); err != nil {
+		return nil, err
+	}
+	state = hook.Data
+
+	d.gate.RLock()
+	defer d.gate.RUnlock()
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	current, err := d.loadCRDT(kind, collection, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := current.mergeJSON(state); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidCRDT, kind, err)
+	}
+
+	if merged, err = json.MarshalIndent(current, "", "  "); err != nil {
+		return nil, fmt.Errorf("could not marshal data: %v", err)
+	}
+	if err := d.put(collection, key, merged); err != nil {
+		return nil, err
+	}
+	op.bytes = len(merged)
+
+	d.log.Info("Merged %s %s in collection %s", kind, key, collection)
+	d.publish(OpWrite, collection, key, merged)
+	return merged, nil
+}
+
+// ReadCRDT returns the resolved value of the CRDT under key: the JSON value
+// of a register, the sorted elements of a set or the count of a counter.
+func (d *Driver) ReadCRDT(collection, key string) (_ interface{}, err error) {
+	if err := d.checkNames(&collection, &key); err != nil {
+		return nil, err
+	}
+
+	op := d.begin(opRead, collection, key)
+	defer op.end(&err)
+
+	kind, ok := d.crdtKind(collection)
+	if !ok {
+		return nil, fmt.Errorf("collection %s is not a CRDT collection", collection)
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	data, err := d.store.get(collection, key)
+	if err != nil {
+		return nil, err
+	}
+	op.bytes = len(data)
+
+	current, _ := newCRDT(kind)
+	if err := json.Unmarshal(data, current); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidCRDT, kind, err)
+	}
+	return current.resolve(), nil
+}
+
+// loadCRDT reads the stored state of a CRDT, or an empty one.
+func (d *Driver) loadCRDT(kind CRDTKind, collection, key string) (crdt, error) {
+	current, err := newCRDT(kind)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := d.store.get(collection, key)
+	if errors.Is(err, os.ErrNotExist) {
+		return current, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, current); err != nil {
+		return nil, fmt.Errorf("%w: stored %s %s: %v", ErrInvalidCRDT, kind, key, err)
+	}
+	return current, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMergeCRDT(t *testing.T) {
+	d, _ := openTestDB(t, &Options{CRDT: map[string]CRDTKind{
+		"counters":  CRDTCounter,
+		"sets":      CRDTSet,
+		"registers": CRDTRegister,
+	}})
+
+	counter := func(node string, delta int64) []byte {
+		var c Counter
+		c.Add(node, delta)
+		return mustMarshal(t, &c)
+	}
+	set := func(elements ...string) []byte {
+		var s ORSet
+		for _, e := range elements {
+			s.Add(e)
+		}
+		return mustMarshal(t, &s)
+	}
+	register := func(value string, at int64) []byte {
+		var r LWWRegister
+		r.Set(json.RawMessage(value), "a", time.Unix(at, 0))
+		return mustMarshal(t, &r)
+	}
+
+	tests := []struct {
+		name       string
+		collection string
+		states     [][]byte
+		want       interface{}
+	}{
+		{"counter", "counters", [][]byte{counter("a", 2), counter("b", 3), counter("a", 2)}, int64(5)},
+		{"counter decrement", "counters", [][]byte{counter("a", 2), counter("a", -1)}, int64(1)},
+		{"set", "sets", [][]byte{set("x"), set("y", "x")}, []string{"x", "y"}},
+		{"register", "registers", [][]byte{register(`"new"`, 20), register(`"old"`, 10)}, json.RawMessage(`"new"`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, state := range tt.states {
+				if _, err := d.MergeCRDT(tt.collection, tt.name, state); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := d.ReadCRDT(tt.collection, tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadCRDT = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := d.MergeCRDT("counters", "bad", []byte(`{"p": "x"}`)); !errors.Is(err, ErrInvalidCRDT) {
+		t.Errorf("merging an invalid state = %v, want ErrInvalidCRDT", err)
+	}
+	if _, err := d.MergeCRDT("users", "ada", counter("a", 1)); err == nil {
+		t.Error("merging into a plain collection succeeded")
+	}
+}
+
+func TestCRDTRejectsRecordWrites(t *testing.T) {
+	d, _ := openTestDB(t, &Options{CRDT: map[string]CRDTKind{"counters": CRDTCounter}})
+	var c Counter
+	c.Add("a", 4)
+	if _, err := d.MergeCRDT("counters", "hits", mustMarshal(t, &c)); err != nil {
+		t.Fatal(err)
+	}
+
+	writes := []struct {
+		name  string
+		write func() error
+	}{
+		{"Write", func() error { return d.Write("counters", "hits", User{Name: "x"}) }},
+		{"WriteStream", func() error {
+			_, err := d.WriteStream("counters", "hits")
+			return err
+		}},
+		{"Tx.Write", func() error { return d.Begin().Write("counters", "hits", User{Name: "x"}) }},
+	}
+	for _, w := range writes {
+		if err := w.write(); err == nil {
+			t.Errorf("%s into a CRDT collection succeeded", w.name)
+		}
+	}
+	if got, err := d.ReadCRDT("counters", "hits"); err != nil || got != int64(4) {
+		t.Errorf("counter after rejected writes = %v, %v, want 4", got, err)
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
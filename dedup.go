@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// blobDir holds the bodies of records written with Options.Dedup, one file
+// per distinct body named by its SHA-256, spread over fan-out directories
+// by the first two hex digits. Every record holding the body is a hard
+// link to it, so the link count is its reference count. The leading dot
+// keeps it out of Collections.
+const blobDir = ".blobs"
+
+// linker is implemented by filesystems with hard links, which Options.Dedup
+// needs.
+type linker interface {
+	Link(oldname, newname string) error
+	// linkCount returns how many names a file has.
+	linkCount(name string) (int, error)
+}
+
+func (OSFS) Link(oldname, newname string) error { return os.Link(oldname, newname) }
+func (OSFS) linkCount(name string) (int, error) { return linkCount(name) }
+
+// stage puts data at tmp for put to rename over the record: a link to the
+// blob holding it when deduplicating, a file of its own otherwise or if the
+// blob cannot take another link.
+func (s *fileStorage) stage(tmp string, data []byte) error {
+	if s.dedup && s.linkBlob(tmp, data) == nil {
+		return nil
+	}
+	// A file left at tmp by a crash may be a link to a blob, which must not
+	// be truncated.
+	s.fs.Remove(tmp)
+	if err := writeFileSync(s.fs, tmp, data, s.layout.fileMode(), s.syncsAside(filepath.Dir(tmp))); err != nil {
+		s.fs.Remove(tmp)
+		return fmt.Errorf("could not write data to file: %v", err)
+	}
+	return nil
+}
+
+// linkBlob links tmp to the blob holding data, writing the blob first if no
+// record holds data yet.
+func (s *fileStorage) linkBlob(tmp string, data []byte) error {
+	l, ok := s.fs.(linker)
+	if !ok {
+		return fmt.Errorf("the file system does not support hard links")
+	}
+	sum := sha256.Sum256(data)
+	name := hex.EncodeToString(sum[:])
+	dir := filepath.Join(s.dir, blobDir, name[:2])
+	blob := filepath.Join(dir, name+".json")
+
+	// Blobs are only removed by GC, which holds writes back, so one found
+	// here stays until it is linked.
+	s.blobs.Lock()
+	defer s.blobs.Unlock()
+
+	_, err := s.fs.Stat(blob)
+	if os.IsNotExist(err) {
+		if err := s.fs.MkdirAll(dir, s.layout.dirMode()); err != nil {
+			return fmt.Errorf("could not create blob directory: %v", err)
+		}
+		if err := writeFileSync(s.fs, blob+".tmp", data, s.layout.fileMode(), s.syncsAside(dir)); err != nil {
+			s.fs.Remove(blob + ".tmp")
+			return fmt.Errorf("could not write blob: %v", err)
+		}
+		if err := s.fs.Rename(blob+".tmp", blob); err != nil {
+			return fmt.Errorf("could not move blob into place: %v", err)
+		}
+		if err := s.persist(dir, blob); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return fmt.Errorf("could not stat blob: %v", err)
+	}
+
+	s.fs.Remove(tmp)
+	if err := l.Link(blob, tmp); err != nil {
+		return fmt.Errorf("could not link blob: %v", err)
+	}
+	return nil
+}
+
+// collectBlobs removes the blobs no record links to any more, and the
+// temporary files of blobs being written when the Driver crashed, and
+// returns their paths relative to the database directory.
+func (s *fileStorage) collectBlobs() ([]string, error) {
+	l, ok := s.fs.(linker)
+	if !ok {
+		return nil, nil
+	}
+	root := filepath.Join(s.dir, blobDir)
+	dirs, err := s.fs.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read blob directory: %v", err)
+	}
+
+	var removed []string
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		entries, err := s.fs.ReadDir(filepath.Join(root, dir.Name()))
+		if err != nil {
+			return removed, fmt.Errorf("could not read blob directory: %v", err)
+		}
+		for _, entry := range entries {
+			path := filepath.Join(root, dir.Name(), entry.Name())
+			if !strings.HasSuffix(entry.Name(), ".tmp") {
+				links, err := l.linkCount(path)
+				if err != nil {
+					// Without link counts no blob is known to be unused.
+					return removed, nil
+				}
+				if links > 1 {
+					continue
+				}
+			}
+			if s.fs.Remove(path) == nil {
+				removed = append(removed, filepath.Join(blobDir, dir.Name(), entry.Name()))
+			}
+		}
+		s.fs.Remove(filepath.Join(root, dir.Name()))
+	}
+	s.fs.Remove(root)
+	return removed, nil
+}
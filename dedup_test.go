@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDedup(t *testing.T) {
+	d, dir := openTestDB(t, &Options{Dedup: true})
+	records := map[string]User{
+		"a": {Name: "same"},
+		"b": {Name: "same"},
+		"c": {Name: "other"},
+	}
+	for key, user := range records {
+		if err := d.Write("users", key, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stat := func(key string) os.FileInfo {
+		info, err := os.Stat(filepath.Join(dir, "users", key+".json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+
+	tests := []struct {
+		name   string
+		a, b   string
+		shared bool
+	}{
+		{"same body", "a", "b", true},
+		{"different body", "a", "c", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := os.SameFile(stat(tt.a), stat(tt.b)); got != tt.shared {
+				t.Errorf("%s and %s share a file: %v, want %v", tt.a, tt.b, got, tt.shared)
+			}
+		})
+	}
+
+	// Overwriting a record leaves the body it shared untouched.
+	if err := d.Write("users", "a", User{Name: "changed"}); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := d.Read("users", "b"); err != nil || user.Name != "same" {
+		t.Errorf("record sharing an overwritten body = %+v, %v", user, err)
+	}
+	if os.SameFile(stat("a"), stat("b")) {
+		t.Error("overwritten record still shares its old body")
+	}
+
+	// The body no record holds any more is collected.
+	if err := d.Delete("users", "b"); err != nil {
+		t.Fatal(err)
+	}
+	report, err := d.GC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Files) != 1 || filepath.Dir(filepath.Dir(report.Files[0])) != blobDir {
+		t.Errorf("collected %v, want the unused blob", report.Files)
+	}
+	for key, want := range map[string]string{"a": "changed", "c": "other"} {
+		if user, err := d.Read("users", key); err != nil || user.Name != want {
+			t.Errorf("read %s after GC = %+v, %v", key, user, err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"time"
+)
+
+// DevNotifyOptions configures the development notifier, which tells the
+// developer when watched records change by running a command, posting to a
+// webhook and/or raising a desktop notification. It is meant for local
+// development, not production use.
+type DevNotifyOptions struct {
+	// Watch lists "collection/key" patterns in path.Match syntax, e.g.
+	// "users/*". An empty list watches every record.
+	Watch []string
+	// Command is run through the shell for each change, with DB_OP,
+	// DB_COLLECTION and DB_KEY set in its environment.
+	Command string
+	// Webhook receives each change as a JSON POST.
+	Webhook string
+	// Desktop raises a desktop notification (notify-send or osascript).
+	Desktop bool
+}
+
+// devNotifyQueueSize bounds how many changes may wait for delivery; beyond
+// that changes are dropped rather than slowing writes down.
+const devNotifyQueueSize = 64
+
+// startDevNotifier delivers changes matching opts in the background until
+// the Driver is closed.
+func (d *Driver) startDevNotifier(opts *DevNotifyOptions) {
+	if opts == nil {
+		return
+	}
+
+	queue := make(chan Change, devNotifyQueueSize)
+	d.subscribe(func(change Change) {
+		if !opts.matches(change) {
+			return
+		}
+		select {
+		case queue <- change:
+		default:
+			d.log.Debug("Dev notifier queue full, dropping change to %s/%s", change.Collection, change.Key)
+		}
+	})
+
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+
+		for {
+			select {
+			case <-d.stop:
+				return
+			case change := <-queue:
+				if err := opts.deliver(client, change); err != nil {
+					d.log.Error("Dev notifier: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+func (opts *DevNotifyOptions) matches(change Change) bool {
+	if len(opts.Watch) == 0 {
+		return true
+	}
+
+	name := change.Collection + "/" + change.Key
+	for _, pattern := range opts.Watch {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (opts *DevNotifyOptions) deliver(client *http.Client, change Change) error {
+	message := fmt.Sprintf("%s %s/%s", change.Op, change.Collection, change.Key)
+
+	if opts.Command != "" {
+		cmd := shellCommand(opts.Command)
+		cmd.Env = append(os.Environ(),
+			"DB_OP="+change.Op,
+			"DB_COLLECTION="+change.Collection,
+			"DB_KEY="+change.Key,
+		)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("command failed on %s: %v: %s", message, err, bytes.TrimSpace(out))
+		}
+	}
+
+	if opts.Webhook != "" {
+		body, err := json.Marshal(change)
+		if err != nil {
+			return fmt.Errorf("could not marshal change: %v", err)
+		}
+		resp, err := client.Post(opts.Webhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("webhook failed on %s: %v", message, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("webhook failed on %s: %s", message, resp.Status)
+		}
+	}
+
+	if opts.Desktop {
+		if err := desktopNotify("Database change", message); err != nil {
+			return fmt.Errorf("desktop notification failed on %s: %v", message, err)
+		}
+	}
+	return nil
+}
+
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+	return exec.Command("sh", "-c", command)
+}
+
+func desktopNotify(title, message string) error {
+	switch runtime.GOOS {
+	case "darwin":
+		script := fmt.Sprintf("display notification %q with title %q", message, title)
+		return exec.Command("osascript", "-e", script).Run()
+	case "linux", "freebsd", "openbsd", "netbsd":
+		return exec.Command("notify-send", title, message).Run()
+	default:
+		return fmt.Errorf("desktop notifications are not supported on %s", runtime.GOOS)
+	}
+}
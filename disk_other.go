@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import "errors"
+
+// diskFree is unavailable on this platform; Health reports the space as
+// unknown.
+func diskFree(dir string) (uint64, error) {
+	return 0, errors.New("disk space is not available on this platform")
+}
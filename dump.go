@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
+
+// A dump is newline-delimited JSON, one object per line, told apart by its
+// "type":
+//
+//	{"type":"header","format":"db-dump","version":1,"created":"...","source":"0.0.1"}
+//	{"type":"collection","collection":"users","meta":{...}}
+//	{"type":"record","collection":"users","key":"ada","meta":{"revision":"...","size":42},"body":{...}}
+//	{"type":"end","records":1}
+//
+// The header comes first and the end line last, so a truncated dump is
+// detected. A collection line carries the CollectionMeta of a configured
+// collection and precedes its records. Records are dumped as stored,
+// before any pending migration, so the loading database upgrades them. A
+// body that is not JSON is carried base64-encoded under "data" instead.
+// The header of a dump written by DumpRedacted is marked "redacted":true.
+// Readers skip line types and fields they do not know, so later versions
+// can add them; a dump of a newer version than the reader's is refused.
+const (
+	dumpFormat  = "db-dump"
+	dumpVersion = 1
+)
+
+// dumpLine is a line of a dump.
+type dumpLine struct {
+	Type string `json:"type"`
+
+	// header
+	Format   string     `json:"format,omitempty"`
+	Version  int        `json:"version,omitempty"`
+	Created  *time.Time `json:"created,omitempty"`
+	Source   string     `json:"source,omitempty"`
+	Redacted bool       `json:"redacted,omitempty"`
+
+	// collection and record
+	Collection string          `json:"collection,omitempty"`
+	Key        string          `json:"key,omitempty"`
+	Meta       json.RawMessage `json:"meta,omitempty"`
+	Body       json.RawMessage `json:"body,omitempty"`
+	Data       []byte          `json:"data,omitempty"`
+
+	// end
+	Records *int `json:"records,omitempty"`
+}
+
+// dumpRecordMeta describes a dumped record.
+type dumpRecordMeta struct {
+	Revision string `json:"revision"`
+	Size     int    `json:"size"`
+}
+
+// Dump writes the collections, or every collection if none are given, to w
+// in the dump format, holding writes back meanwhile so the dump is a
+// consistent point in time. It returns the number of records written.
+// Time series points are not dumped.
+func (d *Driver) Dump(w io.Writer, collections ...string) (int, error) {
+	return d.dump(w, false, collections)
+}
+
+func (d *Driver) dump(w io.Writer, redact bool, collections []string) (int, error) {
+	resume := d.Pause()
+	defer resume()
+
+	if len(collections) == 0 {
+		var err error
+		if collections, err = d.Collections(); err != nil {
+			return 0, err
+		}
+	} else {
+		collections = slices.Clone(collections)
+		for i := range collections {
+			if err := d.checkNames(&collections[i]); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	now := time.Now().UTC()
+	if err := enc.Encode(dumpLine{Type: "header", Format: dumpFormat, Version: dumpVersion, Created: &now, Source: version, Redacted: redact}); err != nil {
+		return 0, fmt.Errorf("could not write dump: %v", err)
+	}
+
+	var records int
+	for _, collection := range collections {
+		meta, configured := d.collectionMeta(collection)
+		if configured {
+			data, err := json.Marshal(meta)
+			if err != nil {
+				return records, fmt.Errorf("could not marshal configuration of collection %s: %v", collection, err)
+			}
+			if err := enc.Encode(dumpLine{Type: "collection", Collection: collection, Meta: data}); err != nil {
+				return records, fmt.Errorf("could not write dump: %v", err)
+			}
+		}
+
+		redactRecords := redact && len(meta.Redact) > 0
+		err := d.scanStored(collection, func(key string, data []byte) error {
+			if redactRecords {
+				if !json.Valid(data) {
+					d.log.Error("Left %s of collection %s out of a redacted dump: it is not JSON, so it cannot be redacted", key, collection)
+					return nil
+				}
+				var err error
+				if data, err = d.Redact(collection, data); err != nil {
+					return err
+				}
+			}
+			meta, err := json.Marshal(dumpRecordMeta{Revision: revision(data), Size: len(data)})
+			if err != nil {
+				return err
+			}
+			line := dumpLine{Type: "record", Collection: collection, Key: key, Meta: meta}
+			if json.Valid(data) {
+				line.Body = data
+			} else {
+				line.Data = data
+			}
+			if err := enc.Encode(line); err != nil {
+				return fmt.Errorf("could not write dump: %v", err)
+			}
+			records++
+			return nil
+		})
+		if err != nil {
+			return records, fmt.Errorf("could not dump collection %s: %v", collection, err)
+		}
+	}
+
+	if err := enc.Encode(dumpLine{Type: "end", Records: &records}); err != nil {
+		return records, fmt.Errorf("could not write dump: %v", err)
+	}
+	if err := bw.Flush(); err != nil {
+		return records, fmt.Errorf("could not write dump: %v", err)
+	}
+	return records, nil
+}
+
+// Load writes the collection configurations and records of a dump into the
+// database, overwriting records with the same keys, and returns the number
+// of records loaded. Records are stored as dumped: hooks, references and
+// schemas are not checked. A dump that ends early fails after loading what
+// it holds.
+func (d *Driver) Load(r io.Reader) (int, error) {
+	if err := d.writable(); err != nil {
+		return 0, err
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<30)
+
+	var records, line int
+	var header, end bool
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var l dumpLine
+		if err := json.Unmarshal(scanner.Bytes(), &l); err != nil {
+			return records, fmt.Errorf("dump line %d: %v", line, err)
+		}
+		if end {
+			return records, fmt.Errorf("dump line %d: data after the end of the dump", line)
+		}
+		if !header && l.Type != "header" {
+			return records, fmt.Errorf("dump line %d: missing dump header", line)
+		}
+
+		switch l.Type {
+		case "header":
+			if header {
+				return records, fmt.Errorf("dump line %d: second dump header", line)
+			}
+			if l.Format != dumpFormat {
+				return records, fmt.Errorf("not a dump: format %q", l.Format)
+			}
+			if l.Version > dumpVersion {
+				return records, fmt.Errorf("dump version %d is newer than the supported version %d", l.Version, dumpVersion)
+			}
+			if l.Redacted {
+				d.log.Info("Loading a redacted dump; masked fields are loaded as masks")
+			}
+			header = true
+		case "collection":
+			var meta CollectionMeta
+			if err := json.Unmarshal(l.Meta, &meta); err != nil {
+				return records, fmt.Errorf("dump line %d: invalid configuration of collection %s: %v", line, l.Collection, err)
+			}
+			if err := d.SetCollectionMeta(l.Collection, meta); err != nil {
+				return records, fmt.Errorf("dump line %d: %v", line, err)
+			}
+		case "record":
+			data := []byte(l.Body)
+			if len(data) == 0 {
+				data = l.Data
+			}
+			if err := d.load(l.Collection, l.Key, data); err != nil {
+				return records, fmt.Errorf("dump line %d: could not load record %s of collection %s: %v", line, l.Key, l.Collection, err)
+			}
+			records++
+		case "end":
+			if l.Records != nil && *l.Records != records {
+				return records, fmt.Errorf("dump line %d: dump holds %d records, %d were read", line, *l.Records, records)
+			}
+			end = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return records, fmt.Errorf("could not read dump: %v", err)
+	}
+	if !end {
+		return records, fmt.Errorf("dump is truncated after %d records", records)
+	}
+
+	d.log.Info("Loaded %d records from dump", records)
+	return records, nil
+}
+
+// load stores a dumped record as it is.
+func (d *Driver) load(collection, key string, data []byte) error {
+	if collection == "" || key == "" {
+		return fmt.Errorf("missing collection or key")
+	}
+
+	d.gate.RLock()
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	err := d.put(collection, key, data)
+	mutex.Unlock()
+	d.gate.RUnlock()
+
+	if err != nil {
+		return err
+	}
+	d.publish(OpWrite, collection, key, data)
+	return nil
+}
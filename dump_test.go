@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDumpLoad(t *testing.T) {
+	source, _ := openTestDB(t, nil)
+	if err := source.SetCollectionMeta("users", CollectionMeta{Indexes: []string{"Company"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"alice", "bob"} {
+		if err := source.Write("users", key, User{Name: key, Company: "Initech"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := source.Write("posts", "p1", User{Name: "post"}); err != nil {
+		t.Fatal(err)
+	}
+	// Bodies that are not JSON are carried too.
+	if err := source.store.put("posts", "raw", []byte("not\njson")); err != nil {
+		t.Fatal(err)
+	}
+
+	var dump bytes.Buffer
+	dumped, err := source.Dump(&dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, _ := openTestDB(t, nil)
+	loaded, err := target.Load(&dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dumped != 4 || loaded != dumped {
+		t.Errorf("dumped %d records and loaded %d, want 4", dumped, loaded)
+	}
+
+	for _, collection := range []string{"users", "posts"} {
+		keys, err := source.store.keys(collection)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := target.store.keys(collection); !slices.Equal(got, keys) {
+			t.Errorf("%s holds %v after loading, want %v", collection, got, keys)
+		}
+		for _, key := range keys {
+			// JSON bodies are carried compacted.
+			want, _ := source.store.get(collection, key)
+			var compact bytes.Buffer
+			if json.Compact(&compact, want) == nil {
+				want = compact.Bytes()
+			}
+			if got, err := target.store.get(collection, key); err != nil || !bytes.Equal(got, want) {
+				t.Errorf("loaded %s/%s = %q, %v, want %q", collection, key, got, err, want)
+			}
+		}
+	}
+	if meta, _ := target.CollectionMeta("users"); !slices.Equal(meta.Indexes, []string{"Company"}) {
+		t.Errorf("loaded configuration %+v", meta)
+	}
+}
+
+func TestLoadRejects(t *testing.T) {
+	const (
+		header = `{"type":"header","format":"db-dump","version":1}`
+		record = `{"type":"record","collection":"users","key":"alice","body":{"Name":"alice"}}`
+		end    = `{"type":"end","records":1}`
+	)
+	tests := []struct {
+		name  string
+		lines []string
+		want  string
+	}{
+		{"missing header", []string{record, end}, "missing dump header"},
+		{"other format", []string{`{"type":"header","format":"tar","version":1}`, end}, "not a dump"},
+		{"newer version", []string{`{"type":"header","format":"db-dump","version":99}`, end}, "newer"},
+		{"second header", []string{header, header, record, end}, "second dump header"},
+		{"truncated", []string{header, record}, "truncated"},
+		{"missing records", []string{header, end}, "holds 1 records"},
+		{"data after the end", []string{header, record, end, record}, "after the end"},
+		{"record without a key", []string{header, `{"type":"record","collection":"users","body":{}}`}, "missing collection or key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _ := openTestDB(t, nil)
+			_, err := d.Load(strings.NewReader(strings.Join(tt.lines, "\n")))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Load = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// Durability selects when writes are forced to stable storage, trading
+// write latency against how much a power loss can take.
+type Durability int
+
+const (
+	// DurabilityOS leaves flushing writes to the operating system's page
+	// cache (the default). A crash of the process loses nothing; a power
+	// loss can lose recent writes.
+	DurabilityOS Durability = iota
+	// DurabilityInterval syncs the files written to in the background
+	// every Options.SyncInterval, and on Close, bounding what a power loss
+	// can take.
+	DurabilityInterval
+	// DurabilityAlways syncs every write before it returns. Bulk loads are
+	// synced whenever their buffer is flushed, or with the file engine when
+	// they end.
+	DurabilityAlways
+)
+
+// defaultSyncInterval is how often DurabilityInterval syncs by default.
+const defaultSyncInterval = time.Second
+
+// syncer is implemented by storage engines that can sync their writes.
+type syncer interface {
+	setDurability(durability Durability)
+	// syncDirty syncs every file written to since the last call.
+	syncDirty() error
+}
+
+// storeSyncer returns the storage engine as a syncer, looking through a
+// Store that can sync its writes, such as a ShardedStore.
+func (d *Driver) storeSyncer() (syncer, bool) {
+	if s, ok := d.store.(externalStore); ok {
+		store, ok := s.Store.(syncer)
+		return store, ok
+	}
+	s, ok := d.store.(syncer)
+	return s, ok
+}
+
+// setDurability applies Options.Durability to the storage engine.
+func (d *Driver) setDurability() {
+	s, ok := d.storeSyncer()
+	if !ok {
+		if d.opts.Durability != DurabilityOS {
+			d.log.Info("Durability levels are not supported by this storage engine, ignoring")
+		}
+		return
+	}
+	s.setDurability(d.opts.Durability)
+}
+
+// startSyncer syncs the writes of the storage engine, and the change log,
+// every interval until the Driver is closed.
+func (d *Driver) startSyncer() {
+	s, ok := d.storeSyncer()
+	if (!ok && d.changes == nil) || d.opts.Durability != DurabilityInterval || d.opts.ReadOnly {
+		return
+	}
+
+	interval := d.opts.SyncInterval
+	if interval <= 0 {
+		interval = defaultSyncInterval
+	}
+
+	ran := d.background.track("durability-sync", interval)
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-d.stop:
+				return
+			case <-ticker.C:
+				if ok {
+					if err := s.syncDirty(); err != nil {
+						d.log.Error("Background sync failed: %v", err)
+					}
+				}
+				if d.changes != nil {
+					if err := d.changes.sync(); err != nil {
+						d.log.Error("Background sync failed: %v", err)
+					}
+				}
+				ran()
+			}
+		}
+	}()
+}
+
+// syncPath syncs the file or directory at path.
+func syncPath(fsys FS, path string) error {
+	file, err := fsys.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// syncDir syncs a directory, so the files created in or removed from it
+// survive a power loss. Windows cannot sync directories, and does not need
+// to.
+func syncDir(fsys FS, dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	return syncPath(fsys, dir)
+}
+
+func (s *fileStorage) setDurability(durability Durability) {
+	s.durability = durability
+}
+
+// syncsAside reports whether files written aside under dir must be synced
+// before they are renamed into place, so a crash cannot leave the rename
+// without the contents.
+func (s *fileStorage) syncsAside(dir string) bool {
+	return s.durability == DurabilityAlways && !s.bulkLoading(dir)
+}
+
+// persist makes the changes to paths, and to the directory holding them,
+// durable as the durability level asks.
+func (s *fileStorage) persist(dir string, paths ...string) error {
+	durability := s.durability
+	if durability == DurabilityAlways && s.bulkLoading(dir) {
+		// Synced once the bulk load ends.
+		durability = DurabilityInterval
+	}
+	switch durability {
+	case DurabilityAlways:
+		for _, path := range paths {
+			if err := syncPath(s.fs, path); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("could not sync %s: %v", filepath.Base(path), err)
+			}
+		}
+		if err := syncDir(s.fs, dir); err != nil {
+			return fmt.Errorf("could not sync collection directory: %v", err)
+		}
+	case DurabilityInterval:
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		if s.dirty == nil {
+			s.dirty = make(map[string]bool)
+		}
+		for _, path := range paths {
+			s.dirty[path] = false
+		}
+		s.dirty[dir] = true
+	}
+	return nil
+}
+
+func (s *fileStorage) syncDirty() error {
+	s.mutex.Lock()
+	dirty := s.dirty
+	s.dirty = nil
+	s.mutex.Unlock()
+
+	var firstErr error
+	failed := make(map[string]bool)
+	for path, isDir := range dirty {
+		sync := syncPath
+		if isDir {
+			sync = syncDir
+		}
+		// Files deleted since they were written have nothing left to sync.
+		if err := sync(s.fs, path); err != nil && !os.IsNotExist(err) {
+			failed[path] = isDir
+			if firstErr == nil {
+				firstErr = fmt.Errorf("could not sync %s: %v", path, err)
+			}
+		}
+	}
+
+	// The paths that failed are tried again on the next sync.
+	if len(failed) > 0 {
+		s.mutex.Lock()
+		if s.dirty == nil {
+			s.dirty = make(map[string]bool)
+		}
+		for path, isDir := range failed {
+			s.dirty[path] = isDir
+		}
+		s.mutex.Unlock()
+	}
+	return firstErr
+}
+
+func (s *logStorage) setDurability(durability Durability) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.durability = durability
+	for _, c := range s.collections {
+		c.Lock()
+		c.durability = durability
+		c.Unlock()
+	}
+}
+
+func (s *logStorage) syncDirty() error {
+	s.mutex.Lock()
+	collections := make([]*logCollection, 0, len(s.collections))
+	for _, c := range s.collections {
+		collections = append(collections, c)
+	}
+	s.mutex.Unlock()
+
+	var firstErr error
+	for _, c := range collections {
+		if err := c.syncDirty(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// written makes an append durable as the durability level asks. The lock
+// must be held.
+func (c *logCollection) written() error {
+	switch c.durability {
+	case DurabilityAlways:
+		if err := c.file.Sync(); err != nil {
+			return fmt.Errorf("could not sync log: %v", err)
+		}
+	case DurabilityInterval:
+		c.dirty = true
+	}
+	return nil
+}
+
+func (c *logCollection) syncDirty() error {
+	c.Lock()
+	defer c.Unlock()
+
+	if !c.dirty {
+		return nil
+	}
+	if err := c.file.Sync(); err != nil {
+		return fmt.Errorf("could not sync log %s: %v", c.path, err)
+	}
+	c.dirty = false
+	return nil
+}
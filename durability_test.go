@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestDurabilityAlwaysSyncsBeforeRename checks that every file written
+// aside is synced before it is renamed over the file it replaces, so a
+// crash cannot leave an empty or torn record in place of a good one.
+func TestDurabilityAlwaysSyncsBeforeRename(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"records", Options{}},
+		{"records and checksums", Options{Checksums: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mutex sync.Mutex
+			synced := make(map[string]bool)
+			var unsynced []string
+			fsys := &FaultFS{FS: OSFS{}, Fault: func(op, path string) error {
+				mutex.Lock()
+				defer mutex.Unlock()
+
+				switch {
+				case op == "sync":
+					synced[path] = true
+				case op == "open" || op == "write":
+					delete(synced, path)
+				case op == "rename" && strings.HasSuffix(path, ".tmp") && !synced[path]:
+					unsynced = append(unsynced, path)
+				}
+				return nil
+			}}
+			opts := tt.opts
+			opts.FS = fsys
+			opts.Durability = DurabilityAlways
+			d, _ := openTestDB(t, &opts)
+
+			for _, company := range []string{"Initech", "Globex"} {
+				if err := d.Write("users", "alice", User{Name: "alice", Company: company}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if len(unsynced) > 0 {
+				t.Errorf("renamed into place before being synced: %q", unsynced)
+			}
+		})
+	}
+}
+
+func TestDurabilityCoversStreamedWrites(t *testing.T) {
+	d, dir := openTestDB(t, &Options{Durability: DurabilityInterval, SyncInterval: time.Hour})
+
+	w, err := d.WriteStream("users", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, `{"Name": "alice"}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := d.store.(*fileStorage)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.dirty[filepath.Join(dir, "users", "alice.json")]; !ok {
+		t.Errorf("streamed record is not due for the next sync: %v", s.dirty)
+	}
+}
+
+// TestDurabilityIntervalRetriesFailedSyncs fails a background sync and
+// checks that the paths it could not sync are synced by the next one.
+func TestDurabilityIntervalRetriesFailedSyncs(t *testing.T) {
+	var failing bool
+	fsys := &FaultFS{FS: OSFS{}, Fault: func(op, path string) error {
+		if failing && op == "sync" {
+			return syscall.EIO
+		}
+		return nil
+	}}
+	d, dir := openTestDB(t, &Options{FS: fsys, Durability: DurabilityInterval, SyncInterval: time.Hour})
+	if err := d.Write("users", "alice", User{Name: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := d.store.(*fileStorage)
+	failing = true
+	if err := s.syncDirty(); err == nil {
+		t.Fatal("failing sync succeeded")
+	}
+	path := filepath.Join(dir, "users", "alice.json")
+	if _, ok := s.dirty[path]; !ok {
+		t.Errorf("record whose sync failed is not due for the next sync: %v", s.dirty)
+	}
+
+	failing = false
+	if err := s.syncDirty(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.dirty) != 0 {
+		t.Errorf("paths left to sync after a successful sync: %v", s.dirty)
+	}
+}
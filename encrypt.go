@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// boundPrefix marks a field value encrypted by sealFields. The rest is the
+// base64 of the nonce followed by the AES-GCM sealed JSON value, with the
+// collection, key and field path as additional data so the value cannot be
+// moved to another record or field. sealedPrefix marks values sealed
+// without additional data by earlier versions, which still open.
+const (
+	boundPrefix  = "$enc2:"
+	sealedPrefix = "$enc:"
+)
+
+// ErrNoEncryptionKey is returned when writing to a collection with
+// encrypted fields without Options.EncryptionKey.
+var ErrNoEncryptionKey = errors.New("no encryption key")
+
+// newFieldCipher returns the cipher encrypting fields under key.
+func newFieldCipher(key []byte) cipher.AEAD {
+	fieldKey := sha256.Sum256(append([]byte("field:"), key...))
+
+	block, err := aes.NewCipher(fieldKey[:])
+	if err != nil {
+		panic(err) // unreachable: the key is always 32 bytes
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+// encryptedFields returns the dot paths of the fields of a collection that
+// are stored encrypted. A view keeps those of its source encrypted too.
+func (d *Driver) encryptedFields(collection string) [][]string {
+	if v := d.viewOf(collection); v != nil {
+		collection = v.Source
+	}
+	meta, _ := d.collectionMeta(collection)
+	paths := make([][]string, len(meta.Encrypted))
+	for i, path := range meta.Encrypted {
+		paths[i] = strings.Split(path, ".")
+	}
+	return paths
+}
+
+// fieldData is the additional data sealing the field at path of a record.
+func fieldData(collection, key string, path []string) []byte {
+	return []byte(collection + "\x00" + key + "\x00" + strings.Join(path, "."))
+}
+
+// sealFields encrypts the fields of a record about to be written that its
+// collection stores encrypted, leaving the others in plaintext so they can
+// still be queried.
+func (d *Driver) sealFields(collection, key string, data []byte) ([]byte, error) {
+	paths := d.encryptedFields(collection)
+	if len(paths) == 0 {
+		return data, nil
+	}
+	if d.fields == nil {
+		return nil, fmt.Errorf("could not encrypt fields of collection %s: %w", collection, ErrNoEncryptionKey)
+	}
+
+	return rewriteFields(data, paths, func(path []string, value interface{}) (interface{}, bool, error) {
+		plain, err := json.Marshal(value)
+		if err != nil {
+			return nil, false, err
+		}
+		sealed, err := d.sealValue(plain, fieldData(collection, key, path))
+		if err != nil {
+			return nil, false, fmt.Errorf("could not encrypt field %s: %v", strings.Join(path, "."), err)
+		}
+		return sealed, true, nil
+	})
+}
+
+// resealFields moves the encrypted fields of a record of collection to
+// toKey of toCollection, sealing them again for their new place.
+func (d *Driver) resealFields(collection, key, toCollection, toKey string, data []byte) ([]byte, error) {
+	paths := d.encryptedFields(collection)
+	if len(paths) == 0 {
+		return data, nil
+	}
+	if d.fields == nil {
+		return nil, fmt.Errorf("could not move encrypted fields of collection %s: %w", collection, ErrNoEncryptionKey)
+	}
+
+	return rewriteFields(data, paths, func(path []string, value interface{}) (interface{}, bool, error) {
+		s, ok := value.(string)
+		if !ok || !isSealed(s) {
+			return value, true, nil
+		}
+		plain, err := d.openValue(s, fieldData(collection, key, path))
+		if err != nil {
+			return nil, false, fmt.Errorf("could not decrypt field %s of %s in collection %s: %v", strings.Join(path, "."), key, collection, err)
+		}
+		sealed, err := d.sealValue(plain, fieldData(toCollection, toKey, path))
+		if err != nil {
+			return nil, false, fmt.Errorf("could not encrypt field %s: %v", strings.Join(path, "."), err)
+		}
+		return sealed, true, nil
+	})
+}
+
+// openFields decrypts the encrypted fields of a stored record. Without the
+// encryption key they are left out instead, so they read as empty. Values
+// written before their field was marked encrypted are left as they are.
+func (d *Driver) openFields(collection, key string, data []byte) ([]byte, error) {
+	paths := d.encryptedFields(collection)
+	if len(paths) == 0 {
+		return data, nil
+	}
+
+	return rewriteFields(data, paths, func(path []string, value interface{}) (interface{}, bool, error) {
+		s, ok := value.(string)
+		if !ok || !isSealed(s) {
+			return value, true, nil
+		}
+		if d.fields == nil {
+			return nil, false, nil
+		}
+
+		plain, err := d.openValue(s, fieldData(collection, key, path))
+		if err != nil {
+			return nil, false, fmt.Errorf("could not decrypt field %s of %s in collection %s: %v", strings.Join(path, "."), key, collection, err)
+		}
+		opened, err := decodeDocument(plain)
+		return opened, true, err
+	})
+}
+
+// isSealed reports whether a field value was encrypted by sealFields.
+func isSealed(s string) bool {
+	return strings.HasPrefix(s, boundPrefix) || strings.HasPrefix(s, sealedPrefix)
+}
+
+// sealValue encrypts a field value with its additional data.
+func (d *Driver) sealValue(plain, additional []byte) (string, error) {
+	nonce := make([]byte, d.fields.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := d.fields.Seal(nonce, nonce, plain, additional)
+	return boundPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openValue decrypts a sealed field value. Values sealed without additional
+// data are opened without it.
+func (d *Driver) openValue(s string, additional []byte) ([]byte, error) {
+	encoded, bound := strings.CutPrefix(s, boundPrefix)
+	if !bound {
+		encoded = strings.TrimPrefix(s, sealedPrefix)
+		additional = nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < d.fields.NonceSize() {
+		return nil, errors.New("too short")
+	}
+	nonce, ciphertext := sealed[:d.fields.NonceSize()], sealed[d.fields.NonceSize():]
+	return d.fields.Open(nil, nonce, ciphertext, additional)
+}
+
+// rewriteFields replaces the fields of a record at paths present in it by
+// what fn returns for them, or removes them if fn does not keep them.
+func rewriteFields(data []byte, paths [][]string, fn func(path []string, value interface{}) (interface{}, bool, error)) ([]byte, error) {
+	doc, err := decodeDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := doc.(map[string]interface{}); !ok {
+		return nil, errors.New("record is not a JSON object")
+	}
+
+	for _, path := range paths {
+		parent, ok := lookupField(doc, path[:len(path)-1])
+		obj, isObj := parent.(map[string]interface{})
+		if !ok || !isObj {
+			continue
+		}
+		name := path[len(path)-1]
+		value, ok := obj[name]
+		if !ok {
+			continue
+		}
+		value, keep, err := fn(path, value)
+		if err != nil {
+			return nil, err
+		}
+		if keep {
+			obj[name] = value
+		} else {
+			delete(obj, name)
+		}
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+)
+
+func TestEncryptedFields(t *testing.T) {
+	d, _ := openTestDB(t, &Options{EncryptionKey: []byte("secret")})
+	if err := d.SetCollectionMeta("users", CollectionMeta{Encrypted: []string{"Company", "Address.Street"}}); err != nil {
+		t.Fatal(err)
+	}
+	for key, company := range map[string]string{"alice": "Initech", "bob": "Globex"} {
+		if err := d.Write("users", key, User{Name: key, Company: company, Address: Address{Street: "1 Main St"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stored := func(key string) map[string]interface{} {
+		data, err := d.store.get("users", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte("Initech")) || bytes.Contains(data, []byte("1 Main St")) {
+			t.Fatalf("%s is stored in plaintext: %s", key, data)
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			t.Fatal(err)
+		}
+		return doc
+	}
+	street := func(doc map[string]interface{}) interface{} {
+		return doc["Address"].(map[string]interface{})["Street"]
+	}
+
+	// Values sealed before fields were bound to their record carry no
+	// additional data.
+	plain, _ := json.Marshal("Initech")
+	nonce := make([]byte, d.fields.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		t.Fatal(err)
+	}
+	legacy := sealedPrefix + base64.StdEncoding.EncodeToString(d.fields.Seal(nonce, nonce, plain, nil))
+
+	tests := []struct {
+		name    string
+		company func() interface{}
+		want    string // "" when the read must fail
+	}{
+		{"as written", func() interface{} { return stored("alice")["Company"] }, "Initech"},
+		{"sealed without additional data", func() interface{} { return legacy }, "Initech"},
+		{"moved from another record", func() interface{} { return stored("bob")["Company"] }, ""},
+		{"moved from another field", func() interface{} { return street(stored("alice")) }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := stored("alice")
+			doc["Company"] = tt.company()
+			if err := d.store.put("users", "alice", mustMarshal(t, doc)); err != nil {
+				t.Fatal(err)
+			}
+
+			user, err := d.Read("users", "alice")
+			switch {
+			case tt.want == "" && err == nil:
+				t.Errorf("read succeeded with Company %q", user.Company)
+			case tt.want != "" && err != nil:
+				t.Error(err)
+			case tt.want != "" && user.Company != tt.want:
+				t.Errorf("Company = %q, want %q", user.Company, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeNamesResealsFields(t *testing.T) {
+	d, dir := openTestDB(t, &Options{EncryptionKey: []byte("secret")})
+	if err := d.SetCollectionMeta("users", CollectionMeta{Encrypted: []string{"Company"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Write("users", "Alice", User{Name: "Alice", Company: "Initech"}); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	d, err := New(dir, &Options{
+		EncryptionKey: []byte("secret"),
+		Naming:        &NamingPolicy{FoldCase: true},
+		Slog:          openTestLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if _, err := d.NormalizeNames(false); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := d.Read("users", "alice"); err != nil || user.Company != "Initech" {
+		t.Errorf("renamed record = %+v, %v", user, err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import "time"
+
+// Change describes a record that was written or deleted. Seq is set when
+// the database keeps a change log. Data holds a written record as stored,
+// except for records written with WriteStream, which are only read back
+// for the change log.
+type Change struct {
+	Seq        uint64    `json:"seq,omitempty"`
+	Op         string    `json:"op"`
+	Collection string    `json:"collection"`
+	Key        string    `json:"key"`
+	Time       time.Time `json:"time"`
+	Data       []byte    `json:"data,omitempty"`
+}
+
+// Change operations.
+const (
+	OpWrite  = "write"
+	OpDelete = "delete"
+)
+
+// subscriber is a function registered with subscribe.
+type subscriber struct {
+	fn func(Change)
+}
+
+// subscribe registers fn to be called synchronously after every change,
+// until the returned function is called. Subscribers must not block; hand
+// slow work off to a goroutine.
+func (d *Driver) subscribe(fn func(Change)) (unsubscribe func()) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	s := &subscriber{fn: fn}
+	d.subscribers = append(d.subscribers, s)
+	return func() {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+
+		// emit may be ranging over the current slice, so it is replaced
+		// rather than modified.
+		var kept []*subscriber
+		for _, other := range d.subscribers {
+			if other != s {
+				kept = append(kept, other)
+			}
+		}
+		d.subscribers = kept
+	}
+}
+
+// publish records a change made by this Driver and notifies subscribers.
+// It is called with the collection lock held, so changes to a collection
+// are recorded in the order they were applied.
+func (d *Driver) publish(op, collection, key string, data []byte) {
+	d.emit(Change{Op: op, Collection: collection, Key: key, Time: time.Now(), Data: data})
+}
+
+// changeData returns the record a write stored, reading it back if the
+// change was published without it.
+func (d *Driver) changeData(change Change) ([]byte, error) {
+	if change.Op != OpWrite || change.Data != nil {
+		return change.Data, nil
+	}
+	return d.store.get(change.Collection, change.Key)
+}
+
+// emit appends a change to the change log, if there is one, and hands it to
+// every subscriber.
+func (d *Driver) emit(change Change) {
+	// A change the log fails to record was still made, so subscribers get
+	// it regardless; Health reports the failure. Only changes replicated
+	// twice are dropped.
+	if d.changes != nil {
+		recorded, ok, err := d.changes.append(change)
+		if err != nil {
+			d.log.Error("Could not record change to %s/%s: %v", change.Collection, change.Key, err)
+		} else if !ok {
+			return
+		}
+		if ok {
+			change = recorded
+		}
+	}
+
+	d.mutex.Lock()
+	subscribers := d.subscribers
+	d.mutex.Unlock()
+
+	for _, s := range subscribers {
+		s.fn(change)
+	}
+}
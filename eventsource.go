@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Event is an immutable entry of the stream of a key in an event sourced
+// collection.
+type Event struct {
+	// Seq numbers the events of a key from 1.
+	Seq   uint64    `json:"seq"`
+	Time  time.Time `json:"time"`
+	Value User      `json:"value"`
+}
+
+// eventStream is how the events of a key are stored, as a single record.
+type eventStream struct {
+	Events []Event `json:"events"`
+}
+
+// Reducer folds an event into the state of a key, starting from an empty
+// user. It may be called for several keys at once.
+type Reducer func(state User, event Event) User
+
+// eventSourced reports whether a collection is event sourced.
+func (d *Driver) eventSourced(collection string) bool {
+	meta, _ := d.collectionMeta(collection)
+	return meta.Events
+}
+
+// RegisterReducer sets how the events of a collection are folded into the
+// state Read returns. Without one the latest event is the state.
+func (d *Driver) RegisterReducer(collection string, fn Reducer) error {
+	if err := d.checkNames(&collection); err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.reducers == nil {
+		d.reducers = make(map[string]Reducer)
+	}
+	if _, ok := d.reducers[collection]; ok {
+		return fmt.Errorf("a reducer of collection %s is already registered", collection)
+	}
+	d.reducers[collection] = fn
+	return nil
+}
+
+// appendEvent returns the stream of key with the user in data appended as
+// its next event. It must be called with the collection locked.
+func (d *Driver) appendEvent(collection, key string, data []byte) ([]byte, error) {
+	var stream eventStream
+	current, err := d.store.get(collection, key)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(current, &stream); err != nil {
+			return nil, fmt.Errorf("could not unmarshal events of %s: %v", key, err)
+		}
+	}
+
+	event := Event{Seq: 1, Time: time.Now().UTC()}
+	if n := len(stream.Events); n > 0 {
+		event.Seq = stream.Events[n-1].Seq + 1
+	}
+	if err := json.Unmarshal(data, &event.Value); err != nil {
+		return nil, fmt.Errorf("could not unmarshal data: %v", err)
+	}
+	stream.Events = append(stream.Events, event)
+
+	data, err = json.MarshalIndent(stream, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal events: %v", err)
+	}
+	return data, nil
+}
+
+// fold returns the state of a key folded from its stored stream.
+func (d *Driver) fold(collection, key string, data []byte) ([]byte, error) {
+	var stream eventStream
+	if err := json.Unmarshal(data, &stream); err != nil {
+		return nil, fmt.Errorf("could not unmarshal events of %s in collection %s: %v", key, collection, err)
+	}
+
+	d.mutex.Lock()
+	reduce := d.reducers[collection]
+	d.mutex.Unlock()
+
+	var state User
+	for _, event := range stream.Events {
+		if reduce == nil {
+			state = event.Value
+			continue
+		}
+		state = reduce(state, event)
+	}
+	return json.MarshalIndent(state, "", "  ")
+}
+
+// ReadEvents returns the events of key after the one numbered since, in
+// order; since 0 returns them all.
+func (d *Driver) ReadEvents(collection, key string, since uint64) (_ []Event, err error) {
+	if err := d.checkNames(&collection, &key); err != nil {
+		return nil, err
+	}
+
+	op := d.begin(opReadRange, collection, key)
+	defer op.end(&err)
+
+	if !d.eventSourced(collection) {
+		return nil, fmt.Errorf("collection %s is not event sourced", collection)
+	}
+	data, err := d.readStored(collection, key)
+	if err != nil {
+		return nil, fmt.Errorf("could not read events of %s in collection %s: %w", key, collection, err)
+	}
+	op.bytes = len(data)
+
+	var stream eventStream
+	if err := json.Unmarshal(data, &stream); err != nil {
+		return nil, fmt.Errorf("could not unmarshal events of %s in collection %s: %v", key, collection, err)
+	}
+	events := []Event{}
+	for _, event := range stream.Events {
+		if event.Seq > since {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// errImmutableEvents rejects changing an event stream other than by
+// appending to it with Write.
+func errImmutableEvents(collection string) error {
+	return fmt.Errorf("collection %s is event sourced; events can only be appended with Write", collection)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// expiresField holds the time a record of a collection with a TTL expires.
+const expiresField = "_expires"
+
+const (
+	defaultExpiryInterval  = time.Minute
+	defaultExpiryBatchSize = 100
+)
+
+// ExpiryOptions paces the removal of expired records, so cleanup does not
+// cause I/O spikes.
+type ExpiryOptions struct {
+	// Interval is how often collections with a TTL are swept. Defaults to
+	// one minute.
+	Interval time.Duration
+	// BatchSize is how many expired records a sweep deletes before it
+	// pauses. Defaults to 100.
+	BatchSize int
+	// BatchPause is how long a sweep pauses between batches.
+	BatchPause time.Duration
+}
+
+// errNotExpired is the condition of an expiry delete failing because the
+// record was rewritten since it was found expired.
+var errNotExpired = errors.New("record has not expired")
+
+// stampExpiry sets when a record about to be written expires, if its
+// collection has a TTL. Records written before the collection had a TTL
+// are not stamped and do not expire until they are written again.
+func (d *Driver) stampExpiry(collection string, data []byte) ([]byte, error) {
+	meta, _ := d.collectionMeta(collection)
+	if meta.TTL <= 0 {
+		return data, nil
+	}
+	expires, err := json.Marshal(time.Now().Add(meta.TTL).UTC())
+	if err != nil {
+		return nil, err
+	}
+	return setRecordField(data, expiresField, expires)
+}
+
+// expired reports whether a record's expiry time has passed.
+func expired(data []byte, now time.Time) bool {
+	var stamp struct {
+		Expires *time.Time `json:"_expires"`
+	}
+	if err := json.Unmarshal(data, &stamp); err != nil || stamp.Expires == nil {
+		return false
+	}
+	return !stamp.Expires.After(now)
+}
+
+func (d *Driver) hasTTL() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for _, meta := range d.meta {
+		if meta.TTL > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ExpireNow deletes the expired records of a collection right away, rather
+// than waiting for the background sweep, and returns how many it deleted.
+// Expired records can be read until they are deleted.
+func (d *Driver) ExpireNow(collection string) (int, error) {
+	if err := d.checkNames(&collection); err != nil {
+		return 0, err
+	}
+
+	return d.expire(collection, 0, 0)
+}
+
+// expire deletes the expired records of a collection, pausing for pause
+// after every batch records.
+func (d *Driver) expire(collection string, batch int, pause time.Duration) (int, error) {
+	if err := d.writable(); err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	var keys []string
+	err := d.scanStored(collection, func(key string, data []byte) error {
+		if expired(data, now) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not sweep collection %s: %v", collection, err)
+	}
+
+	var deleted int
+	for i, key := range keys {
+		if batch > 0 && i > 0 && i%batch == 0 && pause > 0 {
+			select {
+			case <-d.stop:
+				return deleted, nil
+			case <-time.After(pause):
+			}
+		}
+
+		err := d.delete(context.Background(), collection, key, func(current []byte) error {
+			if !expired(current, now) {
+				return errNotExpired
+			}
+			return nil
+		})
+		switch {
+		case err == nil:
+			deleted++
+		case errors.Is(err, errNotExpired), errors.Is(err, os.ErrNotExist):
+		default:
+			return deleted, fmt.Errorf("could not expire %s in collection %s: %v", key, collection, err)
+		}
+	}
+
+	if deleted > 0 {
+		d.log.Info("Expired %d records of collection %s", deleted, collection)
+	}
+	return deleted, nil
+}
+
+// startExpiry sweeps the collections with a TTL for expired records
+// periodically, until the Driver is closed.
+func (d *Driver) startExpiry(opts *ExpiryOptions) {
+	if d.opts.ReadOnly {
+		return
+	}
+	var o ExpiryOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.Interval <= 0 {
+		o.Interval = defaultExpiryInterval
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = defaultExpiryBatchSize
+	}
+
+	sweep := func() {
+		d.mutex.Lock()
+		var collections []string
+		for collection, meta := range d.meta {
+			if meta.TTL > 0 {
+				collections = append(collections, collection)
+			}
+		}
+		d.mutex.Unlock()
+
+		sort.Strings(collections)
+		for _, collection := range collections {
+			if _, err := d.expire(collection, o.BatchSize, o.BatchPause); err != nil && !errors.Is(err, ErrFollower) && !errors.Is(err, ErrNotReplicated) {
+				d.log.Error("Expiry failed: %v", err)
+			}
+		}
+	}
+
+	ran := d.background.track("expiry", o.Interval)
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+
+		ticker := time.NewTicker(o.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-d.stop:
+				return
+			case <-ticker.C:
+				sweep()
+				ran()
+			}
+		}
+	}()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestExpiryStampedOnEveryWrite(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+	if err := d.SetCollectionMeta("sessions", CollectionMeta{TTL: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Write("sessions", "written", User{Name: "written"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := d.Begin()
+	tx.Write("sessions", "committed", User{Name: "committed"})
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := d.WriteStream("sessions", "streamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, `{"Name": "streamed"}`)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	later := time.Now().Add(2 * time.Hour)
+	for _, key := range []string{"written", "committed", "streamed"} {
+		data, err := d.store.get("sessions", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expired(data, time.Now()) || !expired(data, later) {
+			t.Errorf("record %s is not stamped to expire in an hour: %s", key, data)
+		}
+	}
+}
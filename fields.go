@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrNoField is returned when a record has no field at the requested path.
+var ErrNoField = errors.New("no such field")
+
+// ReadField returns the value at a dot path, such as Address.City, within
+// the record under key, decoded as JSON with numbers kept as json.Number.
+func (d *Driver) ReadField(collection, key, path string) (_ interface{}, err error) {
+	if err := d.checkNames(&collection, &key); err != nil {
+		return nil, err
+	}
+
+	op := d.begin(opRead, collection, key)
+	defer op.end(&err)
+
+	data, err := d.readRaw(collection, key)
+	if err != nil {
+		return nil, err
+	}
+	op.bytes = len(data)
+
+	doc, err := decodeDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := lookupField(doc, strings.Split(path, "."))
+	if !ok {
+		return nil, fmt.Errorf("%w: %s in %s/%s", ErrNoField, path, collection, key)
+	}
+	return value, nil
+}
+
+func decodeDocument(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("could not unmarshal data: %v", err)
+	}
+	return doc, nil
+}
+
+// updateUser decodes a record and sets the given fields in it, each as a
+// dot path and a value. Legacy string addresses are upgraded first, so
+// setting Address.City keeps the old address as Address.Street.
+func updateUser(data []byte, fields [][2]string) (User, error) {
+	var user User
+	if err := json.Unmarshal(data, &user); err != nil {
+		return User{}, fmt.Errorf("could not unmarshal data: %v", err)
+	}
+	if len(fields) == 0 {
+		return user, nil
+	}
+
+	data, err := json.Marshal(user)
+	if err != nil {
+		return User{}, err
+	}
+	doc, err := decodeDocument(data)
+	if err != nil {
+		return User{}, err
+	}
+	for _, field := range fields {
+		setField(doc.(map[string]interface{}), field[0], parseFieldValue(field[1]))
+	}
+
+	if data, err = json.Marshal(doc); err != nil {
+		return User{}, err
+	}
+	user = User{}
+	if err := json.Unmarshal(data, &user); err != nil {
+		return User{}, fmt.Errorf("invalid field value: %v", err)
+	}
+	return user, nil
+}
+
+// setField sets the value at a dot path within doc, creating intermediate
+// objects and replacing non-object values in the way.
+func setField(doc map[string]interface{}, path string, value interface{}) {
+	names := strings.Split(path, ".")
+	for _, name := range names[:len(names)-1] {
+		next, ok := doc[name].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			doc[name] = next
+		}
+		doc = next
+	}
+	doc[names[len(names)-1]] = value
+}
+
+// parseFieldValue reads a value given on the command line: JSON literals
+// (numbers, true, false, null, quoted strings, objects) as such, anything
+// else as a plain string.
+func parseFieldValue(s string) interface{} {
+	if value, err := decodeDocument([]byte(s)); err == nil {
+		return value
+	}
+	return s
+}
+
+// Increment atomically adds delta to the integer at a dot path within the
+// record under key and returns the new value. A missing record is created
+// as an empty user and a missing field counts from zero; the field must be
+// one a user has.
+func (d *Driver) Increment(collection, key, path string, delta int64) (value int64, err error) {
+	if err := d.checkNames(&collection, &key); err != nil {
+		return 0, err
+	}
+
+	op := d.begin(opWrite, collection, key)
+	defer op.end(&err)
+
+	if err := d.writable(); err != nil {
+		return 0, err
+	}
+	if kind, ok := d.crdtKind(collection); ok {
+		return 0, fmt.Errorf("collection %s holds %s CRDTs; use MergeCRDT", collection, kind)
+	}
+	if _, ok := d.timeSeries(collection); ok {
+		return 0, fmt.Errorf("collection %s is a time series; use AppendPoint", collection)
+	}
+	if d.eventSourced(collection) {
+		return 0, errImmutableEvents(collection)
+	}
+	if err := d.checkNotView(collection); err != nil {
+		return 0, err
+	}
+
+	// The record is only known under the collection lock, which hooks run
+	// outside of, so Before sees none; After sees the record stored.
+	hook := &HookOp{Op: OpWrite, Collection: collection, Key: key}
+	defer func() { d.after(hook, err) }()
+	if err := d.before(hook); err != nil {
+		return 0, err
+	}
+
+	d.gate.RLock()
+	defer d.gate.RUnlock()
+
+	for _, name := range d.writeLocks(collection) {
+		mutex := d.getOrCreateMutex(name)
+		mutex.Lock()
+		defer mutex.Unlock()
+	}
+
+	data, err := d.store.get(collection, key)
+	if errors.Is(err, os.ErrNotExist) {
+		data, err = json.Marshal(User{})
+	} else if err == nil {
+		if data, _, err = d.upgrade(collection, key, data); err == nil {
+			data, err = d.openFields(collection, key, data)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	doc, err := decodeDocument(data)
+	if err != nil {
+		return 0, err
+	}
+	names := strings.Split(path, ".")
+	if current, ok := lookupField(doc, names); ok && current != nil {
+		number, isNumber := current.(json.Number)
+		if value, err = number.Int64(); !isNumber || err != nil {
+			return 0, fmt.Errorf("field %s of %s in collection %s is not an integer", path, key, collection)
+		}
+	}
+	value += delta
+	setField(doc.(map[string]interface{}), path, json.Number(strconv.FormatInt(value, 10)))
+
+	// Round trip through User, as Write stores it, and check the field
+	// survived.
+	if data, err = json.Marshal(doc); err != nil {
+		return 0, fmt.Errorf("could not marshal data: %v", err)
+	}
+	var user User
+	if err := json.Unmarshal(data, &user); err != nil {
+		return 0, fmt.Errorf("invalid field value: %v", err)
+	}
+	if data, err = json.MarshalIndent(user, "", "  "); err != nil {
+		return 0, fmt.Errorf("could not marshal data: %v", err)
+	}
+	hook.Data = data
+	if stored, err := decodeDocument(data); err != nil {
+		return 0, err
+	} else if _, ok := lookupField(stored, names); !ok {
+		return 0, fmt.Errorf("%w: %s in %s/%s", ErrNoField, path, collection, key)
+	}
+
+	if data, err = d.stampVersion(collection, data); err != nil {
+		return 0, err
+	}
+	if data, err = d.stampExpiry(collection, data); err != nil {
+		return 0, err
+	}
+	if data, err = d.stampModified(collection, data); err != nil {
+		return 0, err
+	}
+	if data, err = d.sealFields(collection, key, data); err != nil {
+		return 0, err
+	}
+	if err := d.checkReferences(collection, key, data, d.stored); err != nil {
+		return 0, err
+	}
+	if err := d.put(collection, key, data); err != nil {
+		return 0, err
+	}
+	op.bytes = len(data)
+
+	if d.redacts(collection, path) {
+		d.log.Info("Incremented %s of %s in collection %s", path, key, collection)
+	} else {
+		d.log.Info("Incremented %s of %s in collection %s to %d", path, key, collection, value)
+	}
+	d.publish(OpWrite, collection, key, data)
+	return value, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestIncrement(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+
+	// A missing record and field count from zero.
+	if n, err := d.Increment("users", "ann", "Age", 5); err != nil || n != 5 {
+		t.Fatalf("Increment of a missing record = %d, %v, want 5", n, err)
+	}
+	if n, err := d.Increment("users", "ann", "Age", -2); err != nil || n != 3 {
+		t.Errorf("Increment = %d, %v, want 3", n, err)
+	}
+	if n, err := d.Increment("users", "ann", "Address.Pincode", 411001); err != nil || n != 411001 {
+		t.Errorf("Increment of a nested field = %d, %v, want 411001", n, err)
+	}
+	user, err := d.Read("users", "ann")
+	if err != nil || user.Age != "3" || user.Address.Pincode != "411001" {
+		t.Errorf("read = %+v, %v", user, err)
+	}
+
+	if err := d.Write("users", "bob", User{Name: "Bob", Age: "40"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Increment("users", "bob", "Name", 1); err == nil {
+		t.Error("Increment of a string field succeeded")
+	}
+	if _, err := d.Increment("users", "bob", "Salary", 1); !errors.Is(err, ErrNoField) {
+		t.Errorf("Increment of a field users do not have = %v, want ErrNoField", err)
+	}
+	if user, err := d.Read("users", "bob"); err != nil || user.Name != "Bob" || user.Age != "40" {
+		t.Errorf("failed increments changed the record: %+v, %v", user, err)
+	}
+}
+
+func TestIncrementConcurrent(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+	const callers, each = 8, 25
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < each; j++ {
+				if _, err := d.Increment("counters", "hits", "Age", 1); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n, err := d.Increment("counters", "hits", "Age", 0); err != nil || n != callers*each {
+		t.Errorf("counter = %d, %v, want %d", n, err, callers*each)
+	}
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FS is the filesystem the file engine keeps records, checksums and
+// collection configuration in, and time series their segments. Paths are
+// operating system paths, as with package os, and errors for missing files
+// satisfy os.IsNotExist. Transactions are journaled and streamed records
+// spooled in it too. The lock and the files of the change log, clusters,
+// remote sync and the pause handshake stay on the operating system's
+// filesystem.
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	ReadFile(name string) ([]byte, error)
+	ReadDir(name string) ([]os.DirEntry, error)
+	Stat(name string) (os.FileInfo, error)
+	MkdirAll(path string, perm os.FileMode) error
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+}
+
+// File is a file opened by an FS.
+type File interface {
+	io.Reader
+	io.Writer
+	io.Closer
+	Sync() error
+}
+
+// writeFile is os.WriteFile on an FS.
+func writeFile(fsys FS, name string, data []byte, perm os.FileMode) error {
+	return writeFileSync(fsys, name, data, perm, false)
+}
+
+// writeFileSync is writeFile, syncing the file before closing it if sync is
+// set.
+func writeFileSync(fsys FS, name string, data []byte, perm os.FileMode, sync bool) error {
+	file, err := fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil && sync {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// onDisk reports whether fsys keeps its files on the operating system's
+// filesystem, possibly through retries or injected faults.
+func onDisk(fsys FS) bool {
+	for {
+		switch f := fsys.(type) {
+		case OSFS:
+			return true
+		case *retryFS:
+			fsys = f.FS
+		case *FaultFS:
+			fsys = f.FS
+		default:
+			return false
+		}
+	}
+}
+
+// diskOption returns the name of the first option set in opts that keeps
+// files on the operating system's filesystem whatever Options.FS is, or ""
+// if there is none.
+func diskOption(opts Options) string {
+	switch {
+	case opts.ChangeLog:
+		return "ChangeLog"
+	case opts.Cluster != nil:
+		return "Cluster"
+	case opts.Sync != nil:
+		return "Sync"
+	case opts.ExternalLock.PollInterval > 0:
+		return "ExternalLock"
+	}
+	return ""
+}
+
+// OSFS is the operating system's filesystem, the default FS.
+type OSFS struct{}
+
+func (OSFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// A nil *os.File must not become a non-nil File.
+		return nil, err
+	}
+	return file, nil
+}
+
+func (OSFS) ReadFile(name string) ([]byte, error)       { return os.ReadFile(name) }
+func (OSFS) ReadDir(name string) ([]os.DirEntry, error) { return os.ReadDir(name) }
+func (OSFS) Stat(name string) (os.FileInfo, error)      { return os.Stat(name) }
+func (OSFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+func (OSFS) Remove(name string) error             { return os.Remove(name) }
+func (OSFS) Rename(oldpath, newpath string) error { return os.Rename(oldpath, newpath) }
+
+// FaultFS wraps an FS, failing the operations Fault returns an error for,
+// to test how a Driver copes with a full or failing disk:
+//
+//	fsys := &FaultFS{FS: OSFS{}, Fault: func(op, path string) error {
+//		if op == "write" {
+//			return syscall.ENOSPC
+//		}
+//		return nil
+//	}}
+type FaultFS struct {
+	FS
+	// Fault is called before every operation with its name, one of open,
+	// read, write, sync, close, readfile, readdir, stat, mkdir, remove and
+	// rename, and the path it is on. A non-nil error fails the operation.
+	Fault func(op, path string) error
+}
+
+func (f *FaultFS) fault(op, path string) error {
+	if f.Fault == nil {
+		return nil
+	}
+	if err := f.Fault(op, path); err != nil {
+		return &os.PathError{Op: op, Path: path, Err: err}
+	}
+	return nil
+}
+
+func (f *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if err := f.fault("open", name); err != nil {
+		return nil, err
+	}
+	file, err := f.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: f, name: name}, nil
+}
+
+func (f *FaultFS) ReadFile(name string) ([]byte, error) {
+	if err := f.fault("readfile", name); err != nil {
+		return nil, err
+	}
+	return f.FS.ReadFile(name)
+}
+
+func (f *FaultFS) ReadDir(name string) ([]os.DirEntry, error) {
+	if err := f.fault("readdir", name); err != nil {
+		return nil, err
+	}
+	return f.FS.ReadDir(name)
+}
+
+func (f *FaultFS) Stat(name string) (os.FileInfo, error) {
+	if err := f.fault("stat", name); err != nil {
+		return nil, err
+	}
+	return f.FS.Stat(name)
+}
+
+func (f *FaultFS) MkdirAll(path string, perm os.FileMode) error {
+	if err := f.fault("mkdir", path); err != nil {
+		return err
+	}
+	return f.FS.MkdirAll(path, perm)
+}
+
+func (f *FaultFS) Remove(name string) error {
+	if err := f.fault("remove", name); err != nil {
+		return err
+	}
+	return f.FS.Remove(name)
+}
+
+func (f *FaultFS) Rename(oldpath, newpath string) error {
+	if err := f.fault("rename", oldpath); err != nil {
+		return err
+	}
+	return f.FS.Rename(oldpath, newpath)
+}
+
+type faultFile struct {
+	File
+	fs   *FaultFS
+	name string
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if err := f.fs.fault("read", f.name); err != nil {
+		return 0, err
+	}
+	return f.File.Read(p)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	if err := f.fs.fault("write", f.name); err != nil {
+		return 0, err
+	}
+	return f.File.Write(p)
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.fs.fault("sync", f.name); err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
+
+func (f *faultFile) Close() error {
+	if err := f.fs.fault("close", f.name); err != nil {
+		f.File.Close()
+		return err
+	}
+	return f.File.Close()
+}
+
+// memFS is an FS held in memory.
+type memFS struct {
+	mutex sync.Mutex
+	nodes map[string]*memNode
+}
+
+type memNode struct {
+	dir     bool
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+}
+
+var (
+	errIsDir    = errors.New("is a directory")
+	errNotDir   = errors.New("not a directory")
+	errNotEmpty = errors.New("directory not empty")
+)
+
+// NewMemFS returns an empty in-memory FS, for tests and throwaway
+// databases. Nothing survives the process.
+func NewMemFS() FS {
+	return &memFS{nodes: make(map[string]*memNode)}
+}
+
+// node returns the node at a cleaned path. Roots always exist.
+func (m *memFS) node(name string) (*memNode, bool) {
+	if n, ok := m.nodes[name]; ok {
+		return n, true
+	}
+	if name == "." || filepath.Dir(name) == name {
+		return &memNode{dir: true, mode: 0755}, true
+	}
+	return nil, false
+}
+
+// parent checks the directory holding name exists.
+func (m *memFS) parent(op, name string) error {
+	parent, ok := m.node(filepath.Dir(name))
+	if !ok {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	if !parent.dir {
+		return &os.PathError{Op: op, Path: name, Err: errNotDir}
+	}
+	return nil
+}
+
+// touch updates the modification time of the directory holding name, as
+// adding or removing an entry does on a real filesystem.
+func (m *memFS) touch(name string) {
+	if parent, ok := m.nodes[filepath.Dir(name)]; ok {
+		parent.modTime = time.Now()
+	}
+}
+
+func (m *memFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	name = filepath.Clean(name)
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	n, ok := m.node(name)
+	switch {
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !ok:
+		if err := m.parent("open", name); err != nil {
+			return nil, err
+		}
+		n = &memNode{mode: perm.Perm(), modTime: time.Now()}
+		m.nodes[name] = n
+		m.touch(name)
+	case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case n.dir && writable:
+		return nil, &os.PathError{Op: "open", Path: name, Err: errIsDir}
+	}
+	if flag&os.O_TRUNC != 0 && writable {
+		n.data, n.modTime = nil, time.Now()
+	}
+	return &memFile{fs: m, node: n, name: name, flag: flag}, nil
+}
+
+func (m *memFS) ReadFile(name string) ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	n, ok := m.node(filepath.Clean(name))
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	if n.dir {
+		return nil, &os.PathError{Op: "read", Path: name, Err: errIsDir}
+	}
+	return append([]byte(nil), n.data...), nil
+}
+
+func (m *memFS) ReadDir(name string) ([]os.DirEntry, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	name = filepath.Clean(name)
+	n, ok := m.node(name)
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	if !n.dir {
+		return nil, &os.PathError{Op: "readdirent", Path: name, Err: errNotDir}
+	}
+
+	var entries []os.DirEntry
+	for path, child := range m.nodes {
+		if path != name && filepath.Dir(path) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(memInfo{name: filepath.Base(path), node: *child}))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (m *memFS) Stat(name string) (os.FileInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	name = filepath.Clean(name)
+	n, ok := m.node(name)
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return memInfo{name: filepath.Base(name), node: *n}, nil
+}
+
+func (m *memFS) MkdirAll(path string, perm os.FileMode) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	path = filepath.Clean(path)
+	var missing []string
+	for dir := path; ; dir = filepath.Dir(dir) {
+		n, ok := m.node(dir)
+		if ok && !n.dir {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: errNotDir}
+		}
+		if ok {
+			break
+		}
+		missing = append(missing, dir)
+	}
+	for _, dir := range missing {
+		m.nodes[dir] = &memNode{dir: true, mode: perm.Perm(), modTime: time.Now()}
+		m.touch(dir)
+	}
+	return nil
+}
+
+func (m *memFS) Remove(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	name = filepath.Clean(name)
+	n, ok := m.nodes[name]
+	if !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if n.dir {
+		for path := range m.nodes {
+			if filepath.Dir(path) == name && path != name {
+				return &os.PathError{Op: "remove", Path: name, Err: errNotEmpty}
+			}
+		}
+	}
+	delete(m.nodes, name)
+	m.touch(name)
+	return nil
+}
+
+func (m *memFS) Rename(oldpath, newpath string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	n, ok := m.nodes[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	if err := m.parent("rename", newpath); err != nil {
+		return err
+	}
+	if target, ok := m.nodes[newpath]; ok && target.dir != n.dir {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errIsDir}
+	}
+	if oldpath == newpath {
+		return nil
+	}
+
+	delete(m.nodes, oldpath)
+	m.nodes[newpath] = n
+	m.touch(oldpath)
+	m.touch(newpath)
+	if n.dir {
+		prefix := oldpath + string(filepath.Separator)
+		for path, child := range m.nodes {
+			if strings.HasPrefix(path, prefix) {
+				delete(m.nodes, path)
+				m.nodes[filepath.Join(newpath, strings.TrimPrefix(path, prefix))] = child
+			}
+		}
+	}
+	return nil
+}
+
+// memFile is a file opened by a memFS. Like an open file descriptor it
+// keeps referring to its node after the path is removed or renamed.
+type memFile struct {
+	fs     *memFS
+	node   *memNode
+	name   string
+	flag   int
+	offset int
+	closed bool
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	switch {
+	case f.closed:
+		return 0, os.ErrClosed
+	case f.node.dir:
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: errIsDir}
+	case f.flag&os.O_WRONLY != 0:
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: os.ErrPermission}
+	case f.offset >= len(f.node.data):
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[f.offset:])
+	f.offset += n
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	switch {
+	case f.closed:
+		return 0, os.ErrClosed
+	case f.flag&(os.O_WRONLY|os.O_RDWR) == 0:
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = len(f.node.data)
+	}
+	if end := f.offset + len(p); end > len(f.node.data) {
+		f.node.data = append(f.node.data, make([]byte, end-len(f.node.data))...)
+	}
+	copy(f.node.data[f.offset:], p)
+	f.offset += len(p)
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Sync() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+// memInfo describes a node of a memFS.
+type memInfo struct {
+	name string
+	node memNode
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return int64(len(i.node.data)) }
+func (i memInfo) ModTime() time.Time { return i.node.modTime }
+func (i memInfo) IsDir() bool        { return i.node.dir }
+func (i memInfo) Sys() interface{}   { return nil }
+
+func (i memInfo) Mode() os.FileMode {
+	if i.node.dir {
+		return os.ModeDir | i.node.mode
+	}
+	return i.node.mode
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// TestMemFSKeepsNothingOnDisk uses a database on an in-memory FS and checks
+// that nothing was created on disk where it lives.
+func TestMemFSKeepsNothingOnDisk(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "db")
+	d, err := New(dir, &Options{FS: NewMemFS(), Slog: openTestLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Write("users", "alice", User{Name: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	w, err := d.WriteStream("users", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, `{"Name": "bob"}`)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tx := d.Begin()
+	tx.Write("users", "carol", User{Name: "carol"})
+	tx.Delete("users", "alice")
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tenant, err := d.OpenTenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tenant.Write("users", "dave", User{Name: "dave"}); err != nil {
+		t.Fatal(err)
+	}
+	if users, err := d.ReadAll("users"); err != nil || len(users) != 2 {
+		t.Errorf("ReadAll = %d users, %v; want 2", len(users), err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("in-memory database created %s on disk", entry.Name())
+	}
+}
+
+func TestMemFSRejectsDiskOptions(t *testing.T) {
+	for _, opts := range []Options{
+		{ChangeLog: true},
+		{Engine: EngineLog},
+		{Sync: &SyncOptions{}},
+	} {
+		opts.FS = NewMemFS()
+		opts.Slog = openTestLogger()
+		if d, err := New(filepath.Join(t.TempDir(), "db"), &opts); err == nil {
+			d.Close()
+			t.Errorf("opening an in-memory database with %+v succeeded", opts)
+		}
+	}
+}
+
+// TestFaultFSFailsWrites fails every write to disk and checks that writes
+// report it and leave the record they would replace intact.
+func TestFaultFSFailsWrites(t *testing.T) {
+	var full bool
+	fsys := &FaultFS{FS: OSFS{}, Fault: func(op, path string) error {
+		if full && op == "write" {
+			return syscall.ENOSPC
+		}
+		return nil
+	}}
+	d, _ := openTestDB(t, &Options{FS: fsys})
+	if err := d.Write("users", "alice", User{Name: "alice", Company: "Initech"}); err != nil {
+		t.Fatal(err)
+	}
+
+	full = true
+	if err := d.Write("users", "alice", User{Name: "alice", Company: "Globex"}); err == nil {
+		t.Error("write to a full disk succeeded")
+	}
+	full = false
+	if user, err := d.Read("users", "alice"); err != nil || user.Company != "Initech" {
+		t.Errorf("read after failed write = %+v, %v; want the record written before", user, err)
+	}
+}
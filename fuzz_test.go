@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"unicode/utf8"
+)
+
+// FuzzKeys checks that a key is either rejected or stored in a file of its
+// collection under exactly that name, and reads back as written.
+func FuzzKeys(f *testing.F) {
+	for _, key := range []string{"alice", "", ".", "..", "../x", `..\x`, "a/b", "_meta", "a\x00b", "key.json", "Ω", " x "} {
+		f.Add(key)
+	}
+	d, dir := openTestDB(f, nil)
+
+	f.Fuzz(func(t *testing.T, key string) {
+		if err := d.Write("users", key, User{Name: key}); err != nil {
+			return
+		}
+		defer d.Delete("users", key)
+
+		path := filepath.Join(dir, "users", key+".json")
+		if filepath.Dir(path) != filepath.Join(dir, "users") {
+			t.Fatalf("key %q is stored outside its collection at %s", key, path)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("key %q: %v", key, err)
+		}
+		user, err := d.Read("users", key)
+		if err != nil {
+			t.Fatalf("could not read back key %q: %v", key, err)
+		}
+		if utf8.ValidString(key) && user.Name != key {
+			t.Fatalf("key %q read back %q", key, user.Name)
+		}
+		keys, err := d.Keys("users")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Contains(keys, key) {
+			t.Fatalf("key %q is missing from %q", key, keys)
+		}
+	})
+}
+
+// FuzzReadCorrupt checks that reading a damaged record file fails cleanly,
+// and that whatever reads successfully writes back and then stays stable.
+func FuzzReadCorrupt(f *testing.F) {
+	for _, data := range []string{
+		`{"Name": "Alice", "Age": 30, "Address": {"City": "Pune"}}`,
+		`{"Name": "Alice", "Address": "12 Main Street"}`,
+		`{"Name": "Alice", "Age": "thirty"}`,
+		`{"Name": "Alice", "Age": 30`,
+		`[1, 2, 3]`,
+		`null`,
+		"",
+		"\x00\xff",
+	} {
+		f.Add([]byte(data))
+	}
+	d, dir := openTestDB(f, nil)
+	if err := d.Write("users", "alice", User{Name: "Alice"}); err != nil {
+		f.Fatal(err)
+	}
+	path := filepath.Join(dir, "users", "alice.json")
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		user, err := d.Read("users", "alice")
+		if err != nil {
+			return
+		}
+		var written []User
+		for range 2 {
+			if err := d.Write("users", "alice", user); err != nil {
+				t.Fatalf("could not write back %+v read from %q: %v", user, data, err)
+			}
+			if user, err = d.Read("users", "alice"); err != nil {
+				t.Fatalf("could not read back a record written from %q: %v", data, err)
+			}
+			written = append(written, user)
+		}
+		if !reflect.DeepEqual(written[0], written[1]) {
+			t.Fatalf("%q wrote back as %+v, then as %+v", data, written[0], written[1])
+		}
+	})
+}
+
+// FuzzLogEntry checks that decoding a log entry from memory and from a
+// stream agree, and that decoded entries encode back to the same bytes.
+func FuzzLogEntry(f *testing.F) {
+	put := encodeLogEntry(logPut, "alice", []byte(`{"Name": "Alice"}`))
+	f.Add(put)
+	f.Add(encodeLogEntry(logDelete, "alice", nil))
+	f.Add(put[:len(put)-1])
+	f.Add(append(put, put...))
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		kind, key, value, size, err := decodeLogEntry(buf)
+		streamKind, streamKey, streamValue, streamSize, streamErr := readLogEntry(bufio.NewReader(bytes.NewReader(buf)))
+
+		if (err == nil) != (streamErr == nil) {
+			t.Fatalf("decodeLogEntry returned %v but readLogEntry %v", err, streamErr)
+		}
+		if err != nil {
+			return
+		}
+		if kind != streamKind || key != streamKey || !bytes.Equal(value, streamValue) || size != streamSize {
+			t.Fatalf("decodeLogEntry and readLogEntry disagree on %q", buf)
+		}
+		if !bytes.Equal(encodeLogEntry(kind, key, value), buf[:size]) {
+			t.Fatalf("entry %q does not encode back to itself", buf[:size])
+		}
+	})
+}
+
+// FuzzParseQuery checks that a query either parses and runs or fails with a
+// QueryError that can point at the offending text.
+func FuzzParseQuery(f *testing.F) {
+	for _, expr := range []string{
+		`Age > 30`,
+		`Age > 30 && (Company == "acme" || !(Address == null))`,
+		`Address.City == "Pune"`,
+		`Name == "multi\nline"`,
+		`Age >`,
+		`(Age > 30`,
+		"Age > 30 &&\n  Compny ==",
+		`"unterminated`,
+	} {
+		f.Add(expr)
+	}
+	record := []byte(`{"Name": "Alice", "Age": 30, "Company": "acme", "Address": {"City": "Pune"}}`)
+
+	f.Fuzz(func(t *testing.T, expr string) {
+		q, err := ParseQuery(expr)
+		if err != nil {
+			var queryErr *QueryError
+			if !errors.As(err, &queryErr) {
+				t.Fatalf("ParseQuery(%q) returned %T, not a QueryError", expr, err)
+			}
+			queryErr.Pointer()
+			return
+		}
+		q.Match(record)
+	})
+}
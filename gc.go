@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// GCReport lists what GC removed, as paths relative to the directory
+// holding them.
+type GCReport struct {
+	// Collections are the empty collections whose directories were removed.
+	Collections []string `json:"collections"`
+	// Files are orphaned temporary files, checksums of missing records,
+	// stale lock files, deduplicated bodies no record holds any more and
+	// key manifests of collections that are gone.
+	Files []string `json:"files"`
+}
+
+func (r *GCReport) String() string {
+	return fmt.Sprintf("removed %d empty collections, %d stale files", len(r.Collections), len(r.Files))
+}
+
+// emptyDropper is implemented by storage engines keeping a file per
+// collection that outlives its last record.
+type emptyDropper interface {
+	// dropEmpty removes the storage of a collection if it holds no
+	// records.
+	dropEmpty(collection string) error
+}
+
+// GC removes what the database no longer needs: the directories of
+// collections without records or configuration, temporary files left by
+// interrupted writes, compactions and snapshots, checksums of records that
+// are gone, bodies stored by Options.Dedup that no record holds any more,
+// key manifests of collections that are gone, and stale pause
+// acknowledgements. Writes are held back meanwhile. Deleting the last
+// record of a collection removes its directory already; GC catches the
+// rest, such as directories emptied by a crash.
+func (d *Driver) GC() (*GCReport, error) {
+	if err := d.writable(); err != nil {
+		return nil, err
+	}
+
+	resume := d.Pause()
+	defer resume()
+
+	report := &GCReport{Collections: []string{}, Files: []string{}}
+
+	// No pause is being served while writes are held back by this one, so
+	// an acknowledgement left in the directory is from a crashed Driver.
+	if removeStale(filepath.Join(d.dir, pauseAckFile)) {
+		report.Files = append(report.Files, pauseAckFile)
+	}
+	if d.memory != "" && d.opts.Memory != nil && removeStale(d.opts.Memory.Path+".tmp") {
+		report.Files = append(report.Files, filepath.Base(d.opts.Memory.Path)+".tmp")
+	}
+
+	collections, err := d.Collections()
+	if err != nil {
+		return report, err
+	}
+	roots := []string{d.dir}
+	if s, ok := d.store.(externalStore); ok {
+		if sharded, ok := s.Store.(*ShardedStore); ok {
+			roots = append(roots, sharded.Dirs()...)
+		}
+	}
+
+	for _, collection := range collections {
+		if dropper, ok := d.store.(emptyDropper); ok {
+			if err := dropper.dropEmpty(collection); err != nil {
+				return report, fmt.Errorf("could not collect collection %s: %v", collection, err)
+			}
+		}
+
+		removed := false
+		for _, root := range roots {
+			// Shards are always on the operating system's filesystem.
+			fsys := d.fs
+			if root != d.dir {
+				fsys = OSFS{}
+			}
+			files, err := collectDir(fsys, filepath.Join(root, collection))
+			if err != nil {
+				return report, fmt.Errorf("could not collect collection %s: %v", collection, err)
+			}
+			for _, file := range files {
+				report.Files = append(report.Files, filepath.Join(collection, file))
+			}
+			if fsys.Remove(filepath.Join(root, collection)) == nil {
+				removed = true
+			}
+		}
+		if removed {
+			report.Collections = append(report.Collections, collection)
+		}
+	}
+
+	if s, ok := d.store.(*fileStorage); ok {
+		blobs, err := s.collectBlobs()
+		report.Files = append(report.Files, blobs...)
+		if err != nil {
+			return report, err
+		}
+		kept := slices.DeleteFunc(collections, func(c string) bool { return slices.Contains(report.Collections, c) })
+		manifests, err := s.collectManifests(kept)
+		report.Files = append(report.Files, manifests...)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	if len(report.Collections) > 0 || len(report.Files) > 0 {
+		d.log.Info("Garbage collected: %s", report)
+	}
+	return report, nil
+}
+
+// collectDir removes the orphaned files of a collection directory, and the
+// fan-out directories left empty, and returns their names.
+func collectDir(fsys FS, dir string) ([]string, error) {
+	entries, err := fsys.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, entry := range entries {
+		name := entry.Name()
+		orphan := false
+		switch {
+		case entry.IsDir() && isFanOutDir(name):
+			files, err := collectDir(fsys, filepath.Join(dir, name))
+			if err != nil {
+				return removed, err
+			}
+			for _, file := range files {
+				removed = append(removed, filepath.Join(name, file))
+			}
+			fsys.Remove(filepath.Join(dir, name))
+		case strings.HasSuffix(name, compactSuffix), strings.HasSuffix(name, ".tmp"):
+			orphan = true
+		case strings.HasSuffix(name, checksumExt):
+			_, err := fsys.Stat(filepath.Join(dir, strings.TrimSuffix(name, checksumExt)))
+			orphan = os.IsNotExist(err)
+		}
+		if orphan && fsys.Remove(filepath.Join(dir, name)) == nil {
+			removed = append(removed, name)
+		}
+	}
+	return removed, nil
+}
+
+// removeStale removes a file if it exists, and reports whether it did.
+func removeStale(path string) bool {
+	return os.Remove(path) == nil
+}
+
+// removeIfEmpty removes a collection directory, and the fan-out directories
+// in it, once its last record is gone. One holding anything else, such as
+// its configuration, stays.
+func (s *fileStorage) removeIfEmpty(collection, dir string) error {
+	if !s.layout.removeEmptyDirs(s.fs, s.dir, collection, dir) {
+		return nil
+	}
+	return s.persist(s.dir)
+}
+
+func (s *logStorage) dropEmpty(collection string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.bulk[collection] {
+		return nil
+	}
+	path := filepath.Join(s.dir, collection, logFileName)
+	c, open := s.collections[collection]
+	if !open {
+		if _, err := os.Stat(path); err != nil {
+			return nil
+		}
+		var err error
+		if c, err = openLogCollection(path, s.mmap, s.layout, s.readOnly); err != nil {
+			return err
+		}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if len(c.index) > 0 {
+		if !open {
+			c.shut()
+		}
+		return nil
+	}
+	if err := c.shut(); err != nil {
+		return fmt.Errorf("could not close log: %v", err)
+	}
+	delete(s.collections, collection)
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("could not remove log: %v", err)
+	}
+	return nil
+}
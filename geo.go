@@ -0,0 +1,459 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// geohashPrecision is the length of the geohashes locations are
+	// indexed by, about 4cm across.
+	geohashPrecision = 12
+	// geoMaxCells bounds how many geohash cells a query looks up; larger
+	// areas are covered by coarser cells.
+	geoMaxCells   = 32
+	earthRadiusKm = 6371.0088
+)
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// GeoPoint is a location in degrees.
+type GeoPoint struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// GeoResult is a record found by Near or WithinBox.
+type GeoResult struct {
+	Key      string   `json:"key"`
+	Value    User     `json:"value"`
+	Location GeoPoint `json:"location"`
+	// DistanceKm is the distance from the point Near searched around.
+	DistanceKm float64 `json:"distanceKm,omitempty"`
+}
+
+// geoIndex holds the locations in a field of the records of a collection,
+// sorted by geohash so that the records in a geohash cell are a range.
+type geoIndex struct {
+	mutex   sync.RWMutex
+	entries []geoEntry
+	hashes  map[string]string
+}
+
+type geoEntry struct {
+	hash string
+	key  string
+}
+
+// hasGeo reports whether any collection indexes locations for Near and
+// WithinBox.
+func (d *Driver) hasGeo() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for _, meta := range d.meta {
+		if len(meta.Geo) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Near returns the records of a collection whose location in field, one of
+// CollectionMeta.Geo, is within radiusKm of (lat, lon), nearest first.
+func (d *Driver) Near(collection, field string, lat, lon, radiusKm float64) (_ []GeoResult, err error) {
+	if err := d.checkNames(&collection); err != nil {
+		return nil, err
+	}
+
+	op := d.begin(opQuery, collection, "")
+	defer op.end(&err)
+
+	if err := checkGeoPoint(lat, lon); err != nil {
+		return nil, err
+	}
+	if radiusKm < 0 {
+		return nil, fmt.Errorf("negative radius %g", radiusKm)
+	}
+
+	// The box around the circle, as wide as its widest parallel.
+	center := GeoPoint{Lat: lat, Lon: lon}
+	dLat := radiusKm / earthRadiusKm * 180 / math.Pi
+	minLat, maxLat := math.Max(lat-dLat, -90), math.Min(lat+dLat, 90)
+	boxes := [][4]float64{{minLat, -180, maxLat, 180}}
+	if maxLat < 90 && minLat > -90 {
+		widest := math.Max(math.Abs(minLat), math.Abs(maxLat))
+		if dLon := dLat / math.Cos(widest*math.Pi/180); dLon < 180 {
+			boxes = lonBoxes(minLat, lon-dLon, maxLat, lon+dLon)
+		}
+	}
+
+	results, err := d.geoSearch(op, collection, field, boxes, func(p GeoPoint) bool {
+		return distanceKm(center, p) <= radiusKm
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range results {
+		results[i].DistanceKm = distanceKm(center, results[i].Location)
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].DistanceKm < results[j].DistanceKm })
+	return results, nil
+}
+
+// WithinBox returns the records of a collection whose location in field,
+// one of CollectionMeta.Geo, is within the box from the south-west corner
+// (minLat, minLon) to the north-east one (maxLat, maxLon), in key order.
+// A box with minLon greater than maxLon crosses the antimeridian.
+func (d *Driver) WithinBox(collection, field string, minLat, minLon, maxLat, maxLon float64) (_ []GeoResult, err error) {
+	if err := d.checkNames(&collection); err != nil {
+		return nil, err
+	}
+
+	op := d.begin(opQuery, collection, "")
+	defer op.end(&err)
+
+	if err := checkGeoPoint(minLat, minLon); err != nil {
+		return nil, err
+	}
+	if err := checkGeoPoint(maxLat, maxLon); err != nil {
+		return nil, err
+	}
+	if minLat > maxLat {
+		return nil, errors.New("the south-west corner of the box is north of the north-east one")
+	}
+	if minLon > maxLon {
+		maxLon += 360
+	}
+
+	return d.geoSearch(op, collection, field, lonBoxes(minLat, minLon, maxLat, maxLon), func(p GeoPoint) bool {
+		lon := p.Lon
+		if lon < minLon {
+			lon += 360
+		}
+		return p.Lat >= minLat && p.Lat <= maxLat && lon >= minLon && lon <= maxLon
+	})
+}
+
+// lonBoxes splits a box whose longitudes may run past ±180 into boxes
+// within range.
+func lonBoxes(minLat, minLon, maxLat, maxLon float64) [][4]float64 {
+	switch {
+	case minLon < -180:
+		return [][4]float64{{minLat, minLon + 360, maxLat, 180}, {minLat, -180, maxLat, maxLon}}
+	case maxLon > 180:
+		return [][4]float64{{minLat, minLon, maxLat, 180}, {minLat, -180, maxLat, maxLon - 360}}
+	}
+	return [][4]float64{{minLat, minLon, maxLat, maxLon}}
+}
+
+// geoSearch returns the records located in field within boxes that match.
+// The index narrows the records down to those in the geohash cells
+// covering the boxes; their locations are checked against the records as
+// read.
+func (d *Driver) geoSearch(op *operation, collection, field string, boxes [][4]float64, match func(GeoPoint) bool) ([]GeoResult, error) {
+	index, err := d.geoIndex(collection, field)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make(map[string]bool)
+	index.mutex.RLock()
+	for _, box := range boxes {
+		for _, prefix := range coveringCells(box) {
+			i := sort.Search(len(index.entries), func(i int) bool { return index.entries[i].hash >= prefix })
+			for ; i < len(index.entries) && strings.HasPrefix(index.entries[i].hash, prefix); i++ {
+				candidates[index.entries[i].key] = true
+			}
+		}
+	}
+	index.mutex.RUnlock()
+
+	keys := make([]string, 0, len(candidates))
+	for key := range candidates {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	data, errs := d.fetch(collection, keys, true)
+	results := []GeoResult{}
+	for i, key := range keys {
+		if errors.Is(errs[i], os.ErrNotExist) {
+			continue
+		}
+		if errs[i] != nil {
+			return nil, fmt.Errorf("could not read %s: %v", key, errs[i])
+		}
+		op.bytes += len(data[i])
+		doc, err := decodeDocument(data[i])
+		if err != nil {
+			return nil, err
+		}
+		p, ok := locationAt(doc, field)
+		if !ok || !match(p) {
+			continue
+		}
+		var user User
+		if err := json.Unmarshal(data[i], &user); err != nil {
+			return nil, fmt.Errorf("could not unmarshal %s: %v", key, err)
+		}
+		d.compute(collection, &user)
+		results = append(results, GeoResult{Key: key, Value: user, Location: p})
+	}
+	return results, nil
+}
+
+// geoIndex returns the index of the locations in field, building it from
+// the collection on first use and keeping it up to date from then on.
+func (d *Driver) geoIndex(collection, field string) (*geoIndex, error) {
+	meta, _ := d.collectionMeta(collection)
+	if !slices.Contains(meta.Geo, field) {
+		return nil, fmt.Errorf("field %s of collection %s is not geo-indexed", field, collection)
+	}
+
+	id := collection + "/" + field
+	d.mutex.Lock()
+	index, ok := d.geo[id]
+	d.mutex.Unlock()
+	if ok {
+		return index, nil
+	}
+
+	// The collection stays locked from building the index until it is
+	// subscribed to changes, so none are missed.
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	d.mutex.Lock()
+	index, ok = d.geo[id]
+	d.mutex.Unlock()
+	if ok {
+		return index, nil
+	}
+
+	index = &geoIndex{hashes: make(map[string]string)}
+	collections, err := d.Collections()
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(collections, collection) {
+		keys, err := d.store.keys(collection)
+		if err != nil {
+			return nil, fmt.Errorf("could not index %s of collection %s: %v", field, collection, err)
+		}
+		for _, key := range keys {
+			data, err := d.store.get(collection, key)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("could not index %s of collection %s: %v", field, collection, err)
+			}
+			index.set(key, d.storedLocation(collection, key, field, data))
+		}
+	}
+
+	d.subscribe(func(change Change) {
+		if change.Collection != collection {
+			return
+		}
+		var hash string
+		if change.Op == OpWrite {
+			data, err := d.changeData(change)
+			if err != nil {
+				d.log.Error("Could not index %s of %s in collection %s: %v", field, change.Key, collection, err)
+				return
+			}
+			hash = d.storedLocation(collection, change.Key, field, data)
+		}
+		index.mutex.Lock()
+		index.set(change.Key, hash)
+		index.mutex.Unlock()
+	})
+
+	d.mutex.Lock()
+	if d.geo == nil {
+		d.geo = make(map[string]*geoIndex)
+	}
+	d.geo[id] = index
+	d.mutex.Unlock()
+	return index, nil
+}
+
+// storedLocation returns the geohash of the location in field of a record
+// as stored, or "" if it has none.
+func (d *Driver) storedLocation(collection, key, field string, data []byte) string {
+	data, _, err := d.upgrade(collection, key, data)
+	if err != nil {
+		return ""
+	}
+	doc, err := decodeDocument(data)
+	if err != nil {
+		return ""
+	}
+	p, ok := locationAt(doc, field)
+	if !ok {
+		return ""
+	}
+	return geohash(p, geohashPrecision)
+}
+
+// set indexes key at hash, or removes it if hash is empty. The index must
+// be locked unless it is not shared yet.
+func (x *geoIndex) set(key, hash string) {
+	if old, ok := x.hashes[key]; ok {
+		i := sort.Search(len(x.entries), func(i int) bool {
+			e := x.entries[i]
+			return e.hash > old || e.hash == old && e.key >= key
+		})
+		x.entries = slices.Delete(x.entries, i, i+1)
+		delete(x.hashes, key)
+	}
+	if hash == "" {
+		return
+	}
+	entry := geoEntry{hash: hash, key: key}
+	i := sort.Search(len(x.entries), func(i int) bool {
+		e := x.entries[i]
+		return e.hash > hash || e.hash == hash && e.key >= key
+	})
+	x.entries = slices.Insert(x.entries, i, entry)
+	x.hashes[key] = hash
+}
+
+// locationAt reads the location at a dot path of a decoded record: an
+// object with lat and lon (or lng) members, or a "lat,lon" string.
+func locationAt(doc interface{}, field string) (GeoPoint, bool) {
+	value, ok := lookupField(doc, strings.Split(field, "."))
+	if !ok {
+		return GeoPoint{}, false
+	}
+
+	var lat, lon float64
+	var err1, err2 error
+	switch value := value.(type) {
+	case map[string]interface{}:
+		lng, ok := value["lon"]
+		if !ok {
+			lng = value["lng"]
+		}
+		lat, err1 = geoNumber(value["lat"])
+		lon, err2 = geoNumber(lng)
+	case string:
+		parts := strings.Split(value, ",")
+		if len(parts) != 2 {
+			return GeoPoint{}, false
+		}
+		lat, err1 = strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+		lon, err2 = strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	default:
+		return GeoPoint{}, false
+	}
+	if err1 != nil || err2 != nil || checkGeoPoint(lat, lon) != nil {
+		return GeoPoint{}, false
+	}
+	return GeoPoint{Lat: lat, Lon: lon}, true
+}
+
+func geoNumber(value interface{}) (float64, error) {
+	n, ok := value.(json.Number)
+	if !ok {
+		return 0, errors.New("not a number")
+	}
+	return n.Float64()
+}
+
+func checkGeoPoint(lat, lon float64) error {
+	if !(lat >= -90 && lat <= 90) || !(lon >= -180 && lon <= 180) {
+		return fmt.Errorf("invalid location %g,%g", lat, lon)
+	}
+	return nil
+}
+
+// distanceKm is the great-circle distance between two points.
+func distanceKm(a, b GeoPoint) float64 {
+	lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	dLat, dLon := lat2-lat1, (b.Lon-a.Lon)*math.Pi/180
+	h := math.Pow(math.Sin(dLat/2), 2) + math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin(dLon/2), 2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// geohash encodes a point as a geohash of precision characters.
+func geohash(p GeoPoint, precision int) string {
+	minLat, maxLat, minLon, maxLon := -90.0, 90.0, -180.0, 180.0
+	hash := make([]byte, 0, precision)
+	bit, ch, even := 0, 0, true
+	for len(hash) < precision {
+		if even {
+			mid := (minLon + maxLon) / 2
+			if p.Lon >= mid {
+				ch = ch<<1 | 1
+				minLon = mid
+			} else {
+				ch <<= 1
+				maxLon = mid
+			}
+		} else {
+			mid := (minLat + maxLat) / 2
+			if p.Lat >= mid {
+				ch = ch<<1 | 1
+				minLat = mid
+			} else {
+				ch <<= 1
+				maxLat = mid
+			}
+		}
+		even = !even
+		if bit++; bit == 5 {
+			hash = append(hash, geohashAlphabet[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return string(hash)
+}
+
+// cellSize returns the height and width in degrees of the geohash cells of
+// a precision.
+func cellSize(precision int) (lat, lon float64) {
+	bits := 5 * precision
+	return 180 / math.Pow(2, float64(bits/2)), 360 / math.Pow(2, float64(bits-bits/2))
+}
+
+// coveringCells returns the geohashes of the cells covering a box, of the
+// finest precision needing no more than geoMaxCells of them.
+func coveringCells(box [4]float64) []string {
+	minLat, minLon, maxLat, maxLon := box[0], box[1], box[2], box[3]
+	precision := geohashPrecision
+	for ; precision > 1; precision-- {
+		h, w := cellSize(precision)
+		rows := math.Floor(maxLat/h) - math.Floor(minLat/h) + 1
+		cols := math.Floor(maxLon/w) - math.Floor(minLon/w) + 1
+		if rows*cols <= geoMaxCells {
+			break
+		}
+	}
+
+	h, w := cellSize(precision)
+	seen := make(map[string]bool)
+	var cells []string
+	for lat := math.Floor(minLat/h) * h; lat <= maxLat; lat += h {
+		for lon := math.Floor(minLon/w) * w; lon <= maxLon; lon += w {
+			// The middle of the cell, clear of rounding at its edges.
+			p := GeoPoint{Lat: math.Min(lat+h/2, 90), Lon: math.Min(lon+w/2, 180)}
+			if cell := geohash(p, precision); !seen[cell] {
+				seen[cell] = true
+				cells = append(cells, cell)
+			}
+		}
+	}
+	return cells
+}
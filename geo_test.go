@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io"
+	"testing"
+)
+
+func TestNearFindsStreamedRecords(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+	if err := d.SetCollectionMeta("places", CollectionMeta{Geo: []string{"Location"}}); err != nil {
+		t.Fatal(err)
+	}
+	// Querying first builds the index, which the stream must then update.
+	if found, err := d.Near("places", "Location", 52.52, 13.40, 1); err != nil || len(found) != 0 {
+		t.Fatalf("Near on an empty collection = %v, %v", found, err)
+	}
+
+	w, err := d.WriteStream("places", "berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, `{"Name": "berlin", "Location": "52.52,13.405"}`)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := d.Near("places", "Location", 52.52, 13.40, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Key != "berlin" {
+		t.Errorf("Near = %+v, want berlin", found)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/rishabhatia010/testdb"
+)
+
+// The golden tests run against the fixtures under testdata and compare the
+// database left behind with a snapshot. Rerun them with TESTDB_UPDATE=1 to
+// accept a change in what is stored.
+
+// openFixture loads a fixture into a scratch directory and opens it.
+func openFixture(t *testing.T, fixture string, opts *Options) (*Driver, string) {
+	t.Helper()
+	dir := testdb.Load(t, fixture)
+	if opts == nil {
+		opts = &Options{}
+	}
+	opts.Slog = openTestLogger()
+	d, err := New(dir, opts)
+	if err != nil {
+		t.Fatalf("could not open fixture %s: %v", fixture, err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d, dir
+}
+
+func TestGoldenFileEngine(t *testing.T) {
+	d, dir := openFixture(t, "testdata/basic", nil)
+
+	if err := d.Write("users", "carol", User{Name: "Carol", Age: "35", Company: "Initech"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Increment("users", "alice", "Age", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete("users", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	testdb.AssertEqual(t, dir, "testdata/basic.files.want")
+}
+
+func TestGoldenLogEngine(t *testing.T) {
+	d, dir := openFixture(t, "testdata/basic", &Options{Engine: EngineLog})
+
+	for _, user := range []User{{Name: "Dave"}, {Name: "Erin"}, {Name: "Frank"}} {
+		if err := d.Write("staff", strings.ToLower(user.Name), user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Delete("staff", "erin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	testdb.AssertEqual(t, dir, "testdata/basic.log.want")
+}
+
+func TestGoldenTx(t *testing.T) {
+	d, dir := openFixture(t, "testdata/basic", nil)
+
+	tx := d.Begin()
+	tx.Write("users", "dave", User{Name: "Dave", Company: "Globex"})
+	tx.Delete("users", "alice")
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed transaction leaves nothing behind.
+	tx = d.Begin()
+	tx.Write("users", "erin", User{Name: "Erin"})
+	tx.Delete("users", "nobody")
+	if err := tx.Commit(); err == nil {
+		t.Fatal("commit deleting a missing record succeeded")
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	testdb.AssertEqual(t, dir, "testdata/basic.tx.want")
+}
+
+func TestGoldenHandler(t *testing.T) {
+	d, dir := openFixture(t, "testdata/basic", nil)
+	h := d.Handler(HandlerOptions{})
+
+	for _, tc := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{"PUT", "/collections/users/carol", `{"Name": "Carol", "Company": "Initech"}`, http.StatusOK},
+		{"DELETE", "/collections/users/bob", "", http.StatusNoContent},
+		{"PUT", "/collections/users/..%2Fescaped", `{"Name": "Mallory"}`, http.StatusBadRequest},
+		{"DELETE", "/collections/users/nobody", "", http.StatusNotFound},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body)))
+		if rec.Code != tc.status {
+			t.Errorf("%s %s: status %d, want %d (%s)", tc.method, tc.path, rec.Code, tc.status, rec.Body)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	testdb.AssertEqual(t, dir, "testdata/basic.http.want")
+}
+
+func TestGoldenNaming(t *testing.T) {
+	d, dir := openFixture(t, "testdata/naming", &Options{
+		Naming: &NamingPolicy{Allowed: PortableNameChars, FoldCase: true},
+	})
+
+	// Names reaching outside the database change nothing.
+	for _, name := range []string{"../users", "users/..", `..\users`} {
+		if err := d.Write(name, "x", User{}); err == nil {
+			t.Errorf("write to collection %q succeeded", name)
+		}
+		if err := d.Write("users", name, User{}); err == nil {
+			t.Errorf("write of key %q succeeded", name)
+		}
+	}
+
+	if _, err := d.NormalizeNames(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	testdb.AssertEqual(t, dir, "testdata/naming.want")
+}
+
+func TestTransientFile(t *testing.T) {
+	d, dir := openTestDB(t, &Options{ChangeLog: true})
+	if err := d.Write("users", "alice", User{Name: "Alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if got, want := TransientFile(entry.Name()), entry.Name() != "users"; got != want {
+			t.Errorf("TransientFile(%q) = %v, want %v", entry.Name(), got, want)
+		}
+	}
+}
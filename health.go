@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HealthStatus summarizes a HealthReport.
+type HealthStatus string
+
+const (
+	// HealthOK means every check passed.
+	HealthOK HealthStatus = "ok"
+	// HealthDegraded means the database serves requests, but needs
+	// attention: it holds corrupt records or background tasks fall behind.
+	HealthDegraded HealthStatus = "degraded"
+	// HealthFailing means the database cannot take writes.
+	HealthFailing HealthStatus = "failing"
+)
+
+// lowDiskSpace is the free space below which a database is failing.
+const lowDiskSpace = 64 << 20
+
+// healthProbeFile is written and removed to check the directory is
+// writable.
+const healthProbeFile = ".health"
+
+// HealthReport is the outcome of Health.
+type HealthReport struct {
+	Status  HealthStatus `json:"status"`
+	Checked time.Time    `json:"checked"`
+	// Problems explains a status other than HealthOK.
+	Problems []string `json:"problems"`
+	// DiskFree is the space left for the database directory in bytes, or
+	// -1 where the platform cannot tell.
+	DiskFree int64 `json:"diskFree"`
+	// Writable is whether a file could be written to the database
+	// directory. Read-only databases are not checked.
+	Writable bool `json:"writable"`
+	// CorruptRecords is how many corrupt records the last Verify or
+	// startup integrity scan found.
+	CorruptRecords int `json:"corruptRecords"`
+	// Tasks are the background tasks running.
+	Tasks []TaskHealth `json:"tasks"`
+}
+
+// TaskHealth describes a background task.
+type TaskHealth struct {
+	Name     string        `json:"name"`
+	Interval time.Duration `json:"interval,omitempty"`
+	// LastRun is when the task last finished a run; zero if it has not yet.
+	LastRun time.Time `json:"lastRun"`
+	// Lag is how long the task is overdue: the time since it last ran, or
+	// started, beyond its interval.
+	Lag time.Duration `json:"lag"`
+	// Backlog is how many changes the task has yet to process.
+	Backlog uint64 `json:"backlog,omitempty"`
+}
+
+// taskTracker records when the background tasks last ran.
+type taskTracker struct {
+	mutex sync.Mutex
+	tasks map[string]*taskState
+}
+
+type taskState struct {
+	interval time.Duration
+	started  time.Time
+	last     time.Time
+}
+
+// track registers a background task running every interval and returns
+// the function it calls after each run.
+func (t *taskTracker) track(name string, interval time.Duration) (ran func()) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.tasks == nil {
+		t.tasks = make(map[string]*taskState)
+	}
+	state := &taskState{interval: interval, started: time.Now()}
+	t.tasks[name] = state
+	return func() {
+		t.mutex.Lock()
+		state.last = time.Now()
+		t.mutex.Unlock()
+	}
+}
+
+func (t *taskTracker) health(now time.Time) []TaskHealth {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	tasks := []TaskHealth{}
+	for name, state := range t.tasks {
+		since := state.last
+		if since.IsZero() {
+			since = state.started
+		}
+		lag := now.Sub(since) - state.interval
+		if lag < 0 {
+			lag = 0
+		}
+		tasks = append(tasks, TaskHealth{Name: name, Interval: state.interval, LastRun: state.last, Lag: lag})
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].Name < tasks[j].Name })
+	return tasks
+}
+
+// Health checks that the database can serve requests: the disk space left,
+// that the directory is writable, the corrupt records known and whether
+// background tasks keep up. A task lagging more than its interval, having
+// missed a run, degrades the database.
+func (d *Driver) Health() HealthReport {
+	now := time.Now()
+	report := HealthReport{Status: HealthOK, Checked: now, Problems: []string{}, DiskFree: -1}
+	fail := func(status HealthStatus, format string, v ...interface{}) {
+		if status == HealthFailing || report.Status == HealthOK {
+			report.Status = status
+		}
+		report.Problems = append(report.Problems, fmt.Sprintf(format, v...))
+	}
+
+	if free, err := diskFree(d.dir); err == nil {
+		report.DiskFree = int64(free)
+		if free < lowDiskSpace {
+			fail(HealthFailing, "low disk space: %d bytes free", free)
+		}
+	}
+
+	if !d.opts.ReadOnly {
+		probe := filepath.Join(d.dir, healthProbeFile)
+		err := writeFile(d.fs, probe, []byte(now.Format(time.RFC3339)), d.layout.fileMode())
+		if err == nil {
+			err = d.fs.Remove(probe)
+		}
+		report.Writable = err == nil
+		if err != nil {
+			fail(HealthFailing, "database directory is not writable: %v", err)
+		}
+	}
+
+	d.opMetrics.mutex.Lock()
+	report.CorruptRecords = d.opMetrics.corrupt
+	d.opMetrics.mutex.Unlock()
+	if report.CorruptRecords > 0 {
+		fail(HealthDegraded, "%d corrupt records", report.CorruptRecords)
+	}
+
+	if d.changes != nil {
+		if err := d.changes.err(); err != nil {
+			fail(HealthDegraded, "%v", err)
+		}
+	}
+
+	report.Tasks = d.background.health(now)
+	if d.opts.Sync != nil && d.changes != nil {
+		task := TaskHealth{Name: "remote-sync"}
+		if synced, err := readSyncCursor(filepath.Join(d.dir, changeLogDir, syncCursorFile)); err == nil {
+			if last := d.changes.lastSeq(); last > synced {
+				task.Backlog = last - synced
+			}
+		}
+		report.Tasks = append(report.Tasks, task)
+	}
+	for _, task := range report.Tasks {
+		if task.Lag > task.Interval {
+			fail(HealthDegraded, "%s is %s behind", task.Name, task.Lag.Round(time.Second))
+		}
+	}
+	return report
+}
+
+// healthz serves Health for load balancers and orchestrators: 200 unless
+// the database is failing, 503 then, with the report as the body.
+func (s *server) healthz(w http.ResponseWriter, r *http.Request) {
+	report := s.d.Health()
+	status := http.StatusOK
+	if report.Status == HealthFailing {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
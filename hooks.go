@@ -0,0 +1,72 @@
+package main
+
+import "fmt"
+
+// OpRead is the operation of a HookOp intercepting a read.
+const OpRead = "read"
+
+// Hook intercepts Write, Read and Delete, the writes and deletes of
+// transactions, Increment, MergeCRDT and WriteStream, e.g. for audit
+// logging, validation or cache invalidation. Either function may be nil.
+//
+// Increment's record is only known once the collection is locked, so its
+// Before sees no Data, and a streamed record is never held in memory, so
+// hooks see no Data for WriteStream at all; MergeCRDT's Data is the state
+// merged in. Not intercepted are queue operations, time series points,
+// records loaded from a dump, and the writes the database makes itself:
+// maintaining views, migrating, renaming, expiring and archiving records.
+type Hook struct {
+	// Before runs ahead of the operation. Returning an error aborts it. A
+	// write's Data may be replaced to change what is stored.
+	Before func(op *HookOp) error
+	// After runs once the operation is done, or was aborted, with its
+	// error. A read's Data holds the record read.
+	After func(op *HookOp, err error)
+}
+
+// HookOp is an operation seen by hooks.
+type HookOp struct {
+	Op         string
+	Collection string
+	Key        string
+	Data       []byte
+}
+
+// Use installs a hook. Hooks run in the order they were installed, outside
+// the collection lock, so they may use the Driver themselves. They must be
+// safe for concurrent use: ReadAll runs read hooks for many records at once.
+func (d *Driver) Use(hook Hook) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.hooks = append(d.hooks, hook)
+}
+
+func (d *Driver) installedHooks() []Hook {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.hooks
+}
+
+// before runs the Before hooks until one aborts the operation.
+func (d *Driver) before(op *HookOp) error {
+	for _, hook := range d.installedHooks() {
+		if hook.Before == nil {
+			continue
+		}
+		if err := hook.Before(op); err != nil {
+			return fmt.Errorf("%s of %s in collection %s aborted by hook: %w", op.Op, op.Key, op.Collection, err)
+		}
+	}
+	return nil
+}
+
+// after runs every After hook.
+func (d *Driver) after(op *HookOp, err error) {
+	for _, hook := range d.installedHooks() {
+		if hook.After != nil {
+			hook.After(op, err)
+		}
+	}
+}
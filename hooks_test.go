@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+)
+
+func TestHooksSeeEveryWrite(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+	if err := d.SetCollectionMeta("counters", CollectionMeta{CRDT: CRDTCounter}); err != nil {
+		t.Fatal(err)
+	}
+
+	var mutex sync.Mutex
+	var before, after []string
+	d.Use(Hook{
+		Before: func(op *HookOp) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			before = append(before, op.Collection+"/"+op.Key)
+			if op.Key == "refused" {
+				return errors.New("refused")
+			}
+			return nil
+		},
+		After: func(op *HookOp, err error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			after = append(after, fmt.Sprintf("%s/%s %v", op.Collection, op.Key, err == nil))
+		},
+	})
+
+	if err := d.Write("users", "alice", User{Name: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Increment("users", "alice", "Age", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Increment("users", "refused", "Age", 1); err == nil {
+		t.Error("increment refused by a hook succeeded")
+	}
+	if _, err := d.MergeCRDT("counters", "hits", []byte(`{"p": {"a": 1}}`)); err != nil {
+		t.Fatal(err)
+	}
+	w, err := d.WriteStream("users", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, `{"Name": "bob"}`)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	wantBefore := []string{"users/alice", "users/alice", "users/refused", "counters/hits", "users/bob"}
+	wantAfter := []string{"users/alice true", "users/alice true", "users/refused false", "counters/hits true", "users/bob true"}
+	if fmt.Sprint(before) != fmt.Sprint(wantBefore) {
+		t.Errorf("before hooks saw %v, want %v", before, wantBefore)
+	}
+	if fmt.Sprint(after) != fmt.Sprint(wantAfter) {
+		t.Errorf("after hooks saw %v, want %v", after, wantAfter)
+	}
+	if _, err := d.Read("users", "refused"); err == nil {
+		t.Error("increment refused by a hook created the record")
+	}
+}
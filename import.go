@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ImportMode selects whether Import writes anything.
+type ImportMode int
+
+const (
+	// ImportModeCommit writes the records (the default).
+	ImportModeCommit ImportMode = iota
+	// ImportModeReport only reports what a commit would do.
+	ImportModeReport
+)
+
+// ImportOptions configures Import.
+type ImportOptions struct {
+	Mode ImportMode
+	// Force overwrites records in conflict instead of skipping them.
+	Force bool
+}
+
+// ImportConflict is a record that changed since the revision an imported
+// record was based on.
+type ImportConflict struct {
+	Key             string `json:"key"`
+	BaseRevision    string `json:"baseRevision"`
+	CurrentRevision string `json:"currentRevision"`
+}
+
+// ImportReport lists what Import did, or in report mode would do, per key.
+type ImportReport struct {
+	Collection  string           `json:"collection"`
+	Created     []string         `json:"created"`
+	Overwritten []string         `json:"overwritten"`
+	Unchanged   []string         `json:"unchanged"`
+	Conflicts   []ImportConflict `json:"conflicts"`
+}
+
+func (r *ImportReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %d created, %d overwritten, %d unchanged, %d conflicts",
+		r.Collection, len(r.Created), len(r.Overwritten), len(r.Unchanged), len(r.Conflicts))
+	for _, key := range r.Overwritten {
+		fmt.Fprintf(&b, "\n  overwrite %s", key)
+	}
+	for _, c := range r.Conflicts {
+		fmt.Fprintf(&b, "\n  conflict  %s: based on revision %s, now %s", c.Key, c.BaseRevision, c.CurrentRevision)
+	}
+	return b.String()
+}
+
+// revision identifies the content of an encoded record.
+func revision(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Export returns every readable record of a collection with its revision,
+// in the form Import accepts.
+func (d *Driver) Export(collection string) ([]Record, error) {
+	if err := d.checkNames(&collection); err != nil {
+		return nil, err
+	}
+
+	return d.export(collection, false)
+}
+
+func (d *Driver) export(collection string, redact bool) ([]Record, error) {
+	var records []Record
+	err := d.scan(collection, func(key string, data []byte) error {
+		if redact {
+			var err error
+			if data, err = d.Redact(collection, data); err != nil {
+				return err
+			}
+		}
+		var user User
+		if err := json.Unmarshal(data, &user); err != nil {
+			return fmt.Errorf("could not unmarshal user %s: %v", key, err)
+		}
+		records = append(records, Record{Key: key, Value: user, Revision: revision(data)})
+		return nil
+	})
+	return records, err
+}
+
+// Import writes records into a collection. A record carrying a Revision is
+// in conflict when the stored record has changed since that revision;
+// conflicts are skipped unless opts.Force is set. In ImportModeReport mode
+// nothing is written and the report shows what a commit would do. Each
+// record is checked again under the lock of its write, so a record changed
+// concurrently is reported as a conflict rather than overwritten.
+func (d *Driver) Import(collection string, records []Record, opts ImportOptions) (*ImportReport, error) {
+	if err := d.checkNames(&collection); err != nil {
+		return nil, err
+	}
+	report := &ImportReport{Collection: collection}
+
+	for _, record := range records {
+		if err := d.checkNames(&collection, &record.Key); err != nil {
+			return report, err
+		}
+		want, err := canonicalUser(record.Value)
+		if err != nil {
+			return report, fmt.Errorf("could not marshal user %s: %v", record.Key, err)
+		}
+
+		current, err := d.readRaw(collection, record.Key)
+		exists := err == nil
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return report, fmt.Errorf("could not read user %s: %v", record.Key, err)
+		}
+		outcome, err := classifyImport(record, want, current, exists, opts)
+		if err != nil {
+			return report, err
+		}
+		if opts.Mode == ImportModeCommit && outcome.writes() {
+			err = d.write(context.Background(), collection, record.Key, record.Value, func(current []byte, exists bool) error {
+				if exists {
+					var err error
+					if current, _, err = d.upgrade(collection, record.Key, current); err != nil {
+						return err
+					}
+					if current, err = d.openFields(collection, record.Key, current); err != nil {
+						return err
+					}
+				}
+				if outcome, err = classifyImport(record, want, current, exists, opts); err != nil {
+					return err
+				}
+				if !outcome.writes() {
+					return errImportSkipped
+				}
+				return nil
+			})
+			if err != nil && !errors.Is(err, errImportSkipped) {
+				return report, err
+			}
+		}
+		outcome.addTo(report, record.Key)
+	}
+	return report, nil
+}
+
+// errImportSkipped stops the write of an imported record found unchanged
+// or in conflict under its lock.
+var errImportSkipped = errors.New("import skipped")
+
+// importOutcome is what Import does with one record.
+type importOutcome struct {
+	created, overwritten, unchanged bool
+	// conflict is set when the record changed since its base revision.
+	conflict *ImportConflict
+	force    bool
+}
+
+// writes reports whether the record is to be written.
+func (o importOutcome) writes() bool {
+	return !o.unchanged && (o.conflict == nil || o.force)
+}
+
+func (o importOutcome) addTo(report *ImportReport, key string) {
+	switch {
+	case o.created:
+		report.Created = append(report.Created, key)
+	case o.unchanged:
+		report.Unchanged = append(report.Unchanged, key)
+	case o.conflict != nil:
+		report.Conflicts = append(report.Conflicts, *o.conflict)
+	case o.overwritten:
+		report.Overwritten = append(report.Overwritten, key)
+	}
+}
+
+// classifyImport works out what importing record over the readable form of
+// the stored record, current, does. want is the canonical encoding of the
+// imported user; the stored record is compared decoded, so fields the
+// database stamps it with do not make it differ.
+func classifyImport(record Record, want, current []byte, exists bool, opts ImportOptions) (importOutcome, error) {
+	outcome := importOutcome{force: opts.Force}
+	if !exists {
+		outcome.created = true
+		return outcome, nil
+	}
+
+	var user User
+	if err := json.Unmarshal(current, &user); err != nil {
+		return outcome, fmt.Errorf("could not unmarshal user %s: %v", record.Key, err)
+	}
+	got, err := canonicalUser(user)
+	if err != nil {
+		return outcome, err
+	}
+
+	switch {
+	case bytes.Equal(got, want):
+		outcome.unchanged = true
+	case record.Revision != "" && record.Revision != revision(current):
+		outcome.conflict = &ImportConflict{
+			Key:             record.Key,
+			BaseRevision:    record.Revision,
+			CurrentRevision: revision(current),
+		}
+	default:
+		outcome.overwritten = true
+	}
+	return outcome, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImportReport(t *testing.T) {
+	tests := []struct {
+		name string
+		opts ImportOptions
+		// want is the name each user has after the import.
+		want map[string]string
+	}{
+		{"report", ImportOptions{Mode: ImportModeReport},
+			map[string]string{"ann": "Ann", "bob": "Bob edited", "cat": "Cat"}},
+		{"commit", ImportOptions{},
+			map[string]string{"ann": "Ann", "bob": "Bob edited", "cat": "Cat imported", "dan": "Dan"}},
+		{"force", ImportOptions{Force: true},
+			map[string]string{"ann": "Ann", "bob": "Bob imported", "cat": "Cat imported", "dan": "Dan"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _ := openTestDB(t, nil)
+			for _, name := range []string{"Ann", "Bob", "Cat"} {
+				if err := d.Write("users", strings.ToLower(name), User{Name: name}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			records, err := d.Export("users")
+			if err != nil || len(records) != 3 {
+				t.Fatalf("Export = %v, %v", records, err)
+			}
+			// bob changes after the export the import is based on.
+			if err := d.Write("users", "bob", User{Name: "Bob edited"}); err != nil {
+				t.Fatal(err)
+			}
+			records[1].Value.Name = "Bob imported"
+			records[2].Value.Name = "Cat imported"
+			records = append(records, Record{Key: "dan", Value: User{Name: "Dan"}})
+
+			report, err := d.Import("users", records, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(report.Created, []string{"dan"}) || !slices.Equal(report.Unchanged, []string{"ann"}) ||
+				!slices.Equal(report.Overwritten, []string{"cat"}) {
+				t.Errorf("report = %v", report)
+			}
+			if len(report.Conflicts) != 1 || report.Conflicts[0].Key != "bob" ||
+				report.Conflicts[0].BaseRevision != records[1].Revision || report.Conflicts[0].CurrentRevision == records[1].Revision {
+				t.Errorf("conflicts = %+v, want bob changed since its exported revision", report.Conflicts)
+			}
+
+			for _, key := range []string{"ann", "bob", "cat", "dan"} {
+				user, err := d.Read("users", key)
+				want, ok := tt.want[key]
+				switch {
+				case !ok && !errors.Is(err, os.ErrNotExist):
+					t.Errorf("%s = %+v, %v, want it not written", key, user, err)
+				case ok && (err != nil || user.Name != want):
+					t.Errorf("%s = %+v, %v, want %s", key, user, err, want)
+				}
+			}
+		})
+	}
+}
+
+// TestImportStampedUnchanged checks that records the database stamps, here
+// with an expiry, import back over themselves unchanged.
+func TestImportStampedUnchanged(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+	if err := d.SetCollectionMeta("sessions", CollectionMeta{TTL: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Write("sessions", "s1", User{Name: "s1"}); err != nil {
+		t.Fatal(err)
+	}
+	records, err := d.Export("sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := d.Import("sessions", records, ImportOptions{Mode: ImportModeReport})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(report.Unchanged, []string{"s1"}) || len(report.Overwritten) != 0 {
+		t.Errorf("report = %v, want s1 unchanged", report)
+	}
+}
+
+// TestImportConflictUnderLock checks that a record changed between the
+// check Import makes up front and its write is reported as a conflict, not
+// overwritten.
+func TestImportConflictUnderLock(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+	writeUsers(t, d, "cat")
+	records, err := d.Export("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	records[0].Value.Name = "Cat imported"
+
+	// The hook runs after the up-front check and before the write takes
+	// the collection lock, where a concurrent writer could get in.
+	changing := false
+	d.Use(Hook{Before: func(op *HookOp) error {
+		if op.Op != OpWrite || changing {
+			return nil
+		}
+		changing = true
+		return d.Write("users", "cat", User{Name: "Cat edited"})
+	}})
+
+	report, err := d.Import("users", records, ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Conflicts) != 1 || len(report.Overwritten) != 0 {
+		t.Errorf("report = %v, want cat in conflict", report)
+	}
+	if user, err := d.Read("users", "cat"); err != nil || user.Name != "Cat edited" {
+		t.Errorf("cat = %+v, %v, want the concurrent write kept", user, err)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// IntegrityScan selects how thoroughly New checks the database on open.
+type IntegrityScan int
+
+const (
+	// ScanNone skips the startup scan (the default).
+	ScanNone IntegrityScan = iota
+	// ScanQuick checks the files on disk against each other without
+	// reading records: empty records, checksums without a record, records
+	// missing their checksum, key manifests that disagree with the records
+	// and leftovers of interrupted operations.
+	ScanQuick
+	// ScanDeep additionally reads every record and verifies its checksum
+	// and JSON, as Verify does.
+	ScanDeep
+)
+
+func (s IntegrityScan) String() string {
+	switch s {
+	case ScanQuick:
+		return "quick"
+	case ScanDeep:
+		return "deep"
+	default:
+		return "none"
+	}
+}
+
+// IntegrityProblem is a single finding of an integrity scan.
+type IntegrityProblem struct {
+	Collection string `json:"collection"`
+	Key        string `json:"key,omitempty"`
+	Problem    string `json:"problem"`
+}
+
+// IntegrityReport is the outcome of a startup integrity scan.
+type IntegrityReport struct {
+	Mode        string             `json:"mode"`
+	Started     time.Time          `json:"started"`
+	Duration    time.Duration      `json:"duration"`
+	Collections int                `json:"collections"`
+	Problems    []IntegrityProblem `json:"problems"`
+}
+
+// maxLoggedProblems bounds how many findings are logged one by one.
+const maxLoggedProblems = 20
+
+// scanIntegrity runs the configured startup scan and keeps its report for
+// Metrics and Stats.
+func (d *Driver) scanIntegrity(mode IntegrityScan) {
+	if mode == ScanNone {
+		return
+	}
+
+	report := &IntegrityReport{Mode: mode.String(), Started: time.Now()}
+	collections, err := d.Collections()
+	if err != nil {
+		d.log.Error("Integrity scan could not list collections: %v", err)
+		return
+	}
+	report.Collections = len(collections)
+
+	for _, collection := range collections {
+		report.Problems = append(report.Problems, d.quickScan(collection)...)
+	}
+
+	if mode == ScanDeep {
+		corrupt, err := d.Verify()
+		if err != nil {
+			d.log.Error("Integrity scan could not verify records: %v", err)
+		}
+		for _, c := range corrupt {
+			report.Problems = append(report.Problems, IntegrityProblem{
+				Collection: c.Collection,
+				Key:        c.Key,
+				Problem:    c.Err.Error(),
+			})
+		}
+	}
+	report.Duration = time.Since(report.Started)
+
+	for i, p := range report.Problems {
+		if i == maxLoggedProblems {
+			d.log.Error("... and %d more integrity problems", len(report.Problems)-i)
+			break
+		}
+		d.log.Error("Integrity problem in %s/%s: %s", p.Collection, p.Key, p.Problem)
+	}
+	d.log.Info("%s integrity scan of %d collections found %d problems in %s",
+		report.Mode, report.Collections, len(report.Problems), report.Duration)
+
+	d.opMetrics.mutex.Lock()
+	d.opMetrics.integrity = report
+	d.opMetrics.mutex.Unlock()
+}
+
+// quickScan checks a collection's files against each other.
+func (d *Driver) quickScan(collection string) []IntegrityProblem {
+	dirs := []string{filepath.Join(d.dir, collection)}
+	if d.opts.Engine == EngineFiles {
+		var err error
+		if dirs, err = d.layout.recordDirs(d.fs, d.dir, collection); err != nil {
+			return []IntegrityProblem{{Collection: collection, Problem: err.Error()}}
+		}
+	}
+
+	var problems []IntegrityProblem
+	add := func(key, problem string) {
+		problems = append(problems, IntegrityProblem{Collection: collection, Key: key, Problem: problem})
+	}
+
+	ext := d.layout.extension()
+	for _, dir := range dirs {
+		entries, err := d.fs.ReadDir(dir)
+		if err != nil {
+			return append(problems, IntegrityProblem{Collection: collection, Problem: err.Error()})
+		}
+		names := make(map[string]bool, len(entries))
+		for _, entry := range entries {
+			names[entry.Name()] = true
+		}
+
+		for _, entry := range entries {
+			name := entry.Name()
+			switch {
+			case name == metaFile || entry.IsDir():
+
+			case strings.HasSuffix(name, compactSuffix):
+				add(name, "leftover of an interrupted compaction")
+
+			case strings.HasSuffix(name, ext+checksumExt):
+				if !names[strings.TrimSuffix(name, checksumExt)] {
+					add(strings.TrimSuffix(name, ext+checksumExt), "checksum without a record")
+				}
+
+			case strings.HasSuffix(name, ext) && d.opts.Engine == EngineFiles:
+				key := strings.TrimSuffix(name, ext)
+				if info, err := entry.Info(); err == nil && info.Size() == 0 {
+					add(key, "empty record")
+				}
+				if d.opts.Checksums && !names[name+checksumExt] {
+					add(key, "record without a checksum")
+				}
+
+			case name == logFileName:
+				if info, err := entry.Info(); err == nil && info.Size() > 0 && info.Size() < logHeaderSize {
+					add(name, "log shorter than one entry header")
+				}
+			}
+		}
+	}
+	return append(problems, d.scanManifest(collection)...)
+}
+
+// scanManifest checks the saved key manifest of a collection against its
+// records. A stale manifest is no problem: it is listed again when used.
+func (d *Driver) scanManifest(collection string) []IntegrityProblem {
+	s, ok := d.store.(*fileStorage)
+	if !ok || !s.manifest {
+		return nil
+	}
+	listed, ok := s.loadManifest(collection)
+	if !ok {
+		return nil
+	}
+	keys, err := s.listKeys(collection)
+	if err != nil {
+		return []IntegrityProblem{{Collection: collection, Problem: err.Error()}}
+	}
+
+	var problems []IntegrityProblem
+	stored := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		stored[key] = true
+	}
+	inManifest := make(map[string]bool, len(listed))
+	for _, key := range listed {
+		inManifest[key] = true
+		if !stored[key] {
+			problems = append(problems, IntegrityProblem{Collection: collection, Key: key, Problem: "key manifest lists a missing record"})
+		}
+	}
+	for _, key := range keys {
+		if !inManifest[key] {
+			problems = append(problems, IntegrityProblem{Collection: collection, Key: key, Problem: "record missing from the key manifest"})
+		}
+	}
+	return problems
+}
+
+// integrityProblems returns what the startup scan found in a collection.
+func (d *Driver) integrityProblems(collection string) []IntegrityProblem {
+	d.opMetrics.mutex.Lock()
+	defer d.opMetrics.mutex.Unlock()
+
+	if d.opMetrics.integrity == nil {
+		return nil
+	}
+	var problems []IntegrityProblem
+	for _, p := range d.opMetrics.integrity.Problems {
+		if p.Collection == collection {
+			problems = append(problems, p)
+		}
+	}
+	return problems
+}
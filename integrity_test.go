@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestQuickScan(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   Options
+		damage func(t *testing.T, users string)
+		// want are the keys the scan finds a problem with.
+		want []string
+	}{
+		{"clean", Options{Checksums: true}, func(*testing.T, string) {}, nil},
+		{"empty record", Options{}, func(t *testing.T, users string) {
+			if err := os.WriteFile(filepath.Join(users, "bob.json"), nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"bob"}},
+		{"checksum without a record", Options{Checksums: true}, func(t *testing.T, users string) {
+			if err := os.Remove(filepath.Join(users, "bob.json")); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"bob"}},
+		{"record without a checksum", Options{Checksums: true}, func(t *testing.T, users string) {
+			if err := os.Remove(filepath.Join(users, "bob.json"+checksumExt)); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"bob"}},
+		{"interrupted compaction", Options{}, func(t *testing.T, users string) {
+			if err := os.WriteFile(filepath.Join(users, "bob.json"+compactSuffix), nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"bob.json" + compactSuffix}},
+		{"key manifest disagrees", Options{KeyManifest: true}, func(t *testing.T, users string) {
+			// A rename keeps the directory's entry count; with its time
+			// restored the manifest still looks current.
+			info, err := os.Stat(users)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Rename(filepath.Join(users, "bob.json"), filepath.Join(users, "dan.json")); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(users, info.ModTime(), info.ModTime()); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"bob", "dan"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			d, dir := openTestDB(t, &opts)
+			writeUsers(t, d, "ann", "bob")
+			if _, err := d.Keys("users"); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.Close(); err != nil {
+				t.Fatal(err)
+			}
+			tt.damage(t, filepath.Join(dir, "users"))
+
+			opts.StartupScan = ScanQuick
+			d, err := New(dir, &opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+
+			stats, err := d.Stats("users")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			for _, p := range stats.Integrity {
+				keys = append(keys, p.Key)
+			}
+			slices.Sort(keys)
+			if !slices.Equal(keys, tt.want) {
+				t.Errorf("Stats.Integrity = %+v, want problems with %v", stats.Integrity, tt.want)
+			}
+			if report := d.Metrics().Integrity; report == nil || len(report.Problems) != len(tt.want) {
+				t.Errorf("Metrics.Integrity = %+v, want %d problems", report, len(tt.want))
+			}
+		})
+	}
+}
+
+// TestStatsIntegrityPerCollection checks that Stats only reports the
+// problems of the collection asked about.
+func TestStatsIntegrityPerCollection(t *testing.T) {
+	d, dir := openTestDB(t, nil)
+	writeUsers(t, d, "ann")
+	if err := d.Write("teams", "red", User{Name: "red"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "teams", "red.json"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := New(dir, &Options{StartupScan: ScanQuick, Slog: openTestLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if stats, err := d.Stats("users"); err != nil || len(stats.Integrity) != 0 {
+		t.Errorf("Stats(users).Integrity = %+v, %v, want none", stats.Integrity, err)
+	}
+	if stats, err := d.Stats("teams"); err != nil || len(stats.Integrity) != 1 || stats.Integrity[0].Key != "red" {
+		t.Errorf("Stats(teams).Integrity = %+v, %v, want red", stats.Integrity, err)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Join looks up, for every record a query returns, the record of another
+// collection it refers to, e.g. the user an order names:
+//
+//	Join{Collection: "users", Field: "UserID"}
+type Join struct {
+	// Collection is the collection looked up.
+	Collection string
+	// Field is the dot path, within the queried records, of the value to
+	// look up.
+	Field string
+	// On is the dot path, within the records of Collection, the value is
+	// matched against. Empty matches their keys; otherwise Collection is
+	// read once, and the first record in key order matching a value is
+	// joined.
+	On string
+	// As names the joined record in JoinedRecord.Joined. Defaults to
+	// Collection.
+	As string
+}
+
+// JoinedRecord is a record returned by QueryJoin with the records joined
+// to it. A join that found no record is left out of Joined.
+type JoinedRecord struct {
+	Key    string           `json:"key"`
+	Value  User             `json:"value"`
+	Joined map[string]*User `json:"joined,omitempty"`
+}
+
+// QueryJoin returns the users of a collection matching the filter
+// expression, as Query does, each with the records of other collections
+// the joins look up. Every joined collection is read once for all the
+// results rather than once per result.
+func (d *Driver) QueryJoin(collection, expr string, joins ...Join) (_ []JoinedRecord, err error) {
+	if err := d.checkNames(&collection); err != nil {
+		return nil, err
+	}
+
+	op := d.begin(opQuery, collection, "")
+	defer op.end(&err)
+
+	q, err := ParseQuery(expr)
+	if err != nil {
+		return nil, err
+	}
+	joins = append([]Join(nil), joins...)
+	for i, j := range joins {
+		if j.Collection == "" || j.Field == "" {
+			return nil, fmt.Errorf("join %d needs a collection and a field", i)
+		}
+		if err := d.checkNames(&joins[i].Collection); err != nil {
+			return nil, err
+		}
+		j = joins[i]
+		if joins[i].As == "" {
+			joins[i].As = j.Collection
+		}
+	}
+
+	// refs[i][j] is the value result i looks up with join j, if any.
+	var results []JoinedRecord
+	var refs [][]string
+	err = d.scanBatches(collection, true, func(keys []string, data [][]byte, errs []error) error {
+		matched := make([]*User, len(keys))
+		values := make([][]string, len(keys))
+		forEach(len(keys), d.readParallelism(), func(i int) {
+			if matched[i] = d.match(q, collection, keys[i], data[i], errs[i]); matched[i] == nil {
+				return
+			}
+			doc, err := decodeDocument(data[i])
+			if err != nil {
+				return
+			}
+			values[i] = make([]string, len(joins))
+			for j, join := range joins {
+				values[i][j], _ = fieldKey(doc, join.Field)
+			}
+		})
+		for i, user := range matched {
+			op.bytes += len(data[i])
+			if user != nil {
+				results = append(results, JoinedRecord{Key: keys[i], Value: *user})
+				refs = append(refs, values[i])
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for j, join := range joins {
+		wanted := make(map[string]bool)
+		for i := range results {
+			if refs[i] != nil && refs[i][j] != "" {
+				wanted[refs[i][j]] = true
+			}
+		}
+		if len(wanted) == 0 {
+			continue
+		}
+
+		found, err := d.lookup(join, wanted)
+		if err != nil {
+			return nil, fmt.Errorf("could not join collection %s: %v", join.Collection, err)
+		}
+		for i := range results {
+			if refs[i] == nil {
+				continue
+			}
+			if user, ok := found[refs[i][j]]; ok {
+				if results[i].Joined == nil {
+					results[i].Joined = make(map[string]*User)
+				}
+				results[i].Joined[join.As] = user
+			}
+		}
+	}
+	return results, nil
+}
+
+// lookup reads the records of a joined collection matching the wanted
+// values.
+func (d *Driver) lookup(join Join, wanted map[string]bool) (map[string]*User, error) {
+	decode := func(key string, data []byte) *User {
+		var user User
+		if err := json.Unmarshal(data, &user); err != nil {
+			d.log.Error("Error reading user %s: could not unmarshal data: %v", key, err)
+			return nil
+		}
+		d.compute(join.Collection, &user)
+		return &user
+	}
+
+	found := make(map[string]*User)
+
+	if join.On == "" {
+		keys := make([]string, 0, len(wanted))
+		for key := range wanted {
+			keys = append(keys, key)
+		}
+		data, errs := d.fetch(join.Collection, keys, true)
+		for i, key := range keys {
+			if errors.Is(errs[i], os.ErrNotExist) {
+				continue
+			}
+			if errs[i] != nil {
+				d.log.Error("Error reading user %s: %v", key, errs[i])
+				continue
+			}
+			if user := decode(key, data[i]); user != nil {
+				found[key] = user
+			}
+		}
+		return found, nil
+	}
+
+	err := d.scan(join.Collection, func(key string, data []byte) error {
+		doc, err := decodeDocument(data)
+		if err != nil {
+			return nil
+		}
+		value, ok := fieldKey(doc, join.On)
+		if !ok || !wanted[value] {
+			return nil
+		}
+		if _, seen := found[value]; !seen {
+			if user := decode(key, data); user != nil {
+				found[value] = user
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+// fieldKey returns the string or number at a dot path within doc as a key.
+func fieldKey(doc interface{}, path string) (string, bool) {
+	value, ok := lookupField(doc, strings.Split(path, "."))
+	if !ok {
+		return "", false
+	}
+	switch value := value.(type) {
+	case string:
+		return value, value != ""
+	case json.Number:
+		return value.String(), true
+	}
+	return "", false
+}
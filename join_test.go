@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestQueryJoin(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+	writes := []struct {
+		collection, key string
+		user            User
+	}{
+		{"companies", "acme", User{Name: "Acme Inc"}},
+		{"cities", "c1", User{Name: "Pune", Company: "first"}},
+		{"cities", "c2", User{Name: "Pune", Company: "second"}},
+		{"users", "ann", User{Name: "Ann", Age: "30", Company: "acme", Address: Address{City: "Pune"}}},
+		{"users", "bob", User{Name: "Bob", Age: "40", Company: "globex", Address: Address{City: "Oslo"}}},
+		{"users", "cat", User{Name: "Cat", Age: "50"}},
+		{"users", "dan", User{Name: "Dan", Age: "10", Company: "acme"}},
+	}
+	for _, w := range writes {
+		if err := d.Write(w.collection, w.key, w.user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results, err := d.QueryJoin("users", "Age >= 30",
+		Join{Collection: "companies", Field: "Company"},
+		Join{Collection: "cities", Field: "Address.City", On: "Name", As: "city"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("results = %+v, want ann, bob and cat", results)
+	}
+
+	ann, bob, cat := results[0], results[1], results[2]
+	if ann.Key != "ann" || len(ann.Joined) != 2 || ann.Joined["companies"].Name != "Acme Inc" {
+		t.Errorf("ann = %+v, want her company and city joined", ann)
+	}
+	if city := ann.Joined["city"]; city == nil || city.Company != "first" {
+		t.Errorf("ann's city = %+v, want the first matching in key order", city)
+	}
+	if bob.Key != "bob" || len(bob.Joined) != 0 {
+		t.Errorf("bob = %+v, want nothing joined for values no record has", bob)
+	}
+	if cat.Key != "cat" || cat.Joined != nil {
+		t.Errorf("cat = %+v, want nothing joined without values", cat)
+	}
+
+	if _, err := d.QueryJoin("users", "Age >= 30", Join{Collection: "companies"}); err == nil {
+		t.Error("join without a field succeeded")
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// keyManifestDir holds the key manifests of the file engine, one per
+// collection, inside the database directory.
+const keyManifestDir = ".keys"
+
+// keyManifest is a saved list of the keys of a collection, in order, with
+// the modification times and entry counts of the collection's directories
+// when it was saved. Any record added or removed behind the manifest's back
+// changes one of them, which makes the manifest stale; the counts catch
+// changes within the resolution of the modification times.
+type keyManifest struct {
+	Keys []string               `json:"keys"`
+	Dirs map[string]manifestDir `json:"dirs"`
+}
+
+// manifestDir is the state of a directory of a collection in its manifest.
+type manifestDir struct {
+	Modified int64 `json:"modified"`
+	Entries  int   `json:"entries"`
+}
+
+// manifestKeys are the keys of a collection while the database is open.
+// Only this Driver writes to the directory meanwhile, so once loaded they
+// are kept up to date by put and delete rather than checked again.
+type manifestKeys struct {
+	sync.Mutex
+	keys    []string
+	loaded  bool
+	changed bool // since loaded from or saved to disk
+	removed bool // the saved manifest, now that the collection changed
+}
+
+// manifestEntry returns the in-memory manifest of a collection.
+func (s *fileStorage) manifestEntry(collection string) *manifestKeys {
+	s.manifestMutex.Lock()
+	defer s.manifestMutex.Unlock()
+
+	if s.manifests == nil {
+		s.manifests = make(map[string]*manifestKeys)
+	}
+	m, ok := s.manifests[collection]
+	if !ok {
+		m = &manifestKeys{}
+		s.manifests[collection] = m
+	}
+	return m
+}
+
+func (s *fileStorage) manifestPath(collection string) string {
+	return filepath.Join(s.dir, keyManifestDir, collection+".json")
+}
+
+// sortedKeys returns the keys of a collection in order from its manifest.
+func (s *fileStorage) sortedKeys(collection string) ([]string, error) {
+	var keys []string
+	err := s.readManifest(collection, func(sorted []string) { keys = slices.Clone(sorted) })
+	return keys, err
+}
+
+// readManifest calls read with the keys of a collection in order from its
+// manifest, loading the saved one, or listing the directory if it has none
+// or it is stale. read must not keep or modify the keys.
+func (s *fileStorage) readManifest(collection string, read func(keys []string)) error {
+	m := s.manifestEntry(collection)
+	m.Lock()
+	defer m.Unlock()
+
+	if !m.loaded {
+		keys, ok := s.loadManifest(collection)
+		if !ok {
+			var err error
+			if keys, err = s.listKeys(collection); err != nil {
+				return err
+			}
+			sort.Strings(keys)
+			m.changed = true
+		}
+		m.keys, m.loaded = keys, true
+	}
+	if len(m.keys) == 0 {
+		// Fail as listing does for a collection that does not exist.
+		if _, err := s.listKeys(collection); err != nil {
+			return err
+		}
+	}
+	read(m.keys)
+	return nil
+}
+
+// loadManifest reads the saved manifest of a collection, if it has one
+// that is not stale.
+func (s *fileStorage) loadManifest(collection string) ([]string, bool) {
+	data, err := s.fs.ReadFile(s.manifestPath(collection))
+	if err != nil {
+		return nil, false
+	}
+	var saved keyManifest
+	if json.Unmarshal(data, &saved) != nil || len(saved.Dirs) == 0 {
+		return nil, false
+	}
+	dirs, err := s.manifestDirs(collection)
+	if err != nil || !maps.Equal(dirs, saved.Dirs) {
+		return nil, false
+	}
+	return saved.Keys, true
+}
+
+// invalidateManifest removes the saved manifest of a collection before it
+// first changes, so a crash cannot leave a manifest that looks current.
+func (s *fileStorage) invalidateManifest(collection string) error {
+	if !s.manifest {
+		return nil
+	}
+	m := s.manifestEntry(collection)
+	m.Lock()
+	defer m.Unlock()
+
+	if m.removed {
+		return nil
+	}
+	if err := s.fs.Remove(s.manifestPath(collection)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove key manifest: %v", err)
+	}
+	m.removed = true
+	return nil
+}
+
+// noteKey records in the manifest of a collection that a record was added
+// or removed.
+func (s *fileStorage) noteKey(collection, key string, present bool) {
+	if !s.manifest {
+		return
+	}
+	m := s.manifestEntry(collection)
+	m.Lock()
+	defer m.Unlock()
+
+	if !m.loaded {
+		return
+	}
+	i, found := slices.BinarySearch(m.keys, key)
+	switch {
+	case present && !found:
+		m.keys = slices.Insert(m.keys, i, key)
+	case !present && found:
+		m.keys = slices.Delete(m.keys, i, i+1)
+	default:
+		return
+	}
+	m.changed = true
+}
+
+// forgetManifest drops the manifest of a collection whose records were
+// changed other than by put and delete, so it is listed again.
+func (s *fileStorage) forgetManifest(collection string) error {
+	if err := s.invalidateManifest(collection); err != nil || !s.manifest {
+		return err
+	}
+	m := s.manifestEntry(collection)
+	m.Lock()
+	m.keys, m.loaded = nil, false
+	m.Unlock()
+	return nil
+}
+
+// saveManifests saves the manifests that changed, for the next Driver to
+// load instead of listing the collections again.
+func (s *fileStorage) saveManifests() error {
+	if !s.manifest {
+		return nil
+	}
+	s.manifestMutex.Lock()
+	defer s.manifestMutex.Unlock()
+
+	for collection, m := range s.manifests {
+		if err := s.saveManifest(collection, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileStorage) saveManifest(collection string, m *manifestKeys) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if !m.loaded || !m.changed {
+		return nil
+	}
+	dirs, err := s.manifestDirs(collection)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not save key manifest of collection %s: %v", collection, err)
+	}
+	data, err := json.Marshal(keyManifest{Keys: m.keys, Dirs: dirs})
+	if err != nil {
+		return fmt.Errorf("could not marshal key manifest: %v", err)
+	}
+
+	path := s.manifestPath(collection)
+	if err := s.fs.MkdirAll(filepath.Dir(path), s.layout.dirMode()); err != nil {
+		return fmt.Errorf("could not create key manifest directory: %v", err)
+	}
+	if err := writeFile(s.fs, path+".tmp", data, s.layout.fileMode()); err != nil {
+		return fmt.Errorf("could not write key manifest: %v", err)
+	}
+	if err := s.fs.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("could not move key manifest into place: %v", err)
+	}
+	m.changed, m.removed = false, false
+	return nil
+}
+
+// manifestDirs returns the modification times and entry counts of the
+// directories holding the records of a collection, and of the fan-out
+// directories above them, by path relative to the database directory.
+func (s *fileStorage) manifestDirs(collection string) (map[string]manifestDir, error) {
+	dirs := make(map[string]manifestDir)
+	level := []string{collection}
+	for depth := 0; ; depth++ {
+		var next []string
+		for _, dir := range level {
+			info, err := s.fs.Stat(filepath.Join(s.dir, dir))
+			if err != nil {
+				return nil, err
+			}
+			entries, err := s.fs.ReadDir(filepath.Join(s.dir, dir))
+			if err != nil {
+				return nil, err
+			}
+			dirs[dir] = manifestDir{Modified: info.ModTime().UnixNano(), Entries: len(entries)}
+			if depth == s.layout.fanOut {
+				continue
+			}
+			for _, entry := range entries {
+				if entry.IsDir() && isFanOutDir(entry.Name()) {
+					next = append(next, filepath.Join(dir, entry.Name()))
+				}
+			}
+		}
+		if len(next) == 0 {
+			return dirs, nil
+		}
+		level = next
+	}
+}
+
+// collectManifests removes the saved manifests of collections that no
+// longer exist, and any left half-written, and returns their names.
+func (s *fileStorage) collectManifests(collections []string) ([]string, error) {
+	dir := filepath.Join(s.dir, keyManifestDir)
+	entries, err := s.fs.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read key manifests: %v", err)
+	}
+
+	var removed []string
+	for _, entry := range entries {
+		name := entry.Name()
+		collection, ok := strings.CutSuffix(name, ".json")
+		if ok && slices.Contains(collections, collection) {
+			continue
+		}
+		if err := s.fs.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			return removed, fmt.Errorf("could not remove key manifest: %v", err)
+		}
+		removed = append(removed, filepath.Join(keyManifestDir, name))
+	}
+	return removed, nil
+}
+
+func (s *fileStorage) keyRange(collection, start, end string) ([]string, error) {
+	if !s.manifest {
+		keys, err := s.listKeys(collection)
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(keys)
+		return searchRange(keys, start, end), nil
+	}
+	var keys []string
+	err := s.readManifest(collection, func(sorted []string) {
+		keys = slices.Clone(searchRange(sorted, start, end))
+	})
+	return keys, err
+}
+
+func (s *fileStorage) count(collection string) (int, error) {
+	if !s.manifest {
+		keys, err := s.listKeys(collection)
+		return len(keys), err
+	}
+	var n int
+	err := s.readManifest(collection, func(keys []string) { n = len(keys) })
+	return n, err
+}
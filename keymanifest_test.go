@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// openManifestDB opens a database keeping key manifests, with three users
+// whose manifest was saved by closing it once.
+func openManifestDB(t *testing.T, fanOut int) (*Driver, *fileStorage, string) {
+	t.Helper()
+	dir := t.TempDir()
+	opts := &Options{KeyManifest: true, Layout: &LayoutOptions{FanOut: fanOut}, Slog: openTestLogger()}
+	d, err := New(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"carol", "alice", "bob"} {
+		if err := d.Write("users", key, User{Name: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.Keys("users"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if d, err = New(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d, d.store.(*fileStorage), dir
+}
+
+func TestKeyManifestLoads(t *testing.T) {
+	for _, fanOut := range []int{0, 1} {
+		_, s, _ := openManifestDB(t, fanOut)
+		keys, ok := s.loadManifest("users")
+		if want := []string{"alice", "bob", "carol"}; !ok || !slices.Equal(keys, want) {
+			t.Errorf("fan-out %d: loadManifest = %v, %v, want %v", fanOut, keys, ok, want)
+		}
+	}
+}
+
+func TestKeyManifestStale(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, dir string)
+	}{
+		{"record added", func(t *testing.T, dir string) {
+			if err := os.WriteFile(filepath.Join(dir, "users", "dave.json"), []byte(`{"name":"dave"}`), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"record added within the same modification time", func(t *testing.T, dir string) {
+			users := filepath.Join(dir, "users")
+			info, err := os.Stat(users)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(users, "dave.json"), []byte(`{"name":"dave"}`), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(users, info.ModTime(), info.ModTime()); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"record removed", func(t *testing.T, dir string) {
+			if err := os.Remove(filepath.Join(dir, "users", "bob.json")); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, s, dir := openManifestDB(t, 0)
+			tt.change(t, dir)
+			if keys, ok := s.loadManifest("users"); ok {
+				t.Errorf("loadManifest = %v, want stale", keys)
+			}
+
+			listed, err := s.listKeys("users")
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys, err := d.Keys("users")
+			if err != nil || len(keys) != len(listed) {
+				t.Errorf("Keys = %v, %v, want the %d keys listed", keys, err, len(listed))
+			}
+		})
+	}
+}
+
+func TestCollectManifests(t *testing.T) {
+	_, s, dir := openManifestDB(t, 0)
+	manifests := filepath.Join(dir, keyManifestDir)
+	for _, name := range []string{"gone.json", "users.json.tmp"} {
+		if err := os.WriteFile(filepath.Join(manifests, name), []byte(`{}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := s.collectManifests([]string{"users"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(removed)
+	want := []string{filepath.Join(keyManifestDir, "gone.json"), filepath.Join(keyManifestDir, "users.json.tmp")}
+	if !slices.Equal(removed, want) {
+		t.Errorf("collectManifests = %v, want %v", removed, want)
+	}
+	if _, err := os.Stat(filepath.Join(manifests, "users.json")); err != nil {
+		t.Errorf("manifest of users was removed: %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import "sort"
+
+// keyRanger is implemented by storage engines that keep the keys of a
+// collection sorted, so a range of them is found without listing them all.
+type keyRanger interface {
+	keyRange(collection, start, end string) ([]string, error)
+}
+
+// counter is implemented by storage engines that count the records of a
+// collection without listing them.
+type counter interface {
+	count(collection string) (int, error)
+}
+
+// Keys returns the keys of a collection in lexicographic order.
+func (d *Driver) Keys(collection string) ([]string, error) {
+	if err := d.checkNames(&collection); err != nil {
+		return nil, err
+	}
+
+	keys, err := d.store.keys(collection)
+	if err != nil {
+		return nil, err
+	}
+	// File names sort by key plus extension, which can differ from the
+	// order of the keys themselves.
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Count returns the number of records in a collection.
+func (d *Driver) Count(collection string) (int, error) {
+	if err := d.checkNames(&collection); err != nil {
+		return 0, err
+	}
+	return d.count(collection)
+}
+
+func (d *Driver) count(collection string) (int, error) {
+	if c, ok := d.store.(counter); ok {
+		return c.count(collection)
+	}
+	keys, err := d.store.keys(collection)
+	return len(keys), err
+}
+
+// ReadRange retrieves the users whose keys fall in [startKey, endKey), in
+// key order. An empty endKey reads to the end of the collection, so
+// time-ordered keys can be read from a point on, and a prefix p can be
+// scanned as the range from p to p with its last byte incremented.
+// Unreadable records are treated as in ReadAll. The bounds are folded as
+// keys are by the naming policy.
+func (d *Driver) ReadRange(collection, startKey, endKey string) (_ []User, err error) {
+	if err := d.checkNames(&collection); err != nil {
+		return nil, err
+	}
+	startKey, endKey = d.foldName(startKey), d.foldName(endKey)
+
+	op := d.begin(opReadRange, collection, "")
+	defer op.end(&err)
+
+	return d.readUsers(op, collection, func() ([]string, error) {
+		return d.keyRange(collection, startKey, endKey)
+	})
+}
+
+// ReadPrefix retrieves the users whose keys start with prefix, e.g.
+// "2024-06-", in key order. The prefix is folded as keys are by the naming
+// policy.
+func (d *Driver) ReadPrefix(collection, prefix string) (_ []User, err error) {
+	if err := d.checkNames(&collection); err != nil {
+		return nil, err
+	}
+	prefix = d.foldName(prefix)
+
+	op := d.begin(opReadPrefix, collection, "")
+	defer op.end(&err)
+
+	return d.readUsers(op, collection, func() ([]string, error) {
+		return d.keyRange(collection, prefix, prefixEnd(prefix))
+	})
+}
+
+// keyRange returns the keys of a collection in [start, end) in order, up to
+// the last key when end is empty.
+func (d *Driver) keyRange(collection, start, end string) ([]string, error) {
+	if r, ok := d.store.(keyRanger); ok {
+		return r.keyRange(collection, start, end)
+	}
+
+	keys, err := d.Keys(collection)
+	if err != nil {
+		return nil, err
+	}
+	return searchRange(keys, start, end), nil
+}
+
+// searchRange returns the part of the sorted keys in [start, end).
+func searchRange(keys []string, start, end string) []string {
+	from := sort.SearchStrings(keys, start)
+	to := len(keys)
+	if end != "" {
+		to = max(from, sort.SearchStrings(keys, end))
+	}
+	return keys[from:to]
+}
+
+// prefixEnd returns the smallest key after every key starting with prefix,
+// or "" if there is none.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+func (s *logStorage) keyRange(collection, start, end string) ([]string, error) {
+	keys, err := s.sortedKeys(collection)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string(nil), searchRange(keys, start, end)...), nil
+}
+
+func (s *logStorage) count(collection string) (int, error) {
+	keys, err := s.sortedKeys(collection)
+	return len(keys), err
+}
+
+// sortedKeys returns the keys of the index in order, sorting them only
+// after keys were added or removed.
+func (c *logCollection) sortedKeys() ([]string, error) {
+	c.RLock()
+	sorted, closed := c.sorted, c.closed
+	c.RUnlock()
+	if closed {
+		return nil, errLogClosed
+	}
+	if sorted != nil {
+		return sorted, nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.sorted == nil {
+		c.sorted = make([]string, 0, len(c.index))
+		for key := range c.index {
+			c.sorted = append(c.sorted, key)
+		}
+		sort.Strings(c.sorted)
+	}
+	return c.sorted, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import "errors"
+
+// KV is a map-like view of a collection, for code written against a
+// key-value abstraction rather than the Driver.
+type KV interface {
+	// Get returns the user under key, failing with an error wrapping
+	// os.ErrNotExist if there is none.
+	Get(key string) (User, error)
+	// Set stores value under key, replacing any user stored there.
+	Set(key string, value User) error
+	// Delete removes the user under key.
+	Delete(key string) error
+	// Range calls fn with every user of the collection until fn returns
+	// false. Like sync.Map.Range it visits each key once, in no particular
+	// order; fn may modify the collection, and users it writes meanwhile
+	// may or may not be visited.
+	Range(fn func(key string, value User) bool) error
+}
+
+// errStopRange stops a scan when the function given to Range returns false.
+var errStopRange = errors.New("stop range")
+
+// KV returns a KV over a collection. It goes through the Driver, so hooks,
+// quotas, references and the like apply as they do to Read and Write.
+func (d *Driver) KV(collection string) KV {
+	return collectionKV{d: d, collection: d.foldName(collection)}
+}
+
+type collectionKV struct {
+	d          *Driver
+	collection string
+}
+
+func (kv collectionKV) Get(key string) (User, error) {
+	return kv.d.Read(kv.collection, key)
+}
+
+func (kv collectionKV) Set(key string, value User) error {
+	return kv.d.Write(kv.collection, key, value)
+}
+
+func (kv collectionKV) Delete(key string) error {
+	return kv.d.Delete(kv.collection, key)
+}
+
+// Range scans the collection a batch at a time; fn is called with no lock
+// held.
+func (kv collectionKV) Range(fn func(key string, value User) bool) (err error) {
+	d := kv.d
+	if err := d.checkNames(&kv.collection); err != nil {
+		return err
+	}
+	op := d.begin(opReadAll, kv.collection, "")
+	defer op.end(&err)
+
+	err = d.scan(kv.collection, func(key string, data []byte) error {
+		user, size, err := d.readUser(kv.collection, key, func() ([]byte, error) { return data, nil })
+		op.bytes += size
+		if err != nil {
+			d.log.Error("Error reading user %s: %v", key, err)
+			return nil
+		}
+		if !fn(key, user) {
+			return errStopRange
+		}
+		return nil
+	})
+	if errors.Is(err, errStopRange) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// layoutFile records the layout of the record files of a database, inside
+// its directory, when it is not the default.
+const layoutFile = ".layout.json"
+
+// transientFiles are the files and directories of a database holding the
+// running state of a Driver rather than data.
+var transientFiles = []string{
+	lockFileName,
+	changeLogDir,
+	streamDir,
+	clusterDir,
+	healthProbeFile,
+	pauseRequestFile,
+	pauseAckFile,
+}
+
+// TransientFile reports whether a file or directory of a database, by
+// name, holds the running state of a Driver rather than data, so tools
+// copying or comparing databases can leave it out.
+func TransientFile(name string) bool {
+	return slices.Contains(transientFiles, name) || strings.HasSuffix(name, compactSuffix)
+}
+
+// maxFanOut bounds LayoutOptions.FanOut: three levels already give 16M
+// directories.
+const maxFanOut = 3
+
+// LayoutOptions configures the files and directories of a database.
+type LayoutOptions struct {
+	// FileMode is the permissions of the files created. Defaults to 0644.
+	FileMode os.FileMode
+	// DirMode is the permissions of the directories created. Defaults to
+	// 0755.
+	DirMode os.FileMode
+	// Extension is the extension of record files of the file engine,
+	// including its dot. Defaults to ".json". It and FanOut apply to the
+	// database directory and Options.Shards, not to Options.Store.
+	Extension string
+	// FanOut spreads the records of each collection of the file engine
+	// over FanOut levels of subdirectories, 256 per level, picked by a hash
+	// of the key, so no directory grows to hundreds of thousands of
+	// entries. At most 3.
+	FanOut int
+}
+
+// layout is how a Driver lays out its files. The zero layout is the
+// default.
+type layout struct {
+	file, dir os.FileMode
+	ext       string
+	fanOut    int
+}
+
+// storedLayout is the content of layoutFile.
+type storedLayout struct {
+	Extension string `json:"extension,omitempty"`
+	FanOut    int    `json:"fanOut,omitempty"`
+}
+
+func (l layout) fileMode() os.FileMode {
+	if l.file == 0 {
+		return 0644
+	}
+	return l.file
+}
+
+func (l layout) dirMode() os.FileMode {
+	if l.dir == 0 {
+		return 0755
+	}
+	return l.dir
+}
+
+func (l layout) extension() string {
+	if l.ext == "" {
+		return ".json"
+	}
+	return l.ext
+}
+
+// recordDir returns the directory holding the file of a record.
+func (l layout) recordDir(root, collection, key string) string {
+	dir := filepath.Join(root, collection)
+	if l.fanOut == 0 {
+		return dir
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	sum := h.Sum32()
+	for i := 0; i < l.fanOut; i++ {
+		dir = filepath.Join(dir, fmt.Sprintf("%02x", byte(sum>>(8*i))))
+	}
+	return dir
+}
+
+// recordPath returns the path of the file of a record.
+func (l layout) recordPath(root, collection, key string) string {
+	return filepath.Join(l.recordDir(root, collection, key), key+l.extension())
+}
+
+// recordDirs returns the existing directories holding the record files of
+// a collection.
+func (l layout) recordDirs(fsys FS, root, collection string) ([]string, error) {
+	dirs := []string{filepath.Join(root, collection)}
+	for level := 0; level < l.fanOut; level++ {
+		var next []string
+		for _, dir := range dirs {
+			entries, err := fsys.ReadDir(dir)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				if entry.IsDir() && isFanOutDir(entry.Name()) {
+					next = append(next, filepath.Join(dir, entry.Name()))
+				}
+			}
+		}
+		dirs = next
+	}
+	return dirs, nil
+}
+
+func isFanOutDir(name string) bool {
+	return len(name) == 2 && strings.Trim(name, "0123456789abcdef") == ""
+}
+
+// removeEmptyDirs removes the fan-out directories above a record file that
+// held nothing else, and its collection directory if it is empty then. It
+// reports whether the collection directory was removed.
+func (l layout) removeEmptyDirs(fsys FS, root, collection, dir string) bool {
+	top := filepath.Join(root, collection)
+	for {
+		if fsys.Remove(dir) != nil {
+			return false
+		}
+		if dir == top {
+			return true
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// optionLayout returns the permissions set by the layout options.
+func optionLayout(opts *LayoutOptions) layout {
+	if opts == nil {
+		return layout{}
+	}
+	return layout{file: opts.FileMode.Perm(), dir: opts.DirMode.Perm()}
+}
+
+// resolveLayout combines the layout options with the layout the database
+// in dir was created with. The extension and fan-out of a database holding
+// collections cannot change; dump and load it into a new database instead.
+func resolveLayout(fsys FS, dir string, shards []string, opts *LayoutOptions, readOnly bool) (layout, error) {
+	l := optionLayout(opts)
+	var stored storedLayout
+	data, err := fsys.ReadFile(filepath.Join(dir, layoutFile))
+	if err != nil && !os.IsNotExist(err) {
+		return l, fmt.Errorf("could not read layout: %v", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return l, fmt.Errorf("could not read layout: %v", err)
+		}
+	}
+	l.ext, l.fanOut = stored.Extension, stored.FanOut
+	if opts == nil {
+		return l, nil
+	}
+
+	want := stored
+	switch ext := opts.Extension; {
+	case ext == ".json":
+		want.Extension = ""
+	case ext == "":
+	case len(ext) < 2 || ext[0] != '.' || filepath.Base(ext) != ext ||
+		ext == checksumExt || ext == compactSuffix || ext == ".tmp":
+		return l, fmt.Errorf("invalid record file extension %q", ext)
+	default:
+		want.Extension = ext
+	}
+	if opts.FanOut < 0 || opts.FanOut > maxFanOut {
+		return l, fmt.Errorf("fan-out %d is not between 0 and %d", opts.FanOut, maxFanOut)
+	}
+	if opts.FanOut != 0 {
+		want.FanOut = opts.FanOut
+	}
+	if want == stored {
+		return l, nil
+	}
+
+	// Shards hold records in the database's layout too; those not created
+	// yet hold none.
+	for i, dir := range append([]string{dir}, shards...) {
+		entries, err := fsys.ReadDir(dir)
+		if err != nil && (i == 0 || !os.IsNotExist(err)) {
+			return l, fmt.Errorf("could not read directory: %v", err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() && entry.Name()[0] != '.' {
+				return l, fmt.Errorf("database was created with extension %q and fan-out %d; dump and load it to change its layout",
+					layout{ext: stored.Extension}.extension(), stored.FanOut)
+			}
+		}
+	}
+	if readOnly {
+		return l, errors.New("cannot set the layout of a read-only database")
+	}
+
+	if data, err = json.Marshal(want); err != nil {
+		return l, err
+	}
+	if err := writeFile(fsys, filepath.Join(dir, layoutFile), data, l.fileMode()); err != nil {
+		return l, fmt.Errorf("could not write layout: %v", err)
+	}
+	l.ext, l.fanOut = want.Extension, want.FanOut
+	return l, nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// errInterrupt is returned by readLine when the user presses Ctrl-C.
+var errInterrupt = errors.New("interrupted")
+
+// maxHistory bounds the lines kept in the history file.
+const maxHistory = 1000
+
+// lineEditor reads lines from a terminal with history and tab completion,
+// falling back to plain line reads when input is not a terminal.
+type lineEditor struct {
+	in          *os.File
+	out         io.Writer
+	reader      *bufio.Reader
+	terminal    bool
+	history     []string
+	historyPath string
+	// complete returns the candidates for the word ending the text before
+	// the cursor.
+	complete func(before string) []string
+}
+
+func newLineEditor(in *os.File, out io.Writer, historyPath string) *lineEditor {
+	e := &lineEditor{
+		in:          in,
+		out:         out,
+		reader:      bufio.NewReader(in),
+		terminal:    isTerminal(in.Fd()),
+		historyPath: historyPath,
+	}
+
+	if data, err := os.ReadFile(historyPath); err == nil {
+		e.history = strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+		if len(e.history) > maxHistory {
+			e.history = e.history[len(e.history)-maxHistory:]
+		}
+	}
+	return e
+}
+
+// addHistory records a line unless it repeats the previous one.
+func (e *lineEditor) addHistory(line string) {
+	if line == "" || (len(e.history) > 0 && e.history[len(e.history)-1] == line) {
+		return
+	}
+	e.history = append(e.history, line)
+
+	if e.historyPath == "" {
+		return
+	}
+	if file, err := os.OpenFile(e.historyPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err == nil {
+		fmt.Fprintln(file, line)
+		file.Close()
+	}
+}
+
+// readLine reads one line after printing prompt. It returns io.EOF on
+// Ctrl-D at an empty line and errInterrupt on Ctrl-C.
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	if !e.terminal {
+		return e.readPlain(prompt)
+	}
+	restore, err := makeRaw(e.in.Fd())
+	if err != nil {
+		return e.readPlain(prompt)
+	}
+	defer restore()
+
+	var line []rune
+	pos := 0
+	browse := len(e.history)
+	var draft []rune
+
+	redraw := func() {
+		fmt.Fprintf(e.out, "\r%s%s\x1b[K", prompt, string(line))
+		if back := len(line) - pos; back > 0 {
+			fmt.Fprintf(e.out, "\x1b[%dD", back)
+		}
+	}
+	recall := func(i int) {
+		if browse == len(e.history) {
+			draft = line
+		}
+		browse = i
+		if i == len(e.history) {
+			line = draft
+		} else {
+			line = []rune(e.history[i])
+		}
+		pos = len(line)
+	}
+
+	redraw()
+	for {
+		r, _, err := e.reader.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\n")
+			return string(line), nil
+		case 3: // Ctrl-C
+			fmt.Fprint(e.out, "^C\n")
+			return "", errInterrupt
+		case 4: // Ctrl-D
+			if len(line) == 0 {
+				fmt.Fprint(e.out, "\n")
+				return "", io.EOF
+			}
+			if pos < len(line) {
+				line = append(line[:pos], line[pos+1:]...)
+			}
+		case 127, 8: // Backspace
+			if pos > 0 {
+				line = append(line[:pos-1], line[pos:]...)
+				pos--
+			}
+		case 1: // Ctrl-A
+			pos = 0
+		case 5: // Ctrl-E
+			pos = len(line)
+		case 21: // Ctrl-U
+			line, pos = append([]rune(nil), line[pos:]...), 0
+		case '\t':
+			line, pos = e.completeLine(line, pos)
+		case 27:
+			switch e.readEscape() {
+			case 'A':
+				if browse > 0 {
+					recall(browse - 1)
+				}
+			case 'B':
+				if browse < len(e.history) {
+					recall(browse + 1)
+				}
+			case 'C':
+				if pos < len(line) {
+					pos++
+				}
+			case 'D':
+				if pos > 0 {
+					pos--
+				}
+			case 'H':
+				pos = 0
+			case 'F':
+				pos = len(line)
+			case '3': // Delete
+				if pos < len(line) {
+					line = append(line[:pos], line[pos+1:]...)
+				}
+			}
+		default:
+			if r >= ' ' {
+				line = append(line[:pos], append([]rune{r}, line[pos:]...)...)
+				pos++
+			}
+		}
+		redraw()
+	}
+}
+
+// readEscape reads the rest of an ANSI escape sequence and returns its
+// final byte (or the digit of a "~" sequence such as Delete).
+func (e *lineEditor) readEscape() byte {
+	b, err := e.reader.ReadByte()
+	if err != nil || (b != '[' && b != 'O') {
+		return 0
+	}
+	b, err = e.reader.ReadByte()
+	if err != nil {
+		return 0
+	}
+	if b >= '0' && b <= '9' {
+		for {
+			next, err := e.reader.ReadByte()
+			if err != nil || next == '~' || (next >= 'A' && next <= 'Z') {
+				break
+			}
+		}
+	}
+	return b
+}
+
+// completeLine completes the word before the cursor: a single candidate
+// replaces it, followed by a space; with several, their common prefix
+// replaces it and the candidates are listed.
+func (e *lineEditor) completeLine(line []rune, pos int) ([]rune, int) {
+	if e.complete == nil {
+		return line, pos
+	}
+
+	before := string(line[:pos])
+	start := wordStart(before)
+	candidates := e.complete(before)
+	if len(candidates) == 0 {
+		return line, pos
+	}
+
+	replacement := commonPrefix(candidates)
+	if len(candidates) == 1 {
+		replacement += " "
+	} else if len(replacement) <= len(before)-start {
+		fmt.Fprintf(e.out, "\n%s\n", strings.Join(candidates, "  "))
+		return line, pos
+	}
+
+	head := []rune(before[:start])
+	completed := append(append(head, []rune(replacement)...), line[pos:]...)
+	return completed, len(head) + len([]rune(replacement))
+}
+
+// wordStart returns where the last word of s begins, treating a quoted
+// word that is still open as one word.
+func wordStart(s string) int {
+	start, quoted := 0, false
+	for i, c := range s {
+		switch {
+		case c == '"':
+			if !quoted {
+				start = i
+			}
+			quoted = !quoted
+		case !quoted && (c == ' ' || c == '\t'):
+			start = i + 1
+		}
+	}
+	return start
+}
+
+func (e *lineEditor) readPlain(prompt string) (string, error) {
+	if e.terminal {
+		fmt.Fprint(e.out, prompt)
+	}
+	line, err := e.reader.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, w := range words[1:] {
+		for !strings.HasPrefix(w, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// openLineEditor returns an editor reading input from a file, which is not
+// a terminal, and writing to out.
+func openLineEditor(t *testing.T, input string, out io.Writer, historyPath string) *lineEditor {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "input")
+	if err := os.WriteFile(path, []byte(input), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	in, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { in.Close() })
+	return newLineEditor(in, out, historyPath)
+}
+
+func TestLineEditorReadsPlainLines(t *testing.T) {
+	var out strings.Builder
+	e := openLineEditor(t, "ls\r\nget users ann\nlast", &out, "")
+	if e.terminal {
+		t.Fatal("a file was taken for a terminal")
+	}
+	var lines []string
+	for {
+		line, err := e.readLine("db> ")
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	if want := []string{"ls", "get users ann", "last"}; !slices.Equal(lines, want) {
+		t.Errorf("read %q, want %q", lines, want)
+	}
+	if out.Len() != 0 {
+		t.Errorf("prompted %q when not on a terminal", out.String())
+	}
+}
+
+func TestLineEditorHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	var saved []string
+	for i := 0; i < maxHistory+5; i++ {
+		saved = append(saved, fmt.Sprint("ls ", i))
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(saved, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	e := openLineEditor(t, "", io.Discard, path)
+	if len(e.history) != maxHistory || e.history[0] != "ls 5" {
+		t.Fatalf("loaded %d lines from %q, want the last %d", len(e.history), e.history[0], maxHistory)
+	}
+	for _, line := range []string{"get users ann", "get users ann", ""} {
+		e.addHistory(line)
+	}
+	if got := e.history[len(e.history)-2:]; !slices.Equal(got, []string{fmt.Sprint("ls ", maxHistory+4), "get users ann"}) {
+		t.Errorf("history ends with %q, want one get added", got)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("ls %d\nget users ann\n", maxHistory+4); !strings.HasSuffix(string(data), want) {
+		t.Errorf("history file does not end with %q", want)
+	}
+}
+
+func TestLineEditorCompleteLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		pos     int
+		want    string
+		wantPos int
+		listed  string
+	}{
+		{"get users a", 11, "get users ann ", 14, ""},
+		{"get users b", 11, "get users bob", 13, ""},
+		{"get users bob", 13, "get users bob", 13, "\nbob  bobby\n"},
+		{"get users c", 11, "get users c", 11, ""},
+		{"get users a Age", 11, "get users ann  Age", 14, ""},
+		{"get users x", 11, "get users x", 11, ""},
+	}
+	candidates := []string{"ann", "bob", "bobby"}
+	for _, tt := range tests {
+		var out strings.Builder
+		e := openLineEditor(t, "", &out, "")
+		e.complete = func(before string) []string {
+			word := before[wordStart(before):]
+			var matches []string
+			for _, c := range candidates {
+				if strings.HasPrefix(c, word) && word != "" {
+					matches = append(matches, c)
+				}
+			}
+			return matches
+		}
+		line, pos := e.completeLine([]rune(tt.line), tt.pos)
+		if string(line) != tt.want || pos != tt.wantPos {
+			t.Errorf("completeLine(%q, %d) = %q, %d, want %q, %d", tt.line, tt.pos, string(line), pos, tt.want, tt.wantPos)
+		}
+		if out.String() != tt.listed {
+			t.Errorf("completeLine(%q, %d) listed %q, want %q", tt.line, tt.pos, out.String(), tt.listed)
+		}
+	}
+}
+
+func TestWordStart(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"", 0},
+		{"get", 0},
+		{"get ", 4},
+		{"get users", 4},
+		{"get\tusers", 4},
+		{`get users "bob s`, 10},
+		{`get users "bob smith" A`, 22},
+	}
+	for _, tt := range tests {
+		if got := wordStart(tt.s); got != tt.want {
+			t.Errorf("wordStart(%q) = %d, want %d", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestCommonPrefix(t *testing.T) {
+	tests := []struct {
+		words []string
+		want  string
+	}{
+		{[]string{"query"}, "query"},
+		{[]string{"query", "quit"}, "qu"},
+		{[]string{"bob", "bobby"}, "bob"},
+		{[]string{"ann", "bob"}, ""},
+	}
+	for _, tt := range tests {
+		if got := commonPrefix(tt.words); got != tt.want {
+			t.Errorf("commonPrefix(%q) = %q, want %q", tt.words, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import "errors"
+
+// linkCount is unavailable on this platform; GC keeps every deduplicated
+// body.
+func linkCount(path string) (int, error) {
+	return 0, errors.New("link counts are not available on this platform")
+}
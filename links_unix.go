@@ -0,0 +1,22 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// linkCount returns how many names the file at path has.
+func linkCount(path string) (int, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, errors.New("link counts are not available on this file system")
+	}
+	return int(st.Nlink), nil
+}
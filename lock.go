@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// lockFileName is the file New locks so that only one process writes to a
+// database directory at a time.
+const lockFileName = ".lock"
+
+var (
+	// ErrLocked is returned by New when another process holds the lock.
+	ErrLocked = errors.New("database is locked by another process")
+	// ErrReadOnly is returned by writes on a Driver opened read-only.
+	ErrReadOnly = errors.New("database is opened read-only")
+)
+
+// dirLock is an OS-level lock on a database directory.
+type dirLock struct {
+	file *os.File
+}
+
+// lockDir locks the database directory: exclusively for a writer, shared
+// for read-only access. Any number of read-only Drivers may share a
+// directory, but never together with a writer.
+func lockDir(dir string, shared bool) (*dirLock, error) {
+	path := filepath.Join(dir, lockFileName)
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil && shared {
+		// A read-only Driver may not be able to create or write the file.
+		file, err = os.Open(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open lock file: %v", err)
+	}
+
+	if err := lockFile(file, shared); err != nil {
+		file.Close()
+		if errors.Is(err, errWouldBlock) && shared {
+			// Only a writer blocks a shared lock, and writers record their pid.
+			return nil, fmt.Errorf("%w: %s%s", ErrLocked, dir, lockHolder(path))
+		}
+		if errors.Is(err, errWouldBlock) {
+			return nil, fmt.Errorf("%w: %s", ErrLocked, dir)
+		}
+		return nil, fmt.Errorf("could not lock %s: %v", path, err)
+	}
+
+	if !shared {
+		file.Truncate(0)
+		file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return &dirLock{file: file}, nil
+}
+
+// lockHolder describes the writer holding the lock.
+func lockHolder(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil || len(strings.TrimSpace(string(data))) == 0 {
+		return ""
+	}
+	return " (held by pid " + strings.TrimSpace(string(data)) + ")"
+}
+
+func (l *dirLock) release() error {
+	if l == nil {
+		return nil
+	}
+	unlockFile(l.file)
+	return l.file.Close()
+}
+
+// writable fails writes on a read-only Driver, a replication follower or
+// a cluster node, which only replicates plain writes and deletes.
+func (d *Driver) writable() error {
+	if err := d.recordWritable(); err != nil {
+		return err
+	}
+	if d.cluster != nil {
+		return ErrNotReplicated
+	}
+	return nil
+}
+
+// recordWritable is writable for the plain writes and deletes a cluster
+// replicates, which fail only on nodes other than the leader.
+func (d *Driver) recordWritable() error {
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if d.replica.following() {
+		return ErrFollower
+	}
+	return d.cluster.writable()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// slogLogger adapts a *slog.Logger to the Logger interface.
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// LevelFatal is the slog level Logger.Fatal messages are logged at.
+const LevelFatal = slog.LevelError + 4
+
+// NewSlogLogger returns a Logger that writes through l.
+func NewSlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l: l}
+}
+
+func (s slogLogger) Fatal(format string, v ...interface{}) { s.log(LevelFatal, format, v) }
+func (s slogLogger) Error(format string, v ...interface{}) { s.log(slog.LevelError, format, v) }
+func (s slogLogger) Info(format string, v ...interface{})  { s.log(slog.LevelInfo, format, v) }
+func (s slogLogger) Debug(format string, v ...interface{}) { s.log(slog.LevelDebug, format, v) }
+
+func (s slogLogger) log(level slog.Level, format string, v []interface{}) {
+	s.l.Log(context.Background(), level, fmt.Sprintf(format, v...))
+}
+
+// loggerHandler is a slog.Handler writing to a Logger, so structured
+// records still reach a plain Logger such as lumber, rendered as
+// "message key=value ...".
+type loggerHandler struct {
+	log   Logger
+	attrs []slog.Attr
+	group string
+}
+
+// Enabled filters out debug records early when the Logger can tell it
+// would drop them anyway, as lumber's loggers can.
+func (h loggerHandler) Enabled(_ context.Context, level slog.Level) bool {
+	if l, ok := h.log.(interface{ IsDebug() bool }); ok && level < slog.LevelInfo {
+		return l.IsDebug()
+	}
+	return true
+}
+
+func (h loggerHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	b.WriteString(r.Message)
+
+	write := func(a slog.Attr) bool {
+		key := a.Key
+		if h.group != "" {
+			key = h.group + "." + key
+		}
+		fmt.Fprintf(&b, " %s=%v", key, a.Value)
+		return true
+	}
+	for _, a := range h.attrs {
+		write(a)
+	}
+	r.Attrs(write)
+
+	switch {
+	case r.Level >= LevelFatal:
+		h.log.Fatal("%s", b.String())
+	case r.Level >= slog.LevelError:
+		h.log.Error("%s", b.String())
+	case r.Level >= slog.LevelInfo:
+		h.log.Info("%s", b.String())
+	default:
+		h.log.Debug("%s", b.String())
+	}
+	return nil
+}
+
+func (h loggerHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h.attrs = append(append([]slog.Attr(nil), h.attrs...), attrs...)
+	return h
+}
+
+func (h loggerHandler) WithGroup(name string) slog.Handler {
+	if h.group != "" {
+		name = h.group + "." + name
+	}
+	h.group = name
+	return h
+}
+
+// log writes a structured record of a finished operation: at the
+// configured operation level on success, at error level on failure.
+func (op *operation) log(err error) {
+	level := slog.LevelDebug
+	if op.d.opts.OpLogLevel != nil {
+		level = op.d.opts.OpLogLevel.Level()
+	}
+	if err != nil {
+		level = slog.LevelError
+	}
+
+	ctx := context.Background()
+	if !op.d.slog.Enabled(ctx, level) {
+		return
+	}
+
+	attrs := []slog.Attr{
+		slog.String("op", op.name),
+		slog.String("collection", op.collection),
+	}
+	if op.key != "" {
+		attrs = append(attrs, slog.String("key", op.key))
+	}
+	attrs = append(attrs, slog.Duration("duration", op.elapsed), slog.Int("bytes", op.bytes))
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	op.d.slog.LogAttrs(ctx, level, "db operation", attrs...)
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	logFileName   = "data.log"
+	logHeaderSize = 13 // crc (4) + kind (1) + key length (4) + value length (4)
+
+	logPut    byte = 1
+	logDelete byte = 2
+
+	// maxLogEntrySize bounds the key and value lengths read from a header,
+	// so a corrupt header cannot trigger a huge allocation.
+	maxLogEntrySize = 1 << 30
+	// maxTornTail bounds the bad tail of a log taken for an interrupted
+	// append; anything longer is reported as corruption.
+	maxTornTail = 64 << 20
+)
+
+// logStorage keeps all records of a collection in a single append-only file
+// (dir/<collection>/data.log) and serves reads through an in-memory index of
+// where the latest value of every key lives, bitcask-style. Overwrites and
+// deletes only append; the superseded entries stay in the file as dead bytes.
+type logStorage struct {
+	mutex       sync.Mutex
+	dir         string
+	mmap        bool
+	layout      layout
+	collections map[string]*logCollection
+	// bulk holds the collections being bulk loaded.
+	bulk       map[string]bool
+	durability Durability
+	// readOnly opens logs for reading only and leaves them as they are.
+	readOnly bool
+
+	hits, misses uint64
+}
+
+// logCollection is the open log file of one collection and its key index.
+type logCollection struct {
+	sync.RWMutex
+	path  string
+	file  *os.File
+	size  int64
+	dead  int64
+	index map[string]logEntry
+	// sorted caches the keys of the index in order. It is dropped rather
+	// than modified when keys come or go, so callers may keep it.
+	sorted []string
+
+	// mapped is a read-only mapping of the head of the file when reads are
+	// memory-mapped. Entries past its end are read with ReadAt until the
+	// next remap.
+	mmap   bool
+	mapped []byte
+	// mode is the permissions of files written for the log.
+	mode os.FileMode
+	// readOnly is set when the log is opened for reading only.
+	readOnly bool
+
+	// bulk buffers appends during a bulk load; buffered is set while it
+	// holds entries not yet in the file.
+	bulk     *bufio.Writer
+	buffered atomic.Bool
+
+	// dirty is set under DurabilityInterval while appends are not synced.
+	durability Durability
+	dirty      bool
+
+	// closed is set once the log is closed to be replayed from disk, so
+	// callers still holding it open it again.
+	closed bool
+}
+
+// errLogClosed is returned by a logCollection closed to be replayed.
+var errLogClosed = errors.New("log was closed")
+
+// logEntry locates the latest put of a key within the log.
+type logEntry struct {
+	offset int64
+	size   int64
+}
+
+func newLogStorage(dir string, mmap bool, l layout, readOnly bool) *logStorage {
+	return &logStorage{
+		dir:         dir,
+		mmap:        mmap,
+		layout:      l,
+		readOnly:    readOnly,
+		collections: make(map[string]*logCollection),
+		bulk:        make(map[string]bool),
+	}
+}
+
+// collection returns the open log of a collection, opening (and replaying)
+// it on first use. Unless create is set, a missing log is reported as such
+// instead of being created.
+func (s *logStorage) collection(name string, create bool) (*logCollection, error) {
+	if err := checkPath(name); err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if c, ok := s.collections[name]; ok {
+		return c, nil
+	}
+
+	path := filepath.Join(s.dir, name, logFileName)
+	if !create || s.readOnly {
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
+		}
+	}
+
+	c, err := openLogCollection(path, s.mmap, s.layout, s.readOnly)
+	if err != nil {
+		return nil, err
+	}
+	if s.bulk[name] {
+		c.startBulk()
+	}
+	c.durability = s.durability
+	s.collections[name] = c
+	return c, nil
+}
+
+// withCollection calls fn with the open log of a collection, opening it
+// again if it was closed to be replayed meanwhile.
+func (s *logStorage) withCollection(name string, create bool, fn func(c *logCollection) error) error {
+	for {
+		c, err := s.collection(name, create)
+		if err != nil {
+			return err
+		}
+		if err := fn(c); !errors.Is(err, errLogClosed) {
+			return err
+		}
+	}
+}
+
+func (s *logStorage) put(collection, key string, data []byte) error {
+	return s.withCollection(collection, true, func(c *logCollection) error {
+		if err := c.append(logPut, key, data); err != nil {
+			if errors.Is(err, errLogClosed) {
+				return err
+			}
+			return fmt.Errorf("could not write data to log: %v", err)
+		}
+		return nil
+	})
+}
+
+func (s *logStorage) get(collection, key string) ([]byte, error) {
+	var data []byte
+	var mapped bool
+	err := s.withCollection(collection, false, func(c *logCollection) error {
+		if err := c.flushForRead(); err != nil {
+			return err
+		}
+		var err error
+		data, mapped, err = c.get(key)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read file: %w", err)
+	}
+	if mapped {
+		atomic.AddUint64(&s.hits, 1)
+	} else if s.mmap {
+		atomic.AddUint64(&s.misses, 1)
+	}
+	return data, nil
+}
+
+func (s *logStorage) delete(collection, key string) error {
+	return s.withCollection(collection, false, func(c *logCollection) error {
+		c.Lock()
+		_, exists := c.index[key]
+		closed := c.closed
+		c.Unlock()
+		switch {
+		case closed:
+			return errLogClosed
+		case !exists:
+			return fmt.Errorf("could not delete file: %w", c.notFound(key))
+		}
+
+		if err := c.append(logDelete, key, nil); err != nil {
+			if errors.Is(err, errLogClosed) {
+				return err
+			}
+			return fmt.Errorf("could not write tombstone to log: %v", err)
+		}
+		return nil
+	})
+}
+
+func (s *logStorage) keys(collection string) ([]string, error) {
+	keys, err := s.sortedKeys(collection)
+	return append([]string(nil), keys...), err
+}
+
+// sortedKeys returns the cached sorted keys of a collection, which must not
+// be modified.
+func (s *logStorage) sortedKeys(collection string) ([]string, error) {
+	var keys []string
+	err := s.withCollection(collection, false, func(c *logCollection) error {
+		var err error
+		keys, err = c.sortedKeys()
+		return err
+	})
+	if os.IsNotExist(err) {
+		// A configured collection may not have been written to yet.
+		if _, statErr := os.Stat(filepath.Join(s.dir, collection, metaFile)); statErr == nil {
+			return nil, nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read directory: %v", err)
+	}
+	return keys, nil
+}
+
+func (s *logStorage) close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var firstErr error
+	for name, c := range s.collections {
+		c.Lock()
+		if err := c.shut(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("could not close log of collection %s: %v", name, err)
+		}
+		c.Unlock()
+		delete(s.collections, name)
+	}
+	return firstErr
+}
+
+// shut flushes and closes the log, unmapping it, and marks it closed. The
+// caller holds the write lock.
+func (c *logCollection) shut() error {
+	err := c.flushBulk()
+	munmap(c.mapped)
+	c.mapped, c.closed = nil, true
+	if closeErr := c.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// openLogCollection opens the log at path, creating it if needed, and
+// rebuilds the key index by replaying it. With readOnly set the log must
+// exist and is not modified.
+func openLogCollection(path string, mmap bool, l layout, readOnly bool) (*logCollection, error) {
+	if readOnly {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not open log: %v", err)
+		}
+		return loadLogCollection(path, file, mmap, l, true)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), l.dirMode()); err != nil {
+		return nil, fmt.Errorf("could not create collection directory: %v", err)
+	}
+
+	// A leftover compaction output means the process died before the swap;
+	// the original log is still authoritative.
+	if err := os.Remove(path + compactSuffix); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not remove stale compaction file: %v", err)
+	}
+
+	_, statErr := os.Stat(path)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, l.fileMode())
+	if err != nil {
+		return nil, fmt.Errorf("could not open log: %v", err)
+	}
+	// A new log, and the collection directory it may have come with, must
+	// survive a power loss along with the appends to it.
+	if os.IsNotExist(statErr) {
+		dir := filepath.Dir(path)
+		if err := syncDir(OSFS{}, dir); err == nil {
+			err = syncDir(OSFS{}, filepath.Dir(dir))
+		}
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("could not sync collection directory: %v", err)
+		}
+	}
+	return loadLogCollection(path, file, mmap, l, false)
+}
+
+// loadLogCollection replays the open log file into a new collection.
+func loadLogCollection(path string, file *os.File, mmap bool, l layout, readOnly bool) (*logCollection, error) {
+	c := &logCollection{path: path, file: file, index: make(map[string]logEntry), mmap: mmap, mode: l.fileMode(), readOnly: readOnly}
+	if err := c.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	c.remap()
+	return c, nil
+}
+
+// load replays the log into the index. An incomplete entry at the tail, left
+// behind by a crash in the middle of an append, is truncated away, or only
+// skipped when the log is read-only; a checksum mismatch anywhere else is
+// reported as corruption.
+func (c *logCollection) load() error {
+	r := bufio.NewReader(io.NewSectionReader(c.file, 0, 1<<62))
+
+	var offset int64
+	for {
+		kind, key, _, size, err := readLogEntry(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			torn, tornErr := c.tornTail(offset)
+			if tornErr != nil {
+				return fmt.Errorf("could not read log %s: %v", c.path, tornErr)
+			}
+			if !torn {
+				return fmt.Errorf("corrupt log %s at offset %d: %v", c.path, offset, err)
+			}
+			if c.readOnly {
+				break
+			}
+			if err := c.file.Truncate(offset); err != nil {
+				return fmt.Errorf("could not truncate torn log entry: %v", err)
+			}
+			break
+		}
+
+		c.apply(kind, key, logEntry{offset: offset, size: size})
+		offset += size
+	}
+
+	c.size = offset
+	return nil
+}
+
+// tornTail reports whether the log from offset on, where an entry failed to
+// decode, is what a crash part way through appending leaves behind: a
+// prefix of an entry, one failing its checksum or zeros where the file grew
+// before its data was written. That is the case when no valid entry follows.
+func (c *logCollection) tornTail(offset int64) (bool, error) {
+	info, err := c.file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if info.Size()-offset > maxTornTail {
+		return false, nil
+	}
+	tail := make([]byte, info.Size()-offset)
+	if _, err := c.file.ReadAt(tail, offset); err != nil && err != io.EOF {
+		return false, err
+	}
+	for i := 1; i+logHeaderSize <= len(tail); i++ {
+		if _, _, _, _, err := decodeLogEntry(tail[i:]); err == nil {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// apply records an entry in the index, accounting for the bytes it makes dead.
+func (c *logCollection) apply(kind byte, key string, entry logEntry) {
+	old, ok := c.index[key]
+	if ok {
+		c.dead += old.size
+	}
+
+	if kind == logDelete {
+		delete(c.index, key)
+		c.dead += entry.size
+		c.sorted = nil
+		return
+	}
+	if !ok {
+		c.sorted = nil
+	}
+	c.index[key] = entry
+}
+
+// append writes one entry at the end of the log and updates the index.
+func (c *logCollection) append(kind byte, key string, value []byte) error {
+	buf := encodeLogEntry(kind, key, value)
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.closed {
+		return errLogClosed
+	}
+	if c.bulk != nil {
+		if _, err := c.bulk.Write(buf); err != nil {
+			return err
+		}
+		c.buffered.Store(c.bulk.Buffered() > 0)
+		c.apply(kind, key, logEntry{offset: c.size, size: int64(len(buf))})
+		c.size += int64(len(buf))
+		return nil
+	}
+
+	if _, err := c.file.WriteAt(buf, c.size); err != nil {
+		return err
+	}
+
+	c.apply(kind, key, logEntry{offset: c.size, size: int64(len(buf))})
+	c.size += int64(len(buf))
+
+	// Remap once the unmapped tail outgrows the mapping, so the mapping
+	// doubles rather than being rebuilt on every append.
+	if c.mmap && c.size-int64(len(c.mapped)) > int64(len(c.mapped)) {
+		c.remap()
+	}
+	return c.written()
+}
+
+// remap replaces the mapping with one covering the whole file. If the file
+// cannot be mapped, reads fall back to ReadAt for good.
+func (c *logCollection) remap() {
+	if !c.mmap {
+		return
+	}
+
+	munmap(c.mapped)
+	mapped, err := mmapFile(c.file, c.size)
+	if err != nil {
+		c.mmap, c.mapped = false, nil
+		return
+	}
+	c.mapped = mapped
+}
+
+// get reads and verifies the latest value stored for key, reporting whether
+// it was served from the memory mapping. The read lock is held throughout so
+// compaction cannot swap the file out from under it.
+func (c *logCollection) get(key string) (value []byte, mapped bool, err error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	if c.closed {
+		return nil, false, errLogClosed
+	}
+	entry, ok := c.index[key]
+	if !ok {
+		return nil, false, c.notFound(key)
+	}
+
+	var buf []byte
+	if end := entry.offset + entry.size; end <= int64(len(c.mapped)) {
+		buf, mapped = c.mapped[entry.offset:end], true
+	} else {
+		buf = make([]byte, entry.size)
+		if _, err := c.file.ReadAt(buf, entry.offset); err != nil {
+			return nil, false, err
+		}
+	}
+
+	// Copy the value out so it stays valid after the mapping is replaced.
+	_, _, value, _, err = decodeLogEntry(buf)
+	value = append([]byte(nil), value...)
+	if err != nil {
+		return nil, mapped, fmt.Errorf("%w: log %s at offset %d: %v", ErrCorruptRecord, c.path, entry.offset, err)
+	}
+	return value, mapped, nil
+}
+
+func (c *logCollection) notFound(key string) error {
+	return &os.PathError{Op: "read", Path: c.path + "#" + key, Err: os.ErrNotExist}
+}
+
+// encodeLogEntry lays out an entry as
+// crc32 | kind | key length | value length | key | value,
+// with the checksum covering everything after itself.
+func encodeLogEntry(kind byte, key string, value []byte) []byte {
+	buf := make([]byte, logHeaderSize+len(key)+len(value))
+	buf[4] = kind
+	binary.BigEndian.PutUint32(buf[5:9], uint32(len(key)))
+	binary.BigEndian.PutUint32(buf[9:13], uint32(len(value)))
+	copy(buf[logHeaderSize:], key)
+	copy(buf[logHeaderSize+len(key):], value)
+	binary.BigEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+// decodeLogEntry decodes the entry at the start of buf without copying,
+// checking its lengths against buf before trusting them.
+func decodeLogEntry(buf []byte) (kind byte, key string, value []byte, size int64, err error) {
+	if len(buf) < logHeaderSize {
+		return 0, "", nil, 0, io.ErrUnexpectedEOF
+	}
+
+	kind = buf[4]
+	keyLen := uint64(binary.BigEndian.Uint32(buf[5:9]))
+	valueLen := uint64(binary.BigEndian.Uint32(buf[9:13]))
+	if kind != logPut && kind != logDelete {
+		return 0, "", nil, 0, fmt.Errorf("unknown entry kind %d", kind)
+	}
+	if logHeaderSize+keyLen+valueLen > uint64(len(buf)) {
+		return 0, "", nil, 0, io.ErrUnexpectedEOF
+	}
+
+	size = int64(logHeaderSize + keyLen + valueLen)
+	if crc32.ChecksumIEEE(buf[4:size]) != binary.BigEndian.Uint32(buf[0:4]) {
+		return 0, "", nil, 0, errors.New("checksum mismatch")
+	}
+	return kind, string(buf[logHeaderSize : logHeaderSize+keyLen]), buf[logHeaderSize+keyLen : size], size, nil
+}
+
+// readLogEntry decodes the next entry from r, returning its total size.
+// It returns io.EOF only at a clean entry boundary.
+func readLogEntry(r *bufio.Reader) (kind byte, key string, value []byte, size int64, err error) {
+	header := make([]byte, logHeaderSize)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return 0, "", nil, 0, err
+	}
+
+	kind = header[4]
+	keyLen := binary.BigEndian.Uint32(header[5:9])
+	valueLen := binary.BigEndian.Uint32(header[9:13])
+	if kind != logPut && kind != logDelete {
+		return 0, "", nil, 0, fmt.Errorf("unknown entry kind %d", kind)
+	}
+	if uint64(keyLen)+uint64(valueLen) > maxLogEntrySize {
+		return 0, "", nil, 0, fmt.Errorf("entry of %d bytes exceeds the maximum size", uint64(keyLen)+uint64(valueLen))
+	}
+
+	body := make([]byte, int(keyLen)+int(valueLen))
+	if _, err = io.ReadFull(r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, "", nil, 0, err
+	}
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(body)
+	if crc.Sum32() != binary.BigEndian.Uint32(header[0:4]) {
+		return 0, "", nil, 0, errors.New("checksum mismatch")
+	}
+
+	size = int64(logHeaderSize) + int64(len(body))
+	return kind, string(body[:keyLen]), body[keyLen:], size, nil
+}
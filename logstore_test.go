@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLogStorageTornTail(t *testing.T) {
+	entry := encodeLogEntry(logPut, "dave", []byte(`{"Name": "dave"}`))
+	badChecksum := append([]byte(nil), entry...)
+	badChecksum[len(badChecksum)-2] ^= 0xff
+
+	for name, damage := range map[string]func(log []byte) []byte{
+		"prefix of an entry": func(log []byte) []byte { return append(log, entry[:len(entry)/2]...) },
+		"bad checksum":       func(log []byte) []byte { return append(log, badChecksum...) },
+		"zeros":              func(log []byte) []byte { return append(log, make([]byte, 4096)...) },
+		"zeroed entry": func(log []byte) []byte {
+			return append(log, append(make([]byte, logHeaderSize), entry[logHeaderSize:]...)...)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := writeTestLog(t, damage)
+			d, err := New(dir, &Options{Engine: EngineLog, Slog: openTestLogger()})
+			if err != nil {
+				t.Fatalf("could not open log with a torn tail: %v", err)
+			}
+			defer d.Close()
+
+			for i := 0; i < 3; i++ {
+				if _, err := d.Read("users", fmt.Sprint("user", i)); err != nil {
+					t.Error(err)
+				}
+			}
+			if err := d.Write("users", "erin", User{Name: "erin"}); err != nil {
+				t.Fatal(err)
+			}
+			if user, err := d.Read("users", "erin"); err != nil || user.Name != "erin" {
+				t.Errorf("read after truncating the torn tail = %+v, %v", user, err)
+			}
+		})
+	}
+}
+
+func TestLogStorageReadOnly(t *testing.T) {
+	entry := encodeLogEntry(logPut, "dave", []byte(`{"Name": "dave"}`))
+	dir := writeTestLog(t, func(log []byte) []byte { return append(log, entry[:len(entry)/2]...) })
+	path := filepath.Join(dir, "users", logFileName)
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := New(dir, &Options{Engine: EngineLog, ReadOnly: true, Slog: openTestLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := d.Read("users", fmt.Sprint("user", i)); err != nil {
+			t.Error(err)
+		}
+	}
+	if after, err := os.ReadFile(path); err != nil || !bytes.Equal(after, before) {
+		t.Errorf("read-only open changed the log: %d bytes before, %d after, %v", len(before), len(after), err)
+	}
+	if _, err := d.Read("posts", "x"); err == nil {
+		t.Error("read from a missing collection succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "posts")); !os.IsNotExist(err) {
+		t.Errorf("read-only open created a collection directory: %v", err)
+	}
+}
+
+func TestLogStorageCorruption(t *testing.T) {
+	dir := writeTestLog(t, func(log []byte) []byte {
+		// Damage the first entry, which valid ones follow.
+		log[logHeaderSize] ^= 0xff
+		return log
+	})
+	d, err := New(dir, &Options{Engine: EngineLog, Slog: openTestLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	// Collections are loaded on first use.
+	if _, err := d.Read("users", "user1"); err == nil || !strings.Contains(err.Error(), "corrupt log") {
+		t.Errorf("read = %v, want corrupt log", err)
+	}
+}
+
+// writeTestLog writes three records to a log collection and damages its
+// log file.
+func writeTestLog(t *testing.T, damage func(log []byte) []byte) string {
+	t.Helper()
+	d, dir := openTestDB(t, &Options{Engine: EngineLog})
+	for i := 0; i < 3; i++ {
+		if err := d.Write("users", fmt.Sprint("user", i), User{Name: fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "users", logFileName)
+	log, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, damage(log), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// TestLogStorageReadsDuringReindex reads memory-mapped logs while their
+// indexes are rebuilt, which closes and unmaps them under the readers.
+func TestLogStorageReadsDuringReindex(t *testing.T) {
+	d, _ := openTestDB(t, &Options{Engine: EngineLog, MmapReads: true})
+	const n = 200
+	for i := 0; i < n; i++ {
+		if err := d.Write("users", fmt.Sprint("user", i), User{Name: fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := fmt.Sprint("user", i%n)
+				if user, err := d.Read("users", key); err != nil || user.Name != fmt.Sprint(i%n) {
+					t.Errorf("read %s = %+v, %v", key, user, err)
+					return
+				}
+				if _, err := d.Keys("users"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := d.RebuildIndexes(); err != nil {
+			t.Error(err)
+			break
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// TestLogStorageStaleCollection uses a log closed by a reindex, as a read
+// that fetched it just before does.
+func TestLogStorageStaleCollection(t *testing.T) {
+	d, _ := openTestDB(t, &Options{Engine: EngineLog, MmapReads: true})
+	if err := d.Write("users", "ann", User{Name: "ann"}); err != nil {
+		t.Fatal(err)
+	}
+	s := d.store.(*logStorage)
+	stale, err := s.collection("users", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.RebuildIndexes(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := stale.get("ann"); !errors.Is(err, errLogClosed) {
+		t.Errorf("read from the closed log = %v, want errLogClosed", err)
+	}
+	if err := stale.append(logPut, "bob", nil); !errors.Is(err, errLogClosed) {
+		t.Errorf("append to the closed log = %v, want errLogClosed", err)
+	}
+	if user, err := d.Read("users", "ann"); err != nil || user.Name != "ann" {
+		t.Errorf("read after reindex = %+v, %v", user, err)
+	}
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"context"
+	"crypto/cipher"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/jcelliott/lumber"
 )
@@ -21,31 +28,220 @@ type Database struct {
 
 // Driver struct to manage the file-based database and logging.
 type Driver struct {
-	mutex   sync.Mutex
-	mutexes map[string]*sync.Mutex
-	dir     string
-	log     Logger
+	mutex     sync.Mutex
+	mutexes   map[string]*sync.RWMutex
+	dir       string
+	log       Logger
+	slog      *slog.Logger
+	opts      Options
+	lock      *dirLock
+	store     storage
+	gate      sync.RWMutex
+	stop      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+	opMetrics metrics
+
+	subscribers []*subscriber
+	changes     *changeLog
+	replica     replicaState
+	cluster     *cluster
+	meta        map[string]CollectionMeta
+	alerts      *alerter
+	hooks       []Hook
+	computed    map[string][]computedField
+	reducers    map[string]Reducer
+	views       map[string]*view
+	geo         map[string]*geoIndex
+	refs        []Reference
+	bulk        map[string]*bulkLoad
+	usage       *usageTracker
+	migrations  map[string][]migration
+	// archiveReports holds the last background archival sweep of each
+	// collection.
+	archiveReports map[string]*ArchiveReport
+	// memory is the scratch directory of an in-memory database.
+	memory string
+	// fields encrypts the encrypted fields of records, if a key is set.
+	fields cipher.AEAD
+
+	tenantMutex sync.Mutex
+	tenants     map[string]*Driver
+
+	// background tracks the background tasks for Health.
+	background taskTracker
+	// layout is how the files of the database are laid out.
+	layout layout
+	// fs holds the files of the file engine and collection configuration.
+	fs FS
 }
 
-// Options struct to hold optional configurations like Logger.
+// Options struct to hold optional configurations like Logger and Engine.
 type Options struct {
 	Logger
+	Engine       Engine
+	Compaction   CompactionOptions
+	ExternalLock ExternalLockOptions
+	// MmapReads serves log engine reads from a memory mapping of each
+	// collection's log instead of a read syscall per record.
+	MmapReads bool
+	DevNotify *DevNotifyOptions
+	Tracer    Tracer
+	ReadAll   ReadAllOptions
+	// ReadParallelism is how many records ReadAll, Query and scans read at
+	// once. Defaults to GOMAXPROCS.
+	ReadParallelism int
+	// Slog receives structured operation logs. When Logger is not set it
+	// also receives the Driver's plain messages.
+	Slog *slog.Logger
+	// OpLogLevel is the level successful operations are logged at
+	// (Debug if nil); failed operations are always logged at Error.
+	OpLogLevel slog.Leveler
+	// Checksums stores a checksum sidecar with every record written by the
+	// file engine and verifies it on read. The log engine always checksums.
+	Checksums bool
+	// Dedup stores the body shared by records of the file engine once, with
+	// every record a hard link to it, which saves space when many keys hold
+	// the same payload. It needs a filesystem with hard links; streamed
+	// records and records with encrypted fields are rarely shared.
+	Dedup bool
+	// KeyManifest keeps the keys of every collection of the file engine in
+	// a manifest, so listing and counting a large collection does not read
+	// its directory. Manifests are saved on Close, and a collection whose
+	// manifest is missing or stale is listed once on first use.
+	KeyManifest bool
+	// StartupScan runs an integrity scan when the database is opened.
+	StartupScan IntegrityScan
+	// ReadOnly opens the database with a shared lock, so several read-only
+	// processes can use it at once; writes fail with ErrReadOnly.
+	ReadOnly bool
+	// ChangeLog keeps a sequenced log of every change under .changelog, which
+	// replication streams to followers.
+	ChangeLog bool
+	// ChangeLogRetention trims the change log to about this many of the
+	// latest changes, never dropping those remote sync has yet to upload;
+	// zero keeps every change. Followers further behind cannot resume.
+	ChangeLogRetention int
+	// Alerts warns when a collection grows past the configured thresholds.
+	Alerts *AlertOptions
+	// Sync mirrors the database to a remote object store.
+	Sync *SyncOptions
+	// ReplicationTLS encrypts replication: ServeReplication serves TLS with
+	// it and Follow connects with TLS.
+	ReplicationTLS *TLSOptions
+	// Cluster makes the database a node of a Raft cluster replicating its
+	// writes, so it survives the loss of a minority of the nodes.
+	Cluster *ClusterOptions
+	// CRDT makes the named collections hold conflict-free replicated data
+	// types, written with MergeCRDT instead of Write.
+	CRDT map[string]CRDTKind
+	// Collections configures collections that have no _meta.json yet; it is
+	// written there, and from then on the stored configuration applies.
+	Collections map[string]CollectionMeta
+	// Quotas limits the size of records, collections and the database.
+	// Only the file and log engines support it.
+	Quotas *QuotaOptions
+	// Store keeps the records in a storage backend other than the built-in
+	// engines, overriding Engine. The Driver closes it.
+	Store Store
+	// Backend opens the storage backend registered under this name with
+	// RegisterStore, when Store is not set.
+	Backend string
+	// Shards spreads the records across these directories with a
+	// ShardedStore, when Store is not set. The database directory keeps
+	// the rest. Records are moved to their shard on open, so shards can be
+	// added between runs; AddShard adds one while the database is open.
+	Shards []string
+	// Durability selects when writes are synced to stable storage.
+	Durability Durability
+	// SyncInterval is how often DurabilityInterval syncs. Defaults to one
+	// second.
+	SyncInterval time.Duration
+	// Expiry paces the removal of records from collections with a TTL.
+	Expiry *ExpiryOptions
+	// Archive configures the archival policies of collections.
+	Archive *ArchiveOptions
+	// Memory persists a database opened with New(MemoryDir, ...).
+	Memory *MemoryOptions
+	// FS is the filesystem records and collection configuration are kept
+	// in, such as NewMemFS for tests or a FaultFS to simulate failing
+	// disks. Only the file engine supports it. Defaults to OSFS. An FS not
+	// on the operating system's filesystem holds the whole database, so it
+	// is not locked against other processes and cannot be combined with
+	// ChangeLog, Cluster, Sync or ExternalLock.
+	FS FS
+	// Naming restricts and normalizes the names of collections and keys.
+	Naming *NamingPolicy
+	// Retry retries the operations on FS failing with transient errors:
+	// those of the file engine, and the collection configuration and time
+	// series of any engine.
+	Retry *RetryOptions
+	// Layout sets the permissions of the files created and how the file
+	// engine names and spreads record files.
+	Layout *LayoutOptions
+	// EncryptionKey encrypts the fields listed in CollectionMeta.Encrypted.
+	// Without it those fields read as empty and records holding them cannot
+	// be written.
+	EncryptionKey []byte
 }
 
+// Engine selects how a Driver lays records out on disk.
+type Engine int
+
+const (
+	// EngineFiles stores every record in its own JSON file (the default).
+	EngineFiles Engine = iota
+	// EngineLog stores each collection in a single append-only log file with
+	// an in-memory index, avoiding one inode and directory entry per record.
+	EngineLog
+)
+
 // User struct representing user data
 type User struct {
 	Name    string
 	Age     json.Number
 	Company string
-	Address string
+	Address Address
+	// Computed holds the fields registered with RegisterComputed. It is
+	// filled in on read and never stored.
+	Computed map[string]interface{} `json:",omitempty"`
 }
 
-// Address struct nested within User
+// Address struct nested within User. Records written before addresses were
+// structured hold a single string, which is read into Street.
 type Address struct {
+	Street  string
 	City    string
 	State   string
 	Country string
-	Pincode json.Number
+	Pincode json.Number `json:",omitempty"`
+}
+
+// UnmarshalJSON accepts both structured addresses and legacy plain strings.
+func (a *Address) UnmarshalJSON(data []byte) error {
+	var line string
+	if err := json.Unmarshal(data, &line); err == nil {
+		*a = Address{Street: line}
+		return nil
+	}
+
+	type address Address
+	return json.Unmarshal(data, (*address)(a))
+}
+
+// String formats the address on one line, skipping empty parts.
+func (a Address) String() string {
+	var parts []string
+	for _, part := range []string{a.Street, a.City, a.State, a.Country} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	line := strings.Join(parts, ", ")
+	if a.Pincode != "" {
+		line = strings.TrimSpace(line + " " + a.Pincode.String())
+	}
+	return line
 }
 
 // Logger interface for various logging levels.
@@ -66,129 +262,643 @@ func New(dir string, options *Options) (*Driver, error) {
 	}
 
 	if opts.Logger == nil {
-		opts.Logger = lumber.NewConsoleLogger(lumber.INFO)
+		if opts.Slog != nil {
+			opts.Logger = NewSlogLogger(opts.Slog)
+		} else {
+			opts.Logger = lumber.NewConsoleLogger(lumber.INFO)
+		}
+	}
+	if opts.Slog == nil {
+		opts.Slog = slog.New(loggerHandler{log: opts.Logger})
+	}
+
+	if opts.FS != nil && (opts.Engine != EngineFiles || opts.Store != nil || opts.Backend != "" || len(opts.Shards) > 0) {
+		return nil, errors.New("could not use Options.FS: only the file engine supports it")
+	}
+	if opts.Dedup && (opts.Engine != EngineFiles || opts.Store != nil || opts.Backend != "" || len(opts.Shards) > 0) {
+		return nil, errors.New("could not use Options.Dedup: only the file engine supports it")
+	}
+	if opts.KeyManifest && (opts.Engine != EngineFiles || opts.Store != nil || opts.Backend != "" || len(opts.Shards) > 0) {
+		return nil, errors.New("could not use Options.KeyManifest: only the file engine supports it")
+	}
+	if _, ok := opts.FS.(linker); opts.Dedup && opts.FS != nil && !ok {
+		return nil, errors.New("could not use Options.Dedup: the filesystem does not support hard links")
+	}
+	if name := diskOption(opts); name != "" && opts.FS != nil && !onDisk(opts.FS) {
+		return nil, fmt.Errorf("could not use Options.%s: it keeps files on the operating system's filesystem, not in Options.FS", name)
+	}
+
+	var memory string
+	if dir == MemoryDir {
+		var err error
+		if memory, err = newMemoryDir(&opts); err != nil {
+			return nil, err
+		}
+		dir = memory
 	}
 
 	driver := &Driver{
+		memory:  memory,
 		dir:     dir,
 		log:     opts.Logger,
-		mutexes: make(map[string]*sync.Mutex),
+		slog:    opts.Slog,
+		opts:    opts,
+		mutexes: make(map[string]*sync.RWMutex),
+		usage:   newUsageTracker(),
+		stop:    make(chan struct{}),
+		fs:      opts.FS,
+	}
+	if driver.fs == nil {
+		driver.fs = OSFS{}
+	}
+	if opts.Retry != nil {
+		driver.fs = newRetryFS(driver.fs, *opts.Retry)
+	}
+	if len(opts.EncryptionKey) > 0 {
+		driver.fields = newFieldCipher(opts.EncryptionKey)
 	}
 
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
+	if _, err := driver.fs.Stat(dir); os.IsNotExist(err) && opts.ReadOnly {
+		return nil, fmt.Errorf("database directory '%s' does not exist", dir)
+	} else if os.IsNotExist(err) {
 		opts.Logger.Info("Creating database directory at '%s'", dir)
-		if err := os.MkdirAll(dir, 0755); err != nil {
+		if err := driver.fs.MkdirAll(dir, optionLayout(opts.Layout).dirMode()); err != nil {
 			return nil, fmt.Errorf("could not create database directory: %v", err)
 		}
 	} else {
 		opts.Logger.Debug("Using existing database directory '%s'", dir)
 	}
 
+	// No other process can open a database held elsewhere than on disk.
+	var lock *dirLock
+	var err error
+	if onDisk(driver.fs) {
+		if lock, err = lockDir(dir, opts.ReadOnly); err != nil {
+			return nil, err
+		}
+	}
+	driver.lock = lock
+	var shards []string
+	if opts.Store == nil {
+		shards = opts.Shards
+	}
+	if driver.layout, err = resolveLayout(driver.fs, dir, shards, opts.Layout, opts.ReadOnly); err != nil {
+		lock.release()
+		return nil, err
+	}
+
+	if opts.Store == nil && len(opts.Shards) > 0 {
+		if opts.Store, err = driver.openShards(); err != nil {
+			lock.release()
+			return nil, err
+		}
+	}
+	if opts.Store == nil && opts.Backend != "" {
+		if opts.Store, err = openStore(opts.Backend, dir); err != nil {
+			lock.release()
+			return nil, err
+		}
+	}
+	switch {
+	case opts.Store != nil:
+		driver.store = newStorage(opts.Store)
+		if s, ok := driver.store.(*fileStorage); ok {
+			s.checksums = opts.Checksums
+		}
+	case opts.Engine == EngineLog:
+		driver.store = newLogStorage(dir, opts.MmapReads, driver.layout, opts.ReadOnly)
+	default:
+		if opts.MmapReads {
+			opts.Logger.Info("Memory-mapped reads are only supported by the log engine, ignoring")
+		}
+		driver.store = driver.newFileStorage(dir)
+	}
+	driver.setDurability()
+	if err := driver.loadMemory(); err != nil {
+		// Keep the snapshot that failed to load rather than overwrite it.
+		driver.opts.Memory = nil
+		driver.Close()
+		return nil, err
+	}
+	if err := driver.loadMeta(configuredCollections(opts)); err != nil {
+		driver.Close()
+		return nil, err
+	}
+	if opts.ChangeLog && !opts.ReadOnly {
+		if driver.changes, err = openChangeLog(dir, driver.layout, opts.Durability, opts.ChangeLogRetention); err != nil {
+			driver.Close()
+			return nil, err
+		}
+		if opts.Sync != nil {
+			driver.changes.keep = driver.syncedSeq
+		}
+	}
+	if err := driver.recoverTransactions(); err != nil {
+		driver.Close()
+		return nil, err
+	}
+	if !opts.ReadOnly {
+		driver.removeStaleStreams()
+	}
+	driver.scanIntegrity(opts.StartupScan)
+	driver.startCompactor(opts.Compaction)
+	driver.startPauseWatcher(opts.ExternalLock)
+	driver.startDevNotifier(opts.DevNotify)
+	driver.subscribe(driver.usage.touch)
+	if err := driver.startQuotas(opts.Quotas); err != nil {
+		driver.Close()
+		return nil, err
+	}
+	driver.startAlerts(opts.Alerts)
+	driver.startRetention()
+	driver.startMemorySnapshots()
+	driver.startSyncer()
+	driver.startExpiry(opts.Expiry)
+	driver.startArchiver(opts.Archive)
+	if err := driver.startSync(opts.Sync); err != nil {
+		driver.Close()
+		return nil, err
+	}
+	if err := driver.startCluster(opts.Cluster); err != nil {
+		driver.Close()
+		return nil, err
+	}
+
 	return driver, nil
 }
 
 // Write saves a User object to the specified directory and file.
 func (d *Driver) Write(collection, key string, value User) error {
-	mutex := d.getOrCreateMutex(collection)
-	mutex.Lock()
-	defer mutex.Unlock()
+	return d.WriteContext(context.Background(), collection, key, value)
+}
 
-	dir := filepath.Join(d.dir, collection)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("could not create collection directory: %v", err)
+// WriteContext is Write, traced as part of ctx.
+func (d *Driver) WriteContext(ctx context.Context, collection, key string, value User) error {
+	if err := d.checkNames(&collection, &key); err != nil {
+		return err
 	}
 
-	filePath := filepath.Join(dir, key+".json")
-	file, err := os.Create(filePath)
-	if err != nil {
-		return fmt.Errorf("could not create file: %v", err)
+	return d.write(ctx, collection, key, value, nil)
+}
+
+// write saves a User object if cond, called under the collection lock with
+// the record currently stored, if any, accepts it.
+func (d *Driver) write(ctx context.Context, collection, key string, value User, cond func(current []byte, exists bool) error) (err error) {
+	op := d.beginContext(ctx, opWrite, collection, key)
+	defer op.end(&err)
+
+	writable := d.writable
+	if cond == nil {
+		writable = d.recordWritable
+	}
+	if err := writable(); err != nil {
+		return err
+	}
+	if err := d.checkRecordWrite(collection, true); err != nil {
+		return err
 	}
-	defer file.Close()
 
+	value.Computed = nil
 	data, err := json.MarshalIndent(value, "", "  ")
 	if err != nil {
 		return fmt.Errorf("could not marshal data: %v", err)
 	}
 
-	if _, err = file.Write(data); err != nil {
-		return fmt.Errorf("could not write data to file: %v", err)
+	hook := &HookOp{Op: OpWrite, Collection: collection, Key: key, Data: data}
+	defer func() { d.after(hook, err) }()
+	if err := d.before(hook); err != nil {
+		return err
+	}
+	if data, err = d.stampVersion(collection, hook.Data); err != nil {
+		return err
+	}
+	if data, err = d.stampExpiry(collection, data); err != nil {
+		return err
+	}
+	if data, err = d.stampModified(collection, data); err != nil {
+		return err
+	}
+	if data, err = d.sealFields(collection, key, data); err != nil {
+		return err
+	}
+	if d.cluster != nil {
+		if len(d.writeLocks(collection)) > 1 || d.eventSourced(collection) {
+			return ErrNotReplicated
+		}
+		if err := d.cluster.apply(Change{Op: OpWrite, Collection: collection, Key: key, Time: time.Now(), Data: data}); err != nil {
+			return err
+		}
+		op.bytes = len(data)
+		d.log.Info("Wrote user %s to collection %s", key, collection)
+		return nil
+	}
+
+	d.gate.RLock()
+	defer d.gate.RUnlock()
+
+	for _, name := range d.writeLocks(collection) {
+		mutex := d.getOrCreateMutex(name)
+		mutex.Lock()
+		defer mutex.Unlock()
+	}
+
+	if cond != nil {
+		current, err := d.store.get(collection, key)
+		exists := err == nil
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := cond(current, exists); err != nil {
+			return err
+		}
+	}
+	if err := d.checkReferences(collection, key, data, d.stored); err != nil {
+		return err
+	}
+	if d.eventSourced(collection) {
+		if data, err = d.appendEvent(collection, key, data); err != nil {
+			return err
+		}
+	}
+
+	if err := d.put(collection, key, data); err != nil {
+		return err
 	}
+	op.bytes = len(data)
 
-	d.log.Info("Wrote user %s to collection %s", key, collection)
+	if !d.countBulk(collection) {
+		d.log.Info("Wrote user %s to collection %s", key, collection)
+	}
+	d.publish(OpWrite, collection, key, data)
 	return nil
 }
 
+// checkRecordWrite fails writes of whole records to collections written
+// through their own API: CRDTs, time series, views and, unless the write
+// appends an event, event sourced collections.
+func (d *Driver) checkRecordWrite(collection string, appendsEvent bool) error {
+	if kind, ok := d.crdtKind(collection); ok {
+		return fmt.Errorf("collection %s holds %s CRDTs; use MergeCRDT", collection, kind)
+	}
+	if _, ok := d.timeSeries(collection); ok {
+		return fmt.Errorf("collection %s is a time series; use AppendPoint", collection)
+	}
+	if !appendsEvent && d.eventSourced(collection) {
+		return errImmutableEvents(collection)
+	}
+	return d.checkNotView(collection)
+}
+
 // Read retrieves a single User object by key.
 func (d *Driver) Read(collection, key string) (User, error) {
-	mutex := d.getOrCreateMutex(collection)
-	mutex.Lock()
-	defer mutex.Unlock()
+	return d.ReadContext(context.Background(), collection, key)
+}
+
+// ReadContext is Read, traced as part of ctx.
+func (d *Driver) ReadContext(ctx context.Context, collection, key string) (_ User, err error) {
+	if err := d.checkNames(&collection, &key); err != nil {
+		return User{}, err
+	}
+
+	op := d.beginContext(ctx, opRead, collection, key)
+	defer op.end(&err)
 
-	filePath := filepath.Join(d.dir, collection, key+".json")
-	data, err := os.ReadFile(filePath)
+	user, size, err := d.readUser(collection, key, func() ([]byte, error) {
+		return d.readRaw(collection, key)
+	})
+	op.bytes = size
+	return user, err
+}
+
+// readUser decodes the record returned by read, running read hooks around
+// it, and returns it with its encoded size.
+func (d *Driver) readUser(collection, key string, read func() ([]byte, error)) (_ User, size int, err error) {
+	hook := &HookOp{Op: OpRead, Collection: collection, Key: key}
+	defer func() { d.after(hook, err) }()
+	if err := d.before(hook); err != nil {
+		return User{}, 0, err
+	}
+
+	data, err := read()
 	if err != nil {
-		return User{}, fmt.Errorf("could not read file: %v", err)
+		return User{}, 0, err
 	}
+	hook.Data = data
 
 	var user User
 	if err = json.Unmarshal(data, &user); err != nil {
-		return User{}, fmt.Errorf("could not unmarshal data: %v", err)
+		return User{}, len(data), fmt.Errorf("could not unmarshal data: %v", err)
+	}
+	d.compute(collection, &user)
+
+	return user, len(data), nil
+}
+
+// readRaw returns the encoded record stored under key, upgraded by any
+// migrations it is missing and with its encrypted fields decrypted.
+func (d *Driver) readRaw(collection, key string) ([]byte, error) {
+	data, err := d.readStored(collection, key)
+	if err != nil {
+		return nil, err
+	}
+	if data, _, err = d.upgrade(collection, key, data); err != nil {
+		return nil, err
 	}
+	return d.openFields(collection, key, data)
+}
+
+// readStored returns the encoded record under key exactly as stored.
+func (d *Driver) readStored(collection, key string) ([]byte, error) {
+	mutex := d.getOrCreateMutex(collection)
+	mutex.RLock()
+	defer mutex.RUnlock()
 
-	return user, nil
+	return d.store.get(collection, key)
 }
 
-// ReadAll retrieves all User objects in a collection.
+// scan calls fn with the key and encoded data of every readable record in
+// a collection, logging and skipping unreadable ones. It stops at the first
+// error returned by fn.
+func (d *Driver) scan(collection string, fn func(key string, data []byte) error) error {
+	return d.scanWith(true, collection, fn)
+}
+
+// scanStored is scan without upgrading records, for mirroring them as
+// stored.
+func (d *Driver) scanStored(collection string, fn func(key string, data []byte) error) error {
+	return d.scanWith(false, collection, fn)
+}
+
+func (d *Driver) scanWith(upgrade bool, collection string, fn func(key string, data []byte) error) error {
+	return d.scanBatches(collection, upgrade, func(keys []string, data [][]byte, errs []error) error {
+		for i, key := range keys {
+			if errs[i] != nil {
+				d.log.Error("Error reading user %s: %v", key, errs[i])
+				continue
+			}
+			if err := fn(key, data[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ReadAll retrieves all User objects in a collection. The collection is
+// listed and its records read ReadParallelism at a time under a single
+// acquisition of the collection lock, so concurrent writes are seen whole
+// or not at all.
 func (d *Driver) ReadAll(collection string) ([]User, error) {
-	dir := filepath.Join(d.dir, collection)
-	files, err := os.ReadDir(dir)
+	return d.ReadAllContext(context.Background(), collection)
+}
+
+// ReadAllContext is ReadAll, traced as part of ctx.
+func (d *Driver) ReadAllContext(ctx context.Context, collection string) (_ []User, err error) {
+	if err := d.checkNames(&collection); err != nil {
+		return nil, err
+	}
+
+	op := d.beginContext(ctx, opReadAll, collection, "")
+	defer op.end(&err)
+
+	return d.readUsers(op, collection, func() ([]string, error) {
+		return d.store.keys(collection)
+	})
+}
+
+// readUsers reads the users under the keys list returns for ReadAll and
+// ReadRange, treating unreadable records as Options.ReadAll says.
+func (d *Driver) readUsers(op *operation, collection string, list func() ([]string, error)) ([]User, error) {
+	keys, data, errs, err := d.fetchListed(collection, true, list)
 	if err != nil {
-		return nil, fmt.Errorf("could not read directory: %v", err)
+		return nil, err
 	}
+	read := make([]User, len(keys))
+	forEach(len(keys), d.readParallelism(), func(i int) {
+		read[i], _, errs[i] = d.readUser(collection, keys[i], func() ([]byte, error) {
+			return data[i], errs[i]
+		})
+	})
+
+	mode := d.opts.ReadAll
+	partial := &PartialResult{Collection: collection}
 
 	var users []User
-	for _, file := range files {
-		if strings.HasSuffix(file.Name(), ".json") {
-			// Extracting the user key by trimming the .json suffix
-			key := strings.TrimSuffix(file.Name(), ".json")
-			user, err := d.Read(collection, key)
-			if err != nil {
-				d.log.Error("Error reading user file %s: %v", file.Name(), err)
-				continue
+	for i, key := range keys {
+		user, err := read[i], errs[i]
+		op.bytes += len(data[i])
+		if err != nil {
+			switch mode.Mode {
+			case ReadAllStrict:
+				return nil, fmt.Errorf("could not read user %s: %v", key, err)
+			case ReadAllPartial:
+				partial.Failed = append(partial.Failed, RecordError{Key: key, Err: err})
+				if mode.ErrorBudget > 0 && len(partial.Failed) > mode.ErrorBudget {
+					partial.Read = len(users)
+					return nil, fmt.Errorf("more than %d records of collection %s could not be read: %v",
+						mode.ErrorBudget, collection, partial)
+				}
+			default:
+				d.log.Error("Error reading user %s: %v", key, err)
 			}
-			users = append(users, user)
+			continue
 		}
+		users = append(users, user)
+	}
+
+	if len(partial.Failed) > 0 {
+		partial.Read = len(users)
+		return users, partial
 	}
 	return users, nil
 }
 
+// Collections lists the collections in the database.
+func (d *Driver) Collections() ([]string, error) {
+	entries, err := d.fs.ReadDir(d.dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read directory: %v", err)
+	}
+
+	var collections []string
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			collections = append(collections, entry.Name())
+		}
+	}
+
+	// Backends keeping records elsewhere still get a directory per
+	// collection holding its metadata, but not necessarily one per
+	// collection holding records.
+	if s, ok := d.store.(externalStore); ok {
+		if l, ok := s.Store.(CollectionLister); ok {
+			stored, err := l.Collections()
+			if err != nil {
+				return nil, fmt.Errorf("could not list collections: %v", err)
+			}
+			for _, collection := range stored {
+				if !slices.Contains(collections, collection) {
+					collections = append(collections, collection)
+				}
+			}
+			sort.Strings(collections)
+		}
+	}
+	return collections, nil
+}
+
 // Delete removes a specific User object by key.
 func (d *Driver) Delete(collection, key string) error {
-	mutex := d.getOrCreateMutex(collection)
-	mutex.Lock()
-	defer mutex.Unlock()
+	return d.DeleteContext(context.Background(), collection, key)
+}
+
+// DeleteContext is Delete, traced as part of ctx.
+func (d *Driver) DeleteContext(ctx context.Context, collection, key string) error {
+	if err := d.checkNames(&collection, &key); err != nil {
+		return err
+	}
+
+	return d.delete(ctx, collection, key, nil)
+}
+
+// delete removes a User object if cond, called under the collection lock
+// with the record currently stored, accepts it.
+func (d *Driver) delete(ctx context.Context, collection, key string, cond func(current []byte) error) (err error) {
+	op := d.beginContext(ctx, opDelete, collection, key)
+	defer op.end(&err)
+
+	writable := d.writable
+	if cond == nil {
+		writable = d.recordWritable
+	}
+	if err := writable(); err != nil {
+		return err
+	}
+	if d.eventSourced(collection) {
+		return errImmutableEvents(collection)
+	}
+	if err := d.checkNotView(collection); err != nil {
+		return err
+	}
 
-	filePath := filepath.Join(d.dir, collection, key+".json")
-	if err := os.Remove(filePath); err != nil {
-		return fmt.Errorf("could not delete file: %v", err)
+	hook := &HookOp{Op: OpDelete, Collection: collection, Key: key}
+	defer func() { d.after(hook, err) }()
+	if err := d.before(hook); err != nil {
+		return err
+	}
+	if d.cluster != nil {
+		if len(d.deleteLocks(collection)) > 1 {
+			return ErrNotReplicated
+		}
+		if _, err := d.readStored(collection, key); err != nil {
+			return err
+		}
+		if err := d.cluster.apply(Change{Op: OpDelete, Collection: collection, Key: key, Time: time.Now()}); err != nil {
+			return err
+		}
+		d.log.Info("Deleted user %s from collection %s", key, collection)
+		return nil
+	}
+
+	d.gate.RLock()
+	defer d.gate.RUnlock()
+
+	for _, name := range d.deleteLocks(collection) {
+		mutex := d.getOrCreateMutex(name)
+		mutex.Lock()
+		defer mutex.Unlock()
+	}
+
+	if cond != nil {
+		current, err := d.store.get(collection, key)
+		if err != nil {
+			return err
+		}
+		if err := cond(current); err != nil {
+			return err
+		}
+	}
+	if !d.stored(collection, key) {
+		return d.remove(collection, key)
+	}
+	cascade, err := d.planDelete(collection, key)
+	if err != nil {
+		return err
+	}
+	for _, id := range cascade {
+		if err := d.remove(id.collection, id.key); err != nil {
+			return err
+		}
+		d.log.Info("Deleted user %s from collection %s (cascaded)", id.key, id.collection)
+		d.publish(OpDelete, id.collection, id.key, nil)
+	}
+
+	if err := d.remove(collection, key); err != nil {
+		return err
 	}
 
 	d.log.Info("Deleted user %s from collection %s", key, collection)
+	d.publish(OpDelete, collection, key, nil)
 	return nil
 }
 
-// getOrCreateMutex provides a mutex for a specific collection.
-func (d *Driver) getOrCreateMutex(collection string) *sync.Mutex {
+// Close stops background work, releases any files held open by the storage
+// engine and unlocks the directory.
+func (d *Driver) Close() error {
+	d.closeOnce.Do(func() { close(d.stop) })
+	clusterErr := d.cluster.close()
+	d.wg.Wait()
+
+	err := d.closeTenants()
+	if err == nil {
+		err = clusterErr
+	}
+	if s, ok := d.storeSyncer(); ok && d.opts.Durability != DurabilityOS {
+		if syncErr := s.syncDirty(); err == nil {
+			err = syncErr
+		}
+	}
+	if s, ok := d.store.(*fileStorage); ok && !d.opts.ReadOnly {
+		if saveErr := s.saveManifests(); err == nil {
+			err = saveErr
+		}
+	}
+	if d.memory != "" && d.opts.Memory != nil {
+		if saveErr := d.saveMemory(); err == nil {
+			err = saveErr
+		}
+	}
+	if closeErr := d.store.close(); err == nil {
+		err = closeErr
+	}
+	if d.changes != nil {
+		if closeErr := d.changes.close(); err == nil {
+			err = closeErr
+		}
+	}
+	if lockErr := d.lock.release(); err == nil {
+		err = lockErr
+	}
+	d.lock = nil
+	if d.memory != "" {
+		os.RemoveAll(d.memory)
+	}
+	return err
+}
+
+// getOrCreateMutex provides a mutex for a specific collection. Reads hold
+// it shared, so they proceed in parallel; writes hold it exclusively.
+func (d *Driver) getOrCreateMutex(collection string) *sync.RWMutex {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 
 	if d.mutexes == nil {
-		d.mutexes = make(map[string]*sync.Mutex)
+		d.mutexes = make(map[string]*sync.RWMutex)
 	}
 
 	mutex, exists := d.mutexes[collection]
 	if !exists {
-		mutex = &sync.Mutex{}
+		mutex = &sync.RWMutex{}
 		d.mutexes[collection] = mutex
 	}
 
@@ -196,89 +906,5 @@ func (d *Driver) getOrCreateMutex(collection string) *sync.Mutex {
 }
 
 func main() {
-	dir := "./db"
-
-	// Initialize the database
-	db, err := New(dir, nil)
-	if err != nil {
-		fmt.Println("Error initializing database:", err)
-		os.Exit(1)
-	}
-
-	// Interactive menu for reading and deleting
-	for {
-		fmt.Println("\nChoose an operation:")
-		fmt.Println("1. Add a new user")
-		fmt.Println("2. Read a user by name")
-		fmt.Println("3. Read all users")
-		fmt.Println("4. Delete a user by name")
-		fmt.Println("5. Exit")
-		var choice int
-		fmt.Print("Enter your choice: ")
-		fmt.Scanln(&choice)
-
-		switch choice {
-		case 1:
-			// Add a new user
-			var name, age, company, address string
-			fmt.Print("Name: ")
-			fmt.Scanln(&name)
-			fmt.Print("Age: ")
-			fmt.Scanln(&age)
-			fmt.Print("Company: ")
-			fmt.Scanln(&company)
-			fmt.Print("Address: ")
-			fmt.Scanln(&address)
-
-			user := User{Name: name, Age: json.Number(age), Company: company, Address: address}
-			if err := db.Write("users", name, user); err != nil {
-				fmt.Println("Error writing user:", err)
-			} else {
-				fmt.Printf("User %s added successfully.\n", name)
-			}
-
-		case 2:
-			// Read a specific user by name
-			var userName string
-			fmt.Print("Enter user name to read: ")
-			fmt.Scanln(&userName)
-			user, err := db.Read("users", userName)
-			if err != nil {
-				fmt.Printf("Error reading user %s: %v\n", userName, err)
-			} else {
-				fmt.Printf("Retrieved user %s: %+v\n", userName, user)
-			}
-
-		case 3:
-			// Read all users
-			allUsers, err := db.ReadAll("users")
-			if err != nil {
-				fmt.Println("Error reading all users:", err)
-			} else {
-				fmt.Println("All users retrieved:")
-				for _, u := range allUsers {
-					fmt.Printf("%+v\n", u)
-				}
-			}
-
-		case 4:
-			// Delete a specific user by name
-			var userName string
-			fmt.Print("Enter user name to delete: ")
-			fmt.Scanln(&userName)
-			if err := db.Delete("users", userName); err != nil {
-				fmt.Printf("Error deleting user %s: %v\n", userName, err)
-			} else {
-				fmt.Printf("User %s deleted successfully.\n", userName)
-			}
-
-		case 5:
-			// Exit the program
-			fmt.Println("Exiting program.")
-			return
-
-		default:
-			fmt.Println("Invalid choice, please try again.")
-		}
-	}
+	os.Exit(runCommand(os.Args[1:]))
 }
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/rishabhatia010/testdb"
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv(crashWorkerEnv) != "" {
+		os.Exit(runCrashWorker())
+	}
+	testdb.Transient = TransientFile
+	code := m.Run()
+	closeBenchFixtures()
+	os.Exit(code)
+}
+
+// openTestLogger returns a logger discarding everything.
+func openTestLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// openTestDB opens a database in a fresh directory, logging nowhere, and
+// closes it when the test ends.
+func openTestDB(t testing.TB, opts *Options) (*Driver, string) {
+	t.Helper()
+
+	if opts == nil {
+		opts = &Options{}
+	}
+	if opts.Slog == nil && opts.Logger == nil {
+		opts.Slog = openTestLogger()
+	}
+	dir := t.TempDir()
+	d, err := New(dir, opts)
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d, dir
+}
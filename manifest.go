@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// manifestObject is the name of the backup manifest in a remote store. It
+// has no collection part, so it is never taken for a record.
+const manifestObject = "manifest.json"
+
+// manifestEvery bounds how many synced changes may go by without the
+// manifest being rewritten while sync is catching up.
+const manifestEvery = 1000
+
+// BackupManifest lists the revision of every record mirrored to a remote
+// store as of change Seq, so a restore can be checked against it.
+type BackupManifest struct {
+	Seq     uint64            `json:"seq"`
+	Written time.Time         `json:"written"`
+	Records map[string]string `json:"records"`
+}
+
+// ReadManifest downloads the backup manifest of a remote store. It wraps
+// os.ErrNotExist when the store has none.
+func ReadManifest(remote RemoteStore) (*BackupManifest, error) {
+	data, err := remote.Get(manifestObject)
+	if err != nil {
+		return nil, err
+	}
+
+	var m BackupManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("could not parse backup manifest: %v", err)
+	}
+	if m.Records == nil {
+		m.Records = make(map[string]string)
+	}
+	return &m, nil
+}
+
+func writeManifest(remote RemoteStore, m *BackupManifest) error {
+	m.Written = time.Now().UTC()
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("could not marshal backup manifest: %v", err)
+	}
+	return remote.Put(manifestObject, data)
+}
+
+// apply records a synced change in the manifest.
+func (m *BackupManifest) apply(change Change) {
+	name := objectName(change.Collection, change.Key)
+	if change.Op == OpDelete {
+		delete(m.Records, name)
+	} else {
+		m.Records[name] = revision(change.Data)
+	}
+	m.Seq = change.Seq
+}
+
+// localManifest lists the revisions of the records in the database.
+func (d *Driver) localManifest() (*BackupManifest, error) {
+	m := &BackupManifest{Records: make(map[string]string)}
+
+	collections, err := d.Collections()
+	if err != nil {
+		return nil, err
+	}
+	for _, collection := range collections {
+		err := d.scanStored(collection, func(key string, data []byte) error {
+			m.Records[objectName(collection, key)] = revision(data)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// RestoreVerification compares a restored database with the manifest of
+// the backup it was restored from.
+type RestoreVerification struct {
+	Seq     uint64
+	Checked int
+	// Missing records are in the manifest but not in the database,
+	// Unexpected ones the other way round, and Mismatched ones differ from
+	// the revision the manifest lists.
+	Missing    []string
+	Unexpected []string
+	Mismatched []string
+	// Reindexed lists the collections whose indexes were rebuilt from disk
+	// before checking.
+	Reindexed []string
+}
+
+// Clean reports whether the database matches the manifest.
+func (v *RestoreVerification) Clean() bool {
+	return len(v.Missing) == 0 && len(v.Unexpected) == 0 && len(v.Mismatched) == 0
+}
+
+func (v *RestoreVerification) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "checked %d records against the manifest at change %d", v.Checked, v.Seq)
+	for _, list := range []struct {
+		name  string
+		names []string
+	}{{"missing", v.Missing}, {"unexpected", v.Unexpected}, {"mismatched", v.Mismatched}} {
+		if len(list.names) > 0 {
+			fmt.Fprintf(&b, "\n  %d %s: %s", len(list.names), list.name, strings.Join(list.names, ", "))
+		}
+	}
+	return b.String()
+}
+
+// RestoreDivergenceError is returned when a restored database does not
+// match its backup manifest.
+type RestoreDivergenceError struct {
+	Verification *RestoreVerification
+}
+
+func (e *RestoreDivergenceError) Error() string {
+	return "restored database diverges from the backup manifest: " + e.Verification.String()
+}
+
+// reindexer is implemented by storage engines that keep in-memory indexes
+// which can be rebuilt from what is on disk.
+type reindexer interface {
+	reindex() ([]string, error)
+}
+
+// VerifyManifest rebuilds in-memory indexes from disk and compares every
+// record with the revision listed in m. Writes are held back while it runs.
+func (d *Driver) VerifyManifest(m *BackupManifest) (*RestoreVerification, error) {
+	resume := d.Pause()
+	defer resume()
+
+	v := &RestoreVerification{Seq: m.Seq}
+	if r, ok := d.store.(reindexer); ok {
+		reindexed, err := r.reindex()
+		if err != nil {
+			return nil, fmt.Errorf("could not rebuild indexes: %v", err)
+		}
+		v.Reindexed = reindexed
+	}
+
+	local, err := d.localManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	for name, rev := range m.Records {
+		v.Checked++
+		switch got, ok := local.Records[name]; {
+		case !ok:
+			v.Missing = append(v.Missing, name)
+		case got != rev:
+			v.Mismatched = append(v.Mismatched, name)
+		}
+	}
+	for name := range local.Records {
+		if _, ok := m.Records[name]; !ok {
+			v.Unexpected = append(v.Unexpected, name)
+		}
+	}
+	sort.Strings(v.Missing)
+	sort.Strings(v.Unexpected)
+	sort.Strings(v.Mismatched)
+	return v, nil
+}
+
+// reindex closes every open log, so each is replayed from disk on next use,
+// and replays them right away to surface damage.
+func (s *logStorage) reindex() ([]string, error) {
+	s.mutex.Lock()
+	for name, c := range s.collections {
+		c.Lock()
+		c.shut()
+		c.Unlock()
+		delete(s.collections, name)
+	}
+	s.mutex.Unlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read directory: %v", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		if _, err := s.collection(entry.Name(), false); errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return names, fmt.Errorf("could not rebuild index of collection %s: %v", entry.Name(), err)
+		}
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
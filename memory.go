@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// MemoryDir opens a database held entirely in memory when passed to New in
+// place of a directory. Everything is lost on Close unless Options.Memory
+// persists it.
+const MemoryDir = ":memory:"
+
+// MemoryOptions persists an in-memory database to a snapshot file, so it
+// can serve as a fast cache that survives restarts. Only records are
+// persisted: collection settings come from Options.Collections.
+type MemoryOptions struct {
+	// Path is the snapshot file. It is loaded when the database is opened,
+	// if it exists, and rewritten every Interval and on Close.
+	Path string
+	// Interval is how often the snapshot is rewritten. Zero only writes it
+	// on Close.
+	Interval time.Duration
+}
+
+// memoryRecord is a line of a memory snapshot.
+type memoryRecord struct {
+	Collection string `json:"collection"`
+	Key        string `json:"key"`
+	Data       []byte `json:"data"`
+}
+
+// newMemoryDir sets opts up for an in-memory database and returns the
+// scratch directory holding what the Driver keeps beside the records,
+// such as its lock and transaction journal.
+func newMemoryDir(opts *Options) (string, error) {
+	if opts.ReadOnly {
+		return "", fmt.Errorf("an in-memory database cannot be opened read-only")
+	}
+	dir, err := os.MkdirTemp("", "db-memory-")
+	if err != nil {
+		return "", fmt.Errorf("could not create scratch directory: %v", err)
+	}
+	if opts.Store == nil && opts.Backend == "" {
+		opts.Backend = "memory"
+	}
+	return dir, nil
+}
+
+// loadMemory fills an in-memory database from its snapshot, if any.
+func (d *Driver) loadMemory() error {
+	if d.memory == "" || d.opts.Memory == nil {
+		return nil
+	}
+
+	path := d.opts.Memory.Path
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not open memory snapshot: %v", err)
+	}
+	defer file.Close()
+
+	var loaded int
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<30)
+	for scanner.Scan() {
+		var record memoryRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("could not read memory snapshot %s: %v", path, err)
+		}
+		if err := d.store.put(record.Collection, record.Key, record.Data); err != nil {
+			return fmt.Errorf("could not load record %s of collection %s: %v", record.Key, record.Collection, err)
+		}
+		loaded++
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("could not read memory snapshot %s: %v", path, err)
+	}
+
+	d.log.Info("Loaded %d records from memory snapshot %s", loaded, path)
+	return nil
+}
+
+// saveMemory writes every record of an in-memory database to its snapshot,
+// holding writes back meanwhile. The snapshot is replaced atomically.
+func (d *Driver) saveMemory() (err error) {
+	resume := d.Pause()
+	defer resume()
+
+	path := d.opts.Memory.Path
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("could not create memory snapshot: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	collections, err := d.Collections()
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+	for _, collection := range collections {
+		keys, err := d.store.keys(collection)
+		if err != nil {
+			continue
+		}
+		for _, key := range keys {
+			data, err := d.store.get(collection, key)
+			if err != nil {
+				return fmt.Errorf("could not read record %s of collection %s: %v", key, collection, err)
+			}
+			if err := enc.Encode(memoryRecord{Collection: collection, Key: key, Data: data}); err != nil {
+				return fmt.Errorf("could not write memory snapshot: %v", err)
+			}
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("could not write memory snapshot: %v", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("could not sync memory snapshot: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("could not write memory snapshot: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("could not replace memory snapshot: %v", err)
+	}
+	return nil
+}
+
+// startMemorySnapshots rewrites the snapshot of an in-memory database every
+// interval until the Driver is closed.
+func (d *Driver) startMemorySnapshots() {
+	if d.memory == "" || d.opts.Memory == nil || d.opts.Memory.Interval <= 0 {
+		return
+	}
+
+	ran := d.background.track("memory-snapshot", d.opts.Memory.Interval)
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+
+		ticker := time.NewTicker(d.opts.Memory.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-d.stop:
+				return
+			case <-ticker.C:
+				if err := d.saveMemory(); err != nil {
+					d.log.Error("Memory snapshot failed: %v", err)
+				}
+				ran()
+			}
+		}
+	}()
+}
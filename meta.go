@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+// metaFile holds the configuration of a collection, inside its directory.
+const metaFile = "_meta.json"
+
+// CollectionMeta is the configuration of a collection. It is persisted in
+// the collection's _meta.json, so a database directory describes itself and
+// every process opening it treats the collection the same way.
+type CollectionMeta struct {
+	// Codec is the encoding of records; only "json" is supported.
+	Codec string `json:"codec,omitempty"`
+	// Compression of records; only "none" is supported.
+	Compression string `json:"compression,omitempty"`
+	// Schema is a JSON schema records are expected to follow.
+	Schema json.RawMessage `json:"schema,omitempty"`
+	// Indexes lists the fields, as dot paths, records are indexed by.
+	Indexes []string `json:"indexes,omitempty"`
+	// TTL is how long records are kept by default; zero keeps them forever.
+	TTL time.Duration `json:"ttl,omitempty"`
+	// CRDT makes the collection hold conflict-free replicated data types.
+	CRDT CRDTKind `json:"crdt,omitempty"`
+	// TimeSeries makes the collection hold timestamped points, written with
+	// AppendPoint into daily segments and read with ReadTimeRange.
+	TimeSeries bool `json:"timeSeries,omitempty"`
+	// Retention is how long a time series keeps its segments; zero keeps
+	// them forever.
+	Retention time.Duration `json:"retention,omitempty"`
+	// ArchiveAfter moves records not written for this long to the archive
+	// store of Options.Archive; zero keeps them in the collection.
+	ArchiveAfter time.Duration `json:"archiveAfter,omitempty"`
+	// DropAfter deletes records not written for this long, from the
+	// archive store too; zero keeps them forever. Records are stamped with
+	// when they were written while either is set.
+	DropAfter time.Duration `json:"dropAfter,omitempty"`
+	// Events makes the collection event sourced: Write appends the user as
+	// an immutable event to the stream of its key, Read returns the state
+	// folded from the stream by the Reducer registered with RegisterReducer,
+	// and ReadEvents the events themselves. Records cannot be deleted.
+	Events bool `json:"events,omitempty"`
+	// Version is the schema version Migrate last upgraded every record to.
+	Version int `json:"version,omitempty"`
+	// Geo lists the fields, as dot paths, holding locations indexed for Near
+	// and WithinBox: objects with lat and lon members, or "lat,lon"
+	// strings.
+	Geo []string `json:"geo,omitempty"`
+	// Encrypted lists the fields, as dot paths, stored encrypted under
+	// Options.EncryptionKey. They cannot be indexed, and match queries only
+	// once decrypted. Records written before a field was listed keep it in
+	// plaintext until they are written again.
+	Encrypted []string `json:"encrypted,omitempty"`
+	// Redact lists the fields, as dot paths, masked by Redact, in redacted
+	// exports and dumps, and in logs.
+	Redact []string `json:"redact,omitempty"`
+	// View is the source of the materialized view the collection holds. It
+	// is set by DefineView and cleared by DropView, so a view can be
+	// defined again over the records it left when the database was closed.
+	View string `json:"view,omitempty"`
+}
+
+func (m CollectionMeta) validate() error {
+	if m.Codec != "" && m.Codec != "json" {
+		return fmt.Errorf("unsupported codec %q", m.Codec)
+	}
+	if m.Compression != "" && m.Compression != "none" {
+		return fmt.Errorf("unsupported compression %q", m.Compression)
+	}
+	if len(m.Schema) > 0 && !json.Valid(m.Schema) {
+		return errors.New("schema is not valid JSON")
+	}
+	if m.Version < 0 {
+		return fmt.Errorf("negative version %d", m.Version)
+	}
+	if m.TTL < 0 {
+		return fmt.Errorf("negative TTL %s", m.TTL)
+	}
+	if m.CRDT != "" {
+		if _, err := newCRDT(m.CRDT); err != nil {
+			return err
+		}
+	}
+	if m.Retention < 0 {
+		return fmt.Errorf("negative retention %s", m.Retention)
+	}
+	if m.Retention > 0 && !m.TimeSeries {
+		return errors.New("retention applies to time series only")
+	}
+	if m.ArchiveAfter < 0 || m.DropAfter < 0 {
+		return errors.New("negative archival policy")
+	}
+	if m.ArchiveAfter > 0 && m.DropAfter > 0 && m.DropAfter <= m.ArchiveAfter {
+		return errors.New("dropAfter must be longer than archiveAfter")
+	}
+	if m.TimeSeries && (m.ArchiveAfter > 0 || m.DropAfter > 0) {
+		return errors.New("a time series drops old points by retention, not by an archival policy")
+	}
+	if m.TimeSeries && m.CRDT != "" {
+		return errors.New("a time series cannot hold CRDTs")
+	}
+	if m.Events && (m.TimeSeries || m.CRDT != "") {
+		return errors.New("an event sourced collection cannot be a time series or hold CRDTs")
+	}
+	if m.Events && (m.TTL > 0 || m.ArchiveAfter > 0 || m.DropAfter > 0) {
+		return errors.New("events are immutable and cannot expire or be archived")
+	}
+	if m.Events && len(m.Encrypted) > 0 {
+		return errors.New("the events of an event sourced collection cannot be encrypted")
+	}
+	for _, path := range m.Encrypted {
+		if path == "" || slices.Contains(strings.Split(path, "."), "") {
+			return fmt.Errorf("invalid encrypted field %q", path)
+		}
+		if slices.Contains(m.Indexes, path) {
+			return fmt.Errorf("encrypted field %s cannot be indexed", path)
+		}
+	}
+	for _, path := range m.Geo {
+		if path == "" || slices.Contains(strings.Split(path, "."), "") {
+			return fmt.Errorf("invalid geo field %q", path)
+		}
+		if slices.Contains(m.Encrypted, path) {
+			return fmt.Errorf("encrypted field %s cannot be geo-indexed", path)
+		}
+	}
+	for _, path := range m.Redact {
+		if path == "" || slices.Contains(strings.Split(path, "."), "") {
+			return fmt.Errorf("invalid redacted field %q", path)
+		}
+	}
+	return nil
+}
+
+// CollectionMeta returns the configuration of a collection, and whether it
+// has any. A name the naming policy rejects has none.
+func (d *Driver) CollectionMeta(collection string) (CollectionMeta, bool) {
+	if d.checkNames(&collection) != nil {
+		return CollectionMeta{}, false
+	}
+	return d.collectionMeta(collection)
+}
+
+// collectionMeta is CollectionMeta for a collection as named on disk.
+func (d *Driver) collectionMeta(collection string) (CollectionMeta, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	meta, ok := d.meta[collection]
+	return meta, ok
+}
+
+// SetCollectionMeta stores the configuration of a collection, creating the
+// collection if needed.
+func (d *Driver) SetCollectionMeta(collection string, meta CollectionMeta) error {
+	if err := d.checkNames(&collection); err != nil {
+		return err
+	}
+
+	if err := d.recordWritable(); err != nil {
+		return err
+	}
+	if d.cluster != nil {
+		if err := meta.validate(); err != nil {
+			return fmt.Errorf("invalid configuration of collection %s: %v", collection, err)
+		}
+		data, err := json.Marshal(meta)
+		if err != nil {
+			return fmt.Errorf("could not marshal collection configuration: %v", err)
+		}
+		return d.cluster.apply(Change{Op: clusterOpMeta, Collection: collection, Time: time.Now(), Data: data})
+	}
+	return d.setCollectionMeta(collection, meta)
+}
+
+// setCollectionMeta stores the configuration of a collection.
+func (d *Driver) setCollectionMeta(collection string, meta CollectionMeta) error {
+	d.gate.RLock()
+	defer d.gate.RUnlock()
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if err := d.writeMeta(collection, meta); err != nil {
+		return err
+	}
+	d.log.Info("Configured collection %s", collection)
+	return nil
+}
+
+func (d *Driver) writeMeta(collection string, meta CollectionMeta) error {
+	if err := meta.validate(); err != nil {
+		return fmt.Errorf("invalid configuration of collection %s: %v", collection, err)
+	}
+
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not marshal collection configuration: %v", err)
+	}
+
+	dir := filepath.Join(d.dir, collection)
+	if err := d.fs.MkdirAll(dir, d.layout.dirMode()); err != nil {
+		return fmt.Errorf("could not create collection directory: %v", err)
+	}
+	path := filepath.Join(dir, metaFile)
+	if err := writeFile(d.fs, path+".tmp", data, d.layout.fileMode()); err != nil {
+		return fmt.Errorf("could not write collection configuration: %v", err)
+	}
+	if err := d.fs.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("could not write collection configuration: %v", err)
+	}
+
+	d.mutex.Lock()
+	d.meta[collection] = meta
+	d.mutex.Unlock()
+	return nil
+}
+
+// loadMeta reads the stored configuration of every collection, then stores
+// the configuration given in options for collections that have none yet. A
+// stored configuration takes precedence over options.
+func (d *Driver) loadMeta(configured map[string]CollectionMeta) error {
+	d.meta = make(map[string]CollectionMeta)
+
+	collections, err := d.Collections()
+	if err != nil {
+		return err
+	}
+	for _, collection := range collections {
+		data, err := d.fs.ReadFile(filepath.Join(d.dir, collection, metaFile))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("could not read configuration of collection %s: %v", collection, err)
+		}
+
+		var meta CollectionMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return fmt.Errorf("could not parse configuration of collection %s: %v", collection, err)
+		}
+		if err := meta.validate(); err != nil {
+			return fmt.Errorf("invalid configuration of collection %s: %v", collection, err)
+		}
+		d.meta[collection] = meta
+	}
+
+	for collection, meta := range configured {
+		if stored, ok := d.meta[collection]; ok {
+			if !reflect.DeepEqual(stored, meta) {
+				d.log.Info("Collection %s is configured by its %s, ignoring options", collection, metaFile)
+			}
+			continue
+		}
+		if d.opts.ReadOnly {
+			if err := meta.validate(); err != nil {
+				return fmt.Errorf("invalid configuration of collection %s: %v", collection, err)
+			}
+			d.meta[collection] = meta
+			continue
+		}
+		if err := d.writeMeta(collection, meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configuredCollections merges Options.CRDT into Options.Collections.
+func configuredCollections(opts Options) map[string]CollectionMeta {
+	configured := make(map[string]CollectionMeta)
+	for collection, meta := range opts.Collections {
+		configured[collection] = meta
+	}
+	for collection, kind := range opts.CRDT {
+		meta := configured[collection]
+		if meta.CRDT == "" {
+			meta.CRDT = kind
+		}
+		configured[collection] = meta
+	}
+	return configured
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Operation names used for instrumentation.
+const (
+	opWrite      = "write"
+	opRead       = "read"
+	opReadMany   = "read_many"
+	opReadAll    = "read_all"
+	opReadRange  = "read_range"
+	opReadPrefix = "read_prefix"
+	opDelete     = "delete"
+	opQuery      = "query"
+	opCompact    = "compact"
+	opCommit     = "commit"
+	opMigrate    = "migrate"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the latency histogram.
+var latencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// Metrics is a point-in-time snapshot of a Driver's instrumentation.
+type Metrics struct {
+	Operations map[string]OpMetrics
+	// Collections maps each collection to its number of records.
+	Collections map[string]int
+	// CollectionBytes maps each collection to the bytes its records take,
+	// as tracked for Stats, when the storage engine can measure them.
+	CollectionBytes map[string]int64
+	// CacheHits and CacheMisses count log engine reads served from the
+	// memory mapping versus read from the file.
+	CacheHits   uint64
+	CacheMisses uint64
+	// Retries counts the filesystem operations retried after a transient
+	// error with Options.Retry, and RetryFailures those still failing once
+	// out of attempts.
+	Retries       uint64
+	RetryFailures uint64
+	// Integrity is the report of the startup integrity scan, if one ran.
+	Integrity *IntegrityReport
+}
+
+// OpMetrics describes one kind of operation.
+type OpMetrics struct {
+	Count  uint64
+	Errors uint64
+	// Buckets holds the cumulative count of operations that took at most
+	// the matching latencyBuckets bound; Sum is their total duration.
+	Buckets []uint64
+	Sum     time.Duration
+}
+
+// CacheHitRate is the share of reads served from the cache, or 0 if there
+// were none.
+func (m Metrics) CacheHitRate() float64 {
+	total := m.CacheHits + m.CacheMisses
+	if total == 0 {
+		return 0
+	}
+	return float64(m.CacheHits) / float64(total)
+}
+
+// metrics accumulates per-operation counters and latencies.
+type metrics struct {
+	mutex     sync.Mutex
+	ops       map[string]*OpMetrics
+	integrity *IntegrityReport
+	// corrupt is how many corrupt records the last Verify found.
+	corrupt int
+}
+
+// cacheStats is implemented by storage engines that serve reads from a cache.
+type cacheStats interface {
+	cacheStats() (hits, misses uint64)
+}
+
+// track records the outcome of an operation that took elapsed.
+func (d *Driver) track(op string, elapsed time.Duration, err error) {
+	d.opMetrics.mutex.Lock()
+	defer d.opMetrics.mutex.Unlock()
+
+	if d.opMetrics.ops == nil {
+		d.opMetrics.ops = make(map[string]*OpMetrics)
+	}
+	m, ok := d.opMetrics.ops[op]
+	if !ok {
+		m = &OpMetrics{Buckets: make([]uint64, len(latencyBuckets))}
+		d.opMetrics.ops[op] = m
+	}
+
+	m.Count++
+	if err != nil {
+		m.Errors++
+	}
+	m.Sum += elapsed
+	for i, bound := range latencyBuckets {
+		if elapsed.Seconds() <= bound {
+			m.Buckets[i]++
+		}
+	}
+}
+
+// Metrics returns a snapshot of the Driver's operation counters, latencies,
+// cache statistics and collection sizes.
+func (d *Driver) Metrics() Metrics {
+	snapshot := Metrics{
+		Operations:      make(map[string]OpMetrics),
+		Collections:     make(map[string]int),
+		CollectionBytes: make(map[string]int64),
+	}
+
+	d.opMetrics.mutex.Lock()
+	for op, m := range d.opMetrics.ops {
+		c := *m
+		c.Buckets = append([]uint64(nil), m.Buckets...)
+		snapshot.Operations[op] = c
+	}
+	snapshot.Integrity = d.opMetrics.integrity
+	d.opMetrics.mutex.Unlock()
+
+	if c, ok := d.store.(cacheStats); ok {
+		snapshot.CacheHits, snapshot.CacheMisses = c.cacheStats()
+	}
+	if r, ok := d.fs.(*retryFS); ok {
+		snapshot.Retries, snapshot.RetryFailures = r.retries.Load(), r.failures.Load()
+	}
+
+	collections, err := d.Collections()
+	if err != nil {
+		d.log.Error("Could not list collections for metrics: %v", err)
+	}
+	for _, collection := range collections {
+		n, err := d.count(collection)
+		if err != nil {
+			continue
+		}
+		snapshot.Collections[collection] = n
+	}
+	if d.canTrack() {
+		for collection := range snapshot.Collections {
+			if err := d.measureUsage(collection); err != nil {
+				continue
+			}
+			d.usage.mutex.Lock()
+			snapshot.CollectionBytes[collection] = d.usage.tally(collection).bytes
+			d.usage.mutex.Unlock()
+		}
+	}
+
+	return snapshot
+}
+
+// MetricsHandler serves the Driver's metrics in the Prometheus text
+// exposition format, for mounting at /metrics.
+func (d *Driver) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		d.Metrics().writePrometheus(w)
+	})
+}
+
+func (m Metrics) writePrometheus(w io.Writer) {
+	ops := make([]string, 0, len(m.Operations))
+	for op := range m.Operations {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	fmt.Fprintln(w, "# HELP db_operations_total Operations performed.")
+	fmt.Fprintln(w, "# TYPE db_operations_total counter")
+	for _, op := range ops {
+		fmt.Fprintf(w, "db_operations_total{op=%q} %d\n", op, m.Operations[op].Count)
+	}
+
+	fmt.Fprintln(w, "# HELP db_operation_errors_total Operations that returned an error.")
+	fmt.Fprintln(w, "# TYPE db_operation_errors_total counter")
+	for _, op := range ops {
+		fmt.Fprintf(w, "db_operation_errors_total{op=%q} %d\n", op, m.Operations[op].Errors)
+	}
+
+	fmt.Fprintln(w, "# HELP db_operation_duration_seconds Operation latency.")
+	fmt.Fprintln(w, "# TYPE db_operation_duration_seconds histogram")
+	for _, op := range ops {
+		o := m.Operations[op]
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "db_operation_duration_seconds_bucket{op=%q,le=\"%g\"} %d\n", op, bound, o.Buckets[i])
+		}
+		fmt.Fprintf(w, "db_operation_duration_seconds_bucket{op=%q,le=\"+Inf\"} %d\n", op, o.Count)
+		fmt.Fprintf(w, "db_operation_duration_seconds_sum{op=%q} %g\n", op, o.Sum.Seconds())
+		fmt.Fprintf(w, "db_operation_duration_seconds_count{op=%q} %d\n", op, o.Count)
+	}
+
+	fmt.Fprintln(w, "# HELP db_cache_requests_total Reads by cache outcome.")
+	fmt.Fprintln(w, "# TYPE db_cache_requests_total counter")
+	fmt.Fprintf(w, "db_cache_requests_total{result=\"hit\"} %d\n", m.CacheHits)
+	fmt.Fprintf(w, "db_cache_requests_total{result=\"miss\"} %d\n", m.CacheMisses)
+
+	fmt.Fprintln(w, "# HELP db_io_retries_total Filesystem operations retried after a transient error.")
+	fmt.Fprintln(w, "# TYPE db_io_retries_total counter")
+	fmt.Fprintf(w, "db_io_retries_total %d\n", m.Retries)
+	fmt.Fprintln(w, "# HELP db_io_retry_failures_total Filesystem operations failing with a transient error after every attempt.")
+	fmt.Fprintln(w, "# TYPE db_io_retry_failures_total counter")
+	fmt.Fprintf(w, "db_io_retry_failures_total %d\n", m.RetryFailures)
+
+	if m.Integrity != nil {
+		fmt.Fprintln(w, "# HELP db_integrity_problems Problems found by the startup integrity scan.")
+		fmt.Fprintln(w, "# TYPE db_integrity_problems gauge")
+		fmt.Fprintf(w, "db_integrity_problems{mode=%q} %d\n", m.Integrity.Mode, len(m.Integrity.Problems))
+	}
+
+	collections := make([]string, 0, len(m.Collections))
+	for collection := range m.Collections {
+		collections = append(collections, collection)
+	}
+	sort.Strings(collections)
+
+	fmt.Fprintln(w, "# HELP db_collection_records Records stored per collection.")
+	fmt.Fprintln(w, "# TYPE db_collection_records gauge")
+	for _, collection := range collections {
+		fmt.Fprintf(w, "db_collection_records{collection=%q} %d\n", collection, m.Collections[collection])
+	}
+
+	fmt.Fprintln(w, "# HELP db_collection_bytes Bytes taken by the records of each collection.")
+	fmt.Fprintln(w, "# TYPE db_collection_bytes gauge")
+	for _, collection := range collections {
+		if bytes, ok := m.CollectionBytes[collection]; ok {
+			fmt.Fprintf(w, "db_collection_bytes{collection=%q} %d\n", collection, bytes)
+		}
+	}
+}
+
+func (s *logStorage) cacheStats() (hits, misses uint64) {
+	return atomic.LoadUint64(&s.hits), atomic.LoadUint64(&s.misses)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+	writeUsers(t, d, "ann", "bob")
+	if err := d.Write("teams", "red", User{Name: "red"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Read("users", "ann"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Read("users", "missing"); err == nil {
+		t.Fatal("read of a missing user succeeded")
+	}
+
+	m := d.Metrics()
+	if w := m.Operations[opWrite]; w.Count != 3 || w.Errors != 0 || w.Buckets[len(w.Buckets)-1] != 3 {
+		t.Errorf("writes = %+v, want 3 without errors", w)
+	}
+	if r := m.Operations[opRead]; r.Count != 2 || r.Errors != 1 {
+		t.Errorf("reads = %+v, want 2 with 1 error", r)
+	}
+	if m.Collections["users"] != 2 || m.Collections["teams"] != 1 {
+		t.Errorf("Collections = %v, want 2 users and 1 team", m.Collections)
+	}
+
+	usage, err := d.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, collection := range []string{"users", "teams"} {
+		if got, want := m.CollectionBytes[collection], usage.Collections[collection].Bytes; got != want || got == 0 {
+			t.Errorf("CollectionBytes[%s] = %d, want %d", collection, got, want)
+		}
+	}
+
+	// The bytes follow writes once measured; ann and bob are the same size.
+	if err := d.Delete("users", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := d.Metrics().CollectionBytes["users"], m.CollectionBytes["users"]/2; got != want {
+		t.Errorf("CollectionBytes[users] after deleting bob = %d, want %d", got, want)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+	writeUsers(t, d, "ann")
+	stats, err := d.Stats("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	d.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+		t.Errorf("Content-Type = %q", got)
+	}
+	body := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE db_operations_total counter",
+		`db_operations_total{op="write"} 1`,
+		`db_operation_errors_total{op="write"} 0`,
+		`db_operation_duration_seconds_bucket{op="write",le="+Inf"} 1`,
+		`db_operation_duration_seconds_count{op="write"} 1`,
+		`db_cache_requests_total{result="hit"} 0`,
+		"db_io_retries_total 0",
+		`db_collection_records{collection="users"} 1`,
+		"# TYPE db_collection_bytes gauge",
+		fmt.Sprintf(`db_collection_bytes{collection="users"} %d`, stats.Bytes),
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics lack %q:\n%s", line, body)
+		}
+	}
+	if strings.Contains(body, "db_integrity_problems") {
+		t.Errorf("metrics report an integrity scan that did not run:\n%s", body)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// versionField is the field records of a collection with migrations carry
+// their schema version in.
+const versionField = "_version"
+
+// Migration upgrades an encoded record to the next schema version.
+type Migration func(raw []byte) ([]byte, error)
+
+type migration struct {
+	version int
+	migrate Migration
+}
+
+// RegisterMigration registers the migration that upgrades records of a
+// collection to version. Versions start at 1 and must be registered in
+// increasing order.
+//
+// Once a collection has migrations, every record written to it is stamped
+// with its schema version in a _version field. Older records are upgraded
+// lazily as they are read, or all at once by Migrate. Records without a
+// stamp are taken to be at the version recorded in the collection's
+// configuration by the last Migrate, so every process writing to the
+// collection should register its migrations.
+func (d *Driver) RegisterMigration(collection string, version int, migrate Migration) error {
+	if err := d.checkNames(&collection); err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.migrations == nil {
+		d.migrations = make(map[string][]migration)
+	}
+	latest := 0
+	if registered := d.migrations[collection]; len(registered) > 0 {
+		latest = registered[len(registered)-1].version
+	}
+	if version <= latest {
+		return fmt.Errorf("migration %d of collection %s must come after version %d", version, collection, latest)
+	}
+
+	d.migrations[collection] = append(d.migrations[collection], migration{version: version, migrate: migrate})
+	return nil
+}
+
+// schemaVersion returns the migrations registered for a collection and the
+// version records are written at.
+func (d *Driver) schemaVersion(collection string) ([]migration, int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	migrations := d.migrations[collection]
+	version := d.meta[collection].Version
+	if len(migrations) > 0 && migrations[len(migrations)-1].version > version {
+		version = migrations[len(migrations)-1].version
+	}
+	return migrations, version
+}
+
+// stampVersion sets the schema version of a record about to be written, if
+// the collection has one.
+func (d *Driver) stampVersion(collection string, data []byte) ([]byte, error) {
+	if _, version := d.schemaVersion(collection); version > 0 {
+		return setRecordVersion(data, version)
+	}
+	return data, nil
+}
+
+// upgrade runs the migrations a record read from a collection is missing.
+// The stream of an event sourced collection is folded into its state
+// instead.
+func (d *Driver) upgrade(collection, key string, data []byte) ([]byte, bool, error) {
+	if d.eventSourced(collection) {
+		data, err := d.fold(collection, key, data)
+		return data, false, err
+	}
+	migrations, version := d.schemaVersion(collection)
+	if len(migrations) == 0 {
+		return data, false, nil
+	}
+
+	current, ok := recordVersion(data)
+	if !ok {
+		meta, _ := d.collectionMeta(collection)
+		current = meta.Version
+	}
+	if current >= version {
+		return data, false, nil
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		upgraded, err := m.migrate(data)
+		if err != nil {
+			return nil, false, fmt.Errorf("could not migrate %s in collection %s to version %d: %v", key, collection, m.version, err)
+		}
+		data = upgraded
+	}
+
+	data, err := setRecordVersion(data, version)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not migrate %s in collection %s: %v", key, collection, err)
+	}
+	return data, true, nil
+}
+
+// Migrate upgrades every record of a collection that is behind its latest
+// registered migration, then records the version in the collection's
+// configuration. It returns the number of records upgraded.
+func (d *Driver) Migrate(collection string) (migrated int, err error) {
+	if err := d.checkNames(&collection); err != nil {
+		return 0, err
+	}
+
+	op := d.begin(opMigrate, collection, "")
+	defer op.end(&err)
+
+	if err := d.writable(); err != nil {
+		return 0, err
+	}
+
+	d.gate.RLock()
+	defer d.gate.RUnlock()
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	_, version := d.schemaVersion(collection)
+	keys, err := d.store.keys(collection)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, key := range keys {
+		data, err := d.store.get(collection, key)
+		if err != nil {
+			return migrated, fmt.Errorf("could not read %s: %v", key, err)
+		}
+		upgraded, changed, err := d.upgrade(collection, key, data)
+		if err != nil {
+			return migrated, err
+		}
+		if !changed {
+			continue
+		}
+
+		if err := d.put(collection, key, upgraded); err != nil {
+			return migrated, err
+		}
+		op.bytes += len(upgraded)
+		migrated++
+		d.publish(OpWrite, collection, key, upgraded)
+	}
+
+	meta, _ := d.collectionMeta(collection)
+	if meta.Version != version {
+		meta.Version = version
+		if err := d.writeMeta(collection, meta); err != nil {
+			return migrated, err
+		}
+	}
+
+	d.log.Info("Migrated %d records of collection %s to version %d", migrated, collection, version)
+	return migrated, nil
+}
+
+// recordVersion reads the schema version a record is stamped with.
+func recordVersion(data []byte) (int, bool) {
+	var stamp struct {
+		Version *int `json:"_version"`
+	}
+	if err := json.Unmarshal(data, &stamp); err != nil || stamp.Version == nil {
+		return 0, false
+	}
+	return *stamp.Version, true
+}
+
+// setRecordVersion stamps a record with a schema version.
+func setRecordVersion(data []byte, version int) ([]byte, error) {
+	return setRecordField(data, versionField, json.RawMessage(strconv.Itoa(version)))
+}
+
+// setRecordField sets a top-level field of a record. A new field goes
+// first, so the rest of the record keeps its field order.
+func setRecordField(data []byte, field string, value json.RawMessage) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("record is not a JSON object: %v", err)
+	}
+
+	if _, ok := fields[field]; ok {
+		fields[field] = value
+		return json.MarshalIndent(fields, "", "  ")
+	}
+
+	stamped := []byte(fmt.Sprintf("{%q:%s", field, value))
+	if len(fields) > 0 {
+		stamped = append(stamped, ',')
+	}
+	stamped = append(stamped, bytes.TrimPrefix(bytes.TrimSpace(data), []byte("{"))...)
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, stamped, "", "  "); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
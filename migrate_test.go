@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// appendCompany returns a migration appending suffix to Company.
+func appendCompany(suffix string) Migration {
+	return func(raw []byte) ([]byte, error) {
+		var doc map[string]interface{}
+		if err := json.Unmarshal(raw, &doc); err != nil {
+			return nil, err
+		}
+		doc["Company"] = doc["Company"].(string) + suffix
+		return json.Marshal(doc)
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+	if err := d.Write("users", "old", User{Company: "acme"}); err != nil {
+		t.Fatal(err)
+	}
+	for version, suffix := range []string{"-1", "-2"} {
+		if err := d.RegisterMigration("users", version+1, appendCompany(suffix)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.RegisterMigration("users", 2, appendCompany("-again")); err == nil {
+		t.Error("registering a version twice succeeded")
+	}
+	if err := d.store.put("users", "at1", []byte(`{"_version": 1, "Company": "acme-1"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Write("users", "new", User{Company: "acme-1-2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key         string
+		wantVersion int // of the record as stored before Migrate
+	}{
+		{"old", 0},
+		{"at1", 1},
+		{"new", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			// Reads upgrade lazily, leaving the stored record as it is.
+			user, err := d.Read("users", tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.Company != "acme-1-2" {
+				t.Errorf("Company = %q, want acme-1-2", user.Company)
+			}
+			data, err := d.store.get("users", tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version, _ := recordVersion(data); version != tt.wantVersion {
+				t.Errorf("stored at version %d, want %d", version, tt.wantVersion)
+			}
+		})
+	}
+
+	if migrated, err := d.Migrate("users"); err != nil || migrated != 2 {
+		t.Errorf("Migrate = %d, %v, want 2", migrated, err)
+	}
+	for _, tt := range tests {
+		data, err := d.store.get("users", tt.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version, _ := recordVersion(data); version != 2 {
+			t.Errorf("%s stored at version %d after Migrate, want 2", tt.key, version)
+		}
+	}
+	if meta, _ := d.CollectionMeta("users"); meta.Version != 2 {
+		t.Errorf("collection at version %d, want 2", meta.Version)
+	}
+	if migrated, err := d.Migrate("users"); err != nil || migrated != 0 {
+		t.Errorf("second Migrate = %d, %v, want 0", migrated, err)
+	}
+}
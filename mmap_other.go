@@ -0,0 +1,17 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// mmapFile is unavailable on this platform; callers fall back to ReadAt.
+func mmapFile(file *os.File, size int64) ([]byte, error) {
+	return nil, errors.New("memory-mapped reads are not supported on this platform")
+}
+
+func munmap(data []byte) error {
+	return nil
+}
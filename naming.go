@@ -0,0 +1,348 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrInvalidName is returned for collection names and keys the naming
+// policy rejects.
+var ErrInvalidName = errors.New("invalid name")
+
+// PortableNameChars are the characters of file names portable across
+// operating systems, a common choice for NamingPolicy.Allowed.
+const PortableNameChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789._-"
+
+// NamingPolicy restricts the names of collections and the keys of records
+// beyond what every database requires: names that are not empty, hold no
+// path separators or NUL bytes and are not . or .., collections whose name
+// does not start with a dot, and no key clashing with a collection's
+// _meta.json.
+type NamingPolicy struct {
+	// Allowed lists the characters names may hold; any if empty.
+	Allowed string
+	// MaxLength bounds names, in bytes; zero leaves them unbounded.
+	MaxLength int
+	// FoldCase lowercases names, so names differing only in case are the
+	// same collection or record.
+	FoldCase bool
+	// Reserved lists names that cannot be used, compared after folding.
+	Reserved []string
+}
+
+// checkNames checks a collection name and keys against the naming policy
+// and normalizes them in place. Every exported call naming a collection or
+// record checks its names first; calls that cannot fail, such as Watch and
+// CollectionMeta, treat a rejected name as naming nothing. Lower down,
+// checkPath keeps any name from reaching outside the database directory.
+func (d *Driver) checkNames(collection *string, keys ...*string) error {
+	normalized, err := d.opts.Naming.normalize(*collection)
+	if err == nil && strings.HasPrefix(normalized, ".") {
+		err = errors.New("starts with a dot")
+	}
+	if err != nil {
+		return fmt.Errorf("%w: collection %q %v", ErrInvalidName, *collection, err)
+	}
+	*collection = normalized
+
+	for _, key := range keys {
+		normalized, err := d.opts.Naming.normalize(*key)
+		if err == nil && d.layout.reservedKey(normalized) != nil {
+			err = errors.New("is reserved")
+		}
+		if err != nil {
+			return fmt.Errorf("%w: key %q %v", ErrInvalidName, *key, err)
+		}
+		*key = normalized
+	}
+	return nil
+}
+
+// checkPath fails for a collection name that is not a directory of its own
+// in the database directory, whatever the naming policy. Collections are
+// listed and read through it.
+func checkPath(collection string) error {
+	_, err := (*NamingPolicy)(nil).normalize(collection)
+	if err == nil && strings.HasPrefix(collection, ".") {
+		err = errors.New("starts with a dot")
+	}
+	if err != nil {
+		return fmt.Errorf("%w: collection %q %v", ErrInvalidName, collection, err)
+	}
+	return nil
+}
+
+// checkRecordPath is checkPath for a record as well: its key must name a
+// file of its own in the collection's directory. Storage engines check
+// every record they are handed, whichever call it came from.
+func checkRecordPath(collection, key string) error {
+	if err := checkPath(collection); err != nil {
+		return err
+	}
+	if _, err := (*NamingPolicy)(nil).normalize(key); err != nil {
+		return fmt.Errorf("%w: key %q %v", ErrInvalidName, key, err)
+	}
+	return nil
+}
+
+// foldName returns name as the naming policy folds it, for calls that
+// cannot fail; the calls using the name check it.
+func (d *Driver) foldName(name string) string {
+	if p := d.opts.Naming; p != nil && p.FoldCase {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+// normalize returns a name as the policy stores it, or why it is rejected.
+// A nil policy only applies the rules every database requires.
+func (p *NamingPolicy) normalize(name string) (string, error) {
+	if p != nil && p.FoldCase {
+		name = strings.ToLower(name)
+	}
+	switch {
+	case name == "":
+		return "", errors.New("is empty")
+	case name == "." || name == "..":
+		return "", errors.New("is a relative path")
+	case strings.ContainsAny(name, "/\\\x00"):
+		return "", errors.New("holds a path separator or NUL byte")
+	}
+	if p == nil {
+		return name, nil
+	}
+
+	if p.MaxLength > 0 && len(name) > p.MaxLength {
+		return "", fmt.Errorf("is longer than %d bytes", p.MaxLength)
+	}
+	if p.Allowed != "" {
+		for _, r := range name {
+			if !strings.ContainsRune(p.Allowed, r) {
+				return "", fmt.Errorf("holds %q, which is not allowed", r)
+			}
+		}
+	}
+	for _, reserved := range p.Reserved {
+		if p.FoldCase {
+			reserved = strings.ToLower(reserved)
+		}
+		if name == reserved {
+			return "", errors.New("is reserved")
+		}
+	}
+	return name, nil
+}
+
+// conform returns the name the policy would accept for name: folded, with
+// characters not allowed replaced by underscores and cut to MaxLength. It
+// fails if there is none, such as for a reserved name.
+func (p *NamingPolicy) conform(name string) (string, error) {
+	if p != nil && p.FoldCase {
+		name = strings.ToLower(name)
+	}
+	var b strings.Builder
+	for _, r := range name {
+		if r == '/' || r == '\\' || r == 0 || p != nil && p.Allowed != "" && !strings.ContainsRune(p.Allowed, r) {
+			r = '_'
+		}
+		b.WriteRune(r)
+	}
+	name = b.String()
+	if p != nil && p.MaxLength > 0 && len(name) > p.MaxLength {
+		name = name[:p.MaxLength]
+		for !utf8.ValidString(name) {
+			name = name[:len(name)-1]
+		}
+	}
+	return p.normalize(name)
+}
+
+// NameChange is a collection or record NormalizeNames renamed, or could
+// not rename. Key is empty for whole collections.
+type NameChange struct {
+	Collection string `json:"collection"`
+	Key        string `json:"key,omitempty"`
+	To         string `json:"to,omitempty"`
+	// Reason tells why a name could not be changed.
+	Reason string `json:"reason,omitempty"`
+}
+
+// RenameReport lists what NormalizeNames did, or on a dry run would do.
+type RenameReport struct {
+	DryRun  bool         `json:"dryRun"`
+	Renamed []NameChange `json:"renamed"`
+	Skipped []NameChange `json:"skipped"`
+}
+
+// NormalizeNames renames the collections and records stored under names
+// the naming policy rejects or would fold, typically after Options.Naming
+// was tightened, to the names it would accept. A collection whose name
+// folds to that of an existing one is merged into it. Records whose new
+// name is taken, and names with no acceptable form, are skipped. Writes
+// are held back meanwhile. With dryRun nothing is changed and the report
+// tells what would be.
+func (d *Driver) NormalizeNames(dryRun bool) (*RenameReport, error) {
+	if !dryRun {
+		if err := d.writable(); err != nil {
+			return nil, err
+		}
+		resume := d.Pause()
+		defer resume()
+	}
+
+	report := &RenameReport{DryRun: dryRun, Renamed: []NameChange{}, Skipped: []NameChange{}}
+	collections, err := d.Collections()
+	if err != nil {
+		return nil, err
+	}
+
+	// taken holds the keys of each collection as they will be once the
+	// records renamed so far are moved.
+	taken := make(map[string]map[string]bool, len(collections))
+	for _, collection := range collections {
+		keys, err := d.store.keys(collection)
+		if err != nil {
+			return report, fmt.Errorf("could not list collection %s: %v", collection, err)
+		}
+		taken[collection] = make(map[string]bool, len(keys))
+		for _, key := range keys {
+			taken[collection][key] = true
+		}
+	}
+
+	policy := d.opts.Naming
+	for _, collection := range collections {
+		target := collection
+		if !policy.conforms(collection) {
+			to, err := policy.conform(collection)
+			if err != nil {
+				report.Skipped = append(report.Skipped, NameChange{Collection: collection, Reason: err.Error()})
+				continue
+			}
+			if d.hasMeta(to) && d.hasMeta(collection) {
+				report.Skipped = append(report.Skipped, NameChange{Collection: collection, To: to, Reason: "both collections are configured"})
+				continue
+			}
+			if taken[to] == nil {
+				taken[to] = make(map[string]bool)
+			}
+			target = to
+		}
+
+		keys := slices.Sorted(maps.Keys(taken[collection]))
+		moved := 0
+		for _, key := range keys {
+			to := key
+			if !policy.conforms(key) {
+				if to, err = policy.conform(key); err == nil {
+					err = d.layout.reservedKey(to)
+				}
+				if err != nil {
+					report.Skipped = append(report.Skipped, NameChange{Collection: collection, Key: key, Reason: err.Error()})
+					continue
+				}
+			}
+			if to == key && target == collection {
+				continue
+			}
+			if taken[target][to] {
+				report.Skipped = append(report.Skipped, NameChange{Collection: collection, Key: key, To: to, Reason: "key exists"})
+				continue
+			}
+			if !dryRun {
+				if err := d.moveRecord(collection, key, target, to); err != nil {
+					return report, err
+				}
+			}
+			taken[target][to] = true
+			if target == collection {
+				delete(taken[collection], key)
+			}
+			moved++
+			if to != key {
+				report.Renamed = append(report.Renamed, NameChange{Collection: collection, Key: key, To: to})
+			}
+		}
+
+		if target == collection {
+			continue
+		}
+		if moved < len(keys) {
+			report.Skipped = append(report.Skipped, NameChange{Collection: collection, To: target, Reason: "some records could not be renamed"})
+			continue
+		}
+		report.Renamed = append(report.Renamed, NameChange{Collection: collection, To: target})
+		if !dryRun {
+			if err := d.moveMeta(collection, target); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	if !dryRun && len(report.Renamed) > 0 {
+		d.log.Info("Renamed %d collections and records to conform to the naming policy", len(report.Renamed))
+	}
+	return report, nil
+}
+
+// conforms reports whether the policy accepts name as it is.
+func (p *NamingPolicy) conforms(name string) bool {
+	normalized, err := p.normalize(name)
+	return err == nil && normalized == name
+}
+
+// hasMeta reports whether a collection is configured.
+func (d *Driver) hasMeta(collection string) bool {
+	_, ok := d.collectionMeta(collection)
+	return ok
+}
+
+// moveRecord stores a record under a new collection and key, then deletes
+// it under the old ones. Writes must be held back.
+func (d *Driver) moveRecord(collection, key, toCollection, toKey string) error {
+	data, err := d.store.get(collection, key)
+	if err != nil {
+		return fmt.Errorf("could not read %s of collection %s: %v", key, collection, err)
+	}
+	if data, err = d.resealFields(collection, key, toCollection, toKey, data); err != nil {
+		return fmt.Errorf("could not rename %s of collection %s: %v", key, collection, err)
+	}
+	if err := d.put(toCollection, toKey, data); err != nil {
+		return fmt.Errorf("could not rename %s of collection %s: %v", key, collection, err)
+	}
+	if err := d.remove(collection, key); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not rename %s of collection %s: %v", key, collection, err)
+	}
+	d.publish(OpWrite, toCollection, toKey, data)
+	d.publish(OpDelete, collection, key, nil)
+	return nil
+}
+
+// moveMeta moves the configuration of a renamed collection, and removes
+// what is left of its directory. Writes must be held back.
+func (d *Driver) moveMeta(collection, to string) error {
+	if meta, ok := d.collectionMeta(collection); ok {
+		if err := d.writeMeta(to, meta); err != nil {
+			return err
+		}
+		if err := d.fs.Remove(filepath.Join(d.dir, collection, metaFile)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove configuration of collection %s: %v", collection, err)
+		}
+		d.mutex.Lock()
+		delete(d.meta, collection)
+		d.mutex.Unlock()
+	}
+	if dropper, ok := d.store.(emptyDropper); ok {
+		if err := dropper.dropEmpty(collection); err != nil {
+			return err
+		}
+	}
+	d.fs.Remove(filepath.Join(d.dir, collection))
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestNamingRejectsTraversal calls every exported method naming a
+// collection or record with names that would reach outside the database
+// directory.
+func TestNamingRejectsTraversal(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+	if err := d.Write("users", "alice", User{Name: "Alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bad := range []string{"../x", "..", "a/b", `a\b`, "", ".hidden"} {
+		collectionCalls := map[string]func(c string) error{
+			"AddReference":          func(c string) error { return d.AddReference(c, "Name", "users") },
+			"AddReference target":   func(c string) error { return d.AddReference("users", "Name", c) },
+			"AddCascadingReference": func(c string) error { return d.AddCascadingReference(c, "Name", "users") },
+			"AppendPoint":           func(c string) error { return d.AppendPoint(c, time.Now(), User{}) },
+			"Archive":               func(c string) error { _, err := d.Archive(c, true); return err },
+			"BeginBulkLoad":         func(c string) error { return d.BeginBulkLoad(c) },
+			"EndBulkLoad":           func(c string) error { return d.EndBulkLoad(c) },
+			"Bench":                 func(c string) error { _, err := d.Bench(c, BenchOptions{}); return err },
+			"Compact":               func(c string) error { return d.Compact(c) },
+			"Count":                 func(c string) error { _, err := d.Count(c); return err },
+			"DefineView":            func(c string) error { return d.DefineView(c, View{Source: "users"}) },
+			"DefineView source":     func(c string) error { return d.DefineView("v", View{Source: c}) },
+			"DropView":              func(c string) error { return d.DropView(c) },
+			"Dump":                  func(c string) error { _, err := d.Dump(io.Discard, c); return err },
+			"DumpRedacted":          func(c string) error { _, err := d.DumpRedacted(io.Discard, c); return err },
+			"ExpireNow":             func(c string) error { _, err := d.ExpireNow(c); return err },
+			"Export":                func(c string) error { _, err := d.Export(c); return err },
+			"ExportRedacted":        func(c string) error { _, err := d.ExportRedacted(c); return err },
+			"Import":                func(c string) error { _, err := d.Import(c, nil, ImportOptions{}); return err },
+			"Keys":                  func(c string) error { _, err := d.Keys(c); return err },
+			"KV.Range":              func(c string) error { return d.KV(c).Range(func(string, User) bool { return true }) },
+			"Migrate":               func(c string) error { _, err := d.Migrate(c); return err },
+			"Near":                  func(c string) error { _, err := d.Near(c, "Location", 0, 0, 1); return err },
+			"Query":                 func(c string) error { _, err := d.Query(c, `Name == "x"`); return err },
+			"QueryJoin":             func(c string) error { _, err := d.QueryJoin(c, `Name == "x"`); return err },
+			"QueryJoin join": func(c string) error {
+				_, err := d.QueryJoin("users", `Name == "Alice"`, Join{Collection: c, Field: "Name", As: "x"})
+				return err
+			},
+			"QueryResults.Stream": func(c string) error { _, err := d.QueryResults(c, "").Stream(io.Discard, FormatNDJSON); return err },
+			"Queue.Enqueue":       func(c string) error { _, err := d.Queue(c).Enqueue([]byte(`{}`), 0); return err },
+			"Queue.Len":           func(c string) error { _, err := d.Queue(c).Len(); return err },
+			"ReadAll":             func(c string) error { _, err := d.ReadAll(c); return err },
+			"ReadMany":            func(c string) error { _, err := d.ReadMany(c, []string{"alice"}); return err },
+			"ReadPrefix":          func(c string) error { _, err := d.ReadPrefix(c, "a"); return err },
+			"ReadRange":           func(c string) error { _, err := d.ReadRange(c, "a", "z"); return err },
+			"ReadTimeRange":       func(c string) error { _, err := d.ReadTimeRange(c, time.Time{}, time.Now()); return err },
+			"Redact":              func(c string) error { _, err := d.Redact(c, []byte(`{}`)); return err },
+			"RegisterComputed":    func(c string) error { return d.RegisterComputed(c, "x", func(User) interface{} { return nil }) },
+			"RegisterMigration": func(c string) error {
+				return d.RegisterMigration(c, 1, func(raw []byte) ([]byte, error) { return raw, nil })
+			},
+			"RegisterReducer":   func(c string) error { return d.RegisterReducer(c, func(s User, e Event) User { return s }) },
+			"Repair":            func(c string) error { _, err := d.Repair(c, RepairOptions{}); return err },
+			"SetCollectionMeta": func(c string) error { return d.SetCollectionMeta(c, CollectionMeta{}) },
+			"Stats":             func(c string) error { _, err := d.Stats(c); return err },
+			"WithinBox":         func(c string) error { _, err := d.WithinBox(c, "Location", 0, 0, 1, 1); return err },
+		}
+		recordCalls := map[string]func(c, k string) error{
+			"CompareAndSwap": func(c, k string) error { return d.CompareAndSwap(c, k, User{}, User{}) },
+			"Delete":         func(c, k string) error { return d.Delete(c, k) },
+			"Increment":      func(c, k string) error { _, err := d.Increment(c, k, "Age", 1); return err },
+			"KV.Get":         func(c, k string) error { _, err := d.KV(c).Get(k); return err },
+			"KV.Set":         func(c, k string) error { return d.KV(c).Set(k, User{}) },
+			"MergeCRDT":      func(c, k string) error { _, err := d.MergeCRDT(c, k, []byte(`{}`)); return err },
+			"Read":           func(c, k string) error { _, err := d.Read(c, k); return err },
+			"ReadArchived":   func(c, k string) error { _, err := d.ReadArchived(c, k); return err },
+			"ReadCRDT":       func(c, k string) error { _, err := d.ReadCRDT(c, k); return err },
+			"ReadEvents":     func(c, k string) error { _, err := d.ReadEvents(c, k, 0); return err },
+			"ReadField":      func(c, k string) error { _, err := d.ReadField(c, k, "Name"); return err },
+			"ReadMany keys":  func(c, k string) error { _, err := d.ReadMany(c, []string{k}); return err },
+			"Tx.Delete":      func(c, k string) error { return d.Begin().Delete(c, k) },
+			"Tx.Read":        func(c, k string) error { _, err := d.Begin().Read(c, k); return err },
+			"Tx.Write":       func(c, k string) error { return d.Begin().Write(c, k, User{}) },
+			"Write":          func(c, k string) error { return d.Write(c, k, User{}) },
+			"WriteIfAbsent":  func(c, k string) error { return d.WriteIfAbsent(c, k, User{}) },
+			"WriteStream":    func(c, k string) error { _, err := d.WriteStream(c, k); return err },
+		}
+
+		// Empty names may be turned down before they are checked.
+		rejected := func(err error) bool {
+			return errors.Is(err, ErrInvalidName) || bad == "" && err != nil
+		}
+		for name, call := range collectionCalls {
+			if err := call(bad); !rejected(err) {
+				t.Errorf("%s(%q) = %v, want ErrInvalidName", name, bad, err)
+			}
+		}
+		for name, call := range recordCalls {
+			if err := call(bad, "alice"); !rejected(err) {
+				t.Errorf("%s(%q, alice) = %v, want ErrInvalidName", name, bad, err)
+			}
+			if bad == ".hidden" {
+				continue // a valid key
+			}
+			if err := call("users", bad); !rejected(err) {
+				t.Errorf("%s(users, %q) = %v, want ErrInvalidName", name, bad, err)
+			}
+		}
+
+		if meta, ok := d.CollectionMeta(bad); ok {
+			t.Errorf("CollectionMeta(%q) = %+v", bad, meta)
+		}
+		changes, stop := d.Watch(bad)
+		if _, open := <-changes; open {
+			t.Errorf("Watch(%q) delivered a change", bad)
+		}
+		stop()
+	}
+}
+
+func TestNamingPolicy(t *testing.T) {
+	d, _ := openTestDB(t, &Options{Naming: &NamingPolicy{
+		Allowed:   PortableNameChars,
+		MaxLength: 8,
+		FoldCase:  true,
+		Reserved:  []string{"admin"},
+	}})
+
+	if err := d.Write("Users", "Alice", User{Name: "Alice"}); err != nil {
+		t.Fatal(err)
+	}
+	user, err := d.Read("users", "alice")
+	if err != nil || user.Name != "Alice" {
+		t.Fatalf("folded read = %+v, %v", user, err)
+	}
+	for _, key := range []string{"Admin", "toolongkey", "a b"} {
+		if err := d.Write("users", key, User{}); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("Write(users, %q) = %v, want ErrInvalidName", key, err)
+		}
+	}
+}
+
+// TestNamingFoldsRanges checks that the bounds of key ranges are folded
+// like the keys they are compared with.
+func TestNamingFoldsRanges(t *testing.T) {
+	d, _ := openTestDB(t, &Options{Naming: &NamingPolicy{FoldCase: true}})
+	for _, key := range []string{"Alice", "Bob", "Carol"} {
+		if err := d.Write("users", key, User{Name: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names := func(users []User) string {
+		var names []string
+		for _, user := range users {
+			names = append(names, user.Name)
+		}
+		return strings.Join(names, ",")
+	}
+	users, err := d.ReadRange("users", "Bob", "Carol")
+	if got := names(users); err != nil || got != "Bob" {
+		t.Errorf("ReadRange(Bob, Carol) = %s, %v, want Bob", got, err)
+	}
+	users, err = d.ReadPrefix("users", "CA")
+	if got := names(users); err != nil || got != "Carol" {
+		t.Errorf("ReadPrefix(CA) = %s, %v, want Carol", got, err)
+	}
+}
+
+// TestReservedKeyFollowsExtension checks that only the key whose record
+// file would be the collection's _meta.json is reserved.
+func TestReservedKeyFollowsExtension(t *testing.T) {
+	tests := []struct {
+		ext      string
+		reserved bool
+	}{
+		{"", true},
+		{".rec", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ext, func(t *testing.T) {
+			d, dir := openTestDB(t, &Options{Layout: &LayoutOptions{Extension: tt.ext}})
+			if err := d.SetCollectionMeta("users", CollectionMeta{Indexes: []string{"Name"}}); err != nil {
+				t.Fatal(err)
+			}
+			err := d.Write("users", "_meta", User{Name: "Meta"})
+			if got := errors.Is(err, ErrInvalidName); got != tt.reserved {
+				t.Fatalf("Write(users, _meta) = %v, want reserved %v", err, tt.reserved)
+			}
+			if data, err := os.ReadFile(filepath.Join(dir, "users", metaFile)); err != nil || !strings.Contains(string(data), "indexes") {
+				t.Errorf("%s = %s, %v, want the collection's configuration", metaFile, data, err)
+			}
+			if !tt.reserved {
+				if user, err := d.Read("users", "_meta"); err != nil || user.Name != "Meta" {
+					t.Errorf("Read(users, _meta) = %+v, %v", user, err)
+				}
+			}
+		})
+	}
+}
+
+func TestNormalizeNames(t *testing.T) {
+	d, dir := openTestDB(t, nil)
+	for _, r := range []struct{ collection, key string }{
+		{"Users", "Bob Smith"},
+		{"users", "alice"},
+		{"users", "ALICE"},
+	} {
+		if err := d.Write(r.collection, r.key, User{Name: r.key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.Close()
+
+	d, err := New(dir, &Options{
+		Naming: &NamingPolicy{Allowed: PortableNameChars, FoldCase: true, MaxLength: 8},
+		Slog:   openTestLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	report, err := d.NormalizeNames(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := d.store.keys("Users"); len(keys) != 1 {
+		t.Fatalf("dry run changed the database: %v", keys)
+	}
+	if _, err := d.NormalizeNames(false); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Skipped) != 1 || report.Skipped[0].Key != "ALICE" {
+		t.Errorf("skipped %+v, want ALICE clashing with alice", report.Skipped)
+	}
+	collections, _ := d.Collections()
+	if len(collections) != 1 || collections[0] != "users" {
+		t.Errorf("collections %v, want [users]", collections)
+	}
+	user, err := d.Read("users", "bob_smit")
+	if err != nil || user.Name != "Bob Smith" {
+		t.Errorf("renamed record = %+v, %v", user, err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+)
+
+// KeyObfuscator maps internal record keys to the opaque IDs exposed by
+// public APIs and back, so clients cannot guess or enumerate keys.
+type KeyObfuscator interface {
+	Encode(key string) string
+	Decode(id string) (string, error)
+}
+
+// ErrInvalidID is returned by KeyObfuscator.Decode for IDs it did not issue.
+var ErrInvalidID = errors.New("invalid record id")
+
+// secretObfuscator encrypts keys deterministically (AES-GCM with a nonce
+// derived from an HMAC of the key, SIV-style), so a key always maps to the
+// same ID, IDs cannot be forged without the secret, and decoding is exact.
+type secretObfuscator struct {
+	aead cipher.AEAD
+	mac  []byte
+}
+
+// NewSecretObfuscator returns a KeyObfuscator keyed by secret. IDs issued
+// under one secret do not decode under another.
+func NewSecretObfuscator(secret []byte) KeyObfuscator {
+	encKey := sha256.Sum256(append([]byte("enc:"), secret...))
+	macKey := sha256.Sum256(append([]byte("mac:"), secret...))
+
+	block, err := aes.NewCipher(encKey[:])
+	if err != nil {
+		panic(err) // unreachable: the key is always 32 bytes
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return &secretObfuscator{aead: aead, mac: macKey[:]}
+}
+
+func (o *secretObfuscator) Encode(key string) string {
+	h := hmac.New(sha256.New, o.mac)
+	h.Write([]byte(key))
+	nonce := h.Sum(nil)[:o.aead.NonceSize()]
+
+	sealed := o.aead.Seal(nonce, nonce, []byte(key), nil)
+	return base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+func (o *secretObfuscator) Decode(id string) (string, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil || len(sealed) < o.aead.NonceSize() {
+		return "", ErrInvalidID
+	}
+
+	nonce, ciphertext := sealed[:o.aead.NonceSize()], sealed[o.aead.NonceSize():]
+	key, err := o.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", ErrInvalidID
+	}
+	return string(key), nil
+}
+
+// plainKeys exposes keys as they are.
+type plainKeys struct{}
+
+func (plainKeys) Encode(key string) string         { return key }
+func (plainKeys) Decode(id string) (string, error) { return id, nil }
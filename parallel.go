@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// scanBatch is how many records a scan hands to its callback at once.
+const scanBatch = 1024
+
+// readParallelism returns how many records are read at once.
+func (d *Driver) readParallelism() int {
+	if d.opts.ReadParallelism > 0 {
+		return d.opts.ReadParallelism
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// forEach calls fn with every index below n, on up to workers goroutines.
+func forEach(n, workers int, fn func(i int)) {
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
+
+// fetch reads the records under keys in parallel, holding the collection
+// lock once for all of them, and upgrades them by any migrations they are
+// missing and decrypts their encrypted fields when upgrade is set. errs[i]
+// is the failure to read keys[i].
+func (d *Driver) fetch(collection string, keys []string, upgrade bool) (data [][]byte, errs []error) {
+	_, data, errs, err := d.fetchListed(collection, upgrade, func() ([]string, error) { return keys, nil })
+	if err != nil {
+		data, errs = make([][]byte, len(keys)), make([]error, len(keys))
+		for i := range errs {
+			errs[i] = err
+		}
+	}
+	return data, errs
+}
+
+// fetchListed is fetch for the keys list returns, which it calls under the
+// same acquisition of the collection lock, so the records read are a
+// consistent snapshot of the collection: a batch written meanwhile is seen
+// whole or not at all, and no record is missed for being written or
+// deleted between listing and reading.
+func (d *Driver) fetchListed(collection string, upgrade bool, list func() ([]string, error)) (keys []string, data [][]byte, errs []error, err error) {
+	if err := checkPath(collection); err != nil {
+		return nil, nil, nil, err
+	}
+	workers := d.readParallelism()
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.RLock()
+	keys, err = list()
+	if err != nil {
+		mutex.RUnlock()
+		return nil, nil, nil, err
+	}
+	data, errs = make([][]byte, len(keys)), make([]error, len(keys))
+	forEach(len(keys), workers, func(i int) {
+		data[i], errs[i] = d.store.get(collection, keys[i])
+	})
+	mutex.RUnlock()
+
+	if upgrade {
+		forEach(len(keys), workers, func(i int) {
+			if errs[i] == nil {
+				data[i], _, errs[i] = d.upgrade(collection, keys[i], data[i])
+			}
+			if errs[i] == nil {
+				data[i], errs[i] = d.openFields(collection, keys[i], data[i])
+			}
+		})
+	}
+	return keys, data, errs, nil
+}
+
+// scanBatches lists a collection, then reads its records scanBatch at a
+// time, as fetch, and calls fn with each batch as it is read, so only one
+// batch is held in memory. The collection lock is not held while fn runs,
+// so fn may write to the collection. Each batch is a consistent snapshot,
+// but the scan as a whole is not: records deleted after the listing are
+// left out and records written after it are not seen. It stops at the
+// first error returned by fn.
+func (d *Driver) scanBatches(collection string, upgrade bool, fn func(keys []string, data [][]byte, errs []error) error) error {
+	if err := checkPath(collection); err != nil {
+		return err
+	}
+	mutex := d.getOrCreateMutex(collection)
+	mutex.RLock()
+	keys, err := d.store.keys(collection)
+	mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(keys); start += scanBatch {
+		batch := keys[start:min(start+scanBatch, len(keys))]
+		data, errs := d.fetch(collection, batch, upgrade)
+
+		// Leave out the records deleted since the listing.
+		found := 0
+		for i := range batch {
+			if errors.Is(errs[i], os.ErrNotExist) {
+				continue
+			}
+			batch[found], data[found], errs[found] = batch[i], data[i], errs[i]
+			found++
+		}
+		if err := fn(batch[:found], data[:found], errs[:found]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
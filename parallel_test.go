@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestScanBatchesReadsAsItGoes(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+	n := scanBatch + 10
+	for i := 0; i < n; i++ {
+		if err := d.Write("users", fmt.Sprintf("user%05d", i), User{Name: fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	last := fmt.Sprintf("user%05d", n-1)
+
+	var batches []int
+	seen := make(map[string]bool)
+	err := d.scanBatches("users", true, func(keys []string, data [][]byte, errs []error) error {
+		batches = append(batches, len(keys))
+		for i, key := range keys {
+			if errs[i] != nil {
+				t.Errorf("%s: %v", key, errs[i])
+			}
+			seen[key] = true
+		}
+		// The next batch is not read yet, so this record is left out.
+		if len(batches) == 1 {
+			return d.Delete("users", last)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(batches) != 2 || batches[0] != scanBatch {
+		t.Errorf("batches of %v records, want %d then the rest", batches, scanBatch)
+	}
+	if seen[last] || len(seen) != n-1 {
+		t.Errorf("scanned %d records, including %s: %v; want the %d left", len(seen), last, seen[last], n-1)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ReadAllMode controls how ReadAll treats records it cannot read.
+type ReadAllMode int
+
+const (
+	// ReadAllSkip logs unreadable records and leaves them out (the default).
+	ReadAllSkip ReadAllMode = iota
+	// ReadAllPartial returns the readable records together with a
+	// *PartialResult error listing the ones that failed.
+	ReadAllPartial
+	// ReadAllStrict fails the whole call on the first unreadable record.
+	ReadAllStrict
+)
+
+// ReadAllOptions configures ReadAll's handling of unreadable records.
+type ReadAllOptions struct {
+	Mode ReadAllMode
+	// ErrorBudget is how many unreadable records ReadAllPartial tolerates
+	// before failing the whole call. Zero means no limit.
+	ErrorBudget int
+}
+
+// RecordError is a failure to read a single record.
+type RecordError struct {
+	Key string
+	Err error
+}
+
+// PartialResult is returned as the error of ReadAll in ReadAllPartial mode
+// when some records could not be read; the readable ones are still returned.
+type PartialResult struct {
+	Collection string
+	Read       int
+	Failed     []RecordError
+}
+
+func (p *PartialResult) Error() string {
+	keys := make([]string, len(p.Failed))
+	for i, f := range p.Failed {
+		keys[i] = f.Key
+	}
+	return fmt.Sprintf("read %d records of collection %s, %d failed: %s",
+		p.Read, p.Collection, len(p.Failed), strings.Join(keys, ", "))
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// External tools (backup scripts, rsync, snapshotting, ...) can ask a running
+// Driver for a brief exclusive window over its directory with this handshake:
+//
+//  1. Create <dir>/.pause.request exclusively. Its content (e.g. a pid or a
+//     reason) is logged by the Driver.
+//  2. Wait for <dir>/.pause.ack to appear. Once it exists every in-flight
+//     write has finished and new writes are held back. Reads keep working.
+//  3. Do the work, then remove .pause.request. The Driver removes
+//     .pause.ack and resumes writes.
+//
+// If the request is not withdrawn within MaxPause the Driver resumes anyway
+// and removes the ack, so the tool can tell its window expired. The expired
+// request is ignored until it is removed and filed again. RequestPause
+// implements the tool side for Go programs.
+const (
+	pauseRequestFile = ".pause.request"
+	pauseAckFile     = ".pause.ack"
+)
+
+// ExternalLockOptions configures how the Driver honors pause requests from
+// external tools.
+type ExternalLockOptions struct {
+	// PollInterval is how often the Driver checks for a pause request. Zero
+	// disables the handshake.
+	PollInterval time.Duration
+	// MaxPause bounds how long a single request may hold writes back.
+	// Defaults to one minute.
+	MaxPause time.Duration
+}
+
+// Pause waits for in-flight writes to finish and holds new ones back until
+// the returned resume function is called.
+func (d *Driver) Pause() (resume func()) {
+	d.gate.Lock()
+	d.flushBulkLoads()
+
+	var once sync.Once
+	return func() { once.Do(d.gate.Unlock) }
+}
+
+// startPauseWatcher polls for external pause requests until the Driver is
+// closed.
+func (d *Driver) startPauseWatcher(opts ExternalLockOptions) {
+	if opts.PollInterval <= 0 {
+		return
+	}
+	if opts.MaxPause <= 0 {
+		opts.MaxPause = time.Minute
+	}
+
+	requestPath := filepath.Join(d.dir, pauseRequestFile)
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+
+		ticker := time.NewTicker(opts.PollInterval)
+		defer ticker.Stop()
+
+		var expired time.Time
+		for {
+			select {
+			case <-d.stop:
+				return
+			case <-ticker.C:
+			}
+
+			info, err := os.Stat(requestPath)
+			if err != nil {
+				expired = time.Time{}
+				continue
+			}
+			if info.ModTime().Equal(expired) {
+				continue
+			}
+			if !d.servePause(requestPath, ticker, opts.MaxPause) {
+				expired = info.ModTime()
+			}
+		}
+	}()
+}
+
+// servePause holds writes back while the request at requestPath stands. It
+// reports false if the window expired before the request was withdrawn.
+func (d *Driver) servePause(requestPath string, ticker *time.Ticker, maxPause time.Duration) bool {
+	reason, _ := os.ReadFile(requestPath)
+	d.log.Info("Pausing writes for external lock request: %s", strings.TrimSpace(string(reason)))
+
+	resume := d.Pause()
+	defer resume()
+
+	ackPath := filepath.Join(d.dir, pauseAckFile)
+	if err := os.WriteFile(ackPath, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		d.log.Error("Could not acknowledge external lock request: %v", err)
+		return false
+	}
+	defer os.Remove(ackPath)
+
+	deadline := time.NewTimer(maxPause)
+	defer deadline.Stop()
+
+	for {
+		select {
+		case <-d.stop:
+			return true
+		case <-deadline.C:
+			d.log.Error("External lock request held writes for over %s, resuming", maxPause)
+			return false
+		case <-ticker.C:
+			if _, err := os.Stat(requestPath); os.IsNotExist(err) {
+				d.log.Info("External lock released, resuming writes")
+				return true
+			}
+		}
+	}
+}
+
+// RequestPause performs the tool side of the handshake against the database
+// in dir: it files a request and waits up to timeout for the Driver to
+// acknowledge it. The returned release function withdraws the request.
+func RequestPause(dir, reason string, timeout time.Duration) (release func() error, err error) {
+	requestPath := filepath.Join(dir, pauseRequestFile)
+	ackPath := filepath.Join(dir, pauseAckFile)
+
+	file, err := os.OpenFile(requestPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, fmt.Errorf("another pause request is pending in %s", dir)
+		}
+		return nil, fmt.Errorf("could not create pause request: %v", err)
+	}
+	fmt.Fprintf(file, "pid %d: %s\n", os.Getpid(), reason)
+	file.Close()
+
+	release = func() error {
+		if err := os.Remove(requestPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove pause request: %v", err)
+		}
+		return nil
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		if _, err := os.Stat(ackPath); err == nil {
+			return release, nil
+		}
+		if time.Now().After(deadline) {
+			release()
+			return nil, fmt.Errorf("database in %s did not acknowledge the pause request within %s", dir, timeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
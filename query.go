@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A query is a boolean filter over the fields of a record, e.g.
+//
+//	Age > 30 && (Company == "acme" || !(Address == null))
+//
+// Fields are referenced by name, nested ones by a dot path such as
+// Address.City; comparisons take a field on the left and a number, string,
+// true, false or null on the right. Conditions combine with
+// &&, || and !, grouped with parentheses.
+
+// QueryError is a query that failed to parse, located precisely enough for
+// a CLI, REPL or editor to point at the offending text.
+type QueryError struct {
+	Query string `json:"query"`
+	// Offset is the byte offset of the offending token and Length its
+	// length in bytes (zero at the end of the query).
+	Offset int `json:"offset"`
+	Length int `json:"length"`
+	// Line and Column locate Offset, both starting at 1; Column counts
+	// characters, not bytes.
+	Line   int `json:"line"`
+	Column int `json:"column"`
+	// Found describes the offending token and Expected the tokens that
+	// would have been accepted in its place.
+	Found    string   `json:"found"`
+	Expected []string `json:"expected,omitempty"`
+	Message  string   `json:"message"`
+}
+
+func (e *QueryError) Error() string {
+	msg := fmt.Sprintf("query:%d:%d: %s", e.Line, e.Column, e.Message)
+	if len(e.Expected) > 0 {
+		msg += ", expected " + strings.Join(e.Expected, ", ")
+	}
+	return msg
+}
+
+// Pointer renders the offending line of the query with a caret under the
+// error, for display in terminals.
+func (e *QueryError) Pointer() string {
+	lines := strings.Split(e.Query, "\n")
+	line := lines[e.Line-1]
+
+	var caret strings.Builder
+	for i, r := range []rune(line) {
+		if i >= e.Column-1 {
+			break
+		}
+		if r == '\t' {
+			caret.WriteByte('\t')
+		} else {
+			caret.WriteByte(' ')
+		}
+	}
+	caret.WriteString("^")
+	if n := utf8.RuneCountInString(e.Query[e.Offset : e.Offset+e.Length]); n > 1 {
+		caret.WriteString(strings.Repeat("~", n-1))
+	}
+	return line + "\n" + caret.String()
+}
+
+// Query is a parsed filter expression.
+type Query struct {
+	source string
+	root   queryNode
+}
+
+// String returns the source the query was parsed from.
+func (q *Query) String() string {
+	return q.source
+}
+
+// Match reports whether the JSON-encoded record satisfies the query.
+func (q *Query) Match(data []byte) (bool, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return false, fmt.Errorf("could not unmarshal data: %v", err)
+	}
+	return q.root.eval(doc), nil
+}
+
+// Query returns the users of a collection matching the filter expression.
+// Malformed expressions fail with a *QueryError.
+func (d *Driver) Query(collection, expr string) (_ []User, err error) {
+	if err := d.checkNames(&collection); err != nil {
+		return nil, err
+	}
+
+	op := d.begin(opQuery, collection, "")
+	defer op.end(&err)
+
+	q, err := ParseQuery(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Records are matched and decoded in parallel, a batch at a time, and
+	// collected in key order.
+	var users []User
+	err = d.scanBatches(collection, true, func(keys []string, data [][]byte, errs []error) error {
+		matched := make([]*User, len(keys))
+		forEach(len(keys), d.readParallelism(), func(i int) {
+			matched[i] = d.match(q, collection, keys[i], data[i], errs[i])
+		})
+		for i, user := range matched {
+			op.bytes += len(data[i])
+			if user != nil {
+				users = append(users, *user)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// match decodes a record read for a query if it satisfies q, logging
+// records that cannot be read or matched.
+func (d *Driver) match(q *Query, collection, key string, data []byte, err error) *User {
+	if err != nil {
+		d.log.Error("Error reading user %s: %v", key, err)
+		return nil
+	}
+
+	ok, err := q.Match(data)
+	if err != nil {
+		d.log.Error("Error matching user %s: %v", key, err)
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+
+	var user User
+	if err := json.Unmarshal(data, &user); err != nil {
+		d.log.Error("Error reading user %s: could not unmarshal data: %v", key, err)
+		return nil
+	}
+	d.compute(collection, &user)
+	return &user
+}
+
+// ParseQuery parses a filter expression.
+func ParseQuery(expr string) (*Query, error) {
+	p := &queryParser{src: expr}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf([]string{"&&", "||", "end of query"}, "unexpected %s", p.tok.describe())
+	}
+	return &Query{source: expr, root: root}, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+	tokNot
+	tokAnd
+	tokOr
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) describe() string {
+	if t.kind == tokEOF {
+		return "end of query"
+	}
+	return strconv.Quote(t.text)
+}
+
+var (
+	comparisonOps  = []string{"==", "!=", "<", "<=", ">", ">="}
+	valueTokens    = []string{"number", "string", "true", "false", "null"}
+	conditionStart = []string{"field", "(", "!"}
+)
+
+type queryParser struct {
+	src string
+	pos int
+	tok token
+}
+
+// errorf builds a QueryError pointing at the current token.
+func (p *queryParser) errorf(expected []string, format string, args ...interface{}) *QueryError {
+	e := &QueryError{
+		Query:    p.src,
+		Offset:   p.tok.pos,
+		Length:   len(p.tok.text),
+		Line:     1 + strings.Count(p.src[:p.tok.pos], "\n"),
+		Found:    p.tok.describe(),
+		Expected: expected,
+		Message:  fmt.Sprintf(format, args...),
+	}
+	lineStart := strings.LastIndex(p.src[:p.tok.pos], "\n") + 1
+	e.Column = 1 + utf8.RuneCountInString(p.src[lineStart:p.tok.pos])
+	return e
+}
+
+// next advances to the following token.
+func (p *queryParser) next() error {
+	for p.pos < len(p.src) {
+		r, size := utf8.DecodeRuneInString(p.src[p.pos:])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		p.pos += size
+	}
+
+	start := p.pos
+	if start == len(p.src) {
+		p.tok = token{kind: tokEOF, pos: start}
+		return nil
+	}
+
+	rest := p.src[start:]
+	for _, op := range []string{"&&", "||", "==", "!=", "<=", ">="} {
+		if strings.HasPrefix(rest, op) {
+			p.pos += 2
+			switch op {
+			case "&&":
+				p.tok = token{kind: tokAnd, text: op, pos: start}
+			case "||":
+				p.tok = token{kind: tokOr, text: op, pos: start}
+			default:
+				p.tok = token{kind: tokOp, text: op, pos: start}
+			}
+			return nil
+		}
+	}
+
+	r, size := utf8.DecodeRuneInString(rest)
+	switch {
+	case r == '(':
+		p.pos += size
+		p.tok = token{kind: tokLParen, text: "(", pos: start}
+	case r == ')':
+		p.pos += size
+		p.tok = token{kind: tokRParen, text: ")", pos: start}
+	case r == '!':
+		p.pos += size
+		p.tok = token{kind: tokNot, text: "!", pos: start}
+	case r == '<' || r == '>':
+		p.pos += size
+		p.tok = token{kind: tokOp, text: string(r), pos: start}
+	case r == '"':
+		return p.lexString()
+	case r == '-' || unicode.IsDigit(r):
+		p.pos += size
+		for p.pos < len(p.src) && (isDigit(p.src[p.pos]) || p.src[p.pos] == '.' ||
+			p.src[p.pos] == 'e' || p.src[p.pos] == 'E') {
+			p.pos++
+		}
+		p.tok = token{kind: tokNumber, text: p.src[start:p.pos], pos: start}
+		if _, err := strconv.ParseFloat(p.tok.text, 64); err != nil {
+			return p.errorf(valueTokens, "malformed number %s", p.tok.describe())
+		}
+	case unicode.IsLetter(r) || r == '_':
+		for p.pos < len(p.src) {
+			r, size := utf8.DecodeRuneInString(p.src[p.pos:])
+			if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '.' {
+				break
+			}
+			p.pos += size
+		}
+		p.tok = token{kind: tokIdent, text: p.src[start:p.pos], pos: start}
+	default:
+		p.pos += size
+		p.tok = token{kind: tokOp, text: p.src[start:p.pos], pos: start}
+		return p.errorf(nil, "unexpected character %s", p.tok.describe())
+	}
+	return nil
+}
+
+func (p *queryParser) lexString() error {
+	start := p.pos
+	p.pos++
+	for p.pos < len(p.src) {
+		switch p.src[p.pos] {
+		case '\\':
+			p.pos += 2
+			continue
+		case '"':
+			p.pos++
+			p.tok = token{kind: tokString, text: p.src[start:p.pos], pos: start}
+			if _, err := strconv.Unquote(p.tok.text); err != nil {
+				return p.errorf(nil, "malformed string %s", p.tok.text)
+			}
+			return nil
+		}
+		p.pos++
+	}
+
+	p.pos = len(p.src)
+	p.tok = token{kind: tokString, text: p.src[start:], pos: start}
+	return p.errorf([]string{`"`}, "unterminated string")
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+func (p *queryParser) parseOr() (queryNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok.kind == tokOr {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseAnd() (queryNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok.kind == tokAnd {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseUnary() (queryNode, error) {
+	switch p.tok.kind {
+	case tokNot:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{inner}, nil
+
+	case tokLParen:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokRParen {
+			return nil, p.errorf([]string{")", "&&", "||"}, "unexpected %s", p.tok.describe())
+		}
+		return inner, p.next()
+
+	case tokIdent:
+		return p.parseComparison()
+	}
+
+	return nil, p.errorf(conditionStart, "unexpected %s", p.tok.describe())
+}
+
+func (p *queryParser) parseComparison() (queryNode, error) {
+	field := p.tok.text
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	if p.tok.kind != tokOp {
+		return nil, p.errorf(comparisonOps, "unexpected %s after field %q", p.tok.describe(), field)
+	}
+	op := p.tok.text
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+	switch p.tok.kind {
+	case tokNumber:
+		value = json.Number(p.tok.text)
+	case tokString:
+		value, _ = strconv.Unquote(p.tok.text)
+	case tokIdent:
+		switch p.tok.text {
+		case "true":
+			value = true
+		case "false":
+			value = false
+		case "null":
+			value = nil
+		default:
+			return nil, p.errorf(valueTokens, "unexpected %s, fields can only be compared to values", p.tok.describe())
+		}
+	default:
+		return nil, p.errorf(valueTokens, "unexpected %s after %s", p.tok.describe(), op)
+	}
+
+	if value == nil && op != "==" && op != "!=" {
+		return nil, p.errorf([]string{"number", "string"}, "null can only be compared with == or !=")
+	}
+	return compareNode{field: strings.Split(field, "."), op: op, value: value}, p.next()
+}
+
+// queryNode is a node of a parsed query.
+type queryNode interface {
+	eval(doc interface{}) bool
+}
+
+type andNode struct{ left, right queryNode }
+type orNode struct{ left, right queryNode }
+type notNode struct{ inner queryNode }
+
+func (n andNode) eval(doc interface{}) bool { return n.left.eval(doc) && n.right.eval(doc) }
+func (n orNode) eval(doc interface{}) bool  { return n.left.eval(doc) || n.right.eval(doc) }
+func (n notNode) eval(doc interface{}) bool { return !n.inner.eval(doc) }
+
+// compareNode compares the field at a dotted path with a literal.
+type compareNode struct {
+	field []string
+	op    string
+	value interface{}
+}
+
+func (n compareNode) eval(doc interface{}) bool {
+	got, _ := lookupField(doc, n.field)
+
+	cmp, comparable := compareValues(got, n.value)
+	switch n.op {
+	case "==":
+		return comparable && cmp == 0
+	case "!=":
+		return !comparable || cmp != 0
+	case "<":
+		return comparable && cmp < 0
+	case "<=":
+		return comparable && cmp <= 0
+	case ">":
+		return comparable && cmp > 0
+	case ">=":
+		return comparable && cmp >= 0
+	}
+	return false
+}
+
+// lookupField walks a dotted path through nested JSON objects.
+func lookupField(doc interface{}, path []string) (interface{}, bool) {
+	for _, name := range path {
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if doc, ok = obj[name]; !ok {
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// compareValues orders two decoded JSON values of the same type. Values of
+// different types are not comparable.
+func compareValues(a, b interface{}) (int, bool) {
+	switch a := a.(type) {
+	case nil:
+		return 0, b == nil
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return 0, false
+		}
+		x, errA := a.Float64()
+		y, errB := b.Float64()
+		if errA != nil || errB != nil {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		b, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(a, b), true
+	case bool:
+		b, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		if a == b {
+			return 0, true
+		}
+		if !a {
+			return -1, true
+		}
+		return 1, true
+	}
+	return 0, false
+}
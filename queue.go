@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+)
+
+var (
+	// ErrQueueEmpty is returned by Dequeue when no job is ready.
+	ErrQueueEmpty = errors.New("no job is ready")
+	// ErrClaimLost is returned by Ack and Nack of a job whose visibility
+	// timeout ran out, so it may have been dequeued again.
+	ErrClaimLost = errors.New("claim on job was lost")
+)
+
+// Job is an entry of a Queue.
+type Job struct {
+	ID string `json:"id"`
+	// Priority orders the jobs ready to be dequeued, highest first; jobs of
+	// the same priority are dequeued in the order they were enqueued.
+	Priority int             `json:"priority"`
+	Payload  json.RawMessage `json:"payload"`
+	Enqueued time.Time       `json:"enqueued"`
+	// Attempts counts the times the job was dequeued.
+	Attempts int `json:"attempts"`
+	// VisibleAt is when the job can be dequeued: once its visibility
+	// timeout runs out after Dequeue, or its delay after Nack.
+	VisibleAt time.Time `json:"visibleAt"`
+	// Claim identifies the Dequeue holding the job.
+	Claim string `json:"claim,omitempty"`
+}
+
+// Queue is a durable job queue kept in a collection of its own, one record
+// per job. Dequeue claims a job for a visibility timeout, after which it
+// is handed out again unless it was acknowledged with Ack; Nack hands it
+// back early. Every call scans the queue, which suits the small queues of
+// background work rather than high throughput.
+type Queue struct {
+	d    *Driver
+	name string
+}
+
+// Queue returns the job queue kept in the named collection.
+func (d *Driver) Queue(name string) *Queue {
+	return &Queue{d: d, name: d.foldName(name)}
+}
+
+// writable fails if jobs cannot be stored in the queue's collection.
+func (q *Queue) writable() error {
+	if err := q.d.writable(); err != nil {
+		return err
+	}
+	name := q.name
+	if err := q.d.checkNames(&name); err != nil {
+		return err
+	}
+	if q.d.eventSourced(q.name) {
+		return errImmutableEvents(q.name)
+	}
+	return q.d.checkNotView(q.name)
+}
+
+// lock holds back other changes to the queue until the returned function
+// is called.
+func (q *Queue) lock() (unlock func()) {
+	q.d.gate.RLock()
+	mutex := q.d.getOrCreateMutex(q.name)
+	mutex.Lock()
+	return func() {
+		mutex.Unlock()
+		q.d.gate.RUnlock()
+	}
+}
+
+// Enqueue adds a job with a JSON payload, ready to be dequeued at once.
+func (q *Queue) Enqueue(payload []byte, priority int) (_ *Job, err error) {
+	id := make([]byte, 4)
+	rand.Read(id)
+	now := time.Now().UTC()
+	job := &Job{
+		// IDs sort in the order jobs were enqueued.
+		ID:        fmt.Sprintf("%016x%s", now.UnixNano(), hex.EncodeToString(id)),
+		Priority:  priority,
+		Payload:   payload,
+		Enqueued:  now,
+		VisibleAt: now,
+	}
+
+	op := q.d.begin(opWrite, q.name, job.ID)
+	defer op.end(&err)
+
+	if !json.Valid(payload) {
+		return nil, errors.New("payload is not valid JSON")
+	}
+	if err := q.writable(); err != nil {
+		return nil, err
+	}
+	unlock := q.lock()
+	defer unlock()
+
+	if err := q.store(job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Dequeue claims the ready job of highest priority for visibility, and
+// fails with ErrQueueEmpty if there is none.
+func (q *Queue) Dequeue(visibility time.Duration) (*Job, error) {
+	op := q.d.begin(opWrite, q.name, "")
+	job, err := q.dequeue(op, visibility)
+	// Polling an empty queue is not a failure.
+	opErr := err
+	if errors.Is(err, ErrQueueEmpty) {
+		opErr = nil
+	}
+	op.end(&opErr)
+	return job, err
+}
+
+func (q *Queue) dequeue(op *operation, visibility time.Duration) (*Job, error) {
+	if visibility <= 0 {
+		return nil, errors.New("visibility timeout must be positive")
+	}
+	if err := q.writable(); err != nil {
+		return nil, err
+	}
+	unlock := q.lock()
+	defer unlock()
+
+	jobs, err := q.jobs()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	var next *Job
+	for _, job := range jobs {
+		if job.VisibleAt.After(now) {
+			continue
+		}
+		if next == nil || job.Priority > next.Priority || job.Priority == next.Priority && job.ID < next.ID {
+			next = job
+		}
+	}
+	if next == nil {
+		return nil, ErrQueueEmpty
+	}
+	op.key = next.ID
+
+	claim := make([]byte, 8)
+	rand.Read(claim)
+	next.Claim = hex.EncodeToString(claim)
+	next.Attempts++
+	next.VisibleAt = now.Add(visibility)
+	if err := q.store(next); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// Ack removes a job handed out by Dequeue once it is done.
+func (q *Queue) Ack(job *Job) (err error) {
+	op := q.d.begin(opDelete, q.name, job.ID)
+	defer op.end(&err)
+
+	if err := q.writable(); err != nil {
+		return err
+	}
+	unlock := q.lock()
+	defer unlock()
+
+	if _, err := q.claimed(job); err != nil {
+		return err
+	}
+	if err := q.d.remove(q.name, job.ID); err != nil {
+		return err
+	}
+	q.d.publish(OpDelete, q.name, job.ID, nil)
+	return nil
+}
+
+// Nack hands a job handed out by Dequeue back to the queue, to be dequeued
+// again after delay.
+func (q *Queue) Nack(job *Job, delay time.Duration) (err error) {
+	op := q.d.begin(opWrite, q.name, job.ID)
+	defer op.end(&err)
+
+	if err := q.writable(); err != nil {
+		return err
+	}
+	unlock := q.lock()
+	defer unlock()
+
+	stored, err := q.claimed(job)
+	if err != nil {
+		return err
+	}
+	stored.Claim = ""
+	stored.VisibleAt = time.Now().UTC().Add(max(delay, 0))
+	return q.store(stored)
+}
+
+// Len returns how many jobs the queue holds, claimed or not.
+func (q *Queue) Len() (int, error) {
+	if ok, err := q.exists(); !ok {
+		return 0, err
+	}
+	keys, err := q.d.Keys(q.name)
+	return len(keys), err
+}
+
+// exists reports whether a job was ever enqueued, creating the queue's
+// collection.
+func (q *Queue) exists() (bool, error) {
+	name := q.name
+	if err := q.d.checkNames(&name); err != nil {
+		return false, err
+	}
+	collections, err := q.d.Collections()
+	return slices.Contains(collections, q.name), err
+}
+
+// claimed returns the stored job, if it is still claimed by the Dequeue
+// that handed out job. The queue must be locked.
+func (q *Queue) claimed(job *Job) (*Job, error) {
+	data, err := q.d.store.get(q.name, job.ID)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: job %s is gone", ErrClaimLost, job.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stored Job
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("could not unmarshal job %s: %v", job.ID, err)
+	}
+	if job.Claim == "" || stored.Claim != job.Claim || !stored.VisibleAt.After(time.Now()) {
+		return nil, fmt.Errorf("%w: job %s", ErrClaimLost, job.ID)
+	}
+	return &stored, nil
+}
+
+// jobs reads every job of the queue. The queue must be locked.
+func (q *Queue) jobs() ([]*Job, error) {
+	if ok, err := q.exists(); !ok {
+		return nil, err
+	}
+	keys, err := q.d.store.keys(q.name)
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]*Job, 0, len(keys))
+	for _, key := range keys {
+		data, err := q.d.store.get(q.name, key)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var job Job
+		if err := json.Unmarshal(data, &job); err != nil {
+			q.d.log.Error("Skipping unreadable job %s of queue %s: %v", key, q.name, err)
+			continue
+		}
+		job.ID = key
+		jobs = append(jobs, &job)
+	}
+	return jobs, nil
+}
+
+// store writes a job. The queue must be locked.
+func (q *Queue) store(job *Job) error {
+	data, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not marshal job: %v", err)
+	}
+	if err := q.d.put(q.name, job.ID, data); err != nil {
+		return err
+	}
+	q.d.publish(OpWrite, q.name, job.ID, data)
+	return nil
+}
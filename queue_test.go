@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestQueueOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		priorities []int
+		// want lists the jobs, by index, in the order they are dequeued.
+		want []int
+	}{
+		{"first in first out", []int{0, 0, 0}, []int{0, 1, 2}},
+		{"highest priority first", []int{1, 5, 3}, []int{1, 2, 0}},
+		{"ties in order", []int{2, 7, 2, 7}, []int{1, 3, 0, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _ := openTestDB(t, nil)
+			q := d.Queue("jobs")
+			ids := make(map[string]int)
+			for i, priority := range tt.priorities {
+				job, err := q.Enqueue([]byte(`{"n": 1}`), priority)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids[job.ID] = i
+			}
+
+			var got []int
+			for {
+				job, err := q.Dequeue(time.Minute)
+				if errors.Is(err, ErrQueueEmpty) {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, ids[job.ID])
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("dequeued %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueueClaims(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+	q := d.Queue("jobs")
+	if _, err := q.Enqueue([]byte(`not json`), 0); err == nil {
+		t.Error("enqueueing a payload that is not JSON succeeded")
+	}
+	if _, err := q.Enqueue([]byte(`{"n": 1}`), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// A nacked job comes back after its delay.
+	job, err := q.Dequeue(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Dequeue(time.Minute); !errors.Is(err, ErrQueueEmpty) {
+		t.Errorf("dequeue of a claimed job = %v, want ErrQueueEmpty", err)
+	}
+	if err := q.Nack(job, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Ack(job); !errors.Is(err, ErrClaimLost) {
+		t.Errorf("ack after nack = %v, want ErrClaimLost", err)
+	}
+
+	// A job whose visibility timeout runs out is handed out again, and
+	// the first claim on it is lost.
+	first, err := q.Dequeue(10 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	second, err := q.Dequeue(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.ID != job.ID || second.Attempts != 3 {
+		t.Errorf("dequeued %s after %d attempts, want %s after 3", second.ID, second.Attempts, job.ID)
+	}
+	if err := q.Ack(first); !errors.Is(err, ErrClaimLost) {
+		t.Errorf("ack of an expired claim = %v, want ErrClaimLost", err)
+	}
+
+	if err := q.Ack(second); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := q.Len(); err != nil || n != 0 {
+		t.Errorf("Len after ack = %d, %v, want 0", n, err)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrQuotaExceeded is returned by writes that would take a collection or
+// the database past a quota.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Quota limits what a collection, or the database, may hold. Zero disables
+// a limit.
+type Quota struct {
+	MaxRecordSize int64
+	MaxBytes      int64
+	MaxRecords    int
+}
+
+// QuotaOptions configures the quotas writes are held to. A database already
+// over a quota can still shrink: only writes that would grow past it fail.
+// Records replicated from a primary are counted but never refused.
+type QuotaOptions struct {
+	// Database limits the database as a whole; its MaxRecordSize applies
+	// to the records of every collection.
+	Database Quota
+	// Collections limits individual collections.
+	Collections map[string]Quota
+}
+
+// Usage is the space taken by the records of the database.
+type Usage struct {
+	Records     int
+	Bytes       int64
+	Collections map[string]CollectionUsage
+}
+
+// CollectionUsage is the space taken by the records of a collection.
+type CollectionUsage struct {
+	Records int
+	Bytes   int64
+}
+
+// sizer is implemented by storage engines that can tell the size of a
+// record without reading it.
+type sizer interface {
+	size(collection, key string) (int64, error)
+}
+
+// quotaChange is how an operation changes the usage of a collection.
+type quotaChange struct {
+	records int
+	bytes   int64
+	// largest is the size of the largest record written.
+	largest int64
+}
+
+// startQuotas measures every collection, so the usage of all of them is
+// tracked from then on, and starts enforcing the quotas.
+func (d *Driver) startQuotas(opts *QuotaOptions) error {
+	if opts == nil {
+		return nil
+	}
+	if !d.canTrack() {
+		return errors.New("could not use Options.Quotas: the storage engine cannot measure records")
+	}
+
+	collections, err := d.Collections()
+	if err != nil {
+		return err
+	}
+	for _, collection := range collections {
+		if err := d.measureUsage(collection); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	d.usage.mutex.Lock()
+	d.usage.quotas = opts
+	d.usage.mutex.Unlock()
+	return nil
+}
+
+// Usage reports the records and bytes held by every collection.
+func (d *Driver) Usage() (Usage, error) {
+	t := d.usage
+	t.mutex.Lock()
+	if t.quotas != nil {
+		defer t.mutex.Unlock()
+
+		usage := Usage{Records: t.records, Bytes: t.bytes, Collections: make(map[string]CollectionUsage)}
+		for collection, tally := range t.collections {
+			if tally.records > 0 {
+				usage.Collections[collection] = CollectionUsage{Records: tally.records, Bytes: tally.bytes}
+			}
+		}
+		return usage, nil
+	}
+	t.mutex.Unlock()
+
+	u, ok := d.store.(usager)
+	if !ok {
+		return Usage{}, fmt.Errorf("usage is not supported by this storage engine")
+	}
+	collections, err := d.Collections()
+	if err != nil {
+		return Usage{}, err
+	}
+
+	usage := Usage{Collections: make(map[string]CollectionUsage)}
+	for _, collection := range collections {
+		measured, err := u.usage(collection)
+		if err != nil && !os.IsNotExist(err) {
+			return usage, fmt.Errorf("could not measure collection %s: %v", collection, err)
+		}
+		if measured.Records == 0 {
+			continue
+		}
+		usage.Records += measured.Records
+		usage.Bytes += measured.Bytes
+		usage.Collections[collection] = CollectionUsage{Records: measured.Records, Bytes: measured.Bytes}
+	}
+	return usage, nil
+}
+
+// put stores a record, failing with ErrQuotaExceeded if that would break
+// a quota. The collection lock must be held.
+func (d *Driver) put(collection, key string, data []byte) error {
+	release, err := d.reserve(collection, key, int64(len(data)), true)
+	if err != nil {
+		return err
+	}
+	if err := d.store.put(collection, key, data); err != nil {
+		release()
+		return err
+	}
+	return nil
+}
+
+// remove deletes a record, handing its space back to the quotas. The
+// collection lock must be held.
+func (d *Driver) remove(collection, key string) error {
+	release, err := d.reserve(collection, key, -1, false)
+	if err != nil {
+		return err
+	}
+	if err := d.store.delete(collection, key); err != nil {
+		release()
+		return err
+	}
+	return nil
+}
+
+// reserve accounts for storing a record of size bytes under key, or
+// deleting it when size is negative, and returns a function that undoes
+// that if the operation fails. With enforce set, growing past a quota fails.
+func (d *Driver) reserve(collection, key string, size int64, enforce bool) (release func(), err error) {
+	t := d.usage
+	if !t.tracking(collection) {
+		return func() {}, nil
+	}
+
+	change, err := d.quotaChange(collection, key, size)
+	if err != nil {
+		return nil, err
+	}
+	changes := map[string]quotaChange{collection: change}
+	if err := t.reserve(changes, enforce); err != nil {
+		return nil, err
+	}
+	return func() { t.release(changes) }, nil
+}
+
+// quotaChange works out how storing a record of size bytes under key, or
+// deleting it when size is negative, changes the usage of its collection.
+func (d *Driver) quotaChange(collection, key string, size int64) (quotaChange, error) {
+	s, ok := d.store.(sizer)
+	if !ok {
+		return quotaChange{}, errors.New("could not measure record: not supported by this storage engine")
+	}
+	old, err := s.size(collection, key)
+	exists := err == nil
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return quotaChange{}, err
+	}
+
+	var change quotaChange
+	if exists {
+		change.records--
+		change.bytes -= old
+	}
+	if size >= 0 {
+		change.records++
+		change.bytes += size
+		change.largest = size
+	}
+	return change, nil
+}
+
+// reserve applies changes to the tracked usage, all or nothing. With
+// enforce set and quotas configured, growing past a quota fails.
+func (t *usageTracker) reserve(changes map[string]quotaChange, enforce bool) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if q := t.quotas; enforce && q != nil {
+		var total quotaChange
+		for collection, change := range changes {
+			tally := t.tally(collection)
+			if err := checkQuota(q.Collections[collection], "collection "+collection, tally.records, tally.bytes, change); err != nil {
+				return err
+			}
+			total.records += change.records
+			total.bytes += change.bytes
+			total.largest = max(total.largest, change.largest)
+		}
+		if err := checkQuota(q.Database, "the database", t.records, t.bytes, total); err != nil {
+			return err
+		}
+	}
+
+	t.apply(changes, 1)
+	return nil
+}
+
+// release undoes reserved changes.
+func (t *usageTracker) release(changes map[string]quotaChange) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.apply(changes, -1)
+}
+
+func (t *usageTracker) apply(changes map[string]quotaChange, sign int) {
+	for collection, change := range changes {
+		tally := t.tally(collection)
+		tally.records += sign * change.records
+		tally.bytes += int64(sign) * change.bytes
+		t.records += sign * change.records
+		t.bytes += int64(sign) * change.bytes
+	}
+}
+
+// checkQuota checks that a change to usage that grows it stays within a
+// quota.
+func checkQuota(quota Quota, what string, records int, bytes int64, change quotaChange) error {
+	if quota.MaxRecordSize > 0 && change.largest > quota.MaxRecordSize {
+		return fmt.Errorf("%w: record of %d bytes is over the %d byte limit of %s",
+			ErrQuotaExceeded, change.largest, quota.MaxRecordSize, what)
+	}
+	if quota.MaxRecords > 0 && change.records > 0 && records+change.records > quota.MaxRecords {
+		return fmt.Errorf("%w: %s would hold %d records, over its limit of %d",
+			ErrQuotaExceeded, what, records+change.records, quota.MaxRecords)
+	}
+	if quota.MaxBytes > 0 && change.bytes > 0 && bytes+change.bytes > quota.MaxBytes {
+		return fmt.Errorf("%w: %s would hold %d bytes, over its limit of %d",
+			ErrQuotaExceeded, what, bytes+change.bytes, quota.MaxBytes)
+	}
+	return nil
+}
+
+// reserveQuotas accounts for the records the transaction leaves behind,
+// failing with ErrQuotaExceeded if that would break a quota.
+func (tx *Tx) reserveQuotas() (release func(), err error) {
+	t := tx.d.usage
+	final := make(map[recordID]int64)
+	for _, op := range tx.ops {
+		if !t.tracking(op.Collection) {
+			continue
+		}
+		size := int64(-1)
+		if op.Op == OpWrite {
+			size = int64(len(op.Data))
+		}
+		final[recordID{op.Collection, op.Key}] = size
+	}
+
+	changes := make(map[string]quotaChange)
+	for id, size := range final {
+		change, err := tx.d.quotaChange(id.collection, id.key, size)
+		if err != nil {
+			return nil, err
+		}
+		total := changes[id.collection]
+		total.records += change.records
+		total.bytes += change.bytes
+		total.largest = max(total.largest, change.largest)
+		changes[id.collection] = total
+	}
+
+	if err := t.reserve(changes, true); err != nil {
+		return nil, fmt.Errorf("transaction %s: %w", tx.id, err)
+	}
+	return func() { t.release(changes) }, nil
+}
+
+func (s *fileStorage) size(collection, key string) (int64, error) {
+	info, err := s.fs.Stat(s.layout.recordPath(s.dir, collection, key))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s *logStorage) size(collection, key string) (int64, error) {
+	c, err := s.collection(collection, false)
+	if err != nil {
+		return 0, err
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+
+	entry, ok := c.index[key]
+	if !ok {
+		return 0, os.ErrNotExist
+	}
+	return entry.size - logHeaderSize - int64(len(key)), nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// quotaOp writes a record named after its key, or deletes it.
+type quotaOp struct {
+	collection, key string
+	delete          bool
+}
+
+func TestQuotas(t *testing.T) {
+	// Every record written below has a one letter name, so they are all
+	// the size of this one.
+	probe, _ := openTestDB(t, &Options{Quotas: &QuotaOptions{}})
+	if err := probe.Write("users", "a", User{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	usage, err := probe.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := usage.Bytes
+
+	users := func(q Quota) map[string]Quota { return map[string]Quota{"users": q} }
+	tests := []struct {
+		name   string
+		quotas QuotaOptions
+		ops    []quotaOp
+		// fails is the index of the op expected to fail, or -1.
+		fails int
+	}{
+		{"records of a collection", QuotaOptions{Collections: users(Quota{MaxRecords: 2})},
+			[]quotaOp{{"users", "a", false}, {"users", "b", false}, {"users", "c", false}}, 2},
+		{"other collections are not limited", QuotaOptions{Collections: users(Quota{MaxRecords: 1})},
+			[]quotaOp{{"users", "a", false}, {"posts", "a", false}, {"posts", "b", false}}, -1},
+		{"overwriting does not grow", QuotaOptions{Collections: users(Quota{MaxRecords: 1})},
+			[]quotaOp{{"users", "a", false}, {"users", "a", false}}, -1},
+		{"deleting makes room", QuotaOptions{Collections: users(Quota{MaxRecords: 1})},
+			[]quotaOp{{"users", "a", false}, {"users", "a", true}, {"users", "b", false}}, -1},
+		{"bytes of a collection", QuotaOptions{Collections: users(Quota{MaxBytes: 2 * size})},
+			[]quotaOp{{"users", "a", false}, {"users", "b", false}, {"users", "c", false}}, 2},
+		{"records of the database", QuotaOptions{Database: Quota{MaxRecords: 2}},
+			[]quotaOp{{"users", "a", false}, {"posts", "a", false}, {"tags", "a", false}}, 2},
+		{"record size", QuotaOptions{Database: Quota{MaxRecordSize: size - 1}},
+			[]quotaOp{{"users", "a", false}}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quotas := tt.quotas
+			d, _ := openTestDB(t, &Options{Quotas: &quotas})
+			for i, op := range tt.ops {
+				var err error
+				if op.delete {
+					err = d.Delete(op.collection, op.key)
+				} else {
+					err = d.Write(op.collection, op.key, User{Name: op.key})
+				}
+				switch {
+				case i == tt.fails && !errors.Is(err, ErrQuotaExceeded):
+					t.Fatalf("op %d = %v, want ErrQuotaExceeded", i, err)
+				case i != tt.fails && err != nil:
+					t.Fatalf("op %d: %v", i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestQuotasHoldTransactions(t *testing.T) {
+	d, _ := openTestDB(t, &Options{Quotas: &QuotaOptions{Collections: map[string]Quota{"users": {MaxRecords: 1}}}})
+
+	tx := d.Begin()
+	for _, key := range []string{"a", "b"} {
+		if err := tx.Write("users", key, User{Name: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("commit = %v, want ErrQuotaExceeded", err)
+	}
+	if usage, err := d.Usage(); err != nil || usage.Records != 0 {
+		t.Errorf("usage after a failed commit = %+v, %v", usage, err)
+	}
+}
+
+func TestQuotasNeedSizes(t *testing.T) {
+	_, err := New(t.TempDir(), &Options{
+		Slog:   openTestLogger(),
+		Shards: []string{t.TempDir(), t.TempDir()},
+		Quotas: &QuotaOptions{Database: Quota{MaxRecords: 1}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "Quotas") {
+		t.Errorf("quotas on a sharded store = %v, want an error", err)
+	}
+}
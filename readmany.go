@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// MissingKeysError is returned by ReadMany, alongside the records it did
+// find, when some of the requested keys do not exist.
+type MissingKeysError struct {
+	Collection string
+	Keys       []string
+}
+
+func (e *MissingKeysError) Error() string {
+	return fmt.Sprintf("%d keys not found in collection %s: %s",
+		len(e.Keys), e.Collection, strings.Join(e.Keys, ", "))
+}
+
+// Is makes errors.Is(err, os.ErrNotExist) hold for missing keys.
+func (e *MissingKeysError) Is(target error) bool {
+	return target == os.ErrNotExist
+}
+
+// ReadMany fetches several records of a collection under a single lock
+// acquisition. Keys that do not exist are left out of the result and
+// reported through a *MissingKeysError; any other failure fails the call.
+func (d *Driver) ReadMany(collection string, keys []string) (_ map[string]json.RawMessage, err error) {
+	keys = slices.Clone(keys)
+	names := make([]*string, len(keys))
+	for i := range keys {
+		names[i] = &keys[i]
+	}
+	if err := d.checkNames(&collection, names...); err != nil {
+		return nil, err
+	}
+
+	op := d.begin(opReadMany, collection, "")
+	defer op.end(&err)
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	records := make(map[string]json.RawMessage, len(keys))
+	var missing []string
+	for _, key := range keys {
+		if _, seen := records[key]; seen {
+			continue
+		}
+
+		data, err := d.store.get(collection, key)
+		if errors.Is(err, os.ErrNotExist) {
+			missing = append(missing, key)
+			continue
+		}
+		if err == nil {
+			data, _, err = d.upgrade(collection, key, data)
+		}
+		if err == nil {
+			data, err = d.openFields(collection, key, data)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %v", key, err)
+		}
+
+		records[key] = json.RawMessage(data)
+		op.bytes += len(data)
+	}
+
+	if len(missing) > 0 {
+		return records, &MissingKeysError{Collection: collection, Keys: missing}
+	}
+	return records, nil
+}
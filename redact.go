@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// redactedMask replaces the strings of redacted fields.
+const redactedMask = "****"
+
+// Redact returns a record of a collection with the fields listed in its
+// CollectionMeta.Redact masked, for handing records to audit logs and other
+// places that must not hold personal data. Strings are replaced by a mask,
+// numbers and other values cleared, and objects masked field by field, so
+// the result still decodes as a User.
+func (d *Driver) Redact(collection string, data []byte) ([]byte, error) {
+	if err := d.checkNames(&collection); err != nil {
+		return nil, err
+	}
+
+	meta, _ := d.collectionMeta(collection)
+	if len(meta.Redact) == 0 {
+		return data, nil
+	}
+
+	paths := make([][]string, len(meta.Redact))
+	for i, path := range meta.Redact {
+		paths[i] = strings.Split(path, ".")
+	}
+	data, err := rewriteFields(data, paths, func(_ []string, value interface{}) (interface{}, bool, error) {
+		return mask(value), true, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not redact record of collection %s: %v", collection, err)
+	}
+	return data, nil
+}
+
+// internalFields are the fields the database stamps records with for its
+// own bookkeeping.
+var internalFields = []string{versionField, expiresField, modifiedField}
+
+// publicRecord returns a stored record as clients may see it: without its
+// internal fields, and redacted.
+func (d *Driver) publicRecord(collection string, data []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("record is not a JSON object: %v", err)
+	}
+	stamped := false
+	for _, field := range internalFields {
+		if _, ok := fields[field]; ok {
+			delete(fields, field)
+			stamped = true
+		}
+	}
+	if stamped {
+		var err error
+		if data, err = json.MarshalIndent(fields, "", "  "); err != nil {
+			return nil, err
+		}
+	}
+	return d.Redact(collection, data)
+}
+
+// mask masks a decoded JSON value.
+func mask(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return redactedMask
+	case map[string]interface{}:
+		for name, field := range v {
+			v[name] = mask(field)
+		}
+		return v
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = mask(elem)
+		}
+		return v
+	}
+	return nil
+}
+
+// redacts reports whether the field at path, or the object holding it, is
+// redacted in a collection.
+func (d *Driver) redacts(collection, path string) bool {
+	meta, _ := d.collectionMeta(collection)
+	for _, redacted := range meta.Redact {
+		if path == redacted || strings.HasPrefix(path, redacted+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// ExportRedacted is Export with the fields each record's collection redacts
+// masked, for sharing outside the team that owns the data. The revisions
+// are those of the masked records, so importing the export back conflicts
+// with every record it masked instead of overwriting it.
+func (d *Driver) ExportRedacted(collection string) ([]Record, error) {
+	if err := d.checkNames(&collection); err != nil {
+		return nil, err
+	}
+
+	return d.export(collection, true)
+}
+
+// DumpRedacted is Dump with the fields each collection redacts masked. The
+// dump header marks it as redacted. Records of those collections that are
+// not JSON cannot be masked, so they are left out and logged.
+func (d *Driver) DumpRedacted(w io.Writer, collections ...string) (int, error) {
+	return d.dump(w, true, collections)
+}
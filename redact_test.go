@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedact(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+	if err := d.SetCollectionMeta("users", CollectionMeta{Redact: []string{"Name", "Age", "Address"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		record string
+		want   string
+	}{
+		{"string", `{"Name": "alice", "Company": "Initech"}`, `{"Company":"Initech","Name":"****"}`},
+		{"number", `{"Age": 42}`, `{"Age":null}`},
+		{"object", `{"Address": {"City": "Pune", "Pincode": 411001}}`, `{"Address":{"City":"****","Pincode":null}}`},
+		{"missing field", `{"Company": "Initech"}`, `{"Company":"Initech"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := d.Redact("users", []byte(tt.record))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var compact bytes.Buffer
+			if err := json.Compact(&compact, got); err != nil {
+				t.Fatal(err)
+			}
+			if compact.String() != tt.want {
+				t.Errorf("Redact = %s, want %s", compact.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestWatchRedactsChanges(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+	if err := d.SetCollectionMeta("users", CollectionMeta{Redact: []string{"Company"}, TTL: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(d.Handler(HandlerOptions{}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/collections/users/watch", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if err := d.Write("users", "alice", User{Name: "alice", Company: "Initech"}); err != nil {
+		t.Fatal(err)
+	}
+	var event watchEvent
+	for scanner := bufio.NewScanner(resp.Body); scanner.Scan(); {
+		if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+
+	var value map[string]interface{}
+	if err := json.Unmarshal(event.Value, &value); err != nil {
+		t.Fatalf("event value %s: %v", event.Value, err)
+	}
+	if value["Company"] != redactedMask || value["Name"] != "alice" {
+		t.Errorf("event value = %v, want Company masked", value)
+	}
+	if _, ok := value[expiresField]; ok {
+		t.Errorf("event value carries %s: %v", expiresField, value)
+	}
+}
+
+func TestDumpRedactedLeavesOutNonJSON(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+	if err := d.SetCollectionMeta("users", CollectionMeta{Redact: []string{"Name"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Write("users", "alice", User{Name: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.store.put("users", "blob", []byte("Name: bob")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	records, err := d.DumpRedacted(&buf, "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records != 1 || strings.Contains(buf.String(), `"blob"`) || strings.Contains(buf.String(), `"Name":"alice"`) {
+		t.Errorf("redacted dump of %d records:\n%s", records, buf.String())
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrDanglingReference is returned by writes of records referring to a
+	// record that does not exist.
+	ErrDanglingReference = errors.New("reference to a missing record")
+	// ErrReferenced is returned by deletes of records other records still
+	// refer to.
+	ErrReferenced = errors.New("record is still referenced")
+)
+
+// Reference declares that Field, a dot path, of the records of Collection
+// holds the key of a record of Target. Records whose field is missing,
+// null or empty refer to nothing.
+type Reference struct {
+	Collection string
+	Field      string
+	Target     string
+	// Cascade deletes the referring records along with their target;
+	// otherwise deleting a referenced record fails with ErrReferenced.
+	Cascade bool
+}
+
+// AddReference makes writes to collection fail with ErrDanglingReference
+// unless field refers to an existing record of target, and deletes of
+// records of target fail with ErrReferenced while they are referred to.
+//
+// Transactions check references too but never cascade: deleting a
+// referenced record in a transaction fails unless the transaction also
+// deletes the records referring to it.
+func (d *Driver) AddReference(collection, field, target string) error {
+	return d.addReference(Reference{Collection: collection, Field: field, Target: target})
+}
+
+// AddCascadingReference is AddReference, except that deleting a record of
+// target also deletes the records of collection referring to it.
+func (d *Driver) AddCascadingReference(collection, field, target string) error {
+	return d.addReference(Reference{Collection: collection, Field: field, Target: target, Cascade: true})
+}
+
+func (d *Driver) addReference(ref Reference) error {
+	if ref.Collection == "" || ref.Field == "" || ref.Target == "" {
+		return errors.New("a reference needs a collection, a field and a target collection")
+	}
+	if err := d.checkNames(&ref.Collection); err != nil {
+		return err
+	}
+	if err := d.checkNames(&ref.Target); err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for _, name := range []string{ref.Collection, ref.Target} {
+		if v, ok := d.views[name]; ok {
+			return fmt.Errorf("collection %s is a view of %s and cannot take part in references", name, v.Source)
+		}
+	}
+	for _, r := range d.refs {
+		if r.Collection == ref.Collection && r.Field == ref.Field {
+			return fmt.Errorf("field %s of collection %s already refers to collection %s", r.Field, r.Collection, r.Target)
+		}
+	}
+	d.refs = append(d.refs, ref)
+	return nil
+}
+
+func (d *Driver) references() []Reference {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.refs
+}
+
+// hasReferences reports whether records of collection refer to others.
+func (d *Driver) hasReferences(collection string) bool {
+	for _, ref := range d.references() {
+		if ref.Collection == collection {
+			return true
+		}
+	}
+	return false
+}
+
+// writeLocks lists the collections to lock, in lock order, to write to
+// collection: itself and the targets of its references.
+func (d *Driver) writeLocks(collection string) []string {
+	names := []string{collection}
+	for _, ref := range d.references() {
+		if ref.Collection == collection {
+			names = append(names, ref.Target)
+		}
+	}
+	return lockOrder(names)
+}
+
+// deleteLocks lists the collections to lock, in lock order, to delete from
+// collection: itself and every collection referring to it, directly or
+// through cascades.
+func (d *Driver) deleteLocks(collection string) []string {
+	refs := d.references()
+	seen := map[string]bool{collection: true}
+	names := []string{collection}
+	for i := 0; i < len(names); i++ {
+		for _, ref := range refs {
+			if ref.Target == names[i] && !seen[ref.Collection] {
+				seen[ref.Collection] = true
+				names = append(names, ref.Collection)
+			}
+		}
+	}
+	return lockOrder(names)
+}
+
+func lockOrder(names []string) []string {
+	sort.Strings(names)
+	unique := names[:0]
+	for i, name := range names {
+		if i == 0 || name != names[i-1] {
+			unique = append(unique, name)
+		}
+	}
+	return unique
+}
+
+// checkReferences fails if a record about to be written to collection
+// refers to a record that does not exist. exists reports whether a record
+// exists; the locks of the targets must be held.
+func (d *Driver) checkReferences(collection, key string, data []byte, exists func(collection, key string) bool) error {
+	for _, ref := range d.references() {
+		if ref.Collection != collection {
+			continue
+		}
+		target, ok, err := referenceKey(data, ref.Field)
+		if err != nil {
+			return fmt.Errorf("could not check references of %s in collection %s: %v", key, collection, err)
+		}
+		if ok && !exists(ref.Target, target) {
+			return fmt.Errorf("%w: %s of %s in collection %s refers to %s, which is not in collection %s",
+				ErrDanglingReference, ref.Field, key, collection, target, ref.Target)
+		}
+	}
+	return nil
+}
+
+// stored reports whether a record exists in the store.
+func (d *Driver) stored(collection, key string) bool {
+	_, err := d.store.get(collection, key)
+	return err == nil
+}
+
+// referring lists the keys of the records of ref.Collection referring to
+// key. The collection's lock must be held.
+func (d *Driver) referring(ref Reference, key string) ([]string, error) {
+	if info, err := d.fs.Stat(filepath.Join(d.dir, ref.Collection)); err != nil || !info.IsDir() {
+		return nil, nil
+	}
+	keys, err := d.store.keys(ref.Collection)
+	if err != nil {
+		return nil, err
+	}
+
+	var referring []string
+	for _, k := range keys {
+		data, err := d.store.get(ref.Collection, k)
+		if err != nil {
+			continue
+		}
+		if target, ok, err := referenceKey(data, ref.Field); err == nil && ok && target == key {
+			referring = append(referring, k)
+		}
+	}
+	return referring, nil
+}
+
+// recordID identifies a record across collections.
+type recordID struct {
+	collection string
+	key        string
+}
+
+// planDelete lists the records a delete of key cascades to, records
+// referring to others first, or fails if a reference restricts it. The
+// locks of deleteLocks must be held.
+func (d *Driver) planDelete(collection, key string) ([]recordID, error) {
+	var plan []recordID
+	visited := map[recordID]bool{{collection, key}: true}
+
+	var visit func(collection, key string) error
+	visit = func(collection, key string) error {
+		for _, ref := range d.references() {
+			if ref.Target != collection {
+				continue
+			}
+			referring, err := d.referring(ref, key)
+			if err != nil {
+				return err
+			}
+			for _, k := range referring {
+				id := recordID{ref.Collection, k}
+				if visited[id] {
+					continue
+				}
+				if !ref.Cascade {
+					return fmt.Errorf("%w: %s of %s in collection %s refers to %s in collection %s",
+						ErrReferenced, ref.Field, k, ref.Collection, key, collection)
+				}
+				visited[id] = true
+				if err := visit(id.collection, id.key); err != nil {
+					return err
+				}
+				plan = append(plan, id)
+			}
+		}
+		return nil
+	}
+
+	if err := visit(collection, key); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// referenceKey returns the key a record refers to through field, if any.
+func referenceKey(data []byte, field string) (string, bool, error) {
+	doc, err := decodeDocument(data)
+	if err != nil {
+		return "", false, err
+	}
+
+	value, ok := lookupField(doc, strings.Split(field, "."))
+	if !ok || value == nil {
+		return "", false, nil
+	}
+	switch value := value.(type) {
+	case string:
+		return value, value != "", nil
+	case json.Number:
+		return value.String(), true, nil
+	}
+	return "", false, fmt.Errorf("field %s does not hold a key", field)
+}
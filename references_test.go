@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestReferences(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+	if err := d.Write("companies", "initech", User{Name: "Initech"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Write("cities", "pune", User{Name: "Pune"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddReference("users", "Company", "companies"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddCascadingReference("people", "Address.City", "cities"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The steps run in order, each on what the ones before left.
+	steps := []struct {
+		name string
+		run  func() error
+		want error
+	}{
+		{"write referring to a record", func() error { return d.Write("users", "alice", User{Company: "initech"}) }, nil},
+		{"write referring to nothing", func() error { return d.Write("users", "bob", User{}) }, nil},
+		{"write with a dangling reference", func() error { return d.Write("users", "eve", User{Company: "globex"}) }, ErrDanglingReference},
+		{"delete a referenced record", func() error { return d.Delete("companies", "initech") }, ErrReferenced},
+		{"delete it with what refers to it", func() error {
+			tx := d.Begin()
+			if err := tx.Delete("users", "alice"); err != nil {
+				return err
+			}
+			if err := tx.Delete("companies", "initech"); err != nil {
+				return err
+			}
+			return tx.Commit()
+		}, nil},
+		{"write referring through a nested field", func() error {
+			return d.Write("people", "p1", User{Address: Address{City: "pune"}})
+		}, nil},
+		{"cascading delete", func() error { return d.Delete("cities", "pune") }, nil},
+		{"referring record is gone", func() error {
+			_, err := d.Read("people", "p1")
+			return err
+		}, os.ErrNotExist},
+	}
+	for _, step := range steps {
+		if err := step.run(); !errors.Is(err, step.want) {
+			t.Fatalf("%s: %v, want %v", step.name, err, step.want)
+		}
+	}
+}
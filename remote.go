@@ -0,0 +1,373 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RemoteStore is an object store the database directory can be mirrored
+// to, such as an S3 bucket (see NewS3Store). Objects are named
+// <collection>/<key>.json and hold the encoded record. Get and Delete wrap
+// os.ErrNotExist for missing objects.
+type RemoteStore interface {
+	Put(name string, data []byte) error
+	Get(name string) ([]byte, error)
+	Delete(name string) error
+	List(prefix string) ([]string, error)
+}
+
+// SyncOptions configures mirroring to a remote store. Sync needs the change
+// log (Options.ChangeLog): the first sync uploads every record, after which
+// only the changes recorded since the last upload are sent.
+type SyncOptions struct {
+	Remote RemoteStore
+	// RetryInterval is how long to wait after a failed upload before trying
+	// again. Defaults to ten seconds.
+	RetryInterval time.Duration
+}
+
+// syncCursorFile records the last change uploaded, relative to the change
+// log directory.
+const syncCursorFile = "synced"
+
+// startSync mirrors changes to the remote store until the Driver is closed.
+func (d *Driver) startSync(opts *SyncOptions) error {
+	if opts == nil || d.opts.ReadOnly {
+		return nil
+	}
+	if d.changes == nil {
+		return errors.New("remote sync requires a change log; open the database with Options.ChangeLog")
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = 10 * time.Second
+	}
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.syncLoop(*opts)
+	}()
+	return nil
+}
+
+func (d *Driver) syncLoop(opts SyncOptions) {
+	cursor := filepath.Join(d.dir, changeLogDir, syncCursorFile)
+	wait := func() bool {
+		select {
+		case <-d.stop:
+			return false
+		case <-time.After(opts.RetryInterval):
+			return true
+		}
+	}
+
+	var manifest *BackupManifest
+	synced, err := readSyncCursor(cursor)
+	for os.IsNotExist(err) {
+		// Nothing was ever uploaded: mirror every record, then catch up on
+		// the changes made meanwhile.
+		since := d.changes.lastSeq()
+		if manifest, err = d.uploadAll(opts.Remote); err == nil {
+			manifest.Seq = since
+			if err = writeManifest(opts.Remote, manifest); err == nil {
+				synced, err = since, writeSyncCursor(cursor, since)
+				break
+			}
+		}
+		d.log.Error("Could not upload database to remote store, retrying in %s: %v", opts.RetryInterval, err)
+		if !wait() {
+			return
+		}
+		err = os.ErrNotExist
+	}
+	if err != nil {
+		d.log.Error("Remote sync stopped: %v", err)
+		return
+	}
+
+	if manifest == nil {
+		if manifest, err = ReadManifest(opts.Remote); errors.Is(err, os.ErrNotExist) {
+			// Stores synced before manifests existed get one once sync has
+			// caught up, when the remote matches the local records again.
+			manifest, err = d.localManifest()
+		}
+		if err != nil {
+			d.log.Error("Remote sync stopped: could not load backup manifest: %v", err)
+			return
+		}
+	}
+
+	r, err := d.changes.reader(synced)
+	if err != nil {
+		d.log.Error("Remote sync stopped: %v", err)
+		return
+	}
+	defer r.close()
+
+	unsaved := 0
+	for {
+		change, err := r.next(d.stop)
+		if err == errStopped {
+			return
+		}
+		if err != nil {
+			d.log.Error("Remote sync stopped: %v", err)
+			return
+		}
+
+		for {
+			if err = uploadChange(opts.Remote, change); err == nil {
+				err = writeSyncCursor(cursor, change.Seq)
+			}
+			if err == nil {
+				break
+			}
+			d.log.Error("Could not sync change %d to remote store, retrying in %s: %v", change.Seq, opts.RetryInterval, err)
+			if !wait() {
+				return
+			}
+		}
+
+		// The manifest is rewritten whole, so only once sync has caught up
+		// or after a long run of changes.
+		manifest.apply(change)
+		if unsaved++; change.Seq >= d.changes.lastSeq() || unsaved >= manifestEvery {
+			if err := writeManifest(opts.Remote, manifest); err != nil {
+				d.log.Error("Could not write backup manifest: %v", err)
+				continue
+			}
+			unsaved = 0
+		}
+	}
+}
+
+// uploadAll puts every record of every collection and returns the manifest
+// of what it uploaded.
+func (d *Driver) uploadAll(remote RemoteStore) (*BackupManifest, error) {
+	collections, err := d.Collections()
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &BackupManifest{Records: make(map[string]string)}
+	for _, collection := range collections {
+		err := d.scanStored(collection, func(key string, data []byte) error {
+			name := objectName(collection, key)
+			manifest.Records[name] = revision(data)
+			return remote.Put(name, data)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not upload collection %s: %v", collection, err)
+		}
+	}
+	d.log.Info("Uploaded %d records to remote store", len(manifest.Records))
+	return manifest, nil
+}
+
+func uploadChange(remote RemoteStore, change Change) error {
+	name := objectName(change.Collection, change.Key)
+	if change.Op == OpDelete {
+		if err := remote.Delete(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	return remote.Put(name, change.Data)
+}
+
+// syncedSeq is the last change remote sync uploaded; the change log keeps
+// every change after it. Until the first upload is done, that is all.
+func (d *Driver) syncedSeq() uint64 {
+	synced, err := readSyncCursor(filepath.Join(d.dir, changeLogDir, syncCursorFile))
+	if err != nil {
+		return 0
+	}
+	return synced
+}
+
+func readSyncCursor(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	seq, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid sync cursor %s: %v", path, err)
+	}
+	return seq, nil
+}
+
+func writeSyncCursor(path string, seq uint64) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(seq, 10)+"\n"), 0644); err != nil {
+		return fmt.Errorf("could not write sync cursor: %v", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+func objectName(collection, key string) string {
+	return collection + "/" + key + ".json"
+}
+
+// parseObjectName splits an object name into collection and key.
+func parseObjectName(name string) (collection, key string, ok bool) {
+	collection, file, ok := strings.Cut(name, "/")
+	if !ok || collection == "" || strings.Contains(file, "/") || !strings.HasSuffix(file, ".json") {
+		return "", "", false
+	}
+	return collection, strings.TrimSuffix(file, ".json"), true
+}
+
+// RestoreFromRemote opens a database in dir, which must hold no
+// collections yet, and fills it with the records in the remote store, e.g.
+// to bootstrap a new machine after losing the old one. When the store has
+// a backup manifest, the records it lists are restored and then verified
+// against it with indexes rebuilt from disk; on any divergence the
+// database is closed again and a *RestoreDivergenceError returned, so it
+// never serves traffic unverified.
+func RestoreFromRemote(remote RemoteStore, dir string, options *Options) (*Driver, error) {
+	d, err := New(dir, options)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.restoreFrom(remote); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *Driver) restoreFrom(remote RemoteStore) error {
+	if err := d.writable(); err != nil {
+		return err
+	}
+	if collections, err := d.Collections(); err != nil {
+		return err
+	} else if len(collections) > 0 {
+		return fmt.Errorf("cannot restore into %s: it already holds collections %s", d.dir, strings.Join(collections, ", "))
+	}
+
+	manifest, err := ReadManifest(remote)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	var names []string
+	if manifest != nil {
+		for name := range manifest.Records {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	} else if names, err = remote.List(""); err != nil {
+		return fmt.Errorf("could not list remote store: %v", err)
+	}
+
+	start := time.Now()
+	restored := 0
+	for _, name := range names {
+		collection, key, ok := parseObjectName(name)
+		if !ok {
+			continue
+		}
+		// Object names come from the remote store, so they are held to the
+		// same rules as the names of records written here.
+		if err := d.checkNames(&collection, &key); err != nil {
+			return fmt.Errorf("could not restore %s: %w", name, err)
+		}
+
+		data, err := remote.Get(name)
+		if errors.Is(err, os.ErrNotExist) && manifest != nil {
+			// Reported as missing by the verification below.
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("could not download %s: %v", name, err)
+		}
+		if err := d.put(collection, key, data); err != nil {
+			return fmt.Errorf("could not restore %s: %v", name, err)
+		}
+		restored++
+	}
+	d.log.Info("Restored %d records from remote store in %s", restored, time.Since(start))
+
+	if manifest == nil {
+		d.log.Info("Remote store has no backup manifest, skipping verification")
+		return nil
+	}
+
+	verification, err := d.VerifyManifest(manifest)
+	if err != nil {
+		return fmt.Errorf("could not verify restore: %v", err)
+	}
+	if !verification.Clean() {
+		return &RestoreDivergenceError{Verification: verification}
+	}
+	d.log.Info("Verified restore: %s", verification)
+	return nil
+}
+
+// dirStore is a RemoteStore backed by a local directory, such as a network
+// mount.
+type dirStore struct {
+	dir string
+}
+
+// NewDirStore returns a RemoteStore keeping objects as files under dir.
+func NewDirStore(dir string) RemoteStore {
+	return &dirStore{dir: dir}
+}
+
+func (s *dirStore) Put(name string, data []byte) error {
+	path := filepath.Join(s.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("could not create directory: %v", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("could not write object: %v", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *dirStore) Get(name string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, fmt.Errorf("could not read object: %w", err)
+	}
+	return data, nil
+}
+
+func (s *dirStore) Delete(name string) error {
+	if err := os.Remove(filepath.Join(s.dir, filepath.FromSlash(name))); err != nil {
+		return fmt.Errorf("could not delete object: %w", err)
+	}
+	return nil
+}
+
+func (s *dirStore) List(prefix string) ([]string, error) {
+	var names []string
+	err := filepath.WalkDir(s.dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		if name := filepath.ToSlash(rel); strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	sort.Strings(names)
+	return names, err
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// mapStore is a RemoteStore in memory.
+type mapStore map[string][]byte
+
+func (s mapStore) Put(name string, data []byte) error { s[name] = data; return nil }
+func (s mapStore) Delete(name string) error           { delete(s, name); return nil }
+
+func (s mapStore) Get(name string) ([]byte, error) {
+	data, ok := s[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return data, nil
+}
+
+func (s mapStore) List(prefix string) ([]string, error) {
+	var names []string
+	for name := range s {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func TestRestoreFromRemote(t *testing.T) {
+	remote := mapStore{"users/alice.json": []byte(`{"Name": "alice"}`)}
+	d, err := RestoreFromRemote(remote, t.TempDir(), &Options{Slog: openTestLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if user, err := d.Read("users", "alice"); err != nil || user.Name != "alice" {
+		t.Errorf("restored record = %+v, %v", user, err)
+	}
+}
+
+func TestRestoreRejectsTraversal(t *testing.T) {
+	for _, name := range []string{"../leak.json", "users/...json", `users/..\..\leak.json`} {
+		t.Run(name, func(t *testing.T) {
+			root := t.TempDir()
+			dir := filepath.Join(root, "db")
+			remote := mapStore{
+				"users/alice.json": []byte(`{"Name": "alice"}`),
+				name:               []byte(`{"Name": "LEAKED"}`),
+			}
+			_, err := RestoreFromRemote(remote, dir, &Options{Slog: openTestLogger()})
+			if !errors.Is(err, ErrInvalidName) {
+				t.Errorf("restore = %v, want ErrInvalidName", err)
+			}
+			if _, err := os.Stat(filepath.Join(root, "leak.json")); err == nil {
+				t.Error("restore wrote outside the database directory")
+			}
+		})
+	}
+}
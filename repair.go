@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// quarantineDir is where Repair moves damaged data, relative to the
+// database directory. Its leading dot keeps it out of Collections.
+const quarantineDir = ".quarantine"
+
+// RepairAction selects what Repair does with damaged records.
+type RepairAction int
+
+const (
+	// RepairQuarantine moves damaged data under .quarantine (the default).
+	RepairQuarantine RepairAction = iota
+	// RepairDelete removes damaged data.
+	RepairDelete
+	// RepairReportOnly only reports damaged data.
+	RepairReportOnly
+)
+
+// RepairOptions configures Repair.
+type RepairOptions struct {
+	Action RepairAction
+}
+
+// RepairReport summarizes what Repair found and did in a collection.
+type RepairReport struct {
+	Collection string
+	Scanned    int
+	Corrupt    []CorruptRecord
+	// Quarantined and Deleted list the paths moved aside or removed.
+	Quarantined []string
+	Deleted     []string
+	// SkippedBytes counts unreadable bytes dropped from a log.
+	SkippedBytes int64
+	// IndexRebuilt is set when in-memory indexes were rebuilt.
+	IndexRebuilt bool
+}
+
+// Clean reports whether nothing damaged was found.
+func (r *RepairReport) Clean() bool {
+	return len(r.Corrupt) == 0 && r.SkippedBytes == 0
+}
+
+func (r *RepairReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: scanned %d records, %d corrupt", r.Collection, r.Scanned, len(r.Corrupt))
+	if r.SkippedBytes > 0 {
+		fmt.Fprintf(&b, ", %d unreadable bytes", r.SkippedBytes)
+	}
+	if len(r.Quarantined) > 0 {
+		fmt.Fprintf(&b, ", %d quarantined", len(r.Quarantined))
+	}
+	if len(r.Deleted) > 0 {
+		fmt.Fprintf(&b, ", %d deleted", len(r.Deleted))
+	}
+	if r.IndexRebuilt {
+		b.WriteString(", index rebuilt")
+	}
+	for _, c := range r.Corrupt {
+		fmt.Fprintf(&b, "\n  %s: %v", c.Key, c.Err)
+	}
+	return b.String()
+}
+
+// repairer is implemented by storage engines that can scan and repair a
+// collection.
+type repairer interface {
+	repair(collection string, opts RepairOptions, report *RepairReport) error
+}
+
+// Repair scans a collection for records that are truncated, fail their
+// checksum or do not hold valid JSON, and quarantines or deletes them as
+// configured. Writes to the collection are held back while it runs. Every
+// record set aside is published as deleted, and the usage of the
+// collection measured again.
+func (d *Driver) Repair(collection string, opts RepairOptions) (*RepairReport, error) {
+	if err := d.checkNames(&collection); err != nil {
+		return nil, err
+	}
+
+	r, ok := d.store.(repairer)
+	if !ok {
+		return nil, fmt.Errorf("repair is not supported by this storage engine")
+	}
+	if opts.Action != RepairReportOnly {
+		if err := d.writable(); err != nil {
+			return nil, err
+		}
+	}
+
+	d.gate.RLock()
+	defer d.gate.RUnlock()
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	// A collection too damaged to list has no keys to publish deletes of.
+	var before []string
+	if opts.Action != RepairReportOnly {
+		before, _ = d.store.keys(collection)
+	}
+
+	report := &RepairReport{Collection: collection}
+	err := r.repair(collection, opts, report)
+	if opts.Action != RepairReportOnly {
+		if settleErr := d.settleRepair(collection, before); err == nil {
+			err = settleErr
+		}
+	}
+	if err != nil {
+		return report, fmt.Errorf("could not repair collection %s: %v", collection, err)
+	}
+
+	if !report.Clean() {
+		d.log.Error("Repair of collection %s found %d corrupt records", collection, len(report.Corrupt))
+	}
+	return report, nil
+}
+
+// settleRepair accounts for the records a repair set aside: the
+// collection is measured again, and each key it no longer holds published
+// as deleted. The collection lock must be held.
+func (d *Driver) settleRepair(collection string, before []string) error {
+	if err := d.remeasureUsage(collection); err != nil {
+		return err
+	}
+	after, err := d.store.keys(collection)
+	if err != nil {
+		return err
+	}
+	kept := make(map[string]bool, len(after))
+	for _, key := range after {
+		kept[key] = true
+	}
+	for _, key := range before {
+		if !kept[key] {
+			d.publish(OpDelete, collection, key, nil)
+		}
+	}
+	return nil
+}
+
+// quarantine moves path under the quarantine directory, keeping its
+// location relative to root.
+func quarantine(fsys FS, root, path string, dirMode os.FileMode) (string, error) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return "", err
+	}
+
+	target := filepath.Join(root, quarantineDir, rel)
+	if err := fsys.MkdirAll(filepath.Dir(target), dirMode); err != nil {
+		return "", fmt.Errorf("could not create quarantine directory: %v", err)
+	}
+	if _, err := fsys.Stat(target); err == nil {
+		target += "." + time.Now().Format("20060102T150405.000")
+	}
+	if err := fsys.Rename(path, target); err != nil {
+		return "", fmt.Errorf("could not quarantine %s: %v", path, err)
+	}
+	return target, nil
+}
+
+func (s *fileStorage) repair(collection string, opts RepairOptions, report *RepairReport) error {
+	if opts.Action != RepairReportOnly {
+		// Records set aside leave the collection behind its manifest's back.
+		if err := s.invalidateManifest(collection); err != nil {
+			return err
+		}
+		defer s.forgetManifest(collection)
+	}
+	dirs, err := s.layout.recordDirs(s.fs, s.dir, collection)
+	if err != nil {
+		return fmt.Errorf("could not read directory: %v", err)
+	}
+	for _, dir := range dirs {
+		if err := s.repairDir(collection, dir, opts, report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// repairDir repairs the records of a collection in one of its directories.
+func (s *fileStorage) repairDir(collection, dir string, opts RepairOptions, report *RepairReport) error {
+	entries, err := s.fs.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("could not read directory: %v", err)
+	}
+
+	ext := s.layout.extension()
+	records := make(map[string]bool)
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ext) {
+			records[entry.Name()] = true
+		}
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(dir, name)
+
+		// A checksum whose record is gone is left over from a crash.
+		if strings.HasSuffix(name, ext+checksumExt) {
+			if !records[strings.TrimSuffix(name, checksumExt)] && opts.Action != RepairReportOnly {
+				if err := s.fs.Remove(path); err != nil {
+					return fmt.Errorf("could not remove orphaned checksum: %v", err)
+				}
+				report.Deleted = append(report.Deleted, path)
+			}
+			continue
+		}
+		if !strings.HasSuffix(name, ext) || name == metaFile || entry.IsDir() {
+			continue
+		}
+
+		report.Scanned++
+		key := strings.TrimSuffix(name, ext)
+
+		_, err := s.get(collection, key)
+		if err == nil {
+			data, _ := s.fs.ReadFile(path)
+			if !json.Valid(data) {
+				err = fmt.Errorf("%w: truncated or invalid JSON", ErrCorruptRecord)
+			}
+		}
+		if err == nil {
+			continue
+		}
+		report.Corrupt = append(report.Corrupt, CorruptRecord{Collection: collection, Key: key, Err: err})
+
+		for _, p := range []string{path, path + checksumExt} {
+			if _, err := s.fs.Stat(p); err != nil {
+				continue
+			}
+			switch opts.Action {
+			case RepairQuarantine:
+				target, err := quarantine(s.fs, s.dir, p, s.layout.dirMode())
+				if err != nil {
+					return err
+				}
+				report.Quarantined = append(report.Quarantined, target)
+			case RepairDelete:
+				if err := s.fs.Remove(p); err != nil {
+					return fmt.Errorf("could not delete %s: %v", p, err)
+				}
+				report.Deleted = append(report.Deleted, p)
+			}
+		}
+	}
+	return nil
+}
+
+// repair salvages a damaged log: every entry that still decodes is kept,
+// bytes that do not are skipped until the next valid entry, and the result
+// replaces the log. The index is rebuilt from the salvaged log.
+func (s *logStorage) repair(collection string, opts RepairOptions, report *RepairReport) error {
+	path := filepath.Join(s.dir, collection, logFileName)
+
+	// Drop the open log so it is replayed from disk afterwards.
+	s.mutex.Lock()
+	if c, ok := s.collections[collection]; ok {
+		c.Lock()
+		c.shut()
+		c.Unlock()
+		delete(s.collections, collection)
+	}
+	s.mutex.Unlock()
+	report.IndexRebuilt = true
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read log: %v", err)
+	}
+
+	var salvaged bytes.Buffer
+	keys := make(map[string]bool)
+	for offset := 0; offset < len(data); {
+		_, key, _, size, err := decodeLogEntry(data[offset:])
+		if err != nil {
+			report.SkippedBytes++
+			offset++
+			continue
+		}
+		keys[key] = true
+		salvaged.Write(data[offset : offset+int(size)])
+		offset += int(size)
+	}
+	report.Scanned = len(keys)
+
+	if report.SkippedBytes == 0 {
+		return nil
+	}
+	report.Corrupt = append(report.Corrupt, CorruptRecord{
+		Collection: collection,
+		Key:        logFileName,
+		Err:        fmt.Errorf("%w: %d unreadable bytes in log", ErrCorruptRecord, report.SkippedBytes),
+	})
+	if opts.Action == RepairReportOnly {
+		return nil
+	}
+
+	tmpPath := path + compactSuffix
+	if err := writeFileSync(OSFS{}, tmpPath, salvaged.Bytes(), s.layout.fileMode(), true); err != nil {
+		return fmt.Errorf("could not write salvaged log: %v", err)
+	}
+
+	switch opts.Action {
+	case RepairQuarantine:
+		target, err := quarantine(OSFS{}, s.dir, path, s.layout.dirMode())
+		if err != nil {
+			return err
+		}
+		report.Quarantined = append(report.Quarantined, target)
+	case RepairDelete:
+		report.Deleted = append(report.Deleted, path)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDir(OSFS{}, filepath.Dir(path))
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestRepairFiles(t *testing.T) {
+	tests := []struct {
+		name                 string
+		action               RepairAction
+		quarantined, deleted int
+		damagedLeft          bool
+	}{
+		{name: "quarantine", action: RepairQuarantine, quarantined: 1},
+		{name: "delete", action: RepairDelete, deleted: 1},
+		{name: "report only", action: RepairReportOnly, damagedLeft: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, dir := openTestDB(t, nil)
+			for i := 0; i < 3; i++ {
+				if err := d.Write("users", fmt.Sprint("user", i), User{Name: fmt.Sprint(i)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			path := filepath.Join(dir, "users", "user1.json")
+			if err := os.WriteFile(path, []byte(`{"Name": "1`), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			report, err := d.Repair("users", RepairOptions{Action: tt.action})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Scanned != 3 || len(report.Corrupt) != 1 || report.Corrupt[0].Key != "user1" || report.Clean() {
+				t.Errorf("report = %v, want user1 corrupt out of 3", report)
+			}
+			if len(report.Quarantined) != tt.quarantined || len(report.Deleted) != tt.deleted {
+				t.Errorf("quarantined %v and deleted %v, want %d and %d",
+					report.Quarantined, report.Deleted, tt.quarantined, tt.deleted)
+			}
+
+			if _, err := os.Stat(path); (err == nil) != tt.damagedLeft {
+				t.Errorf("damaged record after repair: %v, want left in place %v", err, tt.damagedLeft)
+			}
+			_, err = os.Stat(filepath.Join(dir, quarantineDir, "users", "user1.json"))
+			if (err == nil) != (tt.quarantined > 0) {
+				t.Errorf("quarantined record: %v", err)
+			}
+			for _, key := range []string{"user0", "user2"} {
+				if _, err := d.Read("users", key); err != nil {
+					t.Errorf("read %s after repair: %v", key, err)
+				}
+			}
+			if !tt.damagedLeft {
+				if _, err := d.Read("users", "user1"); !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("read of the repaired record = %v, want it gone", err)
+				}
+			}
+		})
+	}
+}
+
+func TestRepairLog(t *testing.T) {
+	tests := []struct {
+		name        string
+		action      RepairAction
+		quarantined bool
+		salvaged    bool
+	}{
+		{"quarantine", RepairQuarantine, true, true},
+		{"delete", RepairDelete, false, true},
+		{"report only", RepairReportOnly, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeTestLog(t, func(log []byte) []byte {
+				log[logHeaderSize] ^= 0xff
+				return log
+			})
+			path := filepath.Join(dir, "users", logFileName)
+			before, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d, err := New(dir, &Options{Engine: EngineLog, Slog: openTestLogger()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+
+			report, err := d.Repair("users", RepairOptions{Action: tt.action})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.SkippedBytes == 0 || len(report.Corrupt) != 1 || !report.IndexRebuilt {
+				t.Errorf("report = %v, want unreadable bytes and a rebuilt index", report)
+			}
+			quarantined := filepath.Join(dir, quarantineDir, "users", logFileName)
+			if got := slices.Equal(report.Quarantined, []string{quarantined}); got != tt.quarantined {
+				t.Errorf("quarantined %v, want the log quarantined %v", report.Quarantined, tt.quarantined)
+			}
+			if data, err := os.ReadFile(quarantined); tt.quarantined && (err != nil || !bytes.Equal(data, before)) {
+				t.Errorf("quarantined log = %d bytes, %v, want the damaged log", len(data), err)
+			}
+
+			after, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if salvaged := !bytes.Equal(after, before); salvaged != tt.salvaged {
+				t.Errorf("log rewritten %v, want %v", salvaged, tt.salvaged)
+			}
+			if !tt.salvaged {
+				return
+			}
+			for _, key := range []string{"user1", "user2"} {
+				if _, err := d.Read("users", key); err != nil {
+					t.Errorf("read %s after salvaging: %v", key, err)
+				}
+			}
+		})
+	}
+}
+
+// TestRepairSettles checks that records set aside by Repair leave the
+// usage of their collection and are published as deleted.
+func TestRepairSettles(t *testing.T) {
+	tests := []struct {
+		name   string
+		engine Engine
+		damage func(t *testing.T, dir string)
+	}{
+		{"files", EngineFiles, func(t *testing.T, dir string) {
+			if err := os.WriteFile(filepath.Join(dir, "users", "a.json"), []byte(`{"Name": "a`), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"log", EngineLog, func(t *testing.T, dir string) {
+			f, err := os.OpenFile(filepath.Join(dir, "users", logFileName), os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if _, err := f.WriteAt([]byte{0xff}, logHeaderSize); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, dir := openTestDB(t, &Options{Engine: tt.engine})
+			writeUsers(t, d, "a", "b")
+			if _, err := d.Stats("users"); err != nil {
+				t.Fatal(err)
+			}
+			tt.damage(t, dir)
+			changes, stop := d.Watch("users")
+			defer stop()
+
+			if _, err := d.Repair("users", RepairOptions{Action: RepairQuarantine}); err != nil {
+				t.Fatal(err)
+			}
+			size, err := d.store.(sizer).size("users", "b")
+			if err != nil {
+				t.Fatal(err)
+			}
+			stats, err := d.Stats("users")
+			if err != nil || stats.Records != 1 || stats.Bytes != size {
+				t.Errorf("Stats = %+v, %v, want 1 record of %d bytes", stats, err, size)
+			}
+			select {
+			case c := <-changes:
+				if c.Op != OpDelete || c.Key != "a" {
+					t.Errorf("change = %s %s, want delete a", c.Op, c.Key)
+				}
+			default:
+				t.Error("the record set aside was not published as deleted")
+			}
+		})
+	}
+}
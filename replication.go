@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Replication streams the change log of a primary to followers over TCP.
+// A follower connects and sends one JSON line, {"since": N}, with the
+// sequence number of the last change it applied. The primary answers with
+// every later change, one JSON line each, and keeps streaming new changes
+// as they are made. A follower that loses its connection reconnects and
+// resumes after the last change it applied, which it knows from its own
+// change log, so both sides must be opened with Options.ChangeLog.
+
+// ErrFollower is returned by writes on a Driver following a primary.
+var ErrFollower = errors.New("database is a replication follower; write to the primary")
+
+const (
+	replicationDialTimeout = 5 * time.Second
+	replicationMaxBackoff  = 10 * time.Second
+)
+
+// replicationHello is the request a follower opens its connection with.
+type replicationHello struct {
+	Since uint64 `json:"since"`
+}
+
+// replicaState tracks the primary a follower replicates from.
+type replicaState struct {
+	mutex   sync.Mutex
+	primary string
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func (r *replicaState) following() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.primary != ""
+}
+
+// ServeReplication accepts followers on addr until the Driver is closed. It
+// returns the address it listens on, which is useful when addr has port 0.
+func (d *Driver) ServeReplication(addr string) (net.Addr, error) {
+	if d.changes == nil {
+		return nil, errors.New("replication requires a change log; open the database with Options.ChangeLog")
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen for followers: %v", err)
+	}
+	if t := d.opts.ReplicationTLS; t != nil {
+		config, err := t.ServerConfig()
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		ln = tls.NewListener(ln, config)
+	}
+	d.log.Info("Serving replication on %s", ln.Addr())
+
+	d.wg.Add(2)
+	go func() {
+		defer d.wg.Done()
+		<-d.stop
+		ln.Close()
+	}()
+	go func() {
+		defer d.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				d.log.Error("Could not accept follower: %v", err)
+				continue
+			}
+
+			d.wg.Add(1)
+			go func() {
+				defer d.wg.Done()
+				d.serveFollower(conn)
+			}()
+		}
+	}()
+	return ln.Addr(), nil
+}
+
+// serveFollower streams changes to one follower until it disconnects or the
+// Driver is closed.
+func (d *Driver) serveFollower(conn net.Conn) {
+	defer conn.Close()
+	remote := conn.RemoteAddr()
+
+	conn.SetReadDeadline(time.Now().Add(replicationDialTimeout))
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		d.log.Error("Could not read replication request from %s: %v", remote, err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	var hello replicationHello
+	if err := json.Unmarshal(line, &hello); err != nil {
+		d.log.Error("Invalid replication request from %s: %v", remote, err)
+		return
+	}
+	if last := d.changes.lastSeq(); hello.Since > last {
+		d.log.Error("Follower %s is ahead of this primary (change %d, primary at %d); refusing to stream",
+			remote, hello.Since, last)
+		return
+	}
+
+	r, err := d.changes.reader(hello.Since)
+	if err != nil {
+		d.log.Error("Could not stream changes to %s: %v", remote, err)
+		return
+	}
+	defer r.close()
+
+	// Followers send nothing after their request, so a finished read means
+	// the follower hung up. Closing the connection on shutdown ends it too.
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(gone)
+	}()
+	go func() {
+		select {
+		case <-d.stop:
+			conn.Close()
+		case <-gone:
+		}
+	}()
+
+	d.log.Info("Follower %s connected, streaming changes after %d", remote, hello.Since)
+
+	w := bufio.NewWriter(conn)
+	enc := json.NewEncoder(w)
+	for {
+		change, err := r.next(gone)
+		if err == errStopped {
+			d.log.Info("Follower %s disconnected", remote)
+			return
+		}
+		if err != nil {
+			d.log.Error("Could not stream changes to %s: %v", remote, err)
+			return
+		}
+
+		if err := enc.Encode(change); err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			d.log.Error("Could not send change %d to %s: %v", change.Seq, remote, err)
+			return
+		}
+	}
+}
+
+// Follow makes the Driver a follower of the primary at addr: local writes
+// fail with ErrFollower while changes streamed from the primary are applied
+// in the background. After a lost connection it reconnects with backoff and
+// catches up from the last change it applied.
+func (d *Driver) Follow(addr string) error {
+	if d.changes == nil {
+		return errors.New("replication requires a change log; open the database with Options.ChangeLog")
+	}
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if d.cluster != nil {
+		return errors.New("a cluster node replicates through the cluster; it cannot follow a primary")
+	}
+
+	d.replica.mutex.Lock()
+	defer d.replica.mutex.Unlock()
+
+	if d.replica.primary != "" {
+		return fmt.Errorf("already following %s", d.replica.primary)
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	d.replica.primary, d.replica.stop, d.replica.done = addr, stop, done
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer close(done)
+		d.follow(addr, stop)
+	}()
+	return nil
+}
+
+// PromoteFollower stops following the primary and makes the Driver
+// writable, so it can take over as the primary, e.g. by calling
+// ServeReplication. Changes the old primary made that were not streamed
+// before promotion are not on this Driver.
+func (d *Driver) PromoteFollower() error {
+	d.replica.mutex.Lock()
+	defer d.replica.mutex.Unlock()
+
+	if d.replica.primary == "" {
+		return errors.New("database is not a replication follower")
+	}
+
+	close(d.replica.stop)
+	<-d.replica.done
+
+	d.log.Info("Promoted to primary at change %d, no longer following %s", d.changes.lastSeq(), d.replica.primary)
+	d.replica.primary, d.replica.stop, d.replica.done = "", nil, nil
+	return nil
+}
+
+// follow replicates from addr until stop or the Driver is closed.
+func (d *Driver) follow(addr string, stop <-chan struct{}) {
+	backoff := 100 * time.Millisecond
+	for {
+		applied, err := d.followOnce(addr, stop)
+
+		select {
+		case <-stop:
+			return
+		case <-d.stop:
+			return
+		default:
+		}
+
+		if applied > 0 {
+			backoff = 100 * time.Millisecond
+		}
+		d.log.Error("Replication from %s interrupted, retrying in %s: %v", addr, backoff, err)
+
+		select {
+		case <-stop:
+			return
+		case <-d.stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > replicationMaxBackoff {
+			backoff = replicationMaxBackoff
+		}
+	}
+}
+
+// dialPrimary connects to the primary, over TLS if configured.
+func (d *Driver) dialPrimary(addr string) (net.Conn, error) {
+	t := d.opts.ReplicationTLS
+	if t == nil {
+		return net.DialTimeout("tcp", addr, replicationDialTimeout)
+	}
+
+	config, err := t.ClientConfig(addr)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: replicationDialTimeout}
+	return tls.DialWithDialer(dialer, "tcp", addr, config)
+}
+
+// followOnce connects to the primary and applies the changes it streams
+// until the connection fails, returning how many it applied.
+func (d *Driver) followOnce(addr string, stop <-chan struct{}) (int, error) {
+	conn, err := d.dialPrimary(addr)
+	if err != nil {
+		return 0, fmt.Errorf("could not connect to primary: %v", err)
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+		case <-d.stop:
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	since := d.changes.lastSeq()
+	hello, _ := json.Marshal(replicationHello{Since: since})
+	if _, err := conn.Write(append(hello, '\n')); err != nil {
+		return 0, fmt.Errorf("could not send replication request: %v", err)
+	}
+	d.log.Info("Following %s from change %d", addr, since)
+
+	r := bufio.NewReader(conn)
+	applied := 0
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return applied, err
+		}
+
+		var change Change
+		if err := json.Unmarshal(line, &change); err != nil {
+			return applied, fmt.Errorf("invalid change from primary: %v", err)
+		}
+		if err := d.applyReplicated(change); err != nil {
+			return applied, fmt.Errorf("could not apply change %d: %v", change.Seq, err)
+		}
+		applied++
+	}
+}
+
+// applyReplicated applies a change streamed from the primary and records
+// it under the primary's sequence number.
+func (d *Driver) applyReplicated(change Change) error {
+	d.gate.RLock()
+	defer d.gate.RUnlock()
+
+	mutex := d.getOrCreateMutex(change.Collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	size := int64(-1)
+	if change.Op == OpWrite {
+		size = int64(len(change.Data))
+	}
+	release, err := d.reserve(change.Collection, change.Key, size, false)
+	if err != nil {
+		return err
+	}
+
+	switch change.Op {
+	case OpWrite:
+		err = d.store.put(change.Collection, change.Key, change.Data)
+	case OpDelete:
+		if err = d.store.delete(change.Collection, change.Key); errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+	default:
+		err = fmt.Errorf("unknown operation %q", change.Op)
+	}
+	if err != nil {
+		release()
+		return err
+	}
+
+	d.emit(change)
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// openReplica opens a database on dir that can serve or follow
+// replication.
+func openReplica(t *testing.T, dir string) *Driver {
+	t.Helper()
+	d, err := New(dir, &Options{Slog: openTestLogger(), ChangeLog: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// servePrimary opens a primary on dir serving replication on addr.
+func servePrimary(t *testing.T, dir, addr string) *Driver {
+	t.Helper()
+	d := openReplica(t, dir)
+	if _, err := d.ServeReplication(addr); err != nil {
+		d.Close()
+		t.Fatal(err)
+	}
+	return d
+}
+
+// waitForUser waits until d holds the user written under key.
+func waitForUser(t *testing.T, d *Driver, key string) {
+	t.Helper()
+	waitFor(t, "user "+key, func() bool {
+		user, err := d.Read("users", key)
+		return err == nil && user.Name == key
+	})
+}
+
+func writeUsers(t *testing.T, d *Driver, keys ...string) {
+	t.Helper()
+	for _, key := range keys {
+		if err := d.Write("users", key, User{Name: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReplicationCatchesUp(t *testing.T) {
+	addr := freeAddr(t)
+	primary := servePrimary(t, t.TempDir(), addr)
+	t.Cleanup(func() { primary.Close() })
+	writeUsers(t, primary, "u0", "u1", "u2")
+
+	follower := openReplica(t, t.TempDir())
+	t.Cleanup(func() { follower.Close() })
+	if err := follower.Follow(addr); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		waitForUser(t, follower, fmt.Sprint("u", i))
+	}
+
+	writeUsers(t, primary, "u3")
+	if err := primary.Delete("users", "u0"); err != nil {
+		t.Fatal(err)
+	}
+	waitForUser(t, follower, "u3")
+	waitFor(t, "the deletion of u0", func() bool {
+		_, err := follower.Read("users", "u0")
+		return err != nil
+	})
+
+	if err := follower.Write("users", "local", User{}); !errors.Is(err, ErrFollower) {
+		t.Errorf("write on a follower = %v, want ErrFollower", err)
+	}
+	if got, want := follower.changes.lastSeq(), primary.changes.lastSeq(); got != want {
+		t.Errorf("follower at change %d, primary at %d", got, want)
+	}
+}
+
+func TestReplicationResumesAfterGap(t *testing.T) {
+	addr, dir := freeAddr(t), t.TempDir()
+	primary := servePrimary(t, dir, addr)
+	writeUsers(t, primary, "u0")
+
+	follower := openReplica(t, t.TempDir())
+	t.Cleanup(func() { follower.Close() })
+	if err := follower.Follow(addr); err != nil {
+		t.Fatal(err)
+	}
+	waitForUser(t, follower, "u0")
+
+	// Changes made while the follower is cut off reach it once it
+	// reconnects.
+	if err := primary.Close(); err != nil {
+		t.Fatal(err)
+	}
+	primary = openReplica(t, dir)
+	t.Cleanup(func() { primary.Close() })
+	writeUsers(t, primary, "u1", "u2")
+	if _, err := primary.ServeReplication(addr); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForUser(t, follower, "u1")
+	waitForUser(t, follower, "u2")
+	writeUsers(t, primary, "u3")
+	waitForUser(t, follower, "u3")
+}
+
+func TestReplicationPromote(t *testing.T) {
+	addr := freeAddr(t)
+	primary := servePrimary(t, t.TempDir(), addr)
+	t.Cleanup(func() { primary.Close() })
+
+	follower := openReplica(t, t.TempDir())
+	t.Cleanup(func() { follower.Close() })
+	if err := follower.PromoteFollower(); err == nil {
+		t.Error("promoting a database that follows nothing succeeded")
+	}
+	if err := follower.Follow(addr); err != nil {
+		t.Fatal(err)
+	}
+	writeUsers(t, primary, "u0")
+	waitForUser(t, follower, "u0")
+
+	if err := follower.PromoteFollower(); err != nil {
+		t.Fatal(err)
+	}
+	if follower.replica.following() {
+		t.Error("a promoted follower still follows its old primary")
+	}
+	writeUsers(t, follower, "promoted")
+	writeUsers(t, primary, "u1")
+	if _, err := follower.Read("users", "u1"); err == nil {
+		t.Error("a promoted follower still applies changes from its old primary")
+	}
+
+	// The promoted follower serves the changes it has to a new follower.
+	newAddr := freeAddr(t)
+	if _, err := follower.ServeReplication(newAddr); err != nil {
+		t.Fatal(err)
+	}
+	next := openReplica(t, t.TempDir())
+	t.Cleanup(func() { next.Close() })
+	if err := next.Follow(newAddr); err != nil {
+		t.Fatal(err)
+	}
+	waitForUser(t, next, "u0")
+	waitForUser(t, next, "promoted")
+}
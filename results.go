@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Format is an encoding query results can be streamed in.
+type Format string
+
+const (
+	// FormatJSON is a JSON array of records.
+	FormatJSON Format = "json"
+	// FormatNDJSON is one JSON record per line.
+	FormatNDJSON Format = "ndjson"
+	// FormatCSV is a header row followed by a row per record, with the
+	// address split into its parts. Computed fields are left out. Text
+	// starting with =, +, -, @, a tab or a carriage return is prefixed with
+	// a single quote, so spreadsheets show it rather than run it as a
+	// formula; numbers are written as they are.
+	FormatCSV Format = "csv"
+)
+
+// csvHeader names the columns of FormatCSV.
+var csvHeader = []string{"key", "Name", "Age", "Company", "Street", "City", "State", "Country", "Pincode"}
+
+// Results is a query whose matches are streamed to a writer rather than
+// collected, so a large result set never needs to fit in memory.
+type Results struct {
+	d          *Driver
+	collection string
+	expr       string
+}
+
+// QueryResults returns the records of a collection matching the filter
+// expression, for streaming:
+//
+//	n, err := db.QueryResults("users", "Age > 30").Stream(w, FormatNDJSON)
+func (d *Driver) QueryResults(collection, expr string) *Results {
+	return &Results{d: d, collection: collection, expr: expr}
+}
+
+// Stream encodes the matching records to w in key order, as Records in
+// the JSON formats, a batch at a time, and returns how many it wrote.
+// Malformed expressions fail with a *QueryError before anything is written.
+func (r *Results) Stream(w io.Writer, format Format) (n int, err error) {
+	d, collection := r.d, r.collection
+	if err := d.checkNames(&collection); err != nil {
+		return 0, err
+	}
+	op := d.begin(opQuery, collection, "")
+	defer op.end(&err)
+
+	q, err := ParseQuery(r.expr)
+	if err != nil {
+		return 0, err
+	}
+	enc, err := newResultEncoder(w, format)
+	if err != nil {
+		return 0, err
+	}
+
+	err = d.scanBatches(collection, true, func(keys []string, data [][]byte, errs []error) error {
+		matched := make([]*User, len(keys))
+		forEach(len(keys), d.readParallelism(), func(i int) {
+			matched[i] = d.match(q, collection, keys[i], data[i], errs[i])
+		})
+		for i, user := range matched {
+			op.bytes += len(data[i])
+			if user == nil {
+				continue
+			}
+			if err := enc.encode(Record{Key: keys[i], Value: *user}); err != nil {
+				return fmt.Errorf("could not write results: %v", err)
+			}
+			n++
+		}
+		return enc.flush()
+	})
+	if err != nil {
+		return n, err
+	}
+	if err := enc.close(); err != nil {
+		return n, fmt.Errorf("could not write results: %v", err)
+	}
+	return n, nil
+}
+
+// resultEncoder writes records in a Format.
+type resultEncoder struct {
+	format Format
+	w      *bufio.Writer
+	csv    *csv.Writer
+	count  int
+}
+
+func newResultEncoder(w io.Writer, format Format) (*resultEncoder, error) {
+	e := &resultEncoder{format: format, w: bufio.NewWriter(w)}
+	switch format {
+	case FormatJSON:
+		_, err := e.w.WriteString("[")
+		return e, err
+	case FormatNDJSON:
+		return e, nil
+	case FormatCSV:
+		e.csv = csv.NewWriter(e.w)
+		return e, e.csv.Write(csvHeader)
+	}
+	return nil, fmt.Errorf("unknown result format %q", format)
+}
+
+func (e *resultEncoder) encode(r Record) error {
+	defer func() { e.count++ }()
+
+	if e.csv != nil {
+		u := r.Value
+		a := u.Address
+		return e.csv.Write([]string{
+			csvText(r.Key), csvText(u.Name), u.Age.String(), csvText(u.Company),
+			csvText(a.Street), csvText(a.City), csvText(a.State), csvText(a.Country), a.Pincode.String(),
+		})
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if e.format == FormatJSON && e.count > 0 {
+		if err := e.w.WriteByte(','); err != nil {
+			return err
+		}
+	}
+	if e.format == FormatJSON {
+		if err := e.w.WriteByte('\n'); err != nil {
+			return err
+		}
+	}
+	if _, err := e.w.Write(data); err != nil {
+		return err
+	}
+	if e.format == FormatNDJSON {
+		return e.w.WriteByte('\n')
+	}
+	return nil
+}
+
+// csvText escapes text a spreadsheet would take for a formula.
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// flush hands what was encoded so far to the writer, so a reader sees the
+// results a batch at a time.
+func (e *resultEncoder) flush() error {
+	if e.csv != nil {
+		e.csv.Flush()
+		if err := e.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return e.w.Flush()
+}
+
+func (e *resultEncoder) close() error {
+	if e.format == FormatJSON {
+		end := "]\n"
+		if e.count > 0 {
+			end = "\n]\n"
+		}
+		if _, err := e.w.WriteString(end); err != nil {
+			return err
+		}
+	}
+	return e.flush()
+}
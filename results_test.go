@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestStreamCSVEscapesFormulas(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+	user := User{Name: "=HYPERLINK(\"x\")", Age: json.Number("-3"), Company: "@corp", Address: Address{City: "Pune"}}
+	if err := d.Write("users", "+key", user); err != nil {
+		t.Fatal(err)
+	}
+
+	var b strings.Builder
+	if n, err := d.QueryResults("users", `Address.City == "Pune"`).Stream(&b, FormatCSV); err != nil || n != 1 {
+		t.Fatalf("Stream = %d, %v", n, err)
+	}
+	rows, err := csv.NewReader(strings.NewReader(b.String())).ReadAll()
+	if err != nil || len(rows) != 2 {
+		t.Fatalf("rows = %q, %v", rows, err)
+	}
+	want := []string{"'+key", "'=HYPERLINK(\"x\")", "-3", "'@corp", "", "Pune", "", "", ""}
+	if !slices.Equal(rows[1], want) {
+		t.Errorf("row = %q, want %q", rows[1], want)
+	}
+}
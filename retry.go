@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultRetryAttempts   = 3
+	defaultRetryBackoff    = 10 * time.Millisecond
+	defaultRetryMaxBackoff = time.Second
+)
+
+// RetryOptions retries filesystem operations failing with transient errors,
+// such as an interrupted call or a stale handle on a network filesystem,
+// rather than failing the Driver call. Short writes are completed. Syncs
+// are not retried, and a remove or rename found done on a retry succeeds.
+type RetryOptions struct {
+	// Attempts is how often an operation is tried in all. Defaults to 3.
+	Attempts int
+	// Backoff is the pause before the first retry, doubled before each
+	// further one up to MaxBackoff. They default to 10ms and a second.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Retryable reports whether an error is transient. Defaults to
+	// TransientError.
+	Retryable func(error) bool
+}
+
+// TransientError reports whether err is one retrying may overcome: EINTR,
+// a short write or, where the platform has them, EAGAIN and ESTALE.
+func TransientError(err error) bool {
+	return errors.Is(err, syscall.EINTR) || errors.Is(err, io.ErrShortWrite) || transientErrno(err)
+}
+
+// retryFS is an FS retrying the operations of the FS it wraps.
+type retryFS struct {
+	FS
+	opts RetryOptions
+	// retries counts the retries made and failures the operations that
+	// failed with a transient error on their last attempt.
+	retries  atomic.Uint64
+	failures atomic.Uint64
+}
+
+func newRetryFS(fsys FS, opts RetryOptions) *retryFS {
+	if opts.Attempts <= 0 {
+		opts.Attempts = defaultRetryAttempts
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = defaultRetryBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = defaultRetryMaxBackoff
+	}
+	if opts.Retryable == nil {
+		opts.Retryable = TransientError
+	}
+	return &retryFS{FS: fsys, opts: opts}
+}
+
+// do calls fn until it succeeds, fails with an error that is not
+// transient, or runs out of attempts.
+func (r *retryFS) do(fn func() error) error {
+	return r.doUnless(fn, nil)
+}
+
+// doUnless is do for operations that are not idempotent: an attempt that
+// reported a transient error may still have taken effect, so a retry
+// failing with an error done takes as the sign of that succeeds.
+func (r *retryFS) doUnless(fn func() error, done func(error) bool) error {
+	delay := r.opts.Backoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err != nil && attempt > 1 && done != nil && done(err) {
+			return nil
+		}
+		if err == nil || !r.opts.Retryable(err) {
+			return err
+		}
+		if attempt >= r.opts.Attempts {
+			r.failures.Add(1)
+			return err
+		}
+		r.retries.Add(1)
+		time.Sleep(delay)
+		delay = min(delay*2, r.opts.MaxBackoff)
+	}
+}
+
+func (r *retryFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	var file File
+	open := func() (err error) {
+		file, err = r.FS.OpenFile(name, flag, perm)
+		return err
+	}
+	var err error
+	if flag&os.O_EXCL != 0 {
+		// A retry could not tell a file created by an attempt that
+		// reported failing from one that was there before.
+		err = open()
+	} else {
+		err = r.do(open)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &retryFile{File: file, fs: r}, nil
+}
+
+func (r *retryFS) ReadFile(name string) (data []byte, err error) {
+	err = r.do(func() (err error) {
+		data, err = r.FS.ReadFile(name)
+		return err
+	})
+	return data, err
+}
+
+func (r *retryFS) ReadDir(name string) (entries []os.DirEntry, err error) {
+	err = r.do(func() (err error) {
+		entries, err = r.FS.ReadDir(name)
+		return err
+	})
+	return entries, err
+}
+
+func (r *retryFS) Stat(name string) (info os.FileInfo, err error) {
+	err = r.do(func() (err error) {
+		info, err = r.FS.Stat(name)
+		return err
+	})
+	return info, err
+}
+
+func (r *retryFS) MkdirAll(path string, perm os.FileMode) error {
+	return r.do(func() error { return r.FS.MkdirAll(path, perm) })
+}
+
+// Remove and Rename take a missing file on a retry to mean an earlier
+// attempt did the job: the files of a database belong to its Driver, which
+// never moves or removes a file from two calls at once.
+func (r *retryFS) Remove(name string) error {
+	return r.doUnless(func() error { return r.FS.Remove(name) }, os.IsNotExist)
+}
+
+func (r *retryFS) Rename(oldpath, newpath string) error {
+	return r.doUnless(func() error { return r.FS.Rename(oldpath, newpath) }, os.IsNotExist)
+}
+
+// Link and linkCount keep Options.Dedup working on a wrapped FS with hard
+// links; without them deduplicated writes fall back to plain files.
+func (r *retryFS) Link(oldname, newname string) error {
+	l, ok := r.FS.(linker)
+	if !ok {
+		return errors.New("the file system does not support hard links")
+	}
+	return r.doUnless(func() error { return l.Link(oldname, newname) }, os.IsExist)
+}
+
+func (r *retryFS) linkCount(name string) (n int, err error) {
+	l, ok := r.FS.(linker)
+	if !ok {
+		return 0, errors.New("the file system does not support hard links")
+	}
+	err = r.do(func() (err error) {
+		n, err = l.linkCount(name)
+		return err
+	})
+	return n, err
+}
+
+type retryFile struct {
+	File
+	fs *retryFS
+}
+
+func (f *retryFile) Read(p []byte) (n int, err error) {
+	err = f.fs.do(func() (err error) {
+		n, err = f.File.Read(p)
+		if n > 0 {
+			// Data was read; hand it over rather than retry.
+			return nil
+		}
+		return err
+	})
+	return n, err
+}
+
+// Write carries on until all of p is written, resuming after what earlier
+// calls wrote. Only calls writing nothing count as failed attempts.
+func (f *retryFile) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		err := f.fs.do(func() error {
+			n, err := f.File.Write(p[written:])
+			written += n
+			if n > 0 {
+				return nil
+			}
+			if err == nil {
+				err = io.ErrShortWrite
+			}
+			return err
+		})
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Sync is never retried: a failed sync may have dropped the data it was
+// to write, which a later sync that succeeds would not bring back.
+func (f *retryFile) Sync() error {
+	return f.File.Sync()
+}
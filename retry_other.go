@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+// transientErrno knows of no further transient errors on this platform.
+func transientErrno(err error) bool {
+	return false
+}
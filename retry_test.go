@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// flakyFS performs renames and removes, then reports them failed once with
+// a transient error, as a network filesystem may after a lost reply.
+type flakyFS struct {
+	FS
+	failed map[string]bool
+}
+
+func (f *flakyFS) flake(op, path string) error {
+	if f.failed[op+path] {
+		return nil
+	}
+	f.failed[op+path] = true
+	return &os.PathError{Op: op, Path: path, Err: syscall.EINTR}
+}
+
+func (f *flakyFS) Rename(oldpath, newpath string) error {
+	if err := f.FS.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	return f.flake("rename", oldpath)
+}
+
+func (f *flakyFS) Remove(name string) error {
+	if err := f.FS.Remove(name); err != nil {
+		return err
+	}
+	return f.flake("remove", name)
+}
+
+func TestRetryNonIdempotentOps(t *testing.T) {
+	fsys := &flakyFS{FS: OSFS{}, failed: make(map[string]bool)}
+	d, _ := openTestDB(t, &Options{FS: fsys, Retry: &RetryOptions{Backoff: 1}})
+
+	if err := d.Write("users", "alice", User{Name: "alice"}); err != nil {
+		t.Fatalf("write with a rename done but reported failed: %v", err)
+	}
+	if user, err := d.Read("users", "alice"); err != nil || user.Name != "alice" {
+		t.Errorf("read = %+v, %v", user, err)
+	}
+	if err := d.Delete("users", "alice"); err != nil {
+		t.Fatalf("delete with a remove done but reported failed: %v", err)
+	}
+}
+
+func TestRetryDoesNotRetrySync(t *testing.T) {
+	var syncs int
+	fsys := &FaultFS{FS: OSFS{}, Fault: func(op, path string) error {
+		if op == "sync" && strings.HasSuffix(path, ".json") {
+			if syncs++; syncs == 1 {
+				return syscall.EINTR
+			}
+		}
+		return nil
+	}}
+	d, _ := openTestDB(t, &Options{FS: fsys, Durability: DurabilityAlways, Retry: &RetryOptions{Backoff: 1}})
+
+	if err := d.Write("users", "alice", User{Name: "alice"}); err == nil {
+		t.Error("write succeeded although syncing it failed")
+	}
+}
@@ -0,0 +1,14 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// transientErrno reports whether err is EAGAIN or ESTALE, which network
+// filesystems return for handles invalidated by the server.
+func transientErrno(err error) bool {
+	return errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.ESTALE)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is an S3 bucket in memory, serving path-style requests for the
+// bucket "db" and listing at most two objects per page.
+type fakeS3 struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=key/") || !strings.Contains(auth, "/eu-west-1/s3/aws4_request") {
+		http.Error(w, "bad authorization "+auth, http.StatusForbidden)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	if r.Header.Get("X-Amz-Content-Sha256") != sha256Hex(body) {
+		http.Error(w, "bad payload hash", http.StatusBadRequest)
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/db")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	key = strings.TrimPrefix(key, "/")
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		s.list(w, r)
+	case r.Method == http.MethodPut:
+		s.objects[key] = body
+	case r.Method == http.MethodGet:
+		data, ok := s.objects[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, r.URL.Query().Get("prefix")) && key > r.URL.Query().Get("continuation-token") {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	type content struct{ Key string }
+	var result struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []content
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}
+	for i, key := range keys {
+		if i == 2 {
+			result.IsTruncated, result.NextContinuationToken = true, keys[i-1]
+			break
+		}
+		result.Contents = append(result.Contents, content{key})
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+// objectNames returns the names of the objects in the bucket.
+func (s *fakeS3) objectNames() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var names []string
+	for name := range s.objects {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// openFakeS3 returns an S3 store over a fakeS3, keeping objects under
+// prefix.
+func openFakeS3(t *testing.T, prefix string) (RemoteStore, *fakeS3) {
+	t.Helper()
+	bucket := &fakeS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(bucket)
+	t.Cleanup(server.Close)
+
+	store, err := NewS3Store(S3Options{
+		Endpoint:        server.URL + "/",
+		Region:          "eu-west-1",
+		Bucket:          "db",
+		Prefix:          prefix,
+		AccessKeyID:     "key",
+		SecretAccessKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, bucket
+}
+
+func TestS3Store(t *testing.T) {
+	store, bucket := openFakeS3(t, "prod/")
+	for _, name := range []string{"users/a.json", "users/b.json", "users/c d.json", "posts/x.json"} {
+		if err := store.Put(name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if names := bucket.objectNames(); len(names) != 4 || !strings.HasPrefix(names[0], "prod/") {
+		t.Errorf("objects = %v, want four under the prefix", names)
+	}
+
+	if data, err := store.Get("users/c d.json"); err != nil || string(data) != "users/c d.json" {
+		t.Errorf("Get = %q, %v", data, err)
+	}
+	if _, err := store.Get("users/missing.json"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Get of a missing object = %v, want os.ErrNotExist", err)
+	}
+
+	names, err := store.List("users/")
+	if want := []string{"users/a.json", "users/b.json", "users/c d.json"}; err != nil || !slices.Equal(names, want) {
+		t.Errorf("List across pages = %v, %v, want %v", names, err, want)
+	}
+
+	if err := store.Delete("users/a.json"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("users/a.json"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Get after Delete = %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestSyncToS3(t *testing.T) {
+	store, bucket := openFakeS3(t, "")
+	d, dir := openTestDB(t, nil)
+	writeUsers(t, d, "ann")
+	d.Close()
+
+	// The records written before sync is configured are uploaded first,
+	// then every change.
+	d, err := New(dir, &Options{Slog: openTestLogger(), ChangeLog: true, Sync: &SyncOptions{Remote: store}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	writeUsers(t, d, "bob", "cat")
+	if err := d.Delete("users", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the changes to be synced", func() bool {
+		names := bucket.objectNames()
+		return slices.Contains(names, "users/cat.json") && !slices.Contains(names, "users/bob.json")
+	})
+
+	restored, err := RestoreFromRemote(store, t.TempDir(), &Options{Slog: openTestLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	for _, key := range []string{"ann", "cat"} {
+		if user, err := restored.Read("users", key); err != nil || user.Name != key {
+			t.Errorf("restored %s = %+v, %v", key, user, err)
+		}
+	}
+	if _, err := restored.Read("users", "bob"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("deleted bob restored: %v", err)
+	}
+}
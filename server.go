@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// HandlerOptions configures the HTTP API returned by Driver.Handler.
+type HandlerOptions struct {
+	// Obfuscator maps record keys to the IDs used in URLs and responses.
+	// Keys are exposed as they are if nil.
+	Obfuscator KeyObfuscator
+	// Policy restricts the API to authenticated clients with access to the
+	// collection. Everything is allowed if nil.
+	Policy *Policy
+	// SessionWait bounds how long a read sent with a session token waits
+	// for the database to catch up. Defaults to five seconds.
+	SessionWait time.Duration
+}
+
+// Record is a keyed record as exchanged over the HTTP API and by
+// Export and Import.
+type Record struct {
+	Key   string `json:"key"`
+	Value User   `json:"value"`
+	// Revision identifies the content the record was read with.
+	Revision string `json:"revision,omitempty"`
+}
+
+// Handler serves the database over HTTP:
+//
+//	GET    /collections/{collection}?q=expr  list (optionally filtered) records
+//	GET    /collections/{collection}/watch   stream changes as server-sent events
+//	GET    /collections/{collection}/{id}    read a record
+//	PUT    /collections/{collection}/{id}    write a record; only create it,
+//	                                         or fail with 412, given
+//	                                         If-None-Match: *
+//	DELETE /collections/{collection}/{id}    delete a record
+//	POST   /collections/{collection}/{id}/merge  merge a CRDT state, returning
+//	                                             the merged state and its value
+//	GET    /collections/{collection}/{id}/events?since=seq  the events of a
+//	                                             key of an event sourced
+//	                                             collection after seq
+//	GET    /healthz                          the Health report, with 503 when
+//	                                         the database is failing
+//
+// Errors are returned as {"error": "..."}; malformed queries additionally
+// carry the structured QueryError under "query". With a Policy, GET needs
+// read access to the collection and the other methods write access;
+// /healthz is open to all. A
+// record keyed "watch" cannot be read by ID; it is listed as usual.
+//
+// With a change log or a cluster, writes return a session token in the
+// X-Session-Token header. Reads sent with it wait until the database has
+// applied that write, or fail with 503, so a client reading from a
+// follower sees its own writes.
+func (d *Driver) Handler(opts HandlerOptions) http.Handler {
+	if opts.Obfuscator == nil {
+		opts.Obfuscator = plainKeys{}
+	}
+	s := &server{d: d, opts: opts}
+
+	mux := http.NewServeMux()
+	p := opts.Policy
+	mux.HandleFunc("GET /collections/{collection}", p.guard(d, AccessRead, s.list))
+	mux.HandleFunc("GET /collections/{collection}/watch", p.guard(d, AccessRead, s.watch))
+	mux.HandleFunc("GET /collections/{collection}/{id}", p.guard(d, AccessRead, s.read))
+	mux.HandleFunc("PUT /collections/{collection}/{id}", p.guard(d, AccessWrite, s.write))
+	mux.HandleFunc("DELETE /collections/{collection}/{id}", p.guard(d, AccessWrite, s.delete))
+	mux.HandleFunc("POST /collections/{collection}/{id}/merge", p.guard(d, AccessWrite, s.merge))
+	mux.HandleFunc("GET /collections/{collection}/{id}/events", p.guard(d, AccessRead, s.events))
+	mux.HandleFunc("GET /healthz", s.healthz)
+	return mux
+}
+
+type server struct {
+	d    *Driver
+	opts HandlerOptions
+}
+
+func (s *server) list(w http.ResponseWriter, r *http.Request) {
+	if !s.session(w, r) {
+		return
+	}
+	collection := r.PathValue("collection")
+	if err := s.d.checkNames(&collection); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var q *Query
+	if expr := r.URL.Query().Get("q"); expr != "" {
+		var err error
+		if q, err = ParseQuery(expr); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	records := []Record{}
+	err := s.d.scan(collection, func(key string, data []byte) error {
+		if q != nil {
+			if ok, err := q.Match(data); err != nil || !ok {
+				return nil
+			}
+		}
+		var user User
+		if err := json.Unmarshal(data, &user); err != nil {
+			return nil
+		}
+		s.d.compute(collection, &user)
+		records = append(records, Record{Key: s.opts.Obfuscator.Encode(key), Value: user})
+		return nil
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+func (s *server) read(w http.ResponseWriter, r *http.Request) {
+	if !s.session(w, r) {
+		return
+	}
+	key, err := s.opts.Obfuscator.Decode(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	user, err := s.d.ReadContext(r.Context(), r.PathValue("collection"), key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, Record{Key: r.PathValue("id"), Value: user})
+}
+
+func (s *server) events(w http.ResponseWriter, r *http.Request) {
+	if !s.session(w, r) {
+		return
+	}
+	key, err := s.opts.Obfuscator.Decode(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var since uint64
+	if v := r.URL.Query().Get("since"); v != "" {
+		if since, err = strconv.ParseUint(v, 10, 64); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "since must be a non-negative integer"})
+			return
+		}
+	}
+
+	events, err := s.d.ReadEvents(r.PathValue("collection"), key, since)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, events)
+}
+
+func (s *server) write(w http.ResponseWriter, r *http.Request) {
+	key, err := s.opts.Obfuscator.Decode(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var user User
+	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body: " + err.Error()})
+		return
+	}
+
+	write := func(collection, key string, user User) error {
+		return s.d.WriteContext(r.Context(), collection, key, user)
+	}
+	if r.Header.Get("If-None-Match") == "*" {
+		write = s.d.WriteIfAbsent
+	}
+	if err := write(r.PathValue("collection"), key, user); err != nil {
+		writeError(w, err)
+		return
+	}
+	s.d.compute(r.PathValue("collection"), &user)
+	s.setSession(w)
+	writeJSON(w, http.StatusOK, Record{Key: r.PathValue("id"), Value: user})
+}
+
+func (s *server) delete(w http.ResponseWriter, r *http.Request) {
+	key, err := s.opts.Obfuscator.Decode(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := s.d.DeleteContext(r.Context(), r.PathValue("collection"), key); err != nil {
+		writeError(w, err)
+		return
+	}
+	s.setSession(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) merge(w http.ResponseWriter, r *http.Request) {
+	key, err := s.opts.Obfuscator.Decode(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	state, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	collection := r.PathValue("collection")
+	merged, err := s.d.MergeCRDT(collection, key, state)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	value, err := s.d.ReadCRDT(collection, key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	s.setSession(w)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"key":   r.PathValue("id"),
+		"state": json.RawMessage(merged),
+		"value": value,
+	})
+}
+
+// writeError maps an error to a status code and JSON body.
+func writeError(w http.ResponseWriter, err error) {
+	body := map[string]interface{}{"error": err.Error()}
+
+	status := http.StatusInternalServerError
+	var qe *QueryError
+	switch {
+	case errors.As(err, &qe):
+		status = http.StatusBadRequest
+		body["query"] = qe
+	case errors.Is(err, ErrInvalidCRDT), errors.Is(err, ErrInvalidSession), errors.Is(err, ErrInvalidName):
+		status = http.StatusBadRequest
+	case errors.Is(err, ErrDanglingReference), errors.Is(err, ErrReferenced):
+		status = http.StatusConflict
+	case errors.Is(err, ErrConditionFailed):
+		status = http.StatusPreconditionFailed
+	case errors.Is(err, ErrQuotaExceeded):
+		status = http.StatusInsufficientStorage
+	case errors.Is(err, ErrBehind), errors.Is(err, ErrNotLeader):
+		status = http.StatusServiceUnavailable
+	case errors.Is(err, ErrNotReplicated), errors.Is(err, ErrNotClustered):
+		status = http.StatusNotImplemented
+	case errors.Is(err, ErrUnauthenticated):
+		status = http.StatusUnauthorized
+		w.Header().Set("WWW-Authenticate", `Basic realm="db"`)
+	case errors.Is(err, ErrForbidden):
+		status = http.StatusForbidden
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, ErrInvalidID):
+		status = http.StatusNotFound
+		body["error"] = "not found"
+	}
+	writeJSON(w, status, body)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
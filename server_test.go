@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHandlerRejectsPathTraversal(t *testing.T) {
+	d, dir := openTestDB(t, nil)
+	if err := d.Write("users", "alice", User{Name: "Alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A collection beside the database directory that must stay out of reach.
+	outside := filepath.Join(filepath.Dir(dir), "outside")
+	if err := os.MkdirAll(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "leak.json"), []byte(`{"Name":"LEAKED"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h := d.Handler(HandlerOptions{})
+	for _, tc := range []struct{ method, path string }{
+		{"GET", "/collections/..%2Foutside"},
+		{"GET", "/collections/..%2F..%2F..%2Ftmp"},
+		{"GET", "/collections/a%2Fb"},
+		{"GET", "/collections/..%2Foutside/watch"},
+		{"GET", "/collections/users/..%2F..%2Foutside%2Fleak"},
+		{"GET", "/collections/users/a%2Fb"},
+		{"GET", "/collections/..%2Foutside/leak"},
+		{"PUT", "/collections/users/..%2Fescaped"},
+		{"PUT", "/collections/..%2Fescaped/x"},
+		{"DELETE", "/collections/users/..%2Fusers%2Falice"},
+	} {
+		var body *strings.Reader
+		if tc.method == "PUT" {
+			body = strings.NewReader(`{"Name":"Mallory"}`)
+		} else {
+			body = strings.NewReader("")
+		}
+		req := httptest.NewRequest(tc.method, tc.path, body)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s %s: status %d, want %d (%s)", tc.method, tc.path, rec.Code, http.StatusBadRequest, rec.Body)
+		}
+		if strings.Contains(rec.Body.String(), "LEAKED") {
+			t.Errorf("%s %s: leaked a file outside the database: %s", tc.method, tc.path, rec.Body)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "escaped")); err == nil {
+		t.Error("a write escaped the database directory")
+	}
+	if _, err := d.Read("users", "alice"); err != nil {
+		t.Errorf("record was deleted through a traversal: %v", err)
+	}
+}
+
+func TestHandlerListsCollection(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+	for _, key := range []string{"alice", "bob"} {
+		if err := d.Write("users", key, User{Name: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	d.Handler(HandlerOptions{}).ServeHTTP(rec, httptest.NewRequest("GET", "/collections/users", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	for _, key := range []string{`"alice"`, `"bob"`} {
+		if !strings.Contains(rec.Body.String(), key) {
+			t.Errorf("listing lacks %s: %s", key, rec.Body)
+		}
+	}
+}
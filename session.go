@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// SessionHeader carries session tokens over the HTTP API. Writes return the
+// token of the change they made; a read sent with a token waits until the
+// database has applied that change, so a client reading from a follower
+// sees its own writes to the primary.
+const SessionHeader = "X-Session-Token"
+
+// defaultSessionWait bounds how long a read waits for a follower to catch
+// up with a session token.
+const defaultSessionWait = 5 * time.Second
+
+// ErrBehind is returned by reads that waited too long for the database to
+// catch up with a session token.
+var ErrBehind = errors.New("database has not caught up with the session")
+
+// ErrInvalidSession is returned for session tokens the Driver did not issue.
+var ErrInvalidSession = errors.New("invalid session token")
+
+// SessionToken returns a token for every change made so far, or "" if the
+// database can issue none. Tokens need Options.ChangeLog, whose sequence
+// numbers a follower shares with its primary, or Options.Cluster, where
+// they are Raft log indexes every node shares.
+func (d *Driver) SessionToken() string {
+	last, _, ok := d.sessionProgress()
+	if !ok {
+		return ""
+	}
+	return strconv.FormatUint(last, 10)
+}
+
+// WaitSession waits until the database has applied every change the token
+// covers, failing with ErrBehind if ctx is done first. Without a change log
+// or a cluster there is nothing to wait for.
+func (d *Driver) WaitSession(ctx context.Context, token string) error {
+	if _, _, ok := d.sessionProgress(); !ok || token == "" {
+		return nil
+	}
+	seq, err := strconv.ParseUint(token, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w %q", ErrInvalidSession, token)
+	}
+
+	for {
+		last, changed, _ := d.sessionProgress()
+		if last >= seq {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-d.stop:
+			return fmt.Errorf("%w: database closed", ErrBehind)
+		case <-ctx.Done():
+			return fmt.Errorf("%w: at change %d, session is at %d", ErrBehind, last, seq)
+		}
+	}
+}
+
+// sessionProgress returns how far the database has applied changes and a
+// channel closed once it moves on: the Raft log on a cluster node, else the
+// change log. ok is false without either.
+func (d *Driver) sessionProgress() (last uint64, changed <-chan struct{}, ok bool) {
+	switch {
+	case d.cluster != nil:
+		last, changed = d.cluster.wait()
+		return last, changed, true
+	case d.changes != nil:
+		changed = d.changes.wait()
+		return d.changes.lastSeq(), changed, true
+	}
+	return 0, nil, false
+}
+
+// session waits for the session token of a read, if any, writing the error
+// response and returning false if the database does not catch up in time.
+func (s *server) session(w http.ResponseWriter, r *http.Request) bool {
+	token := r.Header.Get(SessionHeader)
+	if token == "" {
+		return true
+	}
+
+	wait := s.opts.SessionWait
+	if wait <= 0 {
+		wait = defaultSessionWait
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+
+	if err := s.d.WaitSession(ctx, token); err != nil {
+		writeError(w, err)
+		return false
+	}
+	return true
+}
+
+// setSession hands the client the session token covering its write.
+func (s *server) setSession(w http.ResponseWriter) {
+	if token := s.d.SessionToken(); token != "" {
+		w.Header().Set(SessionHeader, token)
+	}
+}
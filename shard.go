@@ -0,0 +1,384 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ShardedStore is a Store spreading the records of every collection across
+// several directories, typically on different disks. Each record lives in
+// the shard that ranks highest for it under rendezvous hashing, so adding a
+// shard only moves the records that now rank highest there.
+type ShardedStore struct {
+	mutex  sync.RWMutex
+	shards []*fileStorage
+	// newShard returns the file engine of a shard directory.
+	newShard func(dir string) *fileStorage
+	// locks holds the directory locks of the shards, when they are locked
+	// like the database directory.
+	locks    []*dirLock
+	locking  bool
+	readOnly bool
+}
+
+// NewShardedStore returns a ShardedStore over the given directories,
+// creating them if needed. Records already in a directory are found where
+// they are until Rebalance moves them to the shard they belong in.
+func NewShardedStore(dirs ...string) (*ShardedStore, error) {
+	s := &ShardedStore{newShard: func(dir string) *fileStorage {
+		return &fileStorage{dir: dir, fs: OSFS{}}
+	}}
+	return s, s.addShards(dirs)
+}
+
+func (s *ShardedStore) addShards(dirs []string) error {
+	if len(dirs) == 0 {
+		return fmt.Errorf("a sharded store needs at least one directory")
+	}
+	for _, dir := range dirs {
+		if err := s.addShard(dir); err != nil {
+			s.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ShardedStore) addShard(dir string) error {
+	dir = filepath.Clean(dir)
+	if slices.ContainsFunc(s.shards, func(shard *fileStorage) bool { return shard.dir == dir }) {
+		return fmt.Errorf("directory %s is already a shard", dir)
+	}
+	shard := s.newShard(dir)
+	if err := shard.fs.MkdirAll(dir, shard.layout.dirMode()); err != nil {
+		return fmt.Errorf("could not create shard directory: %v", err)
+	}
+	if s.locking {
+		lock, err := lockDir(dir, s.readOnly)
+		if err != nil {
+			return fmt.Errorf("could not lock shard %s: %w", dir, err)
+		}
+		s.locks = append(s.locks, lock)
+	}
+	s.shards = append(s.shards, shard)
+	return nil
+}
+
+// home returns the shard a record belongs in among shards.
+func home(shards []*fileStorage, collection, key string) *fileStorage {
+	var best *fileStorage
+	var bestScore uint64
+	for _, shard := range shards {
+		h := fnv.New64a()
+		h.Write([]byte(shard.dir))
+		h.Write([]byte{0})
+		h.Write([]byte(collection))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		if score := mix(h.Sum64()); best == nil || score > bestScore {
+			best, bestScore = shard, score
+		}
+	}
+	return best
+}
+
+// mix spreads the bits of an FNV hash, whose high bits barely change with
+// the last bytes hashed, so every shard gets its share of similar keys.
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// Dirs returns the directories of the shards.
+func (s *ShardedStore) Dirs() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	dirs := make([]string, len(s.shards))
+	for i, shard := range s.shards {
+		dirs[i] = shard.dir
+	}
+	return dirs
+}
+
+func (s *ShardedStore) Put(collection, key string, data []byte) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return home(s.shards, collection, key).put(collection, key, data)
+}
+
+func (s *ShardedStore) Get(collection, key string) ([]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return home(s.shards, collection, key).get(collection, key)
+}
+
+func (s *ShardedStore) Delete(collection, key string) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return home(s.shards, collection, key).delete(collection, key)
+}
+
+// List returns the keys of a collection across all shards.
+func (s *ShardedStore) List(collection string) ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	seen := make(map[string]bool)
+	var keys []string
+	found := false
+	for _, shard := range s.shards {
+		shardKeys, err := shard.keys(collection)
+		if err != nil {
+			if _, statErr := os.Stat(filepath.Join(shard.dir, collection)); os.IsNotExist(statErr) {
+				continue
+			}
+			return nil, err
+		}
+		found = true
+		for _, key := range shardKeys {
+			// A record being moved by AddShard is briefly in two shards.
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("could not read collection %s: %w", collection, os.ErrNotExist)
+	}
+	return keys, nil
+}
+
+// Collections lists the collections held by any shard.
+func (s *ShardedStore) Collections() ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var collections []string
+	for _, shard := range s.shards {
+		entries, err := os.ReadDir(shard.dir)
+		if err != nil {
+			return nil, fmt.Errorf("could not read shard %s: %v", shard.dir, err)
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() && !strings.HasPrefix(name, ".") && !slices.Contains(collections, name) {
+				collections = append(collections, name)
+			}
+		}
+	}
+	sort.Strings(collections)
+	return collections, nil
+}
+
+// Close releases the locks on the shard directories, if any.
+func (s *ShardedStore) Close() error {
+	var firstErr error
+	for _, lock := range s.locks {
+		if err := lock.release(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.locks = nil
+	return firstErr
+}
+
+func (s *ShardedStore) setDurability(durability Durability) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, shard := range s.shards {
+		shard.setDurability(durability)
+	}
+}
+
+func (s *ShardedStore) syncDirty() error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var firstErr error
+	for _, shard := range s.shards {
+		if err := shard.syncDirty(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// shardMove is a record to move from one shard to another.
+type shardMove struct {
+	collection, key string
+	from, to        *fileStorage
+}
+
+// misplaced lists the records that do not live in their home among shards.
+func (s *ShardedStore) misplaced(shards []*fileStorage) ([]shardMove, error) {
+	collections, err := s.Collections()
+	if err != nil {
+		return nil, err
+	}
+
+	var moves []shardMove
+	for _, shard := range s.shards {
+		for _, collection := range collections {
+			keys, err := shard.keys(collection)
+			if err != nil {
+				if _, statErr := os.Stat(filepath.Join(shard.dir, collection)); os.IsNotExist(statErr) {
+					continue
+				}
+				return nil, err
+			}
+			for _, key := range keys {
+				if to := home(shards, collection, key); to != shard {
+					moves = append(moves, shardMove{collection, key, shard, to})
+				}
+			}
+		}
+	}
+	return moves, nil
+}
+
+// copyTo copies the records of moves to their new shards. Unless overwrite
+// is set, a record already in its new shard is left as it is there.
+func copyTo(moves []shardMove, overwrite bool) error {
+	for _, m := range moves {
+		if !overwrite {
+			if _, err := m.to.size(m.collection, m.key); err == nil {
+				continue
+			}
+		}
+		data, err := m.from.get(m.collection, m.key)
+		if err != nil {
+			return fmt.Errorf("could not read record %s of collection %s: %v", m.key, m.collection, err)
+		}
+		if err := m.to.put(m.collection, m.key, data); err != nil {
+			return fmt.Errorf("could not move record %s of collection %s to %s: %v", m.key, m.collection, m.to.dir, err)
+		}
+	}
+	return nil
+}
+
+// removeFrom deletes the records of moves from their old shards.
+func removeFrom(moves []shardMove) error {
+	for _, m := range moves {
+		if err := m.from.delete(m.collection, m.key); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("could not remove moved record %s of collection %s: %v", m.key, m.collection, err)
+		}
+	}
+	return nil
+}
+
+// Rebalance moves every record not in the shard it belongs in there, for
+// instance after a shard was added while the database was closed. Where a
+// record is in both, the one in the shard it belongs in is kept. It returns
+// the number of records moved. Writes must not run meanwhile.
+func (s *ShardedStore) Rebalance() (int, error) {
+	moves, err := s.misplaced(s.shards)
+	if err != nil {
+		return 0, err
+	}
+	if err := copyTo(moves, false); err != nil {
+		return 0, err
+	}
+	return len(moves), removeFrom(moves)
+}
+
+// AddShard adds a directory to the store and moves the records that belong
+// in it there, returning how many moved. Reads keep finding every record
+// while it runs; writes must not run meanwhile.
+func (s *ShardedStore) AddShard(dir string) (int, error) {
+	grown := &ShardedStore{shards: slices.Clone(s.shards), newShard: s.newShard, locking: s.locking, readOnly: s.readOnly}
+	if err := grown.addShard(dir); err != nil {
+		return 0, err
+	}
+	grown.shards[len(grown.shards)-1].setDurability(s.durability())
+
+	// Copy first and only then route to the new shard, so reads find each
+	// record in its old shard until they are sent to the new one.
+	moves, err := s.misplaced(grown.shards)
+	if err == nil {
+		err = copyTo(moves, true)
+	}
+	if err != nil {
+		grown.Close()
+		return 0, err
+	}
+
+	s.mutex.Lock()
+	s.shards = grown.shards
+	s.locks = append(s.locks, grown.locks...)
+	s.mutex.Unlock()
+
+	return len(moves), removeFrom(moves)
+}
+
+// durability returns the durability level of the shards.
+func (s *ShardedStore) durability() Durability {
+	if len(s.shards) == 0 {
+		return DurabilityOS
+	}
+	return s.shards[0].durability
+}
+
+// openShards opens the ShardedStore of Options.Shards, with every shard
+// stored and locked like the database directory, and moves records left in
+// the wrong shard.
+func (d *Driver) openShards() (*ShardedStore, error) {
+	s := &ShardedStore{newShard: d.newFileStorage, locking: onDisk(d.fs), readOnly: d.opts.ReadOnly}
+	if err := s.addShards(d.opts.Shards); err != nil {
+		return nil, err
+	}
+	if d.opts.ReadOnly {
+		return s, nil
+	}
+	moved, err := s.Rebalance()
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("could not rebalance shards: %v", err)
+	}
+	if moved > 0 {
+		d.log.Info("Rebalanced shards, moved %d records", moved)
+	}
+	return s, nil
+}
+
+// AddShard adds a directory to the ShardedStore the database is kept in and
+// moves the records that belong there, holding writes back meanwhile.
+func (d *Driver) AddShard(dir string) error {
+	if err := d.writable(); err != nil {
+		return err
+	}
+	s, ok := d.store.(externalStore)
+	if !ok {
+		return fmt.Errorf("the database is not sharded")
+	}
+	sharded, ok := s.Store.(*ShardedStore)
+	if !ok {
+		return fmt.Errorf("the database is not sharded")
+	}
+
+	resume := d.Pause()
+	defer resume()
+
+	moved, err := sharded.AddShard(dir)
+	if err != nil {
+		return fmt.Errorf("could not add shard %s: %v", dir, err)
+	}
+	d.log.Info("Added shard %s, moved %d records to it", dir, moved)
+	return nil
+}
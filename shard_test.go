@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestShards(t *testing.T) {
+	tests := []struct {
+		name string
+		add  func(t *testing.T, d *Driver, dir string, dirs []string) *Driver
+	}{
+		{"AddShard", func(t *testing.T, d *Driver, _ string, dirs []string) *Driver {
+			if err := d.AddShard(dirs[len(dirs)-1]); err != nil {
+				t.Fatal(err)
+			}
+			return d
+		}},
+		{"reopened with another shard", func(t *testing.T, d *Driver, dir string, dirs []string) *Driver {
+			d.Close()
+			d, err := New(dir, &Options{Shards: dirs, Slog: openTestLogger()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { d.Close() })
+			return d
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dirs := []string{t.TempDir(), t.TempDir()}
+			d, dir := openTestDB(t, &Options{Shards: dirs})
+			const n = 60
+			for i := 0; i < n; i++ {
+				if err := d.Write("users", fmt.Sprint("user", i), User{Name: fmt.Sprint(i)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			checkShards(t, d, n)
+
+			dirs = append(dirs, t.TempDir())
+			d = tt.add(t, d, dir, dirs)
+			checkShards(t, d, n)
+		})
+	}
+}
+
+// checkShards checks that each of the n records of users is in the shard
+// it belongs in, and only there, and that every shard holds some.
+func checkShards(t *testing.T, d *Driver, n int) {
+	t.Helper()
+	sharded := d.store.(externalStore).Store.(*ShardedStore)
+	held := make(map[string]int)
+	for i := 0; i < n; i++ {
+		key := fmt.Sprint("user", i)
+		if user, err := d.Read("users", key); err != nil || user.Name != fmt.Sprint(i) {
+			t.Errorf("read %s = %+v, %v", key, user, err)
+		}
+		want := home(sharded.shards, "users", key)
+		for _, shard := range sharded.shards {
+			_, err := os.Stat(shard.layout.recordPath(shard.dir, "users", key))
+			switch {
+			case shard == want && err != nil:
+				t.Errorf("%s is not in its shard %s: %v", key, shard.dir, err)
+			case shard != want && err == nil:
+				t.Errorf("%s is also in shard %s", key, shard.dir)
+			}
+		}
+		held[want.dir]++
+	}
+	for _, shard := range sharded.shards {
+		if held[shard.dir] == 0 {
+			t.Errorf("shard %s holds no records", shard.dir)
+		}
+	}
+}
+
+func TestShardsStoredLikeDatabase(t *testing.T) {
+	shard := t.TempDir()
+	d, _ := openTestDB(t, &Options{
+		Shards:    []string{shard},
+		Checksums: true,
+		Layout:    &LayoutOptions{Extension: ".rec", FanOut: 1},
+	})
+	if err := d.Write("users", "ada", User{Name: "Ada"}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := d.store.(externalStore).Store.(*ShardedStore).shards[0]
+	path := s.layout.recordPath(shard, "users", "ada")
+	if filepath.Ext(path) != ".rec" || filepath.Dir(filepath.Dir(path)) != filepath.Join(shard, "users") {
+		t.Errorf("record path = %s, want a .rec file one level under the collection", path)
+	}
+	for _, file := range []string{path, path + checksumExt} {
+		if _, err := os.Stat(file); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, err := New(t.TempDir(), &Options{Shards: []string{shard}, Slog: openTestLogger()}); !errors.Is(err, ErrLocked) {
+		t.Errorf("opening a shard held by another database = %v, want ErrLocked", err)
+	}
+}
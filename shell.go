@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const shellHelp = `Commands:
+  ls                          list collections
+  ls collection               list the keys of a collection
+  get collection key [field]  print a record, or the field at a dot path such as Address.City
+  put collection key json     write a record; the JSON may span several lines
+  set collection key field v  set the field at a dot path of a record, e.g. set users bob Address.City Pune
+  rm collection key           delete a record
+  query collection filter     print the records matching a filter, e.g. Age > 30
+  format text|table|json|jsonl|yaml|go-template=TEMPLATE
+                              choose how records are printed (default json)
+  help                        show this help
+  exit                        leave the shell (or Ctrl-D)
+
+Keys containing spaces can be quoted: get users "alice smith"
+`
+
+var shellCommands = []string{"exit", "format", "get", "help", "ls", "put", "query", "quit", "rm", "set"}
+
+// shell is an interactive session on an open database.
+type shell struct {
+	d      *Driver
+	editor *lineEditor
+	out    io.Writer
+	format string
+}
+
+// runShell starts an interactive shell: dbcli shell [flags]
+func runShell(args []string) int {
+	flags := flag.NewFlagSet("shell", flag.ContinueOnError)
+	db := addDBFlags(flags)
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(positional) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: dbcli shell [flags]")
+		return exitUsage
+	}
+
+	driver, err := db.open()
+	if err != nil {
+		return fail(err)
+	}
+	defer driver.Close()
+
+	historyPath := ""
+	if home, err := os.UserHomeDir(); err == nil {
+		historyPath = filepath.Join(home, ".dbcli_history")
+	}
+
+	s := &shell{d: driver, out: os.Stdout, format: formatJSON}
+	s.editor = newLineEditor(os.Stdin, os.Stdout, historyPath)
+	s.editor.complete = s.complete
+
+	if s.editor.terminal {
+		fmt.Fprintf(s.out, "dbcli %s shell on %s. Type help for commands.\n", version, *db.dir)
+	}
+	return s.run()
+}
+
+func (s *shell) run() int {
+	code := exitOK
+	for {
+		line, err := s.editor.readLine("db> ")
+		if errors.Is(err, errInterrupt) {
+			continue
+		}
+		if err == io.EOF {
+			return code
+		}
+		if err != nil {
+			return fail(err)
+		}
+
+		words, rest := splitWords(line, 1)
+		if len(words) == 0 {
+			continue
+		}
+
+		if words[0] == "put" {
+			if line, err = s.readJSON(line); errors.Is(err, errInterrupt) {
+				continue
+			} else if err != nil {
+				return code
+			}
+			words, rest = splitWords(line, 1)
+		}
+		if s.editor.terminal {
+			s.editor.addHistory(line)
+		}
+
+		if words[0] == "exit" || words[0] == "quit" {
+			return code
+		}
+		if err := s.exec(words[0], rest); err != nil {
+			fmt.Fprintln(s.out, "error:", err)
+			code = exitFailure
+		} else {
+			code = exitOK
+		}
+	}
+}
+
+// readJSON keeps reading continuation lines until the JSON of a put
+// command is complete, returning the whole command as one line.
+func (s *shell) readJSON(line string) (string, error) {
+	for {
+		_, document := splitWords(line, 3)
+		if !jsonIncomplete(document) {
+			return line, nil
+		}
+
+		more, err := s.editor.readLine("...> ")
+		if err != nil {
+			return "", err
+		}
+		line += " " + more
+	}
+}
+
+func (s *shell) exec(command, rest string) error {
+	switch command {
+	case "help":
+		fmt.Fprint(s.out, shellHelp)
+		return nil
+	case "format":
+		format := strings.TrimSpace(rest)
+		if err := checkFormat(format); err != nil {
+			return err
+		}
+		s.format = format
+		return nil
+	case "ls":
+		return s.list(rest)
+	case "get":
+		words, field := splitWords(rest, 2)
+		if len(words) != 2 {
+			return errors.New("usage: get collection key [field]")
+		}
+		if field != "" {
+			value, err := s.d.ReadField(words[0], words[1], field)
+			if err != nil {
+				return err
+			}
+			return printValue(s.out, s.format, value)
+		}
+		user, err := s.d.Read(words[0], words[1])
+		if err != nil {
+			return err
+		}
+		return printUsers(s.out, s.format, []User{user}, true)
+	case "put":
+		words, document := splitWords(rest, 2)
+		if len(words) != 2 || document == "" {
+			return errors.New("usage: put collection key json")
+		}
+		var user User
+		if err := json.Unmarshal([]byte(document), &user); err != nil {
+			return fmt.Errorf("invalid JSON: %v", err)
+		}
+		if err := s.d.Write(words[0], words[1], user); err != nil {
+			return err
+		}
+		fmt.Fprintf(s.out, "wrote %s/%s\n", words[0], words[1])
+		return nil
+	case "set":
+		words, value := splitWords(rest, 3)
+		if len(words) != 3 || value == "" {
+			return errors.New("usage: set collection key field value")
+		}
+		return s.set(words[0], words[1], words[2], value)
+	case "rm":
+		words, _ := splitWords(rest, 2)
+		if len(words) != 2 {
+			return errors.New("usage: rm collection key")
+		}
+		if err := s.d.Delete(words[0], words[1]); err != nil {
+			return err
+		}
+		fmt.Fprintf(s.out, "deleted %s/%s\n", words[0], words[1])
+		return nil
+	case "query":
+		words, filter := splitWords(rest, 1)
+		if len(words) != 1 || filter == "" {
+			return errors.New("usage: query collection filter")
+		}
+		users, err := s.d.Query(words[0], filter)
+		var queryErr *QueryError
+		if errors.As(err, &queryErr) {
+			return fmt.Errorf("%v\n%s", queryErr, queryErr.Pointer())
+		}
+		if err != nil {
+			return err
+		}
+		return printUsers(s.out, s.format, users, false)
+	}
+	return fmt.Errorf("unknown command %q, type help for a list", command)
+}
+
+// set changes one field of a record, creating the record if needed.
+func (s *shell) set(collection, key, field, value string) error {
+	data, err := s.d.readRaw(collection, key)
+	if errors.Is(err, os.ErrNotExist) {
+		data, err = []byte("{}"), nil
+	}
+	if err != nil {
+		return err
+	}
+
+	user, err := updateUser(data, [][2]string{{field, value}})
+	if err != nil {
+		return err
+	}
+	if err := s.d.Write(collection, key, user); err != nil {
+		return err
+	}
+	fmt.Fprintf(s.out, "wrote %s/%s\n", collection, key)
+	return nil
+}
+
+func (s *shell) list(rest string) error {
+	words, _ := splitWords(rest, 1)
+
+	var names []string
+	var err error
+	if len(words) == 0 {
+		names, err = s.d.Collections()
+	} else {
+		names, err = s.d.store.keys(words[0])
+	}
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		fmt.Fprintln(s.out, name)
+	}
+	return nil
+}
+
+// complete offers commands for the first word, collections for the second
+// and keys of that collection for the third. Keys containing spaces are
+// offered quoted.
+func (s *shell) complete(before string) []string {
+	words, _ := splitWords(before, 3)
+	if start := wordStart(before); start == len(before) {
+		words = append(words, "")
+	}
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	word := words[len(words)-1]
+
+	var options []string
+	switch len(words) {
+	case 1:
+		options = shellCommands
+	case 2:
+		if words[0] != "format" {
+			options, _ = s.d.Collections()
+		} else {
+			options = []string{formatJSON, formatJSONL, formatText}
+		}
+	case 3:
+		switch words[0] {
+		case "get", "put", "rm", "set":
+			options, _ = s.d.store.keys(words[1])
+		}
+	}
+
+	var candidates []string
+	for _, option := range options {
+		if !strings.HasPrefix(option, word) {
+			continue
+		}
+		if strings.ContainsAny(option, " \t") || strings.HasPrefix(before[wordStart(before):], `"`) {
+			option = `"` + option + `"`
+		}
+		candidates = append(candidates, option)
+	}
+	sort.Strings(candidates)
+	return candidates
+}
+
+// splitWords splits up to n leading words off line, honoring double quotes,
+// and returns them with the unsplit remainder.
+func splitWords(line string, n int) (words []string, rest string) {
+	rest = strings.TrimSpace(line)
+	for len(words) < n && rest != "" {
+		var word string
+		if rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				word, rest = rest[1:], ""
+			} else {
+				word, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if end := strings.IndexAny(rest, " \t"); end < 0 {
+			word, rest = rest, ""
+		} else {
+			word, rest = rest[:end], rest[end:]
+		}
+		words = append(words, word)
+		rest = strings.TrimSpace(rest)
+	}
+	return words, rest
+}
+
+// jsonIncomplete reports whether s is empty or opens more objects, arrays
+// or strings than it closes, i.e. more input is needed to complete it.
+func jsonIncomplete(s string) bool {
+	if strings.TrimSpace(s) == "" {
+		return true
+	}
+
+	depth := 0
+	inString, escaped := false, false
+	for _, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '{' || c == '[':
+			depth++
+		case c == '}' || c == ']':
+			depth--
+		}
+	}
+	return inString || depth > 0
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestShell(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	db := "--db=" + t.TempDir()
+	script := strings.Join([]string{
+		`put users ann {"Name": "Ann",`,
+		`  "Age": 30}`,
+		`set users "bob smith" Address.City Pune`,
+		`ls`,
+		`ls users`,
+		`get users ann Age`,
+		`format text`,
+		`get users "bob smith" Address.City`,
+		`format jsonl`,
+		`query users Age > 20`,
+		`rm users ann`,
+		`get users ann`,
+		`bogus`,
+	}, "\n")
+	stdout, stderr, code := runCLI(t, script, "shell", db)
+	want := strings.Join([]string{
+		"wrote users/ann",
+		"wrote users/bob smith",
+		"users",
+		"ann",
+		"bob smith",
+		"30",
+		"Pune",
+		`{"Name":"Ann","Age":30,"Company":"","Address":{"Street":"","City":"","State":"","Country":""}}`,
+		"deleted users/ann",
+	}, "\n") + "\n"
+	if !strings.HasPrefix(stdout, want) {
+		t.Errorf("shell printed:\n%s\nwant it to start with:\n%s", stdout, want)
+	}
+	for _, line := range []string{"error: ", `error: unknown command "bogus"`} {
+		if !strings.Contains(stdout, line) {
+			t.Errorf("shell printed:\n%s\nwant %q in it", stdout, line)
+		}
+	}
+	// The last command failed.
+	if code != exitFailure || stderr != "" {
+		t.Errorf("shell exited %d with %q, want %d", code, stderr, exitFailure)
+	}
+
+	// The exit code is that of the last command run; nothing runs after
+	// exit.
+	for _, script := range []string{"help\n", "bogus\nhelp\nexit\nbogus\n"} {
+		if _, _, code := runCLI(t, script, "shell", db); code != exitOK {
+			t.Errorf("shell running %q exited %d, want %d", script, code, exitOK)
+		}
+	}
+	if _, stderr, code := runCLI(t, "", "shell", db, "extra"); code != exitUsage {
+		t.Errorf("shell with an argument exited %d with %q, want %d", code, stderr, exitUsage)
+	}
+}
+
+func TestShellComplete(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+	writeUsers(t, d, "ann", "bob", "bob smith")
+	if err := d.Write("teams", "red", User{}); err != nil {
+		t.Fatal(err)
+	}
+	s := &shell{d: d}
+
+	tests := []struct {
+		before string
+		want   []string
+	}{
+		{"", shellCommands},
+		{"q", []string{"query", "quit"}},
+		{"get ", []string{"teams", "users"}},
+		{"get u", []string{"users"}},
+		{"format j", []string{"json", "jsonl"}},
+		{"get users b", []string{`"bob smith"`, "bob"}},
+		{`get users "bob s`, []string{`"bob smith"`}},
+		{"ls users a", nil},
+	}
+	for _, tt := range tests {
+		if got := s.complete(tt.before); !slices.Equal(got, tt.want) {
+			t.Errorf("complete(%q) = %q, want %q", tt.before, got, tt.want)
+		}
+	}
+}
+
+func TestSplitWords(t *testing.T) {
+	tests := []struct {
+		line  string
+		n     int
+		words []string
+		rest  string
+	}{
+		{"", 2, nil, ""},
+		{"  get users ann  ", 2, []string{"get", "users"}, "ann"},
+		{`get "bob smith" Age`, 2, []string{"get", "bob smith"}, "Age"},
+		{`get "unterminated key`, 3, []string{"get", "unterminated key"}, ""},
+		{"put users ann {\"Name\": \"a b\"}", 3, []string{"put", "users", "ann"}, `{"Name": "a b"}`},
+		{"a\tb", 5, []string{"a", "b"}, ""},
+	}
+	for _, tt := range tests {
+		words, rest := splitWords(tt.line, tt.n)
+		if !slices.Equal(words, tt.words) || rest != tt.rest {
+			t.Errorf("splitWords(%q, %d) = %q, %q, want %q, %q", tt.line, tt.n, words, rest, tt.words, tt.rest)
+		}
+	}
+}
+
+func TestJSONIncomplete(t *testing.T) {
+	tests := []struct {
+		s          string
+		incomplete bool
+	}{
+		{"", true},
+		{"  ", true},
+		{`{"Name": "Ann"}`, false},
+		{`{"Name": "Ann",`, true},
+		{`{"Tags": [1, 2`, true},
+		{`{"Name": "{[`, true},
+		{`{"Name": "a\"}"`, true},
+		{`{"Name": "a\\"}`, false},
+		{`}`, false},
+	}
+	for _, tt := range tests {
+		if got := jsonIncomplete(tt.s); got != tt.incomplete {
+			t.Errorf("jsonIncomplete(%q) = %v, want %v", tt.s, got, tt.incomplete)
+		}
+	}
+}
+
+// TestShellHistory checks that a session's commands are appended to the
+// history file only on a terminal.
+func TestShellHistory(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	if _, _, code := runCLI(t, "ls\n", "shell", "--db="+t.TempDir()); code != exitOK {
+		t.Fatalf("shell exited %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(home, ".dbcli_history")); !os.IsNotExist(err) {
+		t.Errorf("history written for input that is not a terminal: %v", err)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SQLDriverName is the name the database/sql driver is registered under.
+// The data source name is the database directory:
+//
+//	db, err := sql.Open(SQLDriverName, "./db")
+//
+// Use sql.OpenDB(d.SQLConnector()) instead to share a Driver already open.
+// The driver is registered by this program only: package main cannot be
+// imported, so other programs reach the database through Driver.Handler
+// and the client package instead.
+const SQLDriverName = "jsondb"
+
+// The database/sql driver understands a small dialect addressing records by
+// key, where a collection is a table of two columns, key and value, the
+// value being the record as JSON:
+//
+//	SELECT key, value FROM users [WHERE key = ?]
+//	INSERT INTO users [(key, value)] VALUES (?, ?)
+//	DELETE FROM users WHERE key = ?
+//
+// SELECT * selects both columns. Keys may also be given as 'quoted' strings.
+// INSERT fails with ErrConditionFailed if the key is taken. Transactions are
+// not supported.
+var (
+	sqlSelect = regexp.MustCompile(`(?i)^SELECT\s+(\*|key\s*,\s*value|value|key)\s+FROM\s+(\S+)(?:\s+WHERE\s+key\s*=\s*(\?|'[^']*'))?$`)
+	sqlInsert = regexp.MustCompile(`(?i)^INSERT\s+INTO\s+(\S+?)\s*(?:\(\s*key\s*,\s*value\s*\))?\s*VALUES\s*\(\s*(\?|'[^']*')\s*,\s*\?\s*\)$`)
+	sqlDelete = regexp.MustCompile(`(?i)^DELETE\s+FROM\s+(\S+)\s+WHERE\s+key\s*=\s*(\?|'[^']*')$`)
+)
+
+// ErrUnsupportedSQL is returned for statements outside the dialect of the
+// database/sql driver.
+var ErrUnsupportedSQL = errors.New("unsupported SQL statement")
+
+func init() {
+	sql.Register(SQLDriverName, sqlDriver{})
+}
+
+// sqlDriver opens the database in the directory named by the data source
+// name once per sql.DB; its connections share the Driver.
+type sqlDriver struct{}
+
+// Open is not used by database/sql, which prefers OpenConnector.
+func (sqlDriver) Open(dir string) (driver.Conn, error) {
+	return nil, errors.New("open the database with sql.Open, which opens it once for all connections")
+}
+
+func (sqlDriver) OpenConnector(dir string) (driver.Connector, error) {
+	return &sqlConnector{dir: dir}, nil
+}
+
+// sqlConnector hands out connections to one Driver. When it opened the
+// Driver itself it closes it with the sql.DB.
+type sqlConnector struct {
+	dir   string
+	mutex sync.Mutex
+	d     *Driver
+	owns  bool
+}
+
+// SQLConnector returns a connector for sql.OpenDB serving d. Closing the
+// sql.DB leaves d open.
+func (d *Driver) SQLConnector() driver.Connector {
+	return &sqlConnector{d: d}
+}
+
+func (c *sqlConnector) Connect(context.Context) (driver.Conn, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.d == nil {
+		d, err := New(c.dir, nil)
+		if err != nil {
+			return nil, err
+		}
+		c.d, c.owns = d, true
+	}
+	return sqlConn{c.d}, nil
+}
+
+func (c *sqlConnector) Driver() driver.Driver {
+	return sqlDriver{}
+}
+
+// Close is called by sql.DB.Close.
+func (c *sqlConnector) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.owns {
+		return nil
+	}
+	return c.d.Close()
+}
+
+type sqlConn struct {
+	d *Driver
+}
+
+func (c sqlConn) Prepare(query string) (driver.Stmt, error) {
+	query = strings.TrimSuffix(strings.TrimSpace(query), ";")
+	if !sqlSelect.MatchString(query) && !sqlInsert.MatchString(query) && !sqlDelete.MatchString(query) {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedSQL, query)
+	}
+	return sqlStmt{d: c.d, query: query}, nil
+}
+
+func (c sqlConn) Close() error {
+	return nil
+}
+
+func (c sqlConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("%w: transactions", ErrUnsupportedSQL)
+}
+
+type sqlStmt struct {
+	d     *Driver
+	query string
+}
+
+func (s sqlStmt) Close() error {
+	return nil
+}
+
+func (s sqlStmt) NumInput() int {
+	// Placeholders only appear outside quoted keys, and keys are the only
+	// quoted strings.
+	n := 0
+	for i, part := range strings.Split(s.query, "'") {
+		if i%2 == 0 {
+			n += strings.Count(part, "?")
+		}
+	}
+	return n
+}
+
+// sqlKey returns the key of a statement, given as a placeholder or quoted.
+func sqlKey(key string, args []driver.Value) (string, []driver.Value, error) {
+	if key != "?" {
+		return strings.Trim(key, "'"), args, nil
+	}
+	s, ok := args[0].(string)
+	if !ok {
+		return "", nil, fmt.Errorf("key must be a string, not %T", args[0])
+	}
+	return s, args[1:], nil
+}
+
+func (s sqlStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if m := sqlInsert.FindStringSubmatch(s.query); m != nil {
+		key, args, err := sqlKey(m[2], args)
+		if err != nil {
+			return nil, err
+		}
+		var data []byte
+		switch v := args[0].(type) {
+		case string:
+			data = []byte(v)
+		case []byte:
+			data = v
+		default:
+			return nil, fmt.Errorf("value must be JSON text, not %T", v)
+		}
+		var user User
+		if err := json.Unmarshal(data, &user); err != nil {
+			return nil, fmt.Errorf("could not unmarshal value: %v", err)
+		}
+		if err := s.d.WriteIfAbsent(m[1], key, user); err != nil {
+			return nil, err
+		}
+		return driver.RowsAffected(1), nil
+	}
+
+	if m := sqlDelete.FindStringSubmatch(s.query); m != nil {
+		key, _, err := sqlKey(m[2], args)
+		if err != nil {
+			return nil, err
+		}
+		err = s.d.Delete(m[1], key)
+		if errors.Is(err, os.ErrNotExist) {
+			return driver.RowsAffected(0), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return driver.RowsAffected(1), nil
+	}
+	return nil, fmt.Errorf("%w: use Query for %s", ErrUnsupportedSQL, s.query)
+}
+
+func (s sqlStmt) Query(args []driver.Value) (driver.Rows, error) {
+	m := sqlSelect.FindStringSubmatch(s.query)
+	if m == nil {
+		return nil, fmt.Errorf("%w: use Exec for %s", ErrUnsupportedSQL, s.query)
+	}
+
+	rows := &sqlRows{columns: []string{"key", "value"}}
+	switch strings.ToLower(m[1]) {
+	case "key":
+		rows.columns = []string{"key"}
+	case "value":
+		rows.columns = []string{"value"}
+	}
+
+	add := func(key string, user User) error {
+		data, err := json.Marshal(user)
+		if err != nil {
+			return fmt.Errorf("could not marshal user %s: %v", key, err)
+		}
+		rows.rows = append(rows.rows, [2]string{key, string(data)})
+		return nil
+	}
+
+	if m[3] != "" {
+		key, _, err := sqlKey(m[3], args)
+		if err != nil {
+			return nil, err
+		}
+		user, err := s.d.Read(m[2], key)
+		if errors.Is(err, os.ErrNotExist) {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return rows, add(key, user)
+	}
+
+	var addErr error
+	err := s.d.KV(m[2]).Range(func(key string, user User) bool {
+		addErr = add(key, user)
+		return addErr == nil
+	})
+	if err == nil {
+		err = addErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(rows.rows, func(i, j int) bool { return rows.rows[i][0] < rows.rows[j][0] })
+	return rows, nil
+}
+
+// sqlRows are the rows of a SELECT, read up front.
+type sqlRows struct {
+	columns []string
+	rows    [][2]string
+}
+
+func (r *sqlRows) Columns() []string {
+	return r.columns
+}
+
+func (r *sqlRows) Close() error {
+	return nil
+}
+
+func (r *sqlRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	row := r.rows[0]
+	r.rows = r.rows[1:]
+	for i, column := range r.columns {
+		if column == "key" {
+			dest[i] = row[0]
+		} else {
+			dest[i] = row[1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// CollectionStats describes the records of a collection.
+type CollectionStats struct {
+	Records      int
+	Bytes        int64
+	AverageSize  int64
+	LastModified time.Time
+	// Indexes maps each in-memory index the storage engine keeps for the
+	// collection to its number of entries.
+	Indexes map[string]int
+	// Integrity lists what the startup integrity scan found wrong with the
+	// collection.
+	Integrity []IntegrityProblem
+}
+
+// indexSizer is implemented by storage engines that keep in-memory indexes
+// of collections.
+type indexSizer interface {
+	indexSizes(collection string) (map[string]int, error)
+}
+
+// usageTracker keeps the usage of collections up to date as records are
+// written and deleted, for quotas and Stats. A collection is tracked from
+// when it is first measured; with quotas, every collection is.
+type usageTracker struct {
+	mutex       sync.Mutex
+	quotas      *QuotaOptions
+	collections map[string]*tally
+	// records and bytes add up the tracked collections.
+	records int
+	bytes   int64
+}
+
+// tally is the tracked usage of one collection.
+type tally struct {
+	measured bool
+	records  int
+	bytes    int64
+	modified time.Time
+}
+
+func newUsageTracker() *usageTracker {
+	return &usageTracker{collections: make(map[string]*tally)}
+}
+
+// tally returns the usage of a collection. The mutex must be held.
+func (t *usageTracker) tally(collection string) *tally {
+	c, ok := t.collections[collection]
+	if !ok {
+		c = &tally{}
+		t.collections[collection] = c
+	}
+	return c
+}
+
+// tracking reports whether writes to a collection must be accounted for.
+// Under quotas a collection not measured yet has no records, so it is.
+func (t *usageTracker) tracking(collection string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.quotas != nil || t.collections[collection] != nil && t.collections[collection].measured
+}
+
+// enforcing reports whether quotas are configured.
+func (t *usageTracker) enforcing() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.quotas != nil
+}
+
+// touch records when a collection last changed.
+func (t *usageTracker) touch(change Change) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if c := t.tally(change.Collection); change.Time.After(c.modified) {
+		c.modified = change.Time
+	}
+}
+
+// canTrack reports whether the storage engine can measure collections and
+// records, as tracking needs.
+func (d *Driver) canTrack() bool {
+	_, canMeasure := d.store.(usager)
+	_, canSize := d.store.(sizer)
+	return canMeasure && canSize
+}
+
+// measureUsage measures a collection, under its lock, and tracks its
+// usage from then on.
+func (d *Driver) measureUsage(collection string) error {
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if d.usage.tracking(collection) {
+		return nil
+	}
+	return d.measure(collection)
+}
+
+// remeasureUsage measures a tracked collection again after its records
+// changed behind the tracker's back. The collection lock must be held.
+func (d *Driver) remeasureUsage(collection string) error {
+	if !d.canTrack() || !d.usage.tracking(collection) {
+		return nil
+	}
+	return d.measure(collection)
+}
+
+// measure sets the tracked usage of a collection to what it holds. The
+// collection lock must be held.
+func (d *Driver) measure(collection string) error {
+	usage, err := d.store.(usager).usage(collection)
+	if err != nil {
+		return err
+	}
+
+	t := d.usage
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	c := t.tally(collection)
+	t.records += usage.Records - c.records
+	t.bytes += usage.Bytes - c.bytes
+	c.measured, c.records, c.bytes = true, usage.Records, usage.Bytes
+	if usage.Modified.After(c.modified) {
+		c.modified = usage.Modified
+	}
+	return nil
+}
+
+// Stats reports on the records of a collection. The collection is measured
+// the first time, and its statistics kept up to date as it changes.
+func (d *Driver) Stats(collection string) (CollectionStats, error) {
+	if err := d.checkNames(&collection); err != nil {
+		return CollectionStats{}, err
+	}
+
+	if !d.canTrack() {
+		return CollectionStats{}, fmt.Errorf("statistics are not supported by this storage engine")
+	}
+	if err := d.measureUsage(collection); err != nil {
+		return CollectionStats{}, fmt.Errorf("could not measure collection %s: %w", collection, err)
+	}
+
+	t := d.usage
+	t.mutex.Lock()
+	c := t.tally(collection)
+	stats := CollectionStats{Records: c.records, Bytes: c.bytes, LastModified: c.modified}
+	t.mutex.Unlock()
+
+	if stats.Records > 0 {
+		stats.AverageSize = stats.Bytes / int64(stats.Records)
+	}
+	stats.Integrity = d.integrityProblems(collection)
+	if s, ok := d.store.(indexSizer); ok {
+		indexes, err := s.indexSizes(collection)
+		if err != nil && !os.IsNotExist(err) {
+			return stats, err
+		}
+		stats.Indexes = indexes
+	}
+	return stats, nil
+}
+
+func (s *logStorage) indexSizes(collection string) (map[string]int, error) {
+	c, err := s.collection(collection, false)
+	if err != nil {
+		return nil, err
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+	return map[string]int{"keys": len(c.index)}, nil
+}
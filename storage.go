@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// storage is the on-disk layout behind a Driver. Records are handed over
+// already encoded; locking and (un)marshalling stay in the Driver.
+type storage interface {
+	put(collection, key string, data []byte) error
+	get(collection, key string) ([]byte, error)
+	delete(collection, key string) error
+	keys(collection string) ([]string, error)
+	close() error
+}
+
+// fileStorage keeps every record in its own JSON file under dir/collection,
+// optionally with a checksum sidecar next to it. With dedup, records with
+// the same body share one file under blobDir.
+type fileStorage struct {
+	dir        string
+	checksums  bool
+	dedup      bool
+	durability Durability
+	layout     layout
+	fs         FS
+	blobs      sync.Mutex
+
+	// With manifest, the keys of each collection are listed from a key
+	// manifest rather than its directory.
+	manifest      bool
+	manifestMutex sync.Mutex
+	manifests     map[string]*manifestKeys
+
+	// dirty holds the paths written to since the last sync under
+	// DurabilityInterval, or by a bulk load, mapped to whether they are
+	// directories. bulk holds the collections being bulk loaded.
+	mutex sync.Mutex
+	dirty map[string]bool
+	bulk  map[string]bool
+}
+
+// newFileStorage returns the file engine over dir, storing records as the
+// options of d ask.
+func (d *Driver) newFileStorage(dir string) *fileStorage {
+	return &fileStorage{dir: dir, checksums: d.opts.Checksums, dedup: d.opts.Dedup, manifest: d.opts.KeyManifest,
+		durability: d.opts.Durability, layout: d.layout, fs: d.fs}
+}
+
+func (s *fileStorage) put(collection, key string, data []byte) error {
+	if err := checkRecordPath(collection, key); err != nil {
+		return err
+	}
+	if err := s.layout.reservedKey(key); err != nil {
+		return err
+	}
+	if err := s.invalidateManifest(collection); err != nil {
+		return err
+	}
+
+	dir := s.layout.recordDir(s.dir, collection, key)
+	if err := s.fs.MkdirAll(dir, s.layout.dirMode()); err != nil {
+		return fmt.Errorf("could not create collection directory: %v", err)
+	}
+
+	// The record is written aside and renamed over the old one, so a crash
+	// leaves either of them rather than a torn file.
+	path := filepath.Join(dir, key+s.layout.extension())
+	if err := s.stage(path+".tmp", data); err != nil {
+		return err
+	}
+	var sum []byte
+	if s.checksums {
+		sum = checksum(data)
+	}
+	err := s.moveRecord(path, sum, func() error {
+		if err := s.fs.Rename(path+".tmp", path); err != nil {
+			return fmt.Errorf("could not move record into place: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.noteKey(collection, key, true)
+	return s.persist(dir, path, path+checksumExt)
+}
+
+func (s *fileStorage) get(collection, key string) ([]byte, error) {
+	if err := checkRecordPath(collection, key); err != nil {
+		return nil, err
+	}
+	path := s.layout.recordPath(s.dir, collection, key)
+	data, err := s.fs.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read file: %w", err)
+	}
+	if err := s.verifyChecksum(path, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *fileStorage) delete(collection, key string) error {
+	if err := checkRecordPath(collection, key); err != nil {
+		return err
+	}
+	if err := s.invalidateManifest(collection); err != nil {
+		return err
+	}
+	path := s.layout.recordPath(s.dir, collection, key)
+	if err := s.fs.Remove(path); err != nil {
+		return fmt.Errorf("could not delete file: %w", err)
+	}
+	s.noteKey(collection, key, false)
+	if err := s.fs.Remove(path + checksumExt); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not delete checksum: %v", err)
+	}
+	if err := s.persist(filepath.Dir(path)); err != nil {
+		return err
+	}
+	return s.removeIfEmpty(collection, filepath.Dir(path))
+}
+
+func (s *fileStorage) keys(collection string) ([]string, error) {
+	if s.manifest {
+		return s.sortedKeys(collection)
+	}
+	return s.listKeys(collection)
+}
+
+// listKeys lists the keys of a collection from its directories.
+func (s *fileStorage) listKeys(collection string) ([]string, error) {
+	if err := checkPath(collection); err != nil {
+		return nil, err
+	}
+	dirs, err := s.layout.recordDirs(s.fs, s.dir, collection)
+	if err != nil {
+		return nil, fmt.Errorf("could not read directory: %v", err)
+	}
+
+	ext := s.layout.extension()
+	var keys []string
+	for _, dir := range dirs {
+		files, err := s.fs.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("could not read directory: %v", err)
+		}
+		for _, file := range files {
+			if strings.HasSuffix(file.Name(), ext) && file.Name() != metaFile && !file.IsDir() {
+				keys = append(keys, strings.TrimSuffix(file.Name(), ext))
+			}
+		}
+	}
+	if len(dirs) > 1 {
+		sort.Strings(keys)
+	}
+	return keys, nil
+}
+
+// reservedKey rejects keys whose file would clash with the collection's
+// _meta.json under the record file extension of l.
+func (l layout) reservedKey(key string) error {
+	if key+l.extension() == metaFile {
+		return fmt.Errorf("key %s is reserved", key)
+	}
+	return nil
+}
+
+func (s *fileStorage) close() error {
+	return nil
+}
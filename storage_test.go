@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// TestChecksumSurvivesInterruptedPut fails each rename of a put in turn,
+// as a crash there would stop it, and checks the record left behind still
+// passes verification.
+func TestChecksumSurvivesInterruptedPut(t *testing.T) {
+	steps := []struct {
+		name   string
+		suffix string
+		nth    int
+	}{
+		{"sidecar listing both", ".json.sum.tmp", 1},
+		{"record", ".json.tmp", 1},
+		{"sidecar listing the new record", ".json.sum.tmp", 2},
+	}
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			var failing bool
+			var renames int
+			fsys := &FaultFS{FS: OSFS{}, Fault: func(op, path string) error {
+				if failing && op == "rename" && strings.HasSuffix(path, step.suffix) {
+					if renames++; renames == step.nth {
+						return syscall.EIO
+					}
+				}
+				return nil
+			}}
+			d, _ := openTestDB(t, &Options{Checksums: true, FS: fsys})
+
+			if err := d.Write("users", "alice", User{Name: "alice", Company: "Initech"}); err != nil {
+				t.Fatal(err)
+			}
+			failing = true
+			if err := d.Write("users", "alice", User{Name: "alice", Company: "Globex"}); err == nil {
+				t.Fatal("write succeeded despite the failed rename")
+			}
+			failing = false
+
+			user, err := d.Read("users", "alice")
+			if errors.Is(err, ErrCorruptRecord) {
+				t.Fatalf("interrupted put left a record failing its checksum: %v", err)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.Company != "Initech" && user.Company != "Globex" {
+				t.Errorf("read company %q", user.Company)
+			}
+			corrupt, err := d.Verify()
+			if err != nil || len(corrupt) > 0 {
+				t.Errorf("Verify = %v, %v", corrupt, err)
+			}
+
+			if err := d.Write("users", "alice", User{Name: "alice", Company: "Hooli"}); err != nil {
+				t.Fatal(err)
+			}
+			if user, err := d.Read("users", "alice"); err != nil || user.Company != "Hooli" {
+				t.Errorf("read after rewrite = %q, %v", user.Company, err)
+			}
+		})
+	}
+}
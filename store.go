@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Store is a pluggable storage backend. It holds records as opaque bytes
+// under a collection and key; locking, encoding and everything else stay in
+// the Driver. Get and Delete of a missing record return an error wrapping
+// os.ErrNotExist.
+//
+// Stores other than the built-in engines only get the core operations:
+// features needing engine support, such as compaction, quotas and stats,
+// report that they are not supported.
+type Store interface {
+	Put(collection, key string, data []byte) error
+	Get(collection, key string) ([]byte, error)
+	Delete(collection, key string) error
+	// List returns the keys of a collection, in any order.
+	List(collection string) ([]string, error)
+	Close() error
+}
+
+// CollectionLister is implemented by Stores that keep collections somewhere
+// other than directories of the database directory, so Collections can list
+// them.
+type CollectionLister interface {
+	Collections() ([]string, error)
+}
+
+var (
+	storesMutex sync.Mutex
+	stores      = make(map[string]func(dir string) (Store, error))
+)
+
+// RegisterStore makes a storage backend available by name to
+// Options.Backend and the --engine flag of dbcli. open is handed the
+// database directory. It panics if the name is already registered, like
+// database/sql.Register.
+//
+// The Driver lives in package main, which cannot be imported, so backends
+// are added by a file of this program registering from its init function;
+// other programs cannot supply one.
+func RegisterStore(name string, open func(dir string) (Store, error)) {
+	storesMutex.Lock()
+	defer storesMutex.Unlock()
+
+	if open == nil {
+		panic("RegisterStore: open is nil")
+	}
+	if _, ok := stores[name]; ok {
+		panic("RegisterStore: called twice for " + name)
+	}
+	stores[name] = open
+}
+
+// openStore opens the registered backend of the given name.
+func openStore(name, dir string) (Store, error) {
+	storesMutex.Lock()
+	open, ok := stores[name]
+	storesMutex.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown storage backend %q", name)
+	}
+	store, err := open(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not open storage backend %s: %v", name, err)
+	}
+	return store, nil
+}
+
+func registeredStore(name string) bool {
+	storesMutex.Lock()
+	defer storesMutex.Unlock()
+
+	_, ok := stores[name]
+	return ok
+}
+
+func init() {
+	RegisterStore("memory", func(string) (Store, error) {
+		return NewMemoryStore(), nil
+	})
+}
+
+// externalStore adapts a Store to the Driver's storage.
+type externalStore struct {
+	Store
+}
+
+func (s externalStore) put(collection, key string, data []byte) error {
+	if err := checkRecordPath(collection, key); err != nil {
+		return err
+	}
+	return s.Put(collection, key, data)
+}
+
+func (s externalStore) get(collection, key string) ([]byte, error) {
+	if err := checkRecordPath(collection, key); err != nil {
+		return nil, err
+	}
+	return s.Get(collection, key)
+}
+
+func (s externalStore) delete(collection, key string) error {
+	if err := checkRecordPath(collection, key); err != nil {
+		return err
+	}
+	return s.Delete(collection, key)
+}
+
+func (s externalStore) keys(collection string) ([]string, error) {
+	if err := checkPath(collection); err != nil {
+		return nil, err
+	}
+	return s.List(collection)
+}
+
+func (s externalStore) close() error {
+	return s.Close()
+}
+
+// fileStore exposes the file engine as a Store.
+type fileStore struct {
+	s *fileStorage
+}
+
+// FileStore returns the file-per-record engine rooted at dir as a Store,
+// for wrapping or comparing with other backends. Handed to Options.Store
+// it behaves exactly as EngineFiles.
+func FileStore(dir string) Store {
+	return fileStore{&fileStorage{dir: dir, fs: OSFS{}}}
+}
+
+func (f fileStore) Put(collection, key string, data []byte) error {
+	return f.s.put(collection, key, data)
+}
+
+func (f fileStore) Get(collection, key string) ([]byte, error) {
+	return f.s.get(collection, key)
+}
+
+func (f fileStore) Delete(collection, key string) error {
+	return f.s.delete(collection, key)
+}
+
+func (f fileStore) List(collection string) ([]string, error) {
+	return f.s.keys(collection)
+}
+
+func (f fileStore) Close() error {
+	return f.s.close()
+}
+
+// newStorage returns the storage a Store is used through, unwrapping the
+// built-in engines so they keep their optional capabilities.
+func newStorage(store Store) storage {
+	if f, ok := store.(fileStore); ok {
+		return f.s
+	}
+	return externalStore{store}
+}
+
+// MemoryStore is a Store keeping every record in memory, for tests and
+// throwaway databases. Nothing survives Close.
+type MemoryStore struct {
+	mutex       sync.RWMutex
+	collections map[string]map[string][]byte
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{collections: make(map[string]map[string][]byte)}
+}
+
+func (m *MemoryStore) Put(collection, key string, data []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	records, ok := m.collections[collection]
+	if !ok {
+		records = make(map[string][]byte)
+		m.collections[collection] = records
+	}
+	records[key] = append([]byte(nil), data...)
+	return nil
+}
+
+func (m *MemoryStore) Get(collection, key string) ([]byte, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	data, ok := m.collections[collection][key]
+	if !ok {
+		return nil, fmt.Errorf("could not read record %s: %w", key, os.ErrNotExist)
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (m *MemoryStore) Delete(collection, key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	records := m.collections[collection]
+	if _, ok := records[key]; !ok {
+		return fmt.Errorf("could not delete record %s: %w", key, os.ErrNotExist)
+	}
+	delete(records, key)
+	return nil
+}
+
+func (m *MemoryStore) List(collection string) ([]string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	records, ok := m.collections[collection]
+	if !ok {
+		return nil, fmt.Errorf("could not read collection %s: %w", collection, os.ErrNotExist)
+	}
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Collections lists the collections that have held a record.
+func (m *MemoryStore) Collections() ([]string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	collections := make([]string, 0, len(m.collections))
+	for collection := range m.collections {
+		collections = append(collections, collection)
+	}
+	sort.Strings(collections)
+	return collections, nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
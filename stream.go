@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// streamDir holds records being written with WriteStream until they are
+// complete, relative to the database directory.
+const streamDir = ".stream"
+
+// filePutter is implemented by storage engines that can take a record from
+// a spooled file without reading it into memory.
+type filePutter interface {
+	putFile(collection, key, path string) error
+}
+
+// recordStream spools a record written with WriteStream to a temporary
+// file and stores it on Close.
+type recordStream struct {
+	d          *Driver
+	collection string
+	key        string
+	path       string
+	file       File
+	size       int64
+	closed     bool
+}
+
+// WriteStream returns a writer for the record under key, so large documents
+// can be produced without holding them in memory. The record is stored when
+// the writer is closed, and only if what was written is a single valid JSON
+// document. A stream that is never closed leaves the record untouched.
+func (d *Driver) WriteStream(collection, key string) (io.WriteCloser, error) {
+	if err := d.checkNames(&collection, &key); err != nil {
+		return nil, err
+	}
+
+	if err := d.writable(); err != nil {
+		return nil, err
+	}
+	if err := d.checkRecordWrite(collection, false); err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(d.dir, streamDir)
+	if err := d.fs.MkdirAll(dir, d.layout.dirMode()); err != nil {
+		return nil, fmt.Errorf("could not create stream directory: %v", err)
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	path := filepath.Join(dir, "record-"+hex.EncodeToString(id))
+	file, err := d.fs.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("could not create stream file: %v", err)
+	}
+	return &recordStream{d: d, collection: collection, key: key, path: path, file: file}, nil
+}
+
+func (w *recordStream) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Close validates the streamed document and stores it.
+func (w *recordStream) Close() (err error) {
+	if w.closed {
+		return os.ErrClosed
+	}
+	w.closed = true
+
+	d := w.d
+	op := d.begin(opWrite, w.collection, w.key)
+	defer op.end(&err)
+
+	path := w.path
+	defer d.fs.Remove(path)
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("could not write stream file: %v", err)
+	}
+
+	if err := validateJSONFile(d.fs, path); err != nil {
+		return fmt.Errorf("could not write %s to collection %s: %v", w.key, w.collection, err)
+	}
+
+	// The record is never held in memory, so hooks see no Data.
+	hook := &HookOp{Op: OpWrite, Collection: w.collection, Key: w.key}
+	defer func() { d.after(hook, err) }()
+	if err := d.before(hook); err != nil {
+		return err
+	}
+
+	d.gate.RLock()
+	defer d.gate.RUnlock()
+
+	for _, name := range d.writeLocks(w.collection) {
+		mutex := d.getOrCreateMutex(name)
+		mutex.Lock()
+		defer mutex.Unlock()
+	}
+
+	// Records of collections with migrations are stamped with their
+	// schema version, records of collections with a TTL with their expiry,
+	// records of collections with references checked and records of
+	// collections with encrypted fields encrypted, so none can be moved
+	// into place as they are.
+	_, version := d.schemaVersion(w.collection)
+	meta, _ := d.collectionMeta(w.collection)
+	sealed := len(d.encryptedFields(w.collection)) > 0
+	if p, ok := d.store.(filePutter); ok && version == 0 && meta.TTL <= 0 && !d.hasReferences(w.collection) && !sealed {
+		var release func()
+		if release, err = d.reserve(w.collection, w.key, w.size, true); err == nil {
+			if err = p.putFile(w.collection, w.key, path); err != nil {
+				release()
+			}
+		}
+	} else {
+		var data []byte
+		if data, err = d.fs.ReadFile(path); err == nil {
+			if data, err = d.stampVersion(w.collection, data); err == nil {
+				data, err = d.stampExpiry(w.collection, data)
+			}
+			if err == nil {
+				data, err = d.stampModified(w.collection, data)
+			}
+			if err == nil {
+				data, err = d.sealFields(w.collection, w.key, data)
+			}
+			if err == nil {
+				err = d.checkReferences(w.collection, w.key, data, d.stored)
+			}
+			if err == nil {
+				err = d.put(w.collection, w.key, data)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	op.bytes = int(w.size)
+
+	// The change log carries record data, so only then is the record read
+	// back for subscribers.
+	var data []byte
+	if d.changes != nil {
+		if data, err = d.store.get(w.collection, w.key); err != nil {
+			return err
+		}
+	}
+
+	d.log.Info("Wrote record %s to collection %s (%d bytes streamed)", w.key, w.collection, w.size)
+	d.publish(OpWrite, w.collection, w.key, data)
+	return nil
+}
+
+// removeStaleStreams drops spool files of streams interrupted by a crash.
+func (d *Driver) removeStaleStreams() {
+	dir := filepath.Join(d.dir, streamDir)
+	entries, err := d.fs.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return
+	}
+	for _, entry := range entries {
+		if err == nil {
+			err = d.fs.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+	if err == nil {
+		err = d.fs.Remove(dir)
+	}
+	if err != nil {
+		d.log.Error("Could not remove interrupted record streams: %v", err)
+	}
+}
+
+// validateJSONFile checks that the file at path holds exactly one JSON
+// document, without decoding it into memory as a whole.
+func validateJSONFile(fsys FS, path string) error {
+	file, err := fsys.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	decoder.UseNumber()
+
+	depth, values := 0, 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			if depth > 0 {
+				return errors.New("unexpected end of document")
+			}
+			if values == 0 {
+				return errors.New("empty document")
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("invalid JSON at offset %d: %v", decoder.InputOffset(), err)
+		}
+		if values > 0 {
+			return fmt.Errorf("unexpected data after the document at offset %d", decoder.InputOffset())
+		}
+
+		if delim, ok := token.(json.Delim); ok {
+			if delim == '{' || delim == '[' {
+				depth++
+			} else {
+				depth--
+			}
+		}
+		if depth == 0 {
+			values++
+		}
+	}
+}
+
+// putFile moves a spooled record into place, checksumming it as it is read
+// once rather than loading it.
+func (s *fileStorage) putFile(collection, key, path string) error {
+	if err := checkRecordPath(collection, key); err != nil {
+		return err
+	}
+	if err := s.layout.reservedKey(key); err != nil {
+		return err
+	}
+	// Spooled files are only moved into place directly on the operating
+	// system's filesystem, where faults cannot be injected.
+	fsys := s.fs
+	if r, ok := fsys.(*retryFS); ok {
+		fsys = r.FS
+	}
+	if _, ok := fsys.(OSFS); !ok {
+		data, err := s.fs.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("could not read stream file: %v", err)
+		}
+		return s.put(collection, key, data)
+	}
+
+	if err := s.invalidateManifest(collection); err != nil {
+		return err
+	}
+	dir := s.layout.recordDir(s.dir, collection, key)
+	if err := os.MkdirAll(dir, s.layout.dirMode()); err != nil {
+		return fmt.Errorf("could not create collection directory: %v", err)
+	}
+	// Spooled files are created private.
+	if err := os.Chmod(path, s.layout.fileMode()); err != nil {
+		return fmt.Errorf("could not set permissions of record: %v", err)
+	}
+
+	target := filepath.Join(dir, key+s.layout.extension())
+	if s.syncsAside(dir) {
+		if err := syncPath(OSFS{}, path); err != nil {
+			return fmt.Errorf("could not sync stream file: %v", err)
+		}
+	}
+	var sum []byte
+	if s.checksums {
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("could not read stream file: %v", err)
+		}
+		crc := crc32.NewIEEE()
+		_, err = io.Copy(crc, file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("could not checksum record: %v", err)
+		}
+		sum = formatChecksum(crc.Sum32())
+	}
+
+	err := s.moveRecord(target, sum, func() error {
+		if err := os.Rename(path, target); err != nil {
+			return fmt.Errorf("could not move record into place: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.noteKey(collection, key, true)
+	return s.persist(dir, target, target+checksumExt)
+}
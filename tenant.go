@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// tenantDir holds a directory per tenant, inside the database directory.
+const tenantDir = ".tenants"
+
+// Tenant returns the database of a tenant, opening it on first use. Each
+// tenant is a Driver of its own over a subdirectory, with its own
+// collections, locks, quotas and metrics, opened with the options of d;
+// tenants are closed with d. If the tenant cannot be opened, Tenant logs
+// why and returns nil; OpenTenant returns the error instead.
+func (d *Driver) Tenant(name string) *Driver {
+	tenant, err := d.OpenTenant(name)
+	if err != nil {
+		d.log.Error("%v", err)
+		return nil
+	}
+	return tenant
+}
+
+// OpenTenant is Tenant, returning the failure to open the tenant.
+//
+// Tenants are not mirrored by Options.Sync nor kept in memory snapshots,
+// and cannot share an Options.Store; register the backend and set
+// Options.Backend instead, which opens it per tenant. A cluster does not
+// replicate tenants, so they cannot be opened on a cluster node.
+func (d *Driver) OpenTenant(name string) (*Driver, error) {
+	if err := validTenant(name); err != nil {
+		return nil, fmt.Errorf("could not open tenant: %v", err)
+	}
+
+	d.tenantMutex.Lock()
+	defer d.tenantMutex.Unlock()
+
+	select {
+	case <-d.stop:
+		return nil, fmt.Errorf("could not open tenant %s: %w", name, os.ErrClosed)
+	default:
+	}
+	if tenant, ok := d.tenants[name]; ok {
+		return tenant, nil
+	}
+	if d.opts.Store != nil {
+		return nil, fmt.Errorf("could not open tenant %s: tenants cannot share Options.Store", name)
+	}
+	if d.cluster != nil {
+		return nil, fmt.Errorf("could not open tenant %s: %w", name, ErrNotReplicated)
+	}
+
+	opts := d.opts
+	opts.Logger = tenantLogger{Logger: d.log, name: name}
+	opts.Slog = d.slog.With("tenant", name)
+	opts.Sync = nil
+	opts.Memory = nil
+	opts.Shards = make([]string, len(d.opts.Shards))
+	for i, shard := range d.opts.Shards {
+		opts.Shards[i] = filepath.Join(shard, tenantDir, name)
+	}
+
+	tenant, err := New(filepath.Join(d.dir, tenantDir, name), &opts)
+	if err != nil {
+		return nil, fmt.Errorf("could not open tenant %s: %w", name, err)
+	}
+	if d.tenants == nil {
+		d.tenants = make(map[string]*Driver)
+	}
+	d.tenants[name] = tenant
+	return tenant, nil
+}
+
+// Tenants lists the tenants of the database, opened or not.
+func (d *Driver) Tenants() ([]string, error) {
+	entries, err := d.fs.ReadDir(filepath.Join(d.dir, tenantDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not list tenants: %v", err)
+	}
+
+	var tenants []string
+	for _, entry := range entries {
+		if entry.IsDir() && validTenant(entry.Name()) == nil {
+			tenants = append(tenants, entry.Name())
+		}
+	}
+	sort.Strings(tenants)
+	return tenants, nil
+}
+
+// closeTenants closes the tenants opened so far.
+func (d *Driver) closeTenants() error {
+	d.tenantMutex.Lock()
+	defer d.tenantMutex.Unlock()
+
+	var firstErr error
+	for name, tenant := range d.tenants {
+		if err := tenant.Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("could not close tenant %s: %v", name, err)
+		}
+	}
+	d.tenants = nil
+	return firstErr
+}
+
+func validTenant(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid tenant name %q", name)
+	}
+	return nil
+}
+
+// tenantLogger prefixes the messages of a tenant with its name. The name
+// is passed as an argument, so verbs in it are not interpreted.
+type tenantLogger struct {
+	Logger
+	name string
+}
+
+func (l tenantLogger) args(v []interface{}) []interface{} {
+	return append([]interface{}{l.name}, v...)
+}
+
+func (l tenantLogger) Fatal(format string, v ...interface{}) {
+	l.Logger.Fatal("[%s] "+format, l.args(v)...)
+}
+func (l tenantLogger) Error(format string, v ...interface{}) {
+	l.Logger.Error("[%s] "+format, l.args(v)...)
+}
+func (l tenantLogger) Info(format string, v ...interface{}) {
+	l.Logger.Info("[%s] "+format, l.args(v)...)
+}
+func (l tenantLogger) Debug(format string, v ...interface{}) {
+	l.Logger.Debug("[%s] "+format, l.args(v)...)
+}
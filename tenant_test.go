@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpenTenant(t *testing.T) {
+	d, dir := openTestDB(t, nil)
+
+	acme, err := d.OpenTenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := d.OpenTenant("acme"); err != nil || again != acme {
+		t.Errorf("second open = %p, %v; want the tenant already open", again, err)
+	}
+	if err := acme.Write("users", "alice", User{Name: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Read("users", "alice"); err == nil {
+		t.Error("tenant record is visible in the parent database")
+	}
+	if tenants, err := d.Tenants(); err != nil || len(tenants) != 1 || tenants[0] != "acme" {
+		t.Errorf("Tenants = %v, %v", tenants, err)
+	}
+
+	for _, name := range []string{"", "..", ".hidden", "a/b", `a\b`} {
+		if _, err := d.OpenTenant(name); err == nil {
+			t.Errorf("OpenTenant(%q) succeeded", name)
+		}
+	}
+
+	// A file where the tenant's directory goes fails to open rather than
+	// panicking.
+	if err := os.WriteFile(filepath.Join(dir, tenantDir, "broken"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.OpenTenant("broken"); err == nil {
+		t.Error("opening a tenant over a file succeeded")
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.OpenTenant("acme"); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("open after Close = %v, want os.ErrClosed", err)
+	}
+}
+
+func TestTenant(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+
+	acme := d.Tenant("acme")
+	if acme == nil {
+		t.Fatal("Tenant(acme) = nil")
+	}
+	if opened, err := d.OpenTenant("acme"); err != nil || opened != acme {
+		t.Errorf("OpenTenant after Tenant = %p, %v; want the same tenant", opened, err)
+	}
+	if tenant := d.Tenant("../acme"); tenant != nil {
+		t.Error("Tenant with an invalid name is not nil")
+	}
+}
+
+func TestTenantLogger(t *testing.T) {
+	var out bytes.Buffer
+	l := tenantLogger{Logger: NewSlogLogger(slog.New(slog.NewTextHandler(&out, nil))), name: "100%d"}
+
+	l.Info("wrote %s", "alice")
+	if got := out.String(); !strings.Contains(got, `"[100%d] wrote alice"`) {
+		t.Errorf("logged %q, want the tenant name and message intact", got)
+	}
+}
+
+func TestOpenTenantOnClusterNode(t *testing.T) {
+	d, _ := openTestDB(t, &Options{Cluster: &ClusterOptions{NodeID: "a", Bind: "127.0.0.1:0", Bootstrap: true}})
+
+	if _, err := d.OpenTenant("acme"); !errors.Is(err, ErrNotReplicated) {
+		t.Errorf("OpenTenant on a cluster node = %v, want ErrNotReplicated", err)
+	}
+}
@@ -0,0 +1,241 @@
+// Package testdb provides golden database directories for tests: load a
+// fixture into a scratch directory, run the code under test against it, and
+// assert the resulting state against an expected snapshot.
+//
+//	dir := testdb.Load(t, "testdata/basic")
+//	db, _ := New(dir, nil)
+//	... exercise db ...
+//	testdb.AssertEqual(t, dir, "testdata/basic.want")
+//
+// Files the driver keeps only while running, such as its lock, are told by
+// Transient, which tests set to the driver's TransientFile.
+//
+// Running the tests with TESTDB_UPDATE=1 rewrites expected snapshots from the
+// actual state instead of failing.
+package testdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// UpdateEnv is the environment variable that switches AssertEqual into
+// snapshot-rewriting mode.
+const UpdateEnv = "TESTDB_UPDATE"
+
+// Transient reports whether a file or directory, by name, is transient
+// driver state rather than data. Load, Snapshot and Diff leave such files
+// out. It reports false for every name until set.
+var Transient = func(name string) bool { return false }
+
+// Load copies the fixture directory into a fresh temporary directory owned
+// by t and returns its path, so tests never modify the fixture itself.
+func Load(t testing.TB, fixture string) string {
+	t.Helper()
+
+	dir := filepath.Join(t.TempDir(), "db")
+	if err := copyTree(fixture, dir); err != nil {
+		t.Fatalf("testdb: could not load fixture %s: %v", fixture, err)
+	}
+	return dir
+}
+
+// Snapshot replaces the fixture directory with a copy of the database in dir.
+func Snapshot(dir, fixture string) error {
+	if err := os.RemoveAll(fixture); err != nil {
+		return fmt.Errorf("could not clear fixture %s: %v", fixture, err)
+	}
+	return copyTree(dir, fixture)
+}
+
+// AssertEqual fails t with a per-file diff if the database in dir does not
+// match the expected snapshot. JSON records are compared after normalizing
+// their formatting.
+func AssertEqual(t testing.TB, dir, expected string) {
+	t.Helper()
+
+	if os.Getenv(UpdateEnv) != "" {
+		if err := Snapshot(dir, expected); err != nil {
+			t.Fatalf("testdb: could not update snapshot: %v", err)
+		}
+		return
+	}
+
+	diff, err := Diff(dir, expected)
+	if err != nil {
+		t.Fatalf("testdb: %v", err)
+	}
+	if diff != "" {
+		t.Errorf("testdb: database differs from %s (rerun with %s=1 to accept):\n%s", expected, UpdateEnv, diff)
+	}
+}
+
+// Diff describes how the database in dir differs from the expected
+// snapshot, or returns "" if they match.
+func Diff(dir, expected string) (string, error) {
+	got, err := readTree(dir)
+	if err != nil {
+		return "", fmt.Errorf("could not read database %s: %v", dir, err)
+	}
+	want, err := readTree(expected)
+	if err != nil {
+		return "", fmt.Errorf("could not read snapshot %s: %v", expected, err)
+	}
+
+	names := make(map[string]bool)
+	for name := range got {
+		names[name] = true
+	}
+	for name := range want {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var b strings.Builder
+	for _, name := range sorted {
+		g, inGot := got[name]
+		w, inWant := want[name]
+		switch {
+		case !inGot:
+			fmt.Fprintf(&b, "missing %s\n", name)
+		case !inWant:
+			fmt.Fprintf(&b, "unexpected %s\n", name)
+		case !bytes.Equal(g, w):
+			fmt.Fprintf(&b, "--- %s (want)\n+++ %s (got)\n", name, name)
+			if isText(g) && isText(w) {
+				b.WriteString(lineDiff(string(w), string(g)))
+			} else {
+				fmt.Fprintf(&b, "binary contents differ (%d bytes, want %d)\n", len(g), len(w))
+			}
+		}
+	}
+	return b.String(), nil
+}
+
+// readTree loads every regular file under root keyed by slash-separated
+// relative path, normalizing JSON files.
+func readTree(root string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if Transient(entry.Name()) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(path, ".json") {
+			data = normalizeJSON(data)
+		}
+		files[filepath.ToSlash(rel)] = data
+		return nil
+	})
+	return files, err
+}
+
+// copyTree copies the regular files under src into dst.
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if Transient(entry.Name()) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if entry.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, data, 0644)
+	})
+}
+
+func normalizeJSON(data []byte) []byte {
+	var out bytes.Buffer
+	if err := json.Indent(&out, bytes.TrimSpace(data), "", "  "); err != nil {
+		return data
+	}
+	return out.Bytes()
+}
+
+func isText(data []byte) bool {
+	return !bytes.ContainsRune(data, 0)
+}
+
+// lineDiff renders a minimal line diff of want against got.
+func lineDiff(want, got string) string {
+	a := strings.Split(want, "\n")
+	b := strings.Split(got, "\n")
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var out strings.Builder
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			fmt.Fprintf(&out, "  %s\n", a[i])
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(&out, "- %s\n", a[i])
+			i++
+		default:
+			fmt.Fprintf(&out, "+ %s\n", b[j])
+			j++
+		}
+	}
+	return out.String()
+}
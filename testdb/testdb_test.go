@@ -0,0 +1,109 @@
+package testdb
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// transient makes names transient for the rest of the test.
+func transient(t *testing.T, names ...string) {
+	t.Helper()
+	old := Transient
+	Transient = func(name string) bool { return slices.Contains(names, name) }
+	t.Cleanup(func() { Transient = old })
+}
+
+func TestLoadCopiesFixture(t *testing.T) {
+	transient(t, ".lock")
+	fixture := t.TempDir()
+	writeFiles(t, fixture, map[string]string{
+		"users/alice.json": `{"Name": "Alice"}`,
+		".lock":            "",
+	})
+
+	dir := Load(t, fixture)
+	if _, err := os.Stat(filepath.Join(dir, ".lock")); !os.IsNotExist(err) {
+		t.Errorf("lock file was copied: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "users", "alice.json"), []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(fixture, "users", "alice.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"Name": "Alice"}` {
+		t.Errorf("fixture was modified: %s", data)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	transient(t, ".lock", ".changelog")
+	want := t.TempDir()
+	writeFiles(t, want, map[string]string{
+		"users/alice.json": "{\n  \"Name\": \"Alice\"\n}",
+		"users/bob.json":   `{"Name": "Bob"}`,
+		"users/carol.json": `{"Name": "Carol"}`,
+	})
+	got := t.TempDir()
+	writeFiles(t, got, map[string]string{
+		"users/alice.json": `{"Name":"Alice"}`,
+		"users/bob.json":   `{"Name": "Robert"}`,
+		"users/dave.json":  `{"Name": "Dave"}`,
+		".lock":            "",
+		".changelog/0001":  "",
+	})
+
+	diff, err := Diff(got, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"--- users/bob.json (want)",
+		`-   "Name": "Bob"`,
+		`+   "Name": "Robert"`,
+		"missing users/carol.json",
+		"unexpected users/dave.json",
+	} {
+		if !strings.Contains(diff, line+"\n") {
+			t.Errorf("diff is missing %q:\n%s", line, diff)
+		}
+	}
+	if strings.Contains(diff, "alice") || strings.Contains(diff, ".lock") || strings.Contains(diff, ".changelog") {
+		t.Errorf("diff reports equal or transient files:\n%s", diff)
+	}
+
+	if diff, err := Diff(want, want); err != nil || diff != "" {
+		t.Errorf("Diff of a snapshot against itself = %q, %v", diff, err)
+	}
+}
+
+func TestAssertEqualUpdates(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"users/alice.json": `{"Name": "Alice"}`})
+	expected := filepath.Join(t.TempDir(), "want")
+	writeFiles(t, expected, map[string]string{"users/stale.json": `{}`})
+
+	t.Setenv(UpdateEnv, "1")
+	AssertEqual(t, dir, expected)
+
+	if diff, err := Diff(dir, expected); err != nil || diff != "" {
+		t.Errorf("snapshot was not rewritten: %q, %v", diff, err)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// segmentExt is the extension of the daily segment files of a time
+	// series, named after their UTC day.
+	segmentExt = ".ts"
+	dayLayout  = "2006-01-02"
+	// retentionInterval is how often expired segments are dropped.
+	retentionInterval = time.Hour
+)
+
+// Point is a timestamped record of a time series.
+type Point struct {
+	Time  time.Time `json:"time"`
+	Value User      `json:"value"`
+}
+
+// timeSeries returns the configuration of a time series collection, and
+// whether the collection is one.
+func (d *Driver) timeSeries(collection string) (CollectionMeta, bool) {
+	meta, _ := d.collectionMeta(collection)
+	return meta, meta.TimeSeries
+}
+
+// hasTimeSeries reports whether any collection is a time series.
+func (d *Driver) hasTimeSeries() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for _, meta := range d.meta {
+		if meta.TimeSeries {
+			return true
+		}
+	}
+	return false
+}
+
+// AppendPoint adds a point to a time series collection, in the segment of
+// its UTC day. A point at the same time as an earlier one replaces it.
+func (d *Driver) AppendPoint(collection string, t time.Time, value User) (err error) {
+	if err := d.checkNames(&collection); err != nil {
+		return err
+	}
+
+	op := d.begin(opWrite, collection, t.UTC().Format(time.RFC3339Nano))
+	defer op.end(&err)
+
+	if err := d.writable(); err != nil {
+		return err
+	}
+	meta, ok := d.timeSeries(collection)
+	if !ok {
+		return fmt.Errorf("collection %s is not a time series", collection)
+	}
+	if meta.Retention > 0 && t.Before(time.Now().Add(-meta.Retention)) {
+		return fmt.Errorf("point at %s is older than the %s retention of collection %s", t.UTC().Format(time.RFC3339), meta.Retention, collection)
+	}
+
+	value.Computed = nil
+	line, err := json.Marshal(Point{Time: t.UTC(), Value: value})
+	if err != nil {
+		return fmt.Errorf("could not marshal data: %v", err)
+	}
+
+	d.gate.RLock()
+	defer d.gate.RUnlock()
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	dir := filepath.Join(d.dir, collection)
+	if err := d.fs.MkdirAll(dir, d.layout.dirMode()); err != nil {
+		return fmt.Errorf("could not create collection directory: %v", err)
+	}
+	path := filepath.Join(dir, t.UTC().Format(dayLayout)+segmentExt)
+	file, err := d.fs.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, d.layout.fileMode())
+	if err != nil {
+		return fmt.Errorf("could not open segment: %v", err)
+	}
+	_, err = file.Write(append(line, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not append to segment: %v", err)
+	}
+	op.bytes = len(line)
+
+	d.publish(OpWrite, collection, op.key, line)
+	return nil
+}
+
+// ReadTimeRange returns the points of a time series in [from, to), in time
+// order. Only the segments of the days in range are read.
+func (d *Driver) ReadTimeRange(collection string, from, to time.Time) (_ []Point, err error) {
+	if err := d.checkNames(&collection); err != nil {
+		return nil, err
+	}
+
+	op := d.begin(opReadRange, collection, "")
+	defer op.end(&err)
+
+	if _, ok := d.timeSeries(collection); !ok {
+		return nil, fmt.Errorf("collection %s is not a time series", collection)
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	days, err := d.segments(collection)
+	if err != nil {
+		return nil, err
+	}
+
+	first, last := from.UTC().Format(dayLayout), to.UTC().Format(dayLayout)
+	var points []Point
+	for _, day := range days {
+		if day < first || day > last {
+			continue
+		}
+		path := filepath.Join(d.dir, collection, day+segmentExt)
+		segment, err := d.readSegment(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range segment {
+			if !p.Time.Before(from) && p.Time.Before(to) {
+				points = append(points, p)
+			}
+		}
+	}
+	return points, nil
+}
+
+// segments lists the days a time series has segments for, in order.
+func (d *Driver) segments(collection string) ([]string, error) {
+	entries, err := d.fs.ReadDir(filepath.Join(d.dir, collection))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read directory: %v", err)
+	}
+
+	var days []string
+	for _, entry := range entries {
+		if day, ok := strings.CutSuffix(entry.Name(), segmentExt); ok {
+			days = append(days, day)
+		}
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+// readSegment reads the points of a segment in time order, the last one
+// appended winning among points at the same time. Lines that cannot be
+// decoded, such as one torn by a crash, are logged and skipped.
+func (d *Driver) readSegment(path string) ([]Point, error) {
+	file, err := d.fs.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not read segment: %v", err)
+	}
+	defer file.Close()
+
+	latest := make(map[time.Time]Point)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		var p Point
+		if err := json.Unmarshal(scanner.Bytes(), &p); err != nil {
+			d.log.Error("Skipping unreadable point in %s: %v", path, err)
+			continue
+		}
+		latest[p.Time] = p
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read segment: %v", err)
+	}
+
+	points := make([]Point, 0, len(latest))
+	for _, p := range latest {
+		points = append(points, p)
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+	return points, nil
+}
+
+// dropExpiredSegments removes the segments of a time series whose whole
+// day is older than its retention, returning how many it removed.
+func (d *Driver) dropExpiredSegments(collection string) (int, error) {
+	meta, ok := d.timeSeries(collection)
+	if !ok || meta.Retention <= 0 {
+		return 0, nil
+	}
+
+	d.gate.RLock()
+	defer d.gate.RUnlock()
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	days, err := d.segments(collection)
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := time.Now().Add(-meta.Retention)
+	dropped := 0
+	for _, day := range days {
+		start, err := time.Parse(dayLayout, day)
+		if err != nil || !start.AddDate(0, 0, 1).Before(cutoff) {
+			continue
+		}
+		if err := d.fs.Remove(filepath.Join(d.dir, collection, day+segmentExt)); err != nil {
+			return dropped, fmt.Errorf("could not drop segment %s of %s: %v", day, collection, err)
+		}
+		dropped++
+	}
+	if dropped > 0 {
+		d.log.Info("Dropped %d expired segments of time series %s", dropped, collection)
+	}
+	return dropped, nil
+}
+
+// startRetention drops expired time series segments now and then
+// periodically, until the Driver is closed.
+func (d *Driver) startRetention() {
+	if d.opts.ReadOnly {
+		return
+	}
+
+	sweep := func() {
+		d.mutex.Lock()
+		var collections []string
+		for collection, meta := range d.meta {
+			if meta.TimeSeries && meta.Retention > 0 {
+				collections = append(collections, collection)
+			}
+		}
+		d.mutex.Unlock()
+
+		sort.Strings(collections)
+		for _, collection := range collections {
+			if _, err := d.dropExpiredSegments(collection); err != nil {
+				d.log.Error("Retention failed: %v", err)
+			}
+		}
+	}
+	sweep()
+
+	ran := d.background.track("retention", retentionInterval)
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+
+		ticker := time.NewTicker(retentionInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-d.stop:
+				return
+			case <-ticker.C:
+				sweep()
+				ran()
+			}
+		}
+	}()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTimeSeries(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+	if err := d.SetCollectionMeta("temps", CollectionMeta{TimeSeries: true}); err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i, at := range []time.Duration{23 * time.Hour, time.Hour, 25 * time.Hour, time.Hour} {
+		if err := d.AppendPoint("temps", day.Add(at), User{Name: strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		from, to time.Time
+		want     []string
+	}{
+		{"first day", day, day.Add(24 * time.Hour), []string{"3", "0"}},
+		{"across days", day.Add(2 * time.Hour), day.Add(48 * time.Hour), []string{"0", "2"}},
+		{"end is exclusive", day, day.Add(time.Hour), nil},
+		{"no points", day.Add(72 * time.Hour), day.Add(96 * time.Hour), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			points, err := d.ReadTimeRange("temps", tt.from, tt.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, p := range points {
+				got = append(got, p.Value.Name)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("points = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := d.ReadTimeRange("users", day, day); err == nil {
+		t.Error("reading a range of a plain collection succeeded")
+	}
+	if err := d.AppendPoint("users", day, User{}); err == nil {
+		t.Error("appending a point to a plain collection succeeded")
+	}
+}
+
+func TestTimeSeriesRejectsRecordWrites(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+	if err := d.SetCollectionMeta("temps", CollectionMeta{TimeSeries: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Write("temps", "x", User{}); err == nil {
+		t.Error("Write into a time series succeeded")
+	}
+	if _, err := d.WriteStream("temps", "x"); err == nil {
+		t.Error("WriteStream into a time series succeeded")
+	}
+	if err := d.Begin().Write("temps", "x", User{}); err == nil {
+		t.Error("Tx.Write into a time series succeeded")
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// TLSOptions configures TLS for a network endpoint, the HTTP API or
+// replication. The same options serve both ends of a connection.
+type TLSOptions struct {
+	// CertFile and KeyFile hold the PEM certificate and key a server
+	// presents, or a client presents to a server verifying clients.
+	CertFile string
+	KeyFile  string
+	// ClientCAFile, on a server, holds the PEM CAs client certificates must
+	// be signed by. Clients without one are refused (mutual TLS).
+	ClientCAFile string
+	// RootCAFile, on a client, holds the PEM CAs the server's certificate
+	// must be signed by. The system roots are used if empty.
+	RootCAFile string
+}
+
+// ServerConfig returns the TLS configuration of a server, for use as
+// http.Server.TLSConfig.
+func (o *TLSOptions) ServerConfig() (*tls.Config, error) {
+	if o.CertFile == "" || o.KeyFile == "" {
+		return nil, errors.New("TLS needs a certificate and key file")
+	}
+	cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load TLS certificate: %v", err)
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if o.ClientCAFile != "" {
+		if config.ClientCAs, err = loadCertPool(o.ClientCAFile); err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ClientConfig returns the TLS configuration for connecting to the server
+// at addr.
+func (o *TLSOptions) ClientConfig(addr string) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	config := &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	if o.RootCAFile != "" {
+		if config.RootCAs, err = loadCertPool(o.RootCAFile); err != nil {
+			return nil, err
+		}
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load TLS client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CA file: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates in CA file %s", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testPKI holds a CA and PEM files of a server and a client certificate it
+// signed, the server's valid for 127.0.0.1.
+type testPKI struct {
+	caFile                string
+	serverCert, serverKey string
+	clientCert, clientKey string
+}
+
+func newTestPKI(t *testing.T) testPKI {
+	t.Helper()
+	dir := t.TempDir()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pki := testPKI{caFile: filepath.Join(dir, "ca.pem")}
+	writePEM(t, pki.caFile, "CERTIFICATE", caDER)
+	issue := func(name string, serial int64, usage x509.ExtKeyUsage, ips []net.IP) (string, string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  ips,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, cert, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+		writePEM(t, certFile, "CERTIFICATE", der)
+		writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+		return certFile, keyFile
+	}
+	pki.serverCert, pki.serverKey = issue("server", 2, x509.ExtKeyUsageServerAuth, []net.IP{net.IPv4(127, 0, 0, 1)})
+	pki.clientCert, pki.clientKey = issue("client", 3, x509.ExtKeyUsageClientAuth, nil)
+	return pki
+}
+
+func writePEM(t *testing.T, path, kind string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// server returns the TLS options of a server verifying clients.
+func (p testPKI) server() *TLSOptions {
+	return &TLSOptions{CertFile: p.serverCert, KeyFile: p.serverKey, ClientCAFile: p.caFile}
+}
+
+// client returns the TLS options of a client presenting its certificate.
+func (p testPKI) client() *TLSOptions {
+	return &TLSOptions{CertFile: p.clientCert, KeyFile: p.clientKey, RootCAFile: p.caFile}
+}
+
+func TestTLSServer(t *testing.T) {
+	pki := newTestPKI(t)
+	d, _ := openTestDB(t, nil)
+	writeUsers(t, d, "ann")
+
+	server := httptest.NewUnstartedServer(d.Handler(HandlerOptions{}))
+	config, err := pki.server().ServerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.TLS = config
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+	addr := server.Listener.Addr().String()
+
+	get := func(opts *TLSOptions) (Record, error) {
+		var record Record
+		config, err := opts.ClientConfig(addr)
+		if err != nil {
+			return record, err
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		resp, err := client.Get(server.URL + "/collections/users/ann")
+		if err != nil {
+			return record, err
+		}
+		defer resp.Body.Close()
+		return record, json.NewDecoder(resp.Body).Decode(&record)
+	}
+
+	if record, err := get(pki.client()); err != nil || record.Value.Name != "ann" {
+		t.Errorf("GET with a client certificate = %+v, %v", record, err)
+	}
+	if _, err := get(&TLSOptions{RootCAFile: pki.caFile}); err == nil {
+		t.Error("GET without a client certificate succeeded")
+	}
+	if _, err := get(&TLSOptions{CertFile: pki.clientCert, KeyFile: pki.clientKey}); err == nil {
+		t.Error("GET trusting the system roots accepted the test CA")
+	}
+}
+
+func TestTLSReplication(t *testing.T) {
+	pki := newTestPKI(t)
+	addr := freeAddr(t)
+	primary, err := New(t.TempDir(), &Options{Slog: openTestLogger(), ChangeLog: true, ReplicationTLS: pki.server()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	if _, err := primary.ServeReplication(addr); err != nil {
+		t.Fatal(err)
+	}
+
+	follower, err := New(t.TempDir(), &Options{Slog: openTestLogger(), ChangeLog: true, ReplicationTLS: pki.client()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+	if err := follower.Follow(addr); err != nil {
+		t.Fatal(err)
+	}
+	writeUsers(t, primary, "ann")
+	waitForUser(t, follower, "ann")
+}
+
+func TestTLSOptionsNeedFiles(t *testing.T) {
+	if _, err := (&TLSOptions{}).ServerConfig(); err == nil {
+		t.Error("ServerConfig without a certificate succeeded")
+	}
+	if _, err := (&TLSOptions{RootCAFile: filepath.Join(t.TempDir(), "missing.pem")}).ClientConfig("localhost:1"); err == nil {
+		t.Error("ClientConfig with a missing CA file succeeded")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Tracer starts spans around Driver operations. It mirrors the shape of an
+// OpenTelemetry tracer so one can be adapted in a few lines:
+//
+//	func (t otelTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+//		ctx, span := t.tracer.Start(ctx, name)
+//		return ctx, otelSpan{span}
+//	}
+//
+// The spans of ReadContext, WriteContext, DeleteContext and ReadAllContext,
+// and of the requests served by Handler, are started from the context
+// given, so they join the caller's trace; other operations start root
+// spans.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a single traced operation.
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	RecordError(err error)
+	End()
+}
+
+// Attribute is a key/value pair attached to a span.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Span attribute keys set by the Driver.
+const (
+	AttrOperation  = "db.operation"
+	AttrCollection = "db.collection"
+	AttrKey        = "db.key"
+	AttrBytes      = "db.bytes"
+)
+
+// operation is an in-flight Driver call being measured and traced.
+type operation struct {
+	d          *Driver
+	name       string
+	collection string
+	key        string
+	start      time.Time
+	elapsed    time.Duration
+	span       Span
+	// bytes is the size of the data read or written, set by the operation.
+	bytes int
+}
+
+// begin starts measuring an operation. Finish it by deferring end with the
+// operation's named error result:
+//
+//	op := d.begin(opWrite, collection, key)
+//	defer op.end(&err)
+func (d *Driver) begin(name, collection, key string) *operation {
+	return d.beginContext(context.Background(), name, collection, key)
+}
+
+// beginContext is begin, starting the span of the operation as a child of
+// the span in ctx, if any.
+func (d *Driver) beginContext(ctx context.Context, name, collection, key string) *operation {
+	op := &operation{d: d, name: name, collection: collection, key: key, start: time.Now()}
+
+	if d.opts.Tracer != nil {
+		_, op.span = d.opts.Tracer.Start(ctx, "db."+name)
+		op.span.SetAttributes(
+			Attribute{AttrOperation, name},
+			Attribute{AttrCollection, collection},
+		)
+		if key != "" {
+			op.span.SetAttributes(Attribute{AttrKey, key})
+		}
+	}
+	return op
+}
+
+// end records the outcome of the operation in metrics, logs and its span.
+func (op *operation) end(err *error) {
+	op.elapsed = time.Since(op.start)
+	op.d.track(op.name, op.elapsed, *err)
+	op.log(*err)
+
+	if op.span != nil {
+		if op.bytes > 0 {
+			op.span.SetAttributes(Attribute{AttrBytes, op.bytes})
+		}
+		if *err != nil {
+			op.span.RecordError(*err)
+		}
+		op.span.End()
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testTracer records the spans it starts and the span each was started
+// under.
+type testTracer struct {
+	mutex sync.Mutex
+	spans []*testSpan
+}
+
+type testSpan struct {
+	name   string
+	parent *testSpan
+	attrs  map[string]interface{}
+	err    error
+	ended  bool
+}
+
+type spanKey struct{}
+
+func (t *testTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	span := &testSpan{name: name, attrs: make(map[string]interface{})}
+	span.parent, _ = ctx.Value(spanKey{}).(*testSpan)
+	t.spans = append(t.spans, span)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (s *testSpan) SetAttributes(attrs ...Attribute) {
+	for _, attr := range attrs {
+		s.attrs[attr.Key] = attr.Value
+	}
+}
+
+func (s *testSpan) RecordError(err error) { s.err = err }
+func (s *testSpan) End()                  { s.ended = true }
+
+// last returns the last span started with the given name.
+func (t *testTracer) last(name string) *testSpan {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for i := len(t.spans) - 1; i >= 0; i-- {
+		if t.spans[i].name == name {
+			return t.spans[i]
+		}
+	}
+	return nil
+}
+
+func TestTracerJoinsCallerTrace(t *testing.T) {
+	tracer := &testTracer{}
+	d, _ := openTestDB(t, &Options{Tracer: tracer})
+
+	ctx, parent := tracer.Start(context.Background(), "request")
+	if err := d.WriteContext(ctx, "users", "alice", User{Name: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.ReadContext(ctx, "users", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.ReadAllContext(ctx, "users"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DeleteContext(ctx, "users", "bob"); err == nil {
+		t.Fatal("deleting a missing record succeeded")
+	}
+	for _, name := range []string{"db.write", "db.read", "db.read_all", "db.delete"} {
+		span := tracer.last(name)
+		switch {
+		case span == nil:
+			t.Errorf("no %s span", name)
+		case span.parent != parent:
+			t.Errorf("%s span is not a child of the caller's span", name)
+		case !span.ended:
+			t.Errorf("%s span was not ended", name)
+		}
+	}
+	if span := tracer.last("db.delete"); span != nil && span.err == nil {
+		t.Error("failed delete recorded no error on its span")
+	}
+	if span := tracer.last("db.write"); span != nil && (span.attrs[AttrCollection] != "users" || span.attrs[AttrKey] != "alice") {
+		t.Errorf("write span attributes = %v", span.attrs)
+	}
+
+	if err := d.Write("users", "bob", User{Name: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if span := tracer.last("db.write"); span.parent != nil {
+		t.Error("span of a write without a context has a parent")
+	}
+
+	h := d.Handler(HandlerOptions{})
+	req := httptest.NewRequest("GET", "/collections/users/alice", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET: status %d: %s", rec.Code, rec.Body)
+	}
+	req = httptest.NewRequest("PUT", "/collections/users/carol", strings.NewReader(`{"Name": "carol"}`)).WithContext(ctx)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	for _, name := range []string{"db.read", "db.write"} {
+		if span := tracer.last(name); span == nil || span.parent != parent {
+			t.Errorf("%s span of an HTTP request is not a child of the request's span", name)
+		}
+	}
+}
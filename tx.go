@@ -0,0 +1,501 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// journalDir holds the redo journals of transactions being applied,
+// relative to the database directory.
+const journalDir = ".txn"
+
+// ErrTxDone is returned when a committed or rolled back transaction is used.
+var ErrTxDone = errors.New("transaction has already been committed or rolled back")
+
+// ErrTxInDoubt is returned (wrapped) by Commit when a transaction was
+// journaled but not applied in full. It counts as committed: the rest is
+// applied when the database is next opened.
+var ErrTxInDoubt = errors.New("transaction in doubt, will be rolled forward on next open")
+
+// TxOp is a single write or delete buffered in a transaction.
+type TxOp struct {
+	Op         string `json:"op"`
+	Collection string `json:"collection"`
+	Key        string `json:"key"`
+	Data       []byte `json:"data,omitempty"`
+}
+
+// TxHooks let an application coordinate a transaction with an external
+// system (a message broker, another database) in two phases.
+type TxHooks struct {
+	// Prepare runs once every lock is held and the transaction has been
+	// validated, but before anything is written. Returning an error aborts
+	// the transaction.
+	Prepare func(tx *Tx) error
+	// Commit runs after the transaction has been applied, or journaled to
+	// be rolled forward when it failed part way. The transaction stays
+	// committed whatever it returns; its error is passed on to the caller
+	// of Commit wrapped in a *CommitHookError.
+	Commit func(tx *Tx) error
+	// Abort runs when the transaction fails after Prepare succeeded and
+	// before anything was journaled, so the external system can roll its
+	// side back.
+	Abort func(tx *Tx, reason error)
+}
+
+// CommitHookError reports a failed Commit hook of a transaction that was
+// nevertheless committed.
+type CommitHookError struct {
+	TxID string
+	Err  error
+}
+
+func (e *CommitHookError) Error() string {
+	return fmt.Sprintf("transaction %s committed but its commit hook failed: %v", e.TxID, e.Err)
+}
+
+func (e *CommitHookError) Unwrap() error {
+	return e.Err
+}
+
+// Tx buffers writes and deletes across collections and applies them all
+// or not at all. It is not safe for concurrent use.
+type Tx struct {
+	d     *Driver
+	id    string
+	ops   []TxOp
+	hooks TxHooks
+	done  bool
+}
+
+// Begin starts a transaction.
+func (d *Driver) Begin() *Tx {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &Tx{d: d, id: hex.EncodeToString(id)}
+}
+
+// ID identifies the transaction, e.g. towards an external coordinator.
+func (tx *Tx) ID() string {
+	return tx.id
+}
+
+// Ops returns the operations buffered so far.
+func (tx *Tx) Ops() []TxOp {
+	return append([]TxOp(nil), tx.ops...)
+}
+
+// SetHooks installs the two-phase commit callbacks of the transaction.
+func (tx *Tx) SetHooks(hooks TxHooks) {
+	tx.hooks = hooks
+}
+
+// Write buffers a write of value under key.
+func (tx *Tx) Write(collection, key string, value User) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if err := tx.d.checkNames(&collection, &key); err != nil {
+		return err
+	}
+	if err := tx.d.checkRecordWrite(collection, false); err != nil {
+		return err
+	}
+
+	value.Computed = nil
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not marshal data: %v", err)
+	}
+	tx.ops = append(tx.ops, TxOp{Op: OpWrite, Collection: collection, Key: key, Data: data})
+	return nil
+}
+
+// Delete buffers the deletion of key.
+func (tx *Tx) Delete(collection, key string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if err := tx.d.checkNames(&collection, &key); err != nil {
+		return err
+	}
+	if tx.d.eventSourced(collection) {
+		return errImmutableEvents(collection)
+	}
+	if err := tx.d.checkNotView(collection); err != nil {
+		return err
+	}
+
+	tx.ops = append(tx.ops, TxOp{Op: OpDelete, Collection: collection, Key: key})
+	return nil
+}
+
+// Read returns the user stored under key as the transaction would leave it,
+// taking its own buffered writes and deletes into account.
+func (tx *Tx) Read(collection, key string) (User, error) {
+	if err := tx.d.checkNames(&collection, &key); err != nil {
+		return User{}, err
+	}
+	for i := len(tx.ops) - 1; i >= 0; i-- {
+		op := tx.ops[i]
+		if op.Collection != collection || op.Key != key {
+			continue
+		}
+		if op.Op == OpDelete {
+			return User{}, fmt.Errorf("could not read file: %w", os.ErrNotExist)
+		}
+
+		var user User
+		if err := json.Unmarshal(op.Data, &user); err != nil {
+			return User{}, fmt.Errorf("could not unmarshal data: %v", err)
+		}
+		return user, nil
+	}
+	return tx.d.Read(collection, key)
+}
+
+// Rollback discards the transaction.
+func (tx *Tx) Rollback() {
+	tx.done = true
+	tx.ops = nil
+}
+
+// Commit applies the transaction. Every collection it touches is locked,
+// deletes are checked to target existing records, the Prepare hook runs,
+// and the operations are recorded in a redo journal before being applied,
+// so a crash part way through is completed when the database is next
+// opened.
+func (tx *Tx) Commit() (err error) {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+
+	d := tx.d
+	op := d.begin(opCommit, "", tx.id)
+	defer op.end(&err)
+
+	if err := d.writable(); err != nil {
+		return err
+	}
+	if len(tx.ops) == 0 {
+		return nil
+	}
+
+	hooks := make([]*HookOp, len(tx.ops))
+	for i, o := range tx.ops {
+		hooks[i] = &HookOp{Op: o.Op, Collection: o.Collection, Key: o.Key, Data: o.Data}
+	}
+	defer func() {
+		for _, hook := range hooks {
+			d.after(hook, err)
+		}
+	}()
+	for i, hook := range hooks {
+		if err := d.before(hook); err != nil {
+			return fmt.Errorf("transaction %s: %w", tx.id, err)
+		}
+		if hook.Op == OpWrite {
+			data, err := d.stampVersion(hook.Collection, hook.Data)
+			if err == nil {
+				data, err = d.stampExpiry(hook.Collection, data)
+			}
+			if err == nil {
+				data, err = d.stampModified(hook.Collection, data)
+			}
+			if err == nil {
+				data, err = d.sealFields(hook.Collection, hook.Key, data)
+			}
+			if err != nil {
+				return err
+			}
+			tx.ops[i].Data = data
+		}
+	}
+
+	d.gate.RLock()
+	defer d.gate.RUnlock()
+
+	for _, collection := range tx.collections() {
+		mutex := d.getOrCreateMutex(collection)
+		mutex.Lock()
+		defer mutex.Unlock()
+	}
+
+	if err := tx.validate(); err != nil {
+		return err
+	}
+	if err := tx.checkReferences(); err != nil {
+		return err
+	}
+	release, err := tx.reserveQuotas()
+	if err != nil {
+		return err
+	}
+	// Once journaled, the transaction is applied sooner or later and keeps
+	// what it reserved.
+	journaled := false
+	defer func() {
+		if !journaled {
+			release()
+		}
+	}()
+
+	if tx.hooks.Prepare != nil {
+		if err := tx.hooks.Prepare(tx); err != nil {
+			return fmt.Errorf("transaction %s aborted by prepare hook: %v", tx.id, err)
+		}
+	}
+
+	var applied int
+	applied, journaled, err = tx.apply()
+	if err != nil && !journaled {
+		if tx.hooks.Abort != nil {
+			tx.hooks.Abort(tx, err)
+		}
+		return err
+	}
+	// What was applied is published even in doubt, so the change log and
+	// subscribers never miss a change the store holds.
+	for _, o := range tx.ops[:applied] {
+		op.bytes += len(o.Data)
+		d.publish(o.Op, o.Collection, o.Key, o.Data)
+	}
+	if err != nil {
+		d.log.Error("Transaction %s is in doubt: %v", tx.id, err)
+	} else {
+		d.log.Info("Committed transaction %s with %d operations", tx.id, len(tx.ops))
+	}
+
+	if tx.hooks.Commit != nil {
+		if hookErr := tx.hooks.Commit(tx); hookErr != nil {
+			return errors.Join(err, &CommitHookError{TxID: tx.id, Err: hookErr})
+		}
+	}
+	return err
+}
+
+// collections lists the collections touched, and those their references
+// need locked, in lock order.
+func (tx *Tx) collections() []string {
+	var collections []string
+	for _, op := range tx.ops {
+		if op.Op == OpDelete {
+			collections = append(collections, tx.d.deleteLocks(op.Collection)...)
+		} else {
+			collections = append(collections, tx.d.writeLocks(op.Collection)...)
+		}
+	}
+	return lockOrder(collections)
+}
+
+// checkReferences checks the references of the records written against
+// the state the transaction leaves behind, and that no record it leaves
+// behind refers to one it deletes.
+func (tx *Tx) checkReferences() error {
+	refs := tx.d.references()
+	if len(refs) == 0 {
+		return nil
+	}
+
+	final := make(map[recordID]bool)
+	for _, op := range tx.ops {
+		final[recordID{op.Collection, op.Key}] = op.Op == OpWrite
+	}
+	exists := func(collection, key string) bool {
+		if present, ok := final[recordID{collection, key}]; ok {
+			return present
+		}
+		return tx.d.stored(collection, key)
+	}
+
+	for _, op := range tx.ops {
+		if op.Op == OpWrite {
+			if err := tx.d.checkReferences(op.Collection, op.Key, op.Data, exists); err != nil {
+				return fmt.Errorf("transaction %s: %w", tx.id, err)
+			}
+			continue
+		}
+
+		for _, ref := range refs {
+			if ref.Target != op.Collection || exists(op.Collection, op.Key) {
+				continue
+			}
+			referring, err := tx.d.referring(ref, op.Key)
+			if err != nil {
+				return err
+			}
+			for _, k := range referring {
+				if _, rewritten := final[recordID{ref.Collection, k}]; !rewritten {
+					return fmt.Errorf("transaction %s: %w: %s of %s in collection %s refers to %s in collection %s",
+						tx.id, ErrReferenced, ref.Field, k, ref.Collection, op.Key, op.Collection)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// validate checks that every delete targets a record that exists at that
+// point of the transaction.
+func (tx *Tx) validate() error {
+	exists := make(map[string]bool)
+	for _, op := range tx.ops {
+		id := op.Collection + "/" + op.Key
+		if op.Op == OpWrite {
+			exists[id] = true
+			continue
+		}
+
+		present, known := exists[id]
+		if !known {
+			_, err := tx.d.store.get(op.Collection, op.Key)
+			present = err == nil
+		}
+		if !present {
+			return fmt.Errorf("transaction %s deletes missing record %s", tx.id, id)
+		}
+		exists[id] = false
+	}
+	return nil
+}
+
+// apply journals and performs the operations.
+func (tx *Tx) apply() (applied int, journaled bool, err error) {
+	journal, err := tx.d.writeJournal(tx.id, tx.ops)
+	if err != nil {
+		return 0, false, err
+	}
+
+	// From here on the journal stays behind on failure, so the transaction
+	// is completed on the next open. Its quotas are already reserved.
+	if applied, err = tx.d.replay(tx.ops, true); err != nil {
+		return applied, true, fmt.Errorf("transaction %s failed part way: %w: %v", tx.id, ErrTxInDoubt, err)
+	}
+	if err := tx.d.fs.Remove(journal); err != nil {
+		return applied, true, fmt.Errorf("transaction %s could not remove its journal: %w: %v", tx.id, ErrTxInDoubt, err)
+	}
+	return applied, true, nil
+}
+
+// writeJournal durably records the operations of a transaction: the
+// journal and its directory entry are both synced, so no operation can
+// reach the disk without the journal to complete it. On failure no journal
+// is left to be replayed.
+func (d *Driver) writeJournal(id string, ops []TxOp) (_ string, err error) {
+	dir := filepath.Join(d.dir, journalDir)
+	if err := d.fs.MkdirAll(dir, d.layout.dirMode()); err != nil {
+		return "", fmt.Errorf("could not create journal directory: %v", err)
+	}
+
+	data, err := json.Marshal(ops)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal journal: %v", err)
+	}
+
+	path := filepath.Join(dir, id+".json")
+	file, err := d.fs.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, d.layout.fileMode())
+	if err != nil {
+		return "", fmt.Errorf("could not create journal: %v", err)
+	}
+	defer func() {
+		file.Close()
+		if err != nil {
+			d.fs.Remove(path)
+		}
+	}()
+
+	if _, err := file.Write(data); err != nil {
+		return "", fmt.Errorf("could not write journal: %v", err)
+	}
+	if err := file.Sync(); err != nil {
+		return "", fmt.Errorf("could not sync journal: %v", err)
+	}
+	if err := syncDir(d.fs, dir); err != nil {
+		return "", fmt.Errorf("could not sync journal directory: %v", err)
+	}
+	return path, nil
+}
+
+// replay performs journaled operations. Deleting a record that is already
+// gone succeeds, so a journal can be replayed any number of times.
+func (d *Driver) replay(ops []TxOp, reserved bool) (applied int, err error) {
+	put, remove := d.put, d.remove
+	if reserved {
+		put, remove = d.store.put, d.store.delete
+	}
+	for _, op := range ops {
+		switch op.Op {
+		case OpWrite:
+			err = put(op.Collection, op.Key, op.Data)
+		case OpDelete:
+			if err = remove(op.Collection, op.Key); errors.Is(err, os.ErrNotExist) {
+				err = nil
+			}
+		}
+		if err != nil {
+			return applied, err
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+// recoverTransactions completes transactions interrupted by a crash.
+func (d *Driver) recoverTransactions() error {
+	dir := filepath.Join(d.dir, journalDir)
+	entries, err := d.fs.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read journal directory: %v", err)
+	}
+
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		if d.opts.ReadOnly {
+			d.log.Error("Transaction %s is incomplete; open the database read-write to complete it", entry.Name())
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		data, err := d.fs.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("could not read journal: %v", err)
+		}
+
+		var ops []TxOp
+		if err := json.Unmarshal(data, &ops); err != nil {
+			// A journal is synced before anything is applied, so a
+			// torn one means nothing was applied either.
+			d.log.Error("Discarding incomplete journal %s: %v", entry.Name(), err)
+			d.fs.Remove(path)
+			continue
+		}
+
+		start := time.Now()
+		applied, err := d.replay(ops, false)
+		for _, op := range ops[:applied] {
+			d.publish(op.Op, op.Collection, op.Key, op.Data)
+		}
+		if err != nil {
+			return fmt.Errorf("could not complete transaction %s: %v", entry.Name(), err)
+		}
+		if err := d.fs.Remove(path); err != nil {
+			return fmt.Errorf("could not remove journal: %v", err)
+		}
+		d.log.Info("Completed interrupted transaction %s (%d operations) in %s",
+			strings.TrimSuffix(entry.Name(), ".json"), len(ops), time.Since(start))
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestTxCommit(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+
+	if err := d.Write("users", "bob", User{Name: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	tx := d.Begin()
+	tx.Write("users", "alice", User{Name: "alice"})
+	tx.Delete("users", "bob")
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Read("users", "alice"); err != nil {
+		t.Error(err)
+	}
+	if _, err := d.Read("users", "bob"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("read deleted record: %v", err)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrTxDone) {
+		t.Errorf("second commit = %v, want ErrTxDone", err)
+	}
+
+	tx = d.Begin()
+	tx.Delete("users", "nobody")
+	if err := tx.Commit(); err == nil {
+		t.Error("commit deleting a missing record succeeded")
+	}
+}
+
+// TestTxAbortReleasesQuota fails the journal of a transaction and checks
+// it is aborted, and gives back the quota it reserved.
+func TestTxAbortReleasesQuota(t *testing.T) {
+	d, dir := openTestDB(t, &Options{Quotas: &QuotaOptions{Collections: map[string]Quota{"users": {MaxRecords: 1}}}})
+
+	// A file where the journal directory goes fails every journal.
+	if err := os.WriteFile(filepath.Join(dir, journalDir), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var aborted, committed bool
+	tx := d.Begin()
+	tx.SetHooks(TxHooks{
+		Commit: func(*Tx) error { committed = true; return nil },
+		Abort:  func(*Tx, error) { aborted = true },
+	})
+	tx.Write("users", "alice", User{Name: "alice"})
+	if err := tx.Commit(); err == nil || errors.Is(err, ErrTxInDoubt) {
+		t.Fatalf("commit without a journal = %v", err)
+	}
+	if !aborted || committed {
+		t.Errorf("aborted %v, committed %v; want only aborted", aborted, committed)
+	}
+
+	if err := os.Remove(filepath.Join(dir, journalDir)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Write("users", "bob", User{Name: "bob"}); err != nil {
+		t.Errorf("write after aborted transaction: %v", err)
+	}
+}
+
+// TestTxInDoubtRollsForward fails a transaction after it was journaled and
+// checks it is reported in doubt rather than aborted, and completed when
+// the database is opened again.
+func TestTxInDoubtRollsForward(t *testing.T) {
+	var failing bool
+	fsys := &FaultFS{FS: OSFS{}, Fault: func(op, path string) error {
+		if failing && op == "rename" && strings.Contains(path, "bob") {
+			return syscall.EIO
+		}
+		return nil
+	}}
+	d, dir := openTestDB(t, &Options{FS: fsys})
+
+	var aborted, committed bool
+	tx := d.Begin()
+	tx.SetHooks(TxHooks{
+		Commit: func(*Tx) error { committed = true; return nil },
+		Abort:  func(*Tx, error) { aborted = true },
+	})
+	tx.Write("users", "alice", User{Name: "alice"})
+	tx.Write("users", "bob", User{Name: "bob"})
+	failing = true
+	if err := tx.Commit(); !errors.Is(err, ErrTxInDoubt) {
+		t.Fatalf("commit = %v, want ErrTxInDoubt", err)
+	}
+	failing = false
+	if aborted || !committed {
+		t.Errorf("aborted %v, committed %v; want only committed", aborted, committed)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d, err := New(dir, &Options{Slog: openTestLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	for _, key := range []string{"alice", "bob"} {
+		if _, err := d.Read("users", key); err != nil {
+			t.Errorf("read %s after reopening: %v", key, err)
+		}
+	}
+}
+
+// TestTxJournalSynced checks that the journal of a transaction, and the
+// directory entry naming it, are synced before any of its operations is
+// applied.
+func TestTxJournalSynced(t *testing.T) {
+	var ops []string
+	fsys := &FaultFS{FS: OSFS{}, Fault: func(op, path string) error {
+		if op == "sync" || op == "rename" {
+			ops = append(ops, op+" "+filepath.Base(path))
+		}
+		return nil
+	}}
+	d, _ := openTestDB(t, &Options{FS: fsys})
+
+	tx := d.Begin()
+	tx.Write("users", "alice", User{Name: "alice"})
+	ops = nil
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"sync " + tx.id + ".json", "sync " + journalDir}
+	if len(ops) < len(want)+1 || ops[0] != want[0] || ops[1] != want[1] {
+		t.Errorf("commit ran %q, want it to start with %q and then apply", ops, want)
+	}
+}
+
+// TestTxInDoubtPublishes checks that the operations an in-doubt transaction
+// applied reach watchers and the change log, and that those completed on
+// the next open reach the change log too.
+func TestTxInDoubtPublishes(t *testing.T) {
+	var failing bool
+	fsys := &FaultFS{FS: OSFS{}, Fault: func(op, path string) error {
+		if failing && op == "rename" && strings.Contains(path, "bob") {
+			return syscall.EIO
+		}
+		return nil
+	}}
+	d, dir := openTestDB(t, &Options{FS: fsys, ChangeLog: true})
+	changes, stop := d.Watch("users")
+	defer stop()
+
+	tx := d.Begin()
+	tx.Write("users", "alice", User{Name: "alice"})
+	tx.Write("users", "bob", User{Name: "bob"})
+	failing = true
+	if err := tx.Commit(); !errors.Is(err, ErrTxInDoubt) {
+		t.Fatalf("commit = %v, want ErrTxInDoubt", err)
+	}
+	failing = false
+	select {
+	case c := <-changes:
+		if c.Op != OpWrite || c.Key != "alice" {
+			t.Errorf("change = %s %s, want write alice", c.Op, c.Key)
+		}
+	default:
+		t.Error("the write of alice was not published")
+	}
+	select {
+	case c := <-changes:
+		t.Errorf("unexpected change %s %s", c.Op, c.Key)
+	default:
+	}
+	seq := d.changes.lastSeq()
+	if seq != 1 {
+		t.Errorf("change log at %d after the in-doubt commit, want 1", seq)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d, err := New(dir, &Options{Slog: openTestLogger(), ChangeLog: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if got, want := d.changes.lastSeq(), seq+2; got != want {
+		t.Errorf("change log at %d after recovery, want %d", got, want)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+//go:embed ui
+var uiFiles embed.FS
+
+// uiPageSize is the default and uiMaxPageSize the largest number of records
+// the UI API returns per page.
+const (
+	uiPageSize    = 50
+	uiMaxPageSize = 1000
+)
+
+// UIOptions configures the web UI returned by UIHandler.
+type UIOptions struct {
+	// Policy restricts the UI to admins, who sign in with their name and
+	// token through HTTP basic authentication. Everything is allowed if
+	// nil.
+	Policy *Policy
+}
+
+// UIHandler serves a web UI for browsing and editing the database under
+// /ui/, backed by a JSON API of its own:
+//
+//	GET    /ui/                                    the UI
+//	GET    /ui/api/collections                     list collections
+//	GET    /ui/api/collections/{collection}?q=expr&offset=0&limit=50
+//	                                               a page of (optionally
+//	                                               filtered) records in key
+//	                                               order, with the total
+//	GET    /ui/api/collections/{collection}/stats  the collection's Stats
+//	PUT    /ui/api/collections/{collection}/{key}  write a record
+//	DELETE /ui/api/collections/{collection}/{key}  delete a record
+//	GET    /ui/api/stats                           Health, Metrics and
+//	                                               Capabilities
+//
+// The UI is a debugging tool that can change any record, so with a Policy
+// only admins may use it. Errors are returned as by Handler.
+func (d *Driver) UIHandler(opts UIOptions) http.Handler {
+	u := &uiServer{d: d}
+	static, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err)
+	}
+
+	p := opts.Policy
+	mux := http.NewServeMux()
+	mux.Handle("GET /ui/", p.guardAdmin(http.StripPrefix("/ui/", http.FileServerFS(static)).ServeHTTP))
+	mux.HandleFunc("GET /ui/api/collections", p.guardAdmin(u.collections))
+	mux.HandleFunc("GET /ui/api/collections/{collection}", p.guardAdmin(u.page))
+	mux.HandleFunc("GET /ui/api/collections/{collection}/stats", p.guardAdmin(u.stats))
+	mux.HandleFunc("PUT /ui/api/collections/{collection}/{key}", p.guardAdmin(u.write))
+	mux.HandleFunc("DELETE /ui/api/collections/{collection}/{key}", p.guardAdmin(u.delete))
+	mux.HandleFunc("GET /ui/api/stats", p.guardAdmin(u.overview))
+	return mux
+}
+
+type uiServer struct {
+	d *Driver
+}
+
+// uiPage is a page of records as returned by the UI API.
+type uiPage struct {
+	Records []Record `json:"records"`
+	Offset  int      `json:"offset"`
+	// Total is how many records the collection holds, or match the query.
+	Total int `json:"total"`
+}
+
+func (u *uiServer) collections(w http.ResponseWriter, r *http.Request) {
+	names, err := u.d.Collections()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if names == nil {
+		names = []string{}
+	}
+	writeJSON(w, http.StatusOK, names)
+}
+
+func (u *uiServer) page(w http.ResponseWriter, r *http.Request) {
+	collection := r.PathValue("collection")
+	offset, limit, err := uiRange(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	collections, err := u.d.Collections()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	page := uiPage{Offset: offset}
+	switch expr := r.URL.Query().Get("q"); {
+	case !slices.Contains(collections, collection):
+		// A collection not written yet is empty.
+	case expr != "":
+		page, err = u.queryPage(collection, expr, offset, limit)
+	default:
+		page, err = u.keyPage(collection, offset, limit)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if page.Records == nil {
+		page.Records = []Record{}
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// uiRange reads the offset and limit parameters of a page request.
+func uiRange(r *http.Request) (offset, limit int, err error) {
+	limit = uiPageSize
+	if s := r.URL.Query().Get("offset"); s != "" {
+		if offset, err = strconv.Atoi(s); err != nil || offset < 0 {
+			return 0, 0, errors.New("offset must be a non-negative integer")
+		}
+	}
+	if s := r.URL.Query().Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			return 0, 0, errors.New("limit must be a positive integer")
+		}
+	}
+	return offset, min(limit, uiMaxPageSize), nil
+}
+
+// keyPage reads only the records of the page, found by listing the keys.
+func (u *uiServer) keyPage(collection string, offset, limit int) (uiPage, error) {
+	keys, err := u.d.Keys(collection)
+	if err != nil {
+		return uiPage{}, err
+	}
+	page := uiPage{Offset: offset, Total: len(keys)}
+	for _, key := range keys[min(offset, len(keys)):min(offset+limit, len(keys))] {
+		user, err := u.d.Read(collection, key)
+		if errors.Is(err, os.ErrNotExist) {
+			// Deleted since it was listed.
+			continue
+		}
+		if err != nil {
+			return uiPage{}, err
+		}
+		page.Records = append(page.Records, Record{Key: key, Value: user})
+	}
+	return page, nil
+}
+
+// queryPage scans the collection for the records matching expr.
+func (u *uiServer) queryPage(collection, expr string, offset, limit int) (uiPage, error) {
+	q, err := ParseQuery(expr)
+	if err != nil {
+		return uiPage{}, err
+	}
+
+	var records []Record
+	err = u.d.scan(collection, func(key string, data []byte) error {
+		if ok, err := q.Match(data); err != nil || !ok {
+			return nil
+		}
+		var user User
+		if err := json.Unmarshal(data, &user); err != nil {
+			return nil
+		}
+		u.d.compute(collection, &user)
+		records = append(records, Record{Key: key, Value: user})
+		return nil
+	})
+	if err != nil {
+		return uiPage{}, err
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Key < records[j].Key })
+	return uiPage{
+		Records: records[min(offset, len(records)):min(offset+limit, len(records))],
+		Offset:  offset,
+		Total:   len(records),
+	}, nil
+}
+
+func (u *uiServer) stats(w http.ResponseWriter, r *http.Request) {
+	stats, err := u.d.Stats(r.PathValue("collection"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func (u *uiServer) write(w http.ResponseWriter, r *http.Request) {
+	var user User
+	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body: " + err.Error()})
+		return
+	}
+
+	collection, key := r.PathValue("collection"), r.PathValue("key")
+	if err := u.d.Write(collection, key, user); err != nil {
+		writeError(w, err)
+		return
+	}
+	u.d.compute(collection, &user)
+	writeJSON(w, http.StatusOK, Record{Key: key, Value: user})
+}
+
+func (u *uiServer) delete(w http.ResponseWriter, r *http.Request) {
+	if err := u.d.Delete(r.PathValue("collection"), r.PathValue("key")); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (u *uiServer) overview(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"health":       u.d.Health(),
+		"metrics":      u.d.Metrics(),
+		"capabilities": u.d.Capabilities(),
+	})
+}
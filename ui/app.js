@@ -0,0 +1,235 @@
+"use strict";
+
+// The UI talks to the API UIHandler serves next to it.
+const api = "api";
+const pageSize = 50;
+
+const state = {
+  collection: "",
+  query: "",
+  offset: 0,
+  total: 0,
+  // key is the record being edited, or null for a new one.
+  key: null,
+};
+
+const $ = (id) => document.getElementById(id);
+
+async function call(method, path, body) {
+  const options = { method, headers: {} };
+  if (body !== undefined) {
+    options.headers["Content-Type"] = "application/json";
+    options.body = JSON.stringify(body);
+  }
+  const response = await fetch(`${api}/${path}`, options);
+  if (response.status === 204) {
+    return null;
+  }
+  const data = await response.json();
+  if (!response.ok) {
+    throw new Error(data.error || response.statusText);
+  }
+  return data;
+}
+
+function collectionPath(...parts) {
+  return ["collections", state.collection, ...parts].map(encodeURIComponent).join("/");
+}
+
+function showError(err) {
+  $("error").textContent = err ? String(err.message || err) : "";
+  $("error").hidden = !err;
+}
+
+// guard runs an action, reporting its failure.
+function guard(action) {
+  return async (event) => {
+    if (event) {
+      event.preventDefault();
+    }
+    showError(null);
+    try {
+      await action(event);
+    } catch (err) {
+      showError(err);
+    }
+  };
+}
+
+async function loadCollections() {
+  const names = await call("GET", "collections");
+  const list = $("collections");
+  list.replaceChildren();
+  for (const name of names) {
+    const link = document.createElement("a");
+    link.textContent = name;
+    link.classList.toggle("active", name === state.collection);
+    link.addEventListener("click", guard(() => openCollection(name)));
+    const item = document.createElement("li");
+    item.append(link);
+    list.append(item);
+  }
+}
+
+async function openCollection(name) {
+  state.collection = name;
+  state.query = "";
+  state.offset = 0;
+  $("query").elements.q.value = "";
+  $("collection-name").textContent = name;
+  $("browser").hidden = false;
+  $("editor").hidden = true;
+  await Promise.all([loadCollections(), loadPage(), loadCollectionStats()]);
+}
+
+async function loadCollectionStats() {
+  const info = $("collection-stats");
+  try {
+    const stats = await call("GET", collectionPath("stats"));
+    info.textContent = `${stats.Records} records, ${stats.Bytes} bytes` +
+      (stats.LastModified && !stats.LastModified.startsWith("0001") ? `, last modified ${stats.LastModified}` : "");
+  } catch (err) {
+    // Not every engine keeps statistics.
+    info.textContent = "";
+  }
+}
+
+async function loadPage() {
+  const params = new URLSearchParams({ offset: state.offset, limit: pageSize });
+  if (state.query) {
+    params.set("q", state.query);
+  }
+  const page = await call("GET", `${collectionPath()}?${params}`);
+  state.total = page.total;
+
+  const rows = $("records");
+  rows.replaceChildren();
+  for (const record of page.records) {
+    const key = document.createElement("td");
+    key.className = "key";
+    const link = document.createElement("a");
+    link.textContent = record.key;
+    link.addEventListener("click", () => edit(record));
+    key.append(link);
+
+    const value = document.createElement("td");
+    value.className = "value";
+    value.textContent = JSON.stringify(record.value);
+
+    const row = document.createElement("tr");
+    row.append(key, value);
+    rows.append(row);
+  }
+
+  const last = Math.min(state.offset + page.records.length, state.total);
+  $("page-info").textContent = state.total === 0 ? "no records" : `${state.offset + 1}–${last} of ${state.total}`;
+  $("prev").disabled = state.offset === 0;
+  $("next").disabled = state.offset + pageSize >= state.total;
+}
+
+function edit(record) {
+  state.key = record ? record.key : null;
+  $("editor-title").textContent = record ? record.key : "new record";
+  $("editor-key").value = record ? record.key : "";
+  $("editor-key").disabled = !!record;
+  $("editor-value").value = JSON.stringify(record ? record.value : {}, null, 2);
+  $("delete").hidden = !record;
+  $("browser").hidden = true;
+  $("editor").hidden = false;
+}
+
+function closeEditor() {
+  $("editor").hidden = true;
+  $("browser").hidden = false;
+}
+
+async function save() {
+  const key = state.key ?? $("editor-key").value.trim();
+  if (!key) {
+    throw new Error("a record needs a key");
+  }
+  let value;
+  try {
+    value = JSON.parse($("editor-value").value);
+  } catch (err) {
+    throw new Error(`invalid JSON: ${err.message}`);
+  }
+  await call("PUT", collectionPath(key), value);
+  closeEditor();
+  await Promise.all([loadCollections(), loadPage(), loadCollectionStats()]);
+}
+
+async function remove() {
+  if (!confirm(`Delete ${state.key}?`)) {
+    return;
+  }
+  await call("DELETE", collectionPath(state.key));
+  closeEditor();
+  await Promise.all([loadPage(), loadCollectionStats()]);
+}
+
+async function loadStats() {
+  const stats = await call("GET", "stats");
+  $("health").textContent = JSON.stringify(stats.health, null, 2);
+  $("capabilities").textContent = JSON.stringify(stats.capabilities, null, 2);
+
+  const rows = $("operations");
+  rows.replaceChildren();
+  const operations = stats.metrics.Operations || {};
+  for (const name of Object.keys(operations).sort()) {
+    const op = operations[name];
+    const mean = op.Count ? op.Sum / op.Count / 1e6 : 0;
+    const row = document.createElement("tr");
+    for (const text of [name, op.Count, op.Errors, `${mean.toFixed(3)} ms`]) {
+      const cell = document.createElement("td");
+      cell.textContent = text;
+      row.append(cell);
+    }
+    rows.append(row);
+  }
+}
+
+function showTab(name) {
+  $("data").hidden = name !== "data";
+  $("stats").hidden = name !== "stats";
+  $("show-data").classList.toggle("active", name === "data");
+  $("show-stats").classList.toggle("active", name === "stats");
+}
+
+$("show-data").addEventListener("click", guard(async () => {
+  showTab("data");
+  await loadCollections();
+}));
+$("show-stats").addEventListener("click", guard(async () => {
+  showTab("stats");
+  await loadStats();
+}));
+$("open-collection").addEventListener("submit", guard(async (event) => {
+  await openCollection(event.target.elements.name.value.trim());
+  event.target.reset();
+}));
+$("query").addEventListener("submit", guard(async (event) => {
+  state.query = event.target.elements.q.value.trim();
+  state.offset = 0;
+  await loadPage();
+}));
+$("clear-query").addEventListener("click", guard(async () => {
+  $("query").elements.q.value = "";
+  state.query = "";
+  state.offset = 0;
+  await loadPage();
+}));
+$("prev").addEventListener("click", guard(async () => {
+  state.offset = Math.max(0, state.offset - pageSize);
+  await loadPage();
+}));
+$("next").addEventListener("click", guard(async () => {
+  state.offset += pageSize;
+  await loadPage();
+}));
+$("new-record").addEventListener("click", () => edit(null));
+$("save").addEventListener("click", guard(save));
+$("delete").addEventListener("click", guard(remove));
+$("cancel").addEventListener("click", closeEditor);
+
+guard(loadCollections)();
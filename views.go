@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// View defines a materialized view: a collection holding the records of
+// Source that match Query, reduced to Fields, under the same keys. It is
+// updated as Source changes, so it reads like any collection without
+// scanning Source.
+type View struct {
+	Source string
+	// Query filters the records of Source; all are included if empty.
+	Query string
+	// Fields lists the dot paths kept of each record; all if empty.
+	Fields []string
+}
+
+type view struct {
+	View
+	query       *Query
+	unsubscribe func()
+}
+
+// DefineView makes collection name a materialized view, built from Source
+// right away and then updated after every change to Source. Records of the
+// view cannot be written directly, and a collection already holding records
+// of its own cannot become one. A view is not persisted: define it again
+// whenever the database is opened, which also brings it up to date with
+// changes made while it was not defined. Changes to a view are published
+// like any other, so it can be watched.
+func (d *Driver) DefineView(name string, v View) error {
+	if name == "" || v.Source == "" {
+		return errors.New("a view needs a name and a source collection")
+	}
+	if err := d.checkNames(&name); err != nil {
+		return err
+	}
+	if err := d.checkNames(&v.Source); err != nil {
+		return err
+	}
+	if name == v.Source {
+		return fmt.Errorf("view %s cannot be its own source", name)
+	}
+	if d.viewOf(v.Source) != nil {
+		return fmt.Errorf("view %s cannot have view %s as source", name, v.Source)
+	}
+	if d.eventSourced(name) {
+		return fmt.Errorf("collection %s is event sourced and cannot be a view", name)
+	}
+	meta, _ := d.collectionMeta(v.Source)
+	if meta.TimeSeries || meta.CRDT != "" {
+		return fmt.Errorf("collection %s does not hold users and cannot be the source of a view", v.Source)
+	}
+	for _, path := range v.Fields {
+		if path == "" || slices.Contains(strings.Split(path, "."), "") {
+			return fmt.Errorf("invalid field %q of view %s", path, name)
+		}
+	}
+	for _, ref := range d.references() {
+		if ref.Collection == name || ref.Target == name {
+			return fmt.Errorf("collection %s takes part in references and cannot be a view", name)
+		}
+	}
+
+	defined := &view{View: v}
+	if v.Query != "" {
+		q, err := ParseQuery(v.Query)
+		if err != nil {
+			return err
+		}
+		defined.query = q
+	}
+
+	d.mutex.Lock()
+	if _, ok := d.views[name]; ok {
+		d.mutex.Unlock()
+		return fmt.Errorf("view %s is already defined", name)
+	}
+	if d.views == nil {
+		d.views = make(map[string]*view)
+	}
+	d.views[name] = defined
+	d.mutex.Unlock()
+
+	// Source stays locked from the rebuild until the view is subscribed to
+	// its changes, so none are missed. Views are locked after their source,
+	// as updateView does.
+	d.gate.RLock()
+	defer d.gate.RUnlock()
+
+	for _, collection := range []string{v.Source, name} {
+		mutex := d.getOrCreateMutex(collection)
+		mutex.Lock()
+		defer mutex.Unlock()
+	}
+
+	err := d.claimView(name, v.Source)
+	if err == nil {
+		if err = d.rebuildView(name, defined); err != nil {
+			err = fmt.Errorf("could not build view %s: %v", name, err)
+		}
+	}
+	if err != nil {
+		d.mutex.Lock()
+		delete(d.views, name)
+		d.mutex.Unlock()
+		return err
+	}
+	defined.unsubscribe = d.subscribe(func(change Change) {
+		if change.Collection == v.Source {
+			d.updateView(name, defined, change)
+		}
+	})
+	return nil
+}
+
+// DropView stops maintaining a view and deletes its records.
+func (d *Driver) DropView(name string) error {
+	if err := d.checkNames(&name); err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	v, ok := d.views[name]
+	delete(d.views, name)
+	d.mutex.Unlock()
+
+	if !ok {
+		return fmt.Errorf("view %s is not defined", name)
+	}
+	v.unsubscribe()
+
+	d.gate.RLock()
+	defer d.gate.RUnlock()
+
+	mutex := d.getOrCreateMutex(name)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	keys, err := d.store.keys(name)
+	if err != nil {
+		return fmt.Errorf("could not drop view %s: %v", name, err)
+	}
+	for _, key := range keys {
+		if err := d.removeFromView(name, key); err != nil {
+			return fmt.Errorf("could not drop view %s: %v", name, err)
+		}
+	}
+	if meta, ok := d.collectionMeta(name); ok && meta.View != "" {
+		meta.View = ""
+		if err := d.writeMeta(name, meta); err != nil {
+			return fmt.Errorf("could not drop view %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// claimView marks collection name as holding a view of source, failing if
+// it holds records and is not a view already. It must be locked.
+func (d *Driver) claimView(name, source string) error {
+	meta, _ := d.collectionMeta(name)
+	if meta.View == "" {
+		// A collection that cannot be listed holds nothing to lose; errors
+		// listing it for other reasons fail the rebuild.
+		if keys, err := d.store.keys(name); err == nil && len(keys) > 0 {
+			return fmt.Errorf("collection %s holds records and cannot be a view: %w", name, os.ErrExist)
+		}
+	}
+	if meta.View == source {
+		return nil
+	}
+	meta.View = source
+	return d.writeMeta(name, meta)
+}
+
+// viewOf returns the definition of the view held by collection, if it is
+// one.
+func (d *Driver) viewOf(collection string) *view {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.views[collection]
+}
+
+// checkNotView fails for collections holding views, which only change with
+// their source.
+func (d *Driver) checkNotView(collection string) error {
+	if v := d.viewOf(collection); v != nil {
+		return fmt.Errorf("collection %s is a view of %s and cannot be written", collection, v.Source)
+	}
+	return nil
+}
+
+// rebuildView brings a view up to date with every record of its source.
+// Both collections must be locked.
+func (d *Driver) rebuildView(name string, v *view) error {
+	keys, err := d.store.keys(v.Source)
+	if err != nil {
+		return err
+	}
+	included := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		data, err := d.store.get(v.Source, key)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if included[key], err = d.applyView(name, v, key, data); err != nil {
+			return err
+		}
+	}
+
+	stale, err := d.store.keys(name)
+	if err != nil {
+		return err
+	}
+	for _, key := range stale {
+		if included[key] {
+			continue
+		}
+		if err := d.removeFromView(name, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateView applies a change of the source of a view to it. It is called
+// with the source locked.
+func (d *Driver) updateView(name string, v *view, change Change) {
+	mutex := d.getOrCreateMutex(name)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var err error
+	if change.Op == OpWrite {
+		var data []byte
+		if data, err = d.changeData(change); err == nil {
+			_, err = d.applyView(name, v, change.Key, data)
+		}
+	} else {
+		err = d.removeFromView(name, change.Key)
+	}
+	if err != nil {
+		d.log.Error("Could not update view %s with %s: %v", name, change.Key, err)
+	}
+}
+
+// applyView stores the projection of a record of the source of a view
+// under its key if it matches the view's query, or removes it from the
+// view otherwise, and reports whether it matched.
+func (d *Driver) applyView(name string, v *view, key string, data []byte) (bool, error) {
+	data, _, err := d.upgrade(v.Source, key, data)
+	if err != nil {
+		return false, err
+	}
+	if data, err = d.openFields(v.Source, key, data); err != nil {
+		return false, err
+	}
+
+	matched := true
+	if v.query != nil {
+		if matched, err = v.query.Match(data); err != nil {
+			return false, err
+		}
+	}
+	if !matched {
+		return false, d.removeFromView(name, key)
+	}
+
+	if len(v.Fields) > 0 {
+		if data, err = project(data, v.Fields); err != nil {
+			return false, err
+		}
+	}
+	if data, err = d.sealFields(name, key, data); err != nil {
+		return false, err
+	}
+	if err := d.put(name, key, data); err != nil {
+		return false, err
+	}
+	d.publish(OpWrite, name, key, data)
+	return true, nil
+}
+
+// removeFromView removes a record from a view, if it is there.
+func (d *Driver) removeFromView(name, key string) error {
+	err := d.remove(name, key)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	d.publish(OpDelete, name, key, nil)
+	return nil
+}
+
+// project reduces a record to the fields at paths.
+func project(data []byte, paths []string) ([]byte, error) {
+	doc, err := decodeDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	projected := make(map[string]interface{})
+	for _, path := range paths {
+		if value, ok := lookupField(doc, strings.Split(path, ".")); ok {
+			setField(projected, path, value)
+		}
+	}
+	return json.MarshalIndent(projected, "", "  ")
+}
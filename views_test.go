@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestViewKeepsFieldsEncrypted(t *testing.T) {
+	d, dir := openTestDB(t, &Options{EncryptionKey: []byte("secret")})
+
+	if err := d.SetCollectionMeta("users", CollectionMeta{Encrypted: []string{"Company"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Write("users", "alice", User{Name: "alice", Company: "Initech"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DefineView("people", View{Source: "users", Fields: []string{"Name", "Company"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Write("users", "bob", User{Name: "bob", Company: "Globex"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, company := range map[string]string{"alice": "Initech", "bob": "Globex"} {
+		raw, err := os.ReadFile(filepath.Join(dir, "people", key+".json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(raw), company) {
+			t.Errorf("view record %s stores the encrypted field in plaintext: %s", key, raw)
+		}
+
+		record, err := d.Read("people", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Company != company {
+			t.Errorf("read %s from view = %q, want %q", key, record.Company, company)
+		}
+	}
+}
+
+func TestViewFollowsStreamedRecords(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+	if err := d.Write("users", "alice", User{Name: "alice", Company: "Initech"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DefineView("initech", View{Source: "users", Query: `Company == "Initech"`}); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := d.WriteStream("users", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, `{"Name": "bob", "Company": "Initech"}`)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if record, err := d.Read("initech", "bob"); err != nil || record.Name != "bob" {
+		t.Errorf("read streamed record from view = %+v, %v", record, err)
+	}
+}
+
+func TestViewRefusesOrdinaryCollection(t *testing.T) {
+	d, dir := openTestDB(t, nil)
+	if err := d.Write("users", "alice", User{Name: "alice", Company: "Initech"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Write("people", "carol", User{Name: "carol"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.DefineView("people", View{Source: "users"}); !errors.Is(err, os.ErrExist) {
+		t.Errorf("defining a view over a collection with records = %v, want ErrExist", err)
+	}
+	if _, err := d.Read("people", "carol"); err != nil {
+		t.Errorf("refused view removed a record of the collection: %v", err)
+	}
+	if err := d.Write("people", "dave", User{Name: "dave"}); err != nil {
+		t.Errorf("collection is still a view after being refused: %v", err)
+	}
+
+	// A view keeps its records while the database is closed, and can be
+	// defined over them again.
+	if err := d.DefineView("initech", View{Source: "users", Query: `Company == "Initech"`}); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+	d, err := New(dir, &Options{Slog: openTestLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if err := d.DefineView("initech", View{Source: "users", Query: `Company == "Initech"`}); err != nil {
+		t.Errorf("defining a view again after reopening: %v", err)
+	}
+	if err := d.DropView("initech"); err != nil {
+		t.Fatal(err)
+	}
+	if meta, _ := d.CollectionMeta("initech"); meta.View != "" {
+		t.Errorf("dropped view is still marked as one: %+v", meta)
+	}
+}
+
+func TestViewPublishesChanges(t *testing.T) {
+	d, _ := openTestDB(t, nil)
+	if err := d.Write("users", "carol", User{Name: "carol", Company: "Globex"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DefineView("initech", View{Source: "users", Query: `Company == "Initech"`}); err != nil {
+		t.Fatal(err)
+	}
+	changes, stop := d.Watch("initech")
+	defer stop()
+
+	if err := d.Write("users", "alice", User{Name: "alice", Company: "Initech"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Write("users", "bob", User{Name: "bob", Company: "Globex"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete("users", "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []Change{{Op: OpWrite, Key: "alice"}, {Op: OpDelete, Key: "alice"}} {
+		select {
+		case c := <-changes:
+			if c.Op != want.Op || c.Collection != "initech" || c.Key != want.Key {
+				t.Errorf("view change = %s %s/%s, want %s initech/%s", c.Op, c.Collection, c.Key, want.Op, want.Key)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no %s of %s published for the view", want.Op, want.Key)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// watchBuffer is how many changes a watcher may fall behind before it
+	// is dropped.
+	watchBuffer = 256
+	// watchKeepAlive is how often an idle change feed sends a comment, so
+	// proxies keep the connection open.
+	watchKeepAlive = 30 * time.Second
+)
+
+// watcher hands the changes of a collection to a channel.
+type watcher struct {
+	mutex   sync.Mutex
+	changes chan Change
+	closed  bool
+}
+
+func (w *watcher) send(c Change) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return
+	}
+	select {
+	case w.changes <- c:
+	default:
+		// Too far behind: close so the reader can resynchronize.
+		w.closed = true
+		close(w.changes)
+	}
+}
+
+func (w *watcher) close() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if !w.closed {
+		w.closed = true
+		close(w.changes)
+	}
+}
+
+// Watch returns a channel receiving every change to a collection, and a
+// function to stop watching. The channel is closed by stop, and when the
+// reader falls too far behind, in which case it should read the collection
+// again and watch anew. For a name the naming policy rejects the channel is
+// closed right away.
+func (d *Driver) Watch(collection string) (changes <-chan Change, stop func()) {
+	w := &watcher{changes: make(chan Change, watchBuffer)}
+	if d.checkNames(&collection) != nil {
+		close(w.changes)
+		return w.changes, func() {}
+	}
+	unsubscribe := d.subscribe(func(c Change) {
+		if c.Collection == collection {
+			w.send(c)
+		}
+	})
+	return w.changes, func() {
+		unsubscribe()
+		w.close()
+	}
+}
+
+// watchEvent is a change as sent by the change feed.
+type watchEvent struct {
+	Seq   uint64          `json:"seq,omitempty"`
+	Op    string          `json:"op"`
+	Key   string          `json:"key"`
+	Time  time.Time       `json:"time"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// watch streams the changes to a collection as server-sent events, named
+// after their operation and carrying a watchEvent. Values are stripped of
+// internal fields and redacted. The stream ends when the client falls too
+// far behind.
+func (s *server) watch(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "streaming is not supported"})
+		return
+	}
+
+	collection := r.PathValue("collection")
+	if err := s.d.checkNames(&collection); err != nil {
+		writeError(w, err)
+		return
+	}
+	changes, stop := s.d.Watch(collection)
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(watchKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.d.stop:
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case c, ok := <-changes:
+			if !ok {
+				return
+			}
+			var value []byte
+			if c.Data != nil {
+				var err error
+				if value, err = s.d.publicRecord(collection, c.Data); err != nil {
+					// Send the change without a value rather than one that
+					// could not be redacted.
+					s.d.log.Error("Could not send %s of collection %s to a watcher: %v", c.Key, collection, err)
+					value = nil
+				}
+			}
+			data, err := json.Marshal(watchEvent{
+				Seq: c.Seq, Op: c.Op, Key: s.opts.Obfuscator.Encode(c.Key), Time: c.Time, Value: value,
+			})
+			if err != nil {
+				return
+			}
+			if c.Seq > 0 {
+				fmt.Fprintf(w, "id: %d\n", c.Seq)
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", c.Op, data)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// yamlMap is a JSON object with its keys in document order.
+type yamlMap []yamlEntry
+
+type yamlEntry struct {
+	key   string
+	value interface{}
+}
+
+// writeYAML writes v as a YAML document. v goes through encoding/json first,
+// so struct tags and MarshalJSON methods apply and fields keep their order.
+func writeYAML(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("could not marshal value: %v", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	value, err := decodeOrdered(decoder)
+	if err != nil {
+		return fmt.Errorf("could not decode value: %v", err)
+	}
+
+	var b strings.Builder
+	switch value := value.(type) {
+	case yamlMap:
+		if len(value) == 0 {
+			b.WriteString("{}\n")
+		}
+		writeYAMLMap(&b, value, 0, false)
+	case []interface{}:
+		if len(value) == 0 {
+			b.WriteString("[]\n")
+		}
+		writeYAMLList(&b, value, 0)
+	default:
+		b.WriteString(yamlScalar(value) + "\n")
+	}
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+// decodeOrdered reads the next JSON value, keeping the key order of objects.
+func decodeOrdered(decoder *json.Decoder) (interface{}, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case json.Delim('{'):
+		m := yamlMap{}
+		for decoder.More() {
+			key, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeOrdered(decoder)
+			if err != nil {
+				return nil, err
+			}
+			m = append(m, yamlEntry{key: key.(string), value: value})
+		}
+		_, err := decoder.Token()
+		return m, err
+	case json.Delim('['):
+		list := []interface{}{}
+		for decoder.More() {
+			value, err := decodeOrdered(decoder)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		_, err := decoder.Token()
+		return list, err
+	}
+	return token, nil
+}
+
+// writeYAMLMap writes the entries of m. When inline, the first entry
+// follows the dash of a list item already written.
+func writeYAMLMap(b *strings.Builder, m yamlMap, indent int, inline bool) {
+	for i, entry := range m {
+		if i > 0 || !inline {
+			b.WriteString(strings.Repeat(" ", indent))
+		}
+		b.WriteString(yamlScalar(entry.key) + ":")
+		writeYAMLValue(b, entry.value, indent+2)
+	}
+}
+
+func writeYAMLList(b *strings.Builder, list []interface{}, indent int) {
+	for _, value := range list {
+		b.WriteString(strings.Repeat(" ", indent) + "-")
+		switch value := value.(type) {
+		case yamlMap:
+			if len(value) == 0 {
+				b.WriteString(" {}\n")
+				continue
+			}
+			b.WriteString(" ")
+			writeYAMLMap(b, value, indent+2, true)
+		case []interface{}:
+			if len(value) == 0 {
+				b.WriteString(" []\n")
+				continue
+			}
+			b.WriteString("\n")
+			writeYAMLList(b, value, indent+2)
+		default:
+			b.WriteString(" " + yamlScalar(value) + "\n")
+		}
+	}
+}
+
+// writeYAMLValue writes the value of a map entry after its key.
+func writeYAMLValue(b *strings.Builder, value interface{}, indent int) {
+	switch value := value.(type) {
+	case yamlMap:
+		if len(value) == 0 {
+			b.WriteString(" {}\n")
+			return
+		}
+		b.WriteString("\n")
+		writeYAMLMap(b, value, indent, false)
+	case []interface{}:
+		if len(value) == 0 {
+			b.WriteString(" []\n")
+			return
+		}
+		b.WriteString("\n")
+		writeYAMLList(b, value, indent)
+	default:
+		b.WriteString(" " + yamlScalar(value) + "\n")
+	}
+}
+
+// yamlScalar formats a JSON scalar, quoting strings a YAML parser would
+// read as something else.
+func yamlScalar(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(value)
+	case json.Number:
+		return value.String()
+	case string:
+		if yamlNeedsQuotes(value) {
+			return strconv.Quote(value)
+		}
+		return value
+	}
+	return fmt.Sprint(value)
+}
+
+// yamlImplicit matches plain scalars YAML 1.1 parsers resolve to numbers or
+// timestamps beyond what strconv parses: sexagesimal numbers such as 1:30
+// and dates such as 2024-06-01.
+var yamlImplicit = regexp.MustCompile(`^[-+]?[0-9][0-9_]*(:[0-5]?[0-9])+(\.[0-9_]*)?$|^[0-9]{4}-[0-9]{1,2}-[0-9]{1,2}`)
+
+func yamlNeedsQuotes(s string) bool {
+	if s == "" || strings.TrimSpace(s) != s {
+		return true
+	}
+	switch strings.ToLower(s) {
+	case "true", "false", "yes", "no", "on", "off", "null", "~", "y", "n",
+		".inf", "-.inf", "+.inf", ".nan":
+		return true
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return true
+	}
+	if _, err := strconv.ParseInt(s, 0, 64); err == nil {
+		return true
+	}
+	if yamlImplicit.MatchString(s) {
+		return true
+	}
+	if strings.ContainsAny(s[:1], "-?:,[]{}#&*!|>'\"%@`") {
+		return true
+	}
+	if strings.Contains(s, ": ") || strings.Contains(s, " #") || strings.HasSuffix(s, ":") {
+		return true
+	}
+	for _, r := range s {
+		if r < ' ' || r == 0x7f {
+			return true
+		}
+	}
+	return false
+}
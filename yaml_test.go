@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestYAMLNeedsQuotes(t *testing.T) {
+	tests := []struct {
+		s      string
+		quoted bool
+	}{
+		{"Pune", false},
+		{"Bob Smith", false},
+		{"a:b", false},
+		{"C#", false},
+		{"", true},
+		{" padded", true},
+		{"padded ", true},
+		{"true", true},
+		{"No", true},
+		{"~", true},
+		{"null", true},
+		{"42", true},
+		{"-1.5", true},
+		{"1e3", true},
+		{".inf", true},
+		{"-.Inf", true},
+		{"+.INF", true},
+		{".NaN", true},
+		{"0x1F", true},
+		{"0o17", true},
+		{"0b101", true},
+		{"1_000", true},
+		{"1:30", true},
+		{"2024-06-01", true},
+		{"- item", true},
+		{"#comment", true},
+		{"*alias", true},
+		{"key: value", true},
+		{"trailing #comment", true},
+		{"ends:", true},
+		{"tab\there", true},
+		{"line\nbreak", true},
+	}
+	for _, tt := range tests {
+		if got := yamlNeedsQuotes(tt.s); got != tt.quoted {
+			t.Errorf("yamlNeedsQuotes(%q) = %v, want %v", tt.s, got, tt.quoted)
+		}
+	}
+}
+
+func TestWriteYAML(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{"scalar", "Pune", "Pune\n"},
+		{"quoted scalar", ".inf", "\".inf\"\n"},
+		{"number", json.Number("42"), "42\n"},
+		{"null", nil, "null\n"},
+		{"empty map", map[string]int{}, "{}\n"},
+		{"empty list", []string{}, "[]\n"},
+		{"list", []interface{}{"a", true, nil}, "- a\n- true\n- null\n"},
+		{"user", User{Name: "Ann", Age: "30", Address: Address{City: "Pune"}},
+			"Name: Ann\nAge: 30\nCompany: \"\"\nAddress:\n  Street: \"\"\n  City: Pune\n  State: \"\"\n  Country: \"\"\n"},
+		{"nested", map[string]interface{}{"tags": []string{"x"}, "empty": map[string]int{}, "none": []int{}},
+			"empty: {}\nnone: []\ntags:\n  - x\n"},
+		{"list of maps", []interface{}{map[string]int{"a": 1, "b": 2}, map[string]int{}},
+			"- a: 1\n  b: 2\n- {}\n"},
+		{"list of lists", [][]int{{1, 2}, {}},
+			"-\n  - 1\n  - 2\n- []\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+			if err := writeYAML(&b, tt.value); err != nil {
+				t.Fatal(err)
+			}
+			if b.String() != tt.want {
+				t.Errorf("writeYAML = %q, want %q", b.String(), tt.want)
+			}
+		})
+	}
+}